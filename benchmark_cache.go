@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// benchmarkCacheAccesses is the length of the synthetic access pattern
+const benchmarkCacheAccesses = 100000
+
+// benchmarkCache replays an access pattern against CIPHERDIR with DirIV
+// caches of different capacities and prints the cache counters and the
+// latency of path resolution for each. The pattern is read from the
+// "-benchmark-cache-pattern" file, one plaintext path per line, or is
+// generated from the tree.
+//
+// This is called when you pass the "-benchmark-cache" option.
+func benchmarkCache(args *argContainer) {
+	sizes, err := parseCacheSizes(args.benchmarkcachesizes)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid \"-benchmark-cache-sizes\" setting: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	fs := newCheckFS(args, "-benchmark-cache")
+	var pattern []string
+	if args.benchmarkcachepattern != "" {
+		pattern, err = readPattern(args.benchmarkcachepattern)
+	} else {
+		pattern, err = fs.SyntheticAccessPattern(benchmarkCacheAccesses, 1)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Other)
+	}
+	results := make([]fusefrontend.CacheBenchmark, 0, len(sizes))
+	for _, n := range sizes {
+		b, err := fs.BenchmarkDirIVCache(pattern, n)
+		if err != nil {
+			tlog.Fatal.Printf("%v", err)
+			os.Exit(exitcodes.Other)
+		}
+		results = append(results, b)
+	}
+	printCacheBenchmarks(os.Stdout, results)
+	os.Exit(0)
+}
+
+// parseCacheSizes parses the comma-separated list of "-benchmark-cache-sizes"
+func parseCacheSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("size %d is not positive", n)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// readPattern reads a recorded access pattern: one plaintext path relative
+// to the mountpoint per line. Empty lines are skipped.
+func readPattern(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pattern []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if p := strings.Trim(s.Text(), "/"); p != "" {
+			pattern = append(pattern, p)
+		}
+	}
+	return pattern, s.Err()
+}
+
+// printCacheBenchmarks prints one line per capacity
+func printCacheBenchmarks(w *os.File, results []fusefrontend.CacheBenchmark) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "maxEntries\tlookups\thits\tmisses\thit ratio\tevictions\tentries\tp50\tp90\tp99\tmax\t")
+	for _, b := range results {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.3f\t%d\t%d\t%v\t%v\t%v\t%v\t\n",
+			b.MaxEntries, b.Lookups, b.Hits, b.Misses, b.HitRatio(), b.Evictions,
+			b.Entries, b.P50, b.P90, b.P99, b.Max)
+	}
+	tw.Flush()
+}
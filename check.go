@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// newCheckFS unlocks CIPHERDIR and returns an FS instance that is used
+// without mounting it. "op" is the option name for error messages.
+func newCheckFS(args *argContainer, op string) *fusefrontend.FS {
+	if args.reverse {
+		tlog.Fatal.Printf("%s is not supported in reverse mode", op)
+		os.Exit(exitcodes.Usage)
+	}
+	var masterkey []byte
+	var confFile *configfile.ConfFile
+	var err error
+	if args.zerokey {
+		masterkey = make([]byte, cryptocore.KeyLen)
+	} else {
+		masterkey, confFile, err = loadConfig(args)
+		if err != nil {
+			exitcodes.Exit(err)
+		}
+	}
+	frontendArgs := makeFrontendArgs(args, confFile)
+	// Checking must not write to CIPHERDIR, not even the atime
+	frontendArgs.Atime = fusefrontend.AtimeNone
+	fs := fusefrontend.NewFS(masterkey, frontendArgs)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	return fs
+}
+
+// checkFile authenticates the name and content of the file "path" without
+// mounting the filesystem.
+// This is called when you pass the "-check" option.
+func checkFile(args *argContainer, path string) {
+	fs := newCheckFS(args, "-check")
+	blocks, err := fs.CheckFile(path)
+	if err != nil {
+		if be, ok := err.(*fusefrontend.CheckBlockError); ok {
+			fmt.Printf("%s: %d blocks checked, first failing block: %d (%s)\n",
+				path, blocks, be.Block, be.Status.String())
+		} else {
+			tlog.Fatal.Printf("%v", err)
+		}
+		os.Exit(exitcodes.CheckFailed)
+	}
+	fmt.Printf("%s: OK, %d blocks checked\n", path, blocks)
+	os.Exit(0)
+}
+
+// findPath prints the absolute paths of the backing files that store the
+// plaintext path "path", one per line.
+// This is called when you pass the "-findpath" option.
+func findPath(args *argContainer, path string) {
+	fs := newCheckFS(args, "-findpath")
+	paths, err := fs.BackingPaths(path)
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.FindPath)
+	}
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+	os.Exit(0)
+}
+
+// verifyTree authenticates all names, symlinks and file contents in
+// CIPHERDIR without mounting the filesystem. As it needs no FUSE, it can
+// run unprivileged, for example to verify backups.
+// This is called when you pass the "-verify" option.
+func verifyTree(args *argContainer) {
+	fs := newCheckFS(args, "-verify")
+	res := fs.VerifyTree("")
+	for _, e := range res.Errors {
+		fmt.Println(e)
+	}
+	fmt.Printf("%d directories, %d files (%d blocks), %d symlinks checked, %d errors\n",
+		res.Dirs, res.Files, res.Blocks, res.Symlinks, len(res.Errors))
+	if len(res.Errors) > 0 {
+		os.Exit(exitcodes.CheckFailed)
+	}
+	os.Exit(0)
+}
+
+// merkleRoot authenticates the whole tree in CIPHERDIR and prints its Merkle
+// root in hex. Store or sign the output; any later change to the volume
+// gives a different root.
+// This is called when you pass the "-merkle-root" option.
+func merkleRoot(args *argContainer) {
+	fs := newCheckFS(args, "-merkle-root")
+	root, err := fs.MerkleRoot("")
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.CheckFailed)
+	}
+	fmt.Println(hex.EncodeToString(root))
+	os.Exit(0)
+}
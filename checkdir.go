@@ -22,6 +22,12 @@ func checkDirEmpty(dir string) error {
 	return fmt.Errorf("directory %s not empty", dir)
 }
 
+// isRegularFile - check if "path" exists and is a regular file
+func isRegularFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
 // checkDir - check if "dir" exists and is a directory
 func checkDir(dir string) error {
 	fi, err := os.Stat(dir)
@@ -3,16 +3,25 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rfjakob/gocryptfs/internal/archive"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
-	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -20,14 +29,40 @@ import (
 type argContainer struct {
 	debug, init, zerokey, fusedebug, openssl, passwd, fg, version,
 	plaintextnames, quiet, nosyslog, wpanic,
-	longnames, allow_other, ro, reverse, aessiv, nonempty, raw64,
+	longnames, allow_other, allow_root, ro, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom bool
+	sharedstorage, devrandom, compress, trash, dirsync, check, caseinsensitive, nfcnames,
+	reencrypt, debugfuse, atime, relatime, noatime, verify, networkbackend, allowemptypassword,
+	encrypteddiriv, healthcheck, findpath, finddup, diff, snapshot, writeintent, fingerprint, symlinkfiles, acl, ephemeral, keepgoing, notifychanges, paranoiddiriv, checksum, benchmarkcache, changekdf, merkleroot, snapshots bool
 	masterkey, mountpoint, cipherdir, cpuprofile, extpass,
-	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace string
+	memprofile, ko, passfile, passenv, ctlsock, fsname, force_owner, trace, keyfile, keyprovider, quota, directio, preload, replica, scryptpreset, scrubbwlimit, createumask, forcemode, cachesize, forcetime, benchmarkcachesizes, benchmarkcachepattern, invalidnames, namepolicy, xattrpassthrough, maxfilesize string
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	healthchecktimeout time.Duration
+
+	// "-scryptr" and "-scryptp", 0 if not set
+	scryptr, scryptp int
+	// "-scrub-interval", 0 if the scrubber is off
+	scrubinterval time.Duration
+	// "-trace-slow-ops", 0 if slow operations are not logged
+	traceslowops time.Duration
+	// "-op-timeout", 0 if operations never time out
+	optimeout time.Duration
+	// "-name-padding", 0 if not set
+	namepadding int
+	// "-max-name-length", 0 means the limit of CIPHERDIR
+	maxnamelength int
+	// "-retry", 0 if transient errors are not retried
+	retry int
+	// "-retry-delay"
+	retrydelay time.Duration
+	// "-gcm-iv-bits", 0 if not set
+	gcmivbits int
+	// "-label" and "-set-label"
+	label, setlabel string
+	// "-json" output for "-version"
+	json bool
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
@@ -35,6 +70,35 @@ type argContainer struct {
 	_ctlsockFd net.Listener
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _quotas is the parsed form of "-quota"
+	_quotas map[string]uint64
+	// _directIO is the parsed form of "-direct-io"
+	_directIO []string
+	// _preload is the list of paths read from the "-preload" file
+	_preload []string
+	// _scrubBandwidth is the parsed form of "-scrub-bwlimit"
+	_scrubBandwidth uint64
+	// _createUmask and _forceMode are the parsed forms of "-create-umask"
+	// and "-force-mode"
+	_createUmask, _forceMode uint32
+	// _namePolicy is the parsed form of "-name-policy"
+	_namePolicy *fusefrontend.NamePolicy
+	// _xattrPassthrough is the parsed form of "-xattr-passthrough"
+	_xattrPassthrough []string
+	// _maxFileSize is the parsed form of "-max-file-size"
+	_maxFileSize uint64
+	// _cacheSize is the parsed form of "-cache-size"
+	_cacheSize uint64
+	// _forceTime is the parsed form of "-force-time", nil if not set. Set
+	// in makeFrontendArgs for "-force-time init".
+	_forceTime *time.Time
+	// _command is the command given after "CIPHERDIR MOUNTPOINT --"
+	_command []string
+	// _singleFile is the name of the file in "cipherdir" when "-reverse"
+	// serves a single file
+	_singleFile string
+	// _archive is the opened archive when CIPHERDIR is a tar or zip file
+	_archive *archive.Archive
 }
 
 var flagSet *flag.FlagSet
@@ -102,14 +166,17 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.debug, "d", false, "")
 	flagSet.BoolVar(&args.debug, "debug", false, "Enable debug output")
 	flagSet.BoolVar(&args.fusedebug, "fusedebug", false, "Enable fuse library debug output")
+	flagSet.BoolVar(&args.debugfuse, "debug-fuse", false, "Log FUSE requests and responses with plaintext redacted")
 	flagSet.BoolVar(&args.init, "init", false, "Initialize encrypted directory")
 	flagSet.BoolVar(&args.zerokey, "zerokey", false, "Use all-zero dummy master key")
 	// Tri-state true/false/auto
 	flagSet.StringVar(&opensslAuto, "openssl", "auto", "Use OpenSSL instead of built-in Go crypto")
 	flagSet.BoolVar(&args.passwd, "passwd", false, "Change password")
+	flagSet.BoolVar(&args.changekdf, "change-kdf", false, "Re-encrypt the master key with new scrypt parameters, keeping the password")
 	flagSet.BoolVar(&args.fg, "f", false, "")
 	flagSet.BoolVar(&args.fg, "fg", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
+	flagSet.BoolVar(&args.json, "json", false, "Print build information as JSON (with -version)")
 	flagSet.BoolVar(&args.plaintextnames, "plaintextnames", false, "Do not encrypt file names")
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
@@ -118,6 +185,9 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
+	flagSet.BoolVar(&args.acl, "acl", false, "Check permissions in gocryptfs, honoring POSIX ACLs of the backing files (with -allow_other)")
+	flagSet.BoolVar(&args.allow_root, "allow_root", false, "Allow root to access the filesystem. "+
+		"Only works if user_allow_other is set in /etc/fuse.conf.")
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
@@ -131,23 +201,85 @@ func parseCliOpts() (args argContainer) {
 		" Requires gocryptfs to be compiled with openssl support and implies -openssl true")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.check, "check", false, "Check the integrity of a single file in CIPHERDIR")
+	flagSet.BoolVar(&args.findpath, "findpath", false, "Print the backing files of a plaintext path in CIPHERDIR")
+	flagSet.BoolVar(&args.finddup, "finddup", false, "Print groups of files in CIPHERDIR that have the same plaintext content")
+	flagSet.BoolVar(&args.benchmarkcache, "benchmark-cache", false, "Measure the DirIV cache on CIPHERDIR with different capacities")
+	flagSet.StringVar(&args.benchmarkcachesizes, "benchmark-cache-sizes", "10,100,1000", "With -benchmark-cache: comma-separated cache capacities per shard")
+	flagSet.StringVar(&args.benchmarkcachepattern, "benchmark-cache-pattern", "", "With -benchmark-cache: file with the plaintext paths to access, one per line")
+	flagSet.BoolVar(&args.diff, "diff", false, "Compare the plaintext content of CIPHERDIR and a second CIPHERDIR")
+	flagSet.BoolVar(&args.verify, "verify", false, "Check the integrity of all files in CIPHERDIR")
+	flagSet.BoolVar(&args.merkleroot, "merkle-root", false, "Authenticate CIPHERDIR and print a hash over all of it")
+	flagSet.BoolVar(&args.reencrypt, "reencrypt", false, "Copy CIPHERDIR into NEWCIPHERDIR under a new master key")
+	flagSet.BoolVar(&args.keepgoing, "keep-going", false, "With -reencrypt, -diff and -verify: skip files that cannot be processed instead of stopping")
+	flagSet.BoolVar(&args.ephemeral, "ephemeral", false, "Mount a throwaway filesystem that is kept in memory at MOUNTPOINT")
+	flagSet.BoolVar(&args.snapshot, "snapshot", false, "Read-only mount without caching, can run next to a read-write mount")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
+	flagSet.BoolVar(&args.allowemptypassword, "allow-empty-password", false, "Accept an empty password on -init and -passwd")
+	flagSet.BoolVar(&args.networkbackend, "network-backend", false, "CIPHERDIR is on a network filesystem that other clients may modify")
+	flagSet.BoolVar(&args.paranoiddiriv, "paranoid-diriv", false, "Check cached DirIVs against the gocryptfs.diriv files before every use")
+	flagSet.BoolVar(&args.notifychanges, "notify-changes", false, "Watch CIPHERDIR and tell the kernel about changes made behind our back")
+	flagSet.BoolVar(&args.healthcheck, "healthcheck", false, "Check that the filesystem mounted at MOUNTPOINT is responsive")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
+	flagSet.BoolVar(&args.compress, "compress", false, "Compress file content before encryption")
+	flagSet.BoolVar(&args.encrypteddiriv, "encrypted-diriv", false, "Encrypt and authenticate the gocryptfs.diriv files")
+	flagSet.BoolVar(&args.symlinkfiles, "symlink-files", false, "Store symlinks as regular files holding the encrypted target (with -init)")
+	flagSet.IntVar(&args.gcmivbits, "gcm-iv-bits", 0, "GCM IV length for file content, 96 or 128 (with -init). Default 128")
+	flagSet.IntVar(&args.namepadding, "name-padding", 0, "Pad file names to a multiple of this many bytes to hide their length (with -init)")
+	flagSet.StringVar(&args.label, "label", "", "Store this label in the config file (with -init)")
+	flagSet.StringVar(&args.setlabel, "set-label", "", "Change the label stored in the config file")
+	flagSet.BoolVar(&args.nfcnames, "nfcnames", false, "Normalize file names to Unicode NFC before encryption")
+	flagSet.BoolVar(&args.trash, "trash", false, "Move deleted files to a trash directory instead of deleting them")
+	flagSet.BoolVar(&args.snapshots, "cow-snapshots", false, "Allow taking copy-on-write snapshots of CIPHERDIR through the control socket")
+	flagSet.BoolVar(&args.caseinsensitive, "caseinsensitive", false, "Fall back to case-insensitive name lookup")
+	flagSet.BoolVar(&args.atime, "atime", false, "Update the access time on every read")
+	flagSet.BoolVar(&args.relatime, "relatime", false, "Update the access time only if it is older than mtime or one day (default)")
+	flagSet.BoolVar(&args.noatime, "noatime", false, "Never update the access time on reads")
+	flagSet.StringVar(&args.invalidnames, "invalid-names", "skip", "What directory listings do with names that cannot be decrypted: skip, raw, fail")
+	flagSet.BoolVar(&args.dirsync, "dirsync", false, "Fsync directories after create, rename and delete for crash consistency")
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.extpass, "extpass", "", "Use external program for the password prompt")
 	flagSet.StringVar(&args.passfile, "passfile", "", "Read password from file")
+	flagSet.StringVar(&args.passenv, "passenv", "", "Read password from environment variable")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.DurationVar(&args.traceslowops, "trace-slow-ops", 0, "Log FUSE operations that take longer than this (0 = off)")
+	flagSet.DurationVar(&args.optimeout, "op-timeout", 0, "Fail FUSE operations with EIO that take longer than this (0 = off)")
+	flagSet.StringVar(&args.keyfile, "keyfile", "", "Store the master key in this key file (on -init), or read it from there")
+	flagSet.StringVar(&args.keyprovider, "keyprovider", "", "Wrap the master key with this key provider URI instead of a password (on -init)")
+	flagSet.BoolVar(&args.fingerprint, "fingerprint", false, "Print the fingerprint of the master key")
+	flagSet.BoolVar(&args.writeintent, "write-intent", false, "Record the durable size of files on fsync, for resuming writes after a crash")
+	flagSet.BoolVar(&args.checksum, "checksum", false, "Store the SHA-256 of file contents as the xattr user.gocryptfs.sha256")
+	flagSet.StringVar(&args.cachesize, "cache-size", "", "Memory budget of all caches in bytes, like 64M (default: no limit)")
+	flagSet.StringVar(&args.createumask, "create-umask", "", "Clear these permission bits (octal) on created files and directories")
+	flagSet.StringVar(&args.forcemode, "force-mode", "", "Set these permission bits (octal) on created files and directories")
+	flagSet.StringVar(&args.forcetime, "force-time", "", "Report this time (RFC 3339, Unix seconds or \"init\") as the timestamps of all files")
+	flagSet.StringVar(&args.namepolicy, "name-policy", "", "Only allow new file names that follow these comma-separated rules: ascii, nospace, maxlen=N, regex=RE")
+	flagSet.StringVar(&args.xattrpassthrough, "xattr-passthrough", "", "Enable user xattrs; store those starting with one of these comma-separated prefixes unencrypted")
+	flagSet.StringVar(&args.directio, "direct-io", "", "Bypass the kernel page cache for files matching this comma-separated list of patterns")
+	flagSet.StringVar(&args.preload, "preload", "", "Warm the caches for the plaintext paths listed in this file after mounting")
+	flagSet.StringVar(&args.replica, "replica", "", "Mirror all changes of CIPHERDIR to this directory")
+	flagSet.StringVar(&args.maxfilesize, "max-file-size", "", "Limit the size of each file in bytes, like 100M (default: no limit)")
+	flagSet.StringVar(&args.quota, "quota", "", "Limit the size of directories, comma-separated list of DIR=SIZE")
+	flagSet.DurationVar(&args.healthchecktimeout, "healthcheck-timeout", 5*time.Second, "Timeout for -healthcheck")
+	flagSet.DurationVar(&args.scrubinterval, "scrub-interval", 0, "Check the integrity of all files in the background this often (0 = off)")
+	flagSet.StringVar(&args.scrubbwlimit, "scrub-bwlimit", "1M", "Maximum read rate of -scrub-interval in bytes per second")
+	flagSet.IntVar(&args.retry, "retry", 0, "Retry reads and writes this often after transient errors of CIPHERDIR like EIO")
+	flagSet.DurationVar(&args.retrydelay, "retry-delay", 100*time.Millisecond, "Delay before the first -retry, doubled for every further one")
+	flagSet.IntVar(&args.maxnamelength, "max-name-length", 0, "Longest encrypted name CIPHERDIR can store. Default: ask the filesystem")
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	flagSet.IntVar(&args.scryptn, "scryptn", configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
+	flagSet.IntVar(&args.scryptr, "scryptr", 0, "scrypt block size parameter r (on -init and -change-kdf). Default 8")
+	flagSet.IntVar(&args.scryptp, "scryptp", 0, "scrypt parallelization parameter p (on -init and -change-kdf). Default 1")
+	flagSet.StringVar(&args.scryptpreset, "scrypt-preset", "", "scrypt cost preset (on -init and -change-kdf): fast, default, paranoid")
 	// Ignored otions
 	var dummyBool bool
 	ignoreText := "(ignored for compatibility)"
@@ -166,6 +298,24 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("%v", err)
 		os.Exit(exitcodes.Usage)
 	}
+	// "CIPHERDIR MOUNTPOINT -- CMD ARGS...". The flag package stops parsing at
+	// CIPHERDIR, so a "--" after it is still in flagSet.Args().
+	for i, a := range flagSet.Args() {
+		if a == "--" && i > 0 {
+			args._command = flagSet.Args()[i+1:]
+			flagSet.Parse(flagSet.Args()[:i])
+			if len(args._command) == 0 {
+				tlog.Fatal.Printf("Missing command after \"--\"")
+				os.Exit(exitcodes.Usage)
+			}
+			if args.init || args.passwd || args.changekdf || args.info || args.check || args.reencrypt ||
+				args.verify || args.merkleroot || args.findpath || args.finddup || args.benchmarkcache || args.diff || args.healthcheck || isFlagPassed("set-label") {
+				tlog.Fatal.Printf("A command after \"--\" can only be given when mounting")
+				os.Exit(exitcodes.Usage)
+			}
+			break
+		}
+	}
 	// "-openssl" needs some post-processing
 	if opensslAuto == "auto" {
 		args.openssl = prefer_openssl.PreferOpenSSL()
@@ -178,18 +328,6 @@ func parseCliOpts() (args argContainer) {
 	}
 	// "-forcedecode" only works with openssl. Check compilation and command line parameters
 	if args.forcedecode == true {
-		if stupidgcm.BuiltWithoutOpenssl == true {
-			tlog.Fatal.Printf("The -forcedecode flag requires openssl support, but gocryptfs was compiled without it!")
-			os.Exit(exitcodes.Usage)
-		}
-		if args.aessiv == true {
-			tlog.Fatal.Printf("The -forcedecode and -aessiv flags are incompatible because they use different crypto libs (openssl vs native Go)")
-			os.Exit(exitcodes.Usage)
-		}
-		if args.reverse == true {
-			tlog.Fatal.Printf("The reverse mode and the -forcedecode option are not compatible")
-			os.Exit(exitcodes.Usage)
-		}
 		// Has the user explicitly disabled openssl using "-openssl=false/0"?
 		if !args.openssl && opensslAuto != "auto" {
 			tlog.Fatal.Printf("-forcedecode requires openssl, but is disabled via command-line option")
@@ -200,19 +338,562 @@ func parseCliOpts() (args argContainer) {
 		// Try to make it harder for the user to shoot himself in the foot.
 		args.ro = true
 		args.allow_other = false
+		args.allow_root = false
 		args.ko = "noexec"
 	}
+	if args.json && !args.version {
+		tlog.Fatal.Printf("The -json flag can only be used with -version")
+		os.Exit(exitcodes.Usage)
+	}
+	// Check the cipher and mode combination
+	if err = cryptocore.ValidateBackend(args.cryptoBackend(), args.reverse, args.forcedecode); err != nil {
+		tlog.Fatal.Printf("Invalid crypto settings: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	// FUSE only allows one of them. "-force_owner" implies "-allow_other".
+	if args.allow_root && (args.allow_other || args.force_owner != "") {
+		tlog.Fatal.Printf("The -allow_root and -allow_other (or -force_owner) options are mutually exclusive")
+		os.Exit(exitcodes.Usage)
+	}
+	// With "-force_owner", the owner we show is not the one we would check
+	if args.acl && (!args.allow_other || args.force_owner != "" || args.reverse) {
+		tlog.Fatal.Printf("The -acl flag requires -allow_other and cannot be used with -force_owner or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.invalidnames {
+	case "skip", "raw", "fail":
+	default:
+		tlog.Fatal.Printf("Invalid \"-invalid-names\" setting %q, must be skip, raw or fail", args.invalidnames)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.atime && args.relatime || args.atime && args.noatime || args.relatime && args.noatime {
+		tlog.Fatal.Printf("At most one of -atime, -relatime, -noatime is allowed")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-snapshot" is a read-only mount that neither writes to CIPHERDIR nor
+	// caches anything, so it is safe next to a read-write mount.
+	if args.snapshot {
+		if args.atime || args.relatime || args.reverse {
+			tlog.Fatal.Printf("The -snapshot flag cannot be used with -atime, -relatime or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		args.ro = true
+		args.noatime = true
+		// No kernel caching and no hard link tracking
+		args.sharedstorage = true
+		// Revalidate cached DirIVs, the read-write mount may replace
+		// directories
+		args.networkbackend = true
+	}
+	// A read-only mount must not write the atime to CIPHERDIR
+	if args.ro && (args.atime || args.relatime) {
+		tlog.Fatal.Printf("The -atime and -relatime flags cannot be used with -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	// Reverse mode computes the ciphertext on the fly and has no use for
+	// compression.
+	if args.compress && args.reverse {
+		tlog.Fatal.Printf("The -compress and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.nfcnames && (args.reverse || args.plaintextnames) {
+		tlog.Fatal.Printf("The -nfcnames flag cannot be used with -reverse or -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.encrypteddiriv && (args.reverse || args.plaintextnames) {
+		tlog.Fatal.Printf("The -encrypted-diriv flag cannot be used with -reverse or -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.symlinkfiles && (!args.init || args.reverse) {
+		tlog.Fatal.Printf("The -symlink-files flag can only be used with -init and cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.namepadding != 0 {
+		if !args.init || args.reverse || args.plaintextnames {
+			tlog.Fatal.Printf("The -name-padding flag can only be used with -init and cannot be used with -reverse or -plaintextnames")
+			os.Exit(exitcodes.Usage)
+		}
+		if err = nametransform.CheckNamePadding(args.namepadding); err != nil {
+			tlog.Fatal.Printf("Invalid \"-name-padding\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.gcmivbits != 0 {
+		if !args.init || args.reverse || args.aessiv {
+			tlog.Fatal.Printf("The -gcm-iv-bits flag can only be used with -init and cannot be used with -reverse or -aessiv")
+			os.Exit(exitcodes.Usage)
+		}
+		if err = cryptocore.CheckGCMIVBits(args.gcmivbits); err != nil {
+			tlog.Fatal.Printf("%v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.maxnamelength != 0 {
+		if args.reverse {
+			tlog.Fatal.Printf("The -max-name-length and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		minLen := 1
+		if args.longnames {
+			minLen = nametransform.MinNameMax
+		}
+		if args.maxnamelength < minLen || args.maxnamelength > syscall.NAME_MAX {
+			tlog.Fatal.Printf("Invalid \"-max-name-length\" setting %d: must be between %d and %d",
+				args.maxnamelength, minLen, syscall.NAME_MAX)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.label != "" {
+		if !args.init {
+			tlog.Fatal.Printf("The -label flag can only be used with -init. Use -set-label to change the label.")
+			os.Exit(exitcodes.Usage)
+		}
+		if err = configfile.CheckLabel(args.label); err != nil {
+			tlog.Fatal.Printf("Invalid \"-label\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if err = configfile.CheckLabel(args.setlabel); err != nil {
+		tlog.Fatal.Printf("Invalid \"-set-label\" setting: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.caseinsensitive && args.reverse {
+		tlog.Fatal.Printf("The -caseinsensitive and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.trash && args.reverse {
+		tlog.Fatal.Printf("The -trash and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	// Snapshots are written to CIPHERDIR
+	if args.snapshots && (args.reverse || args.ro) {
+		tlog.Fatal.Printf("The -cow-snapshots flag cannot be used with -reverse, -ro or -snapshot")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.quota != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -quota and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		args._quotas, err = parseQuotas(args.quota)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-quota\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.directio != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -direct-io and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		args._directIO, err = parseDirectIO(args.directio)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-direct-io\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.namepolicy != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -name-policy and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		args._namePolicy, err = parseNamePolicy(args.namepolicy)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-name-policy\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.xattrpassthrough != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -xattr-passthrough and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		args._xattrPassthrough, err = parseXattrPassthrough(args.xattrpassthrough)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-xattr-passthrough\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.preload != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -preload and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		args._preload, err = readPreloadList(args.preload)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-preload\" file: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.replica != "" && args.reverse {
+		tlog.Fatal.Printf("The -replica and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.createumask != "" || args.forcemode != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -create-umask and -force-mode flags cannot be used with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		args._createUmask, err = parsePermBits(args.createumask)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-create-umask\" setting %q: %v", args.createumask, err)
+			os.Exit(exitcodes.Usage)
+		}
+		args._forceMode, err = parsePermBits(args.forcemode)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-force-mode\" setting %q: %v", args.forcemode, err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.ephemeral {
+		if args.reverse || args.masterkey != "" || args.zerokey || args.config != "" || args.init || args.passwd {
+			tlog.Fatal.Printf("-ephemeral cannot be combined with -reverse, -masterkey, -zerokey, -config, -init or -passwd")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.notifychanges && runtime.GOOS == "darwin" {
+		tlog.Fatal.Printf("-notify-changes is not supported on macOS")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.paranoiddiriv && args.reverse {
+		tlog.Fatal.Printf("-paranoid-diriv cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keepgoing && !args.reencrypt && !args.diff && !args.verify {
+		tlog.Fatal.Printf("-keep-going only works with -reencrypt, -diff and -verify")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.forcetime != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -force-time and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.forcetime != "init" {
+			t, err := parseTime(args.forcetime)
+			if err != nil {
+				tlog.Fatal.Printf("Invalid \"-force-time\" setting %q: %v", args.forcetime, err)
+				os.Exit(exitcodes.Usage)
+			}
+			args._forceTime = &t
+		}
+	}
+	if args.maxfilesize != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -max-file-size and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		args._maxFileSize, err = parseSize(args.maxfilesize)
+		if err != nil || args._maxFileSize == 0 {
+			tlog.Fatal.Printf("Invalid \"-max-file-size\" setting %q", args.maxfilesize)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.cachesize != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("The -cache-size and -reverse flags are incompatible")
+			os.Exit(exitcodes.Usage)
+		}
+		args._cacheSize, err = parseSize(args.cachesize)
+		if err != nil || args._cacheSize == 0 {
+			tlog.Fatal.Printf("Invalid \"-cache-size\" setting %q", args.cachesize)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.scrubinterval < 0 {
+		tlog.Fatal.Printf("The -scrub-interval setting must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.traceslowops < 0 {
+		tlog.Fatal.Printf("The -trace-slow-ops setting must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.optimeout < 0 {
+		tlog.Fatal.Printf("The -op-timeout setting must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.retry < 0 || args.retrydelay < 0 {
+		tlog.Fatal.Printf("The -retry and -retry-delay settings must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.retry > 0 && args.reverse {
+		tlog.Fatal.Printf("The -retry and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scrubinterval > 0 && args.reverse {
+		tlog.Fatal.Printf("The -scrub-interval and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.writeintent && args.reverse {
+		tlog.Fatal.Printf("The -write-intent and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.checksum && args.reverse {
+		tlog.Fatal.Printf("The -checksum and -reverse flags are incompatible")
+		os.Exit(exitcodes.Usage)
+	}
+	args._scrubBandwidth, err = parseSize(args.scrubbwlimit)
+	if err != nil || args._scrubBandwidth == 0 {
+		tlog.Fatal.Printf("Invalid \"-scrub-bwlimit\" setting %q", args.scrubbwlimit)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keyprovider != "" && (!args.init || args.keyfile != "") {
+		tlog.Fatal.Printf("The -keyprovider flag can only be used with -init and without -keyfile")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-scrypt-preset" sets the scrypt parameters that are not given
+	// explicitly
+	if args.scryptpreset != "" {
+		p, err := configfile.ScryptPreset(args.scryptpreset)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-scrypt-preset\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		if !isFlagPassed("scryptn") {
+			args.scryptn = p.LogN
+		}
+		if args.scryptr == 0 {
+			args.scryptr = p.R
+		}
+		if args.scryptp == 0 {
+			args.scryptp = p.P
+		}
+	}
+	if args.init {
+		p := configfile.ScryptParams{LogN: args.scryptn, R: args.scryptr, P: args.scryptp}
+		if p.R == 0 {
+			p.R = 8
+		}
+		if p.P == 0 {
+			p.P = 1
+		}
+		if err = p.Validate(); err != nil {
+			tlog.Fatal.Printf("Invalid scrypt parameters: %v", err)
+			os.Exit(exitcodes.ScryptParams)
+		}
+	}
+	pwSources := 0
+	for _, s := range []string{args.extpass, args.passfile, args.passenv, args.masterkey} {
+		if s != "" {
+			pwSources++
+		}
+	}
+	if pwSources > 1 {
+		tlog.Fatal.Printf("At most one of -extpass, -passfile, -passenv and -masterkey can be used")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.passenv != "" && args.passwd {
+		// The variable is cleared after reading the old password
+		tlog.Fatal.Printf("-passenv cannot be used with -passwd")
+		os.Exit(exitcodes.Usage)
+	}
 	// '-passfile FILE' is a shortcut for -extpass='/bin/cat -- FILE'
 	if args.passfile != "" {
 		args.extpass = "/bin/cat -- " + args.passfile
 	}
-	if args.extpass != "" && args.masterkey != "" {
-		tlog.Fatal.Printf("The options -extpass and -masterkey cannot be used at the same time")
-		os.Exit(exitcodes.Usage)
-	}
 	return args
 }
 
+// cryptoBackend returns the content encryption backend selected by "-aessiv",
+// "-reverse" (which implies "-aessiv") and "-openssl".
+func (args *argContainer) cryptoBackend() cryptocore.AEADTypeEnum {
+	if args.aessiv || args.reverse {
+		return cryptocore.BackendAESSIV
+	}
+	if args.openssl {
+		return cryptocore.BackendOpenSSL
+	}
+	return cryptocore.BackendGoGCM
+}
+
+// isFlagPassed returns true if the flag "name" was given on the command line,
+// as opposed to having its default value.
+func isFlagPassed(name string) bool {
+	found := false
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// parseQuotas parses the "-quota" argument, a comma-separated list of
+// DIR=SIZE pairs like "photos=10G,tmp=500M", into a map from relative
+// plaintext directory paths to limits in bytes.
+// Testcases in TestParseQuotas().
+func parseQuotas(s string) (map[string]uint64, error) {
+	quotas := make(map[string]uint64)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.LastIndex(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%q: expected DIR=SIZE", kv)
+		}
+		dir := filepath.Clean("/" + kv[:i])[1:]
+		limit, err := parseSize(kv[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", kv, err)
+		}
+		if _, ok := quotas[dir]; ok {
+			return nil, fmt.Errorf("%q: duplicate directory", kv)
+		}
+		quotas[dir] = limit
+	}
+	return quotas, nil
+}
+
+// parseDirectIO parses the "-direct-io" argument, a comma-separated list of
+// filepath.Match patterns like "logs/*.log,status", and checks that the
+// patterns are valid.
+// Testcases in TestParseDirectIO().
+func parseDirectIO(s string) ([]string, error) {
+	patterns := strings.Split(s, ",")
+	for _, p := range patterns {
+		if p == "" {
+			return nil, fmt.Errorf("empty pattern")
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", p, err)
+		}
+	}
+	return patterns, nil
+}
+
+// readPreloadList reads the "-preload" file, which lists one plaintext path
+// relative to the mountpoint per line. Empty lines and lines starting with
+// "#" are ignored.
+func readPreloadList(file string) ([]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, filepath.Clean("/" + line)[1:])
+	}
+	return paths, nil
+}
+
+// parseNamePolicy parses the "-name-policy" argument, a comma-separated list
+// of the rules "ascii", "nospace", "maxlen=N" and "regex=RE". As a regular
+// expression may contain commas, "regex=" has to be the last rule and takes
+// the rest of the argument.
+// Testcases in TestParseNamePolicy().
+func parseNamePolicy(s string) (*fusefrontend.NamePolicy, error) {
+	p := &fusefrontend.NamePolicy{}
+	for s != "" {
+		if strings.HasPrefix(s, "regex=") {
+			expr := s[len("regex="):]
+			if _, err := regexp.Compile(expr); err != nil {
+				return nil, err
+			}
+			p.Regexp = regexp.MustCompile("^(?:" + expr + ")$")
+			break
+		}
+		rule := s
+		s = ""
+		if i := strings.Index(rule, ","); i >= 0 {
+			rule, s = rule[:i], rule[i+1:]
+			if s == "" {
+				return nil, fmt.Errorf("empty rule")
+			}
+		}
+		switch {
+		case rule == "ascii":
+			p.ASCII = true
+		case rule == "nospace":
+			p.NoSpace = true
+		case strings.HasPrefix(rule, "maxlen="):
+			n, err := strconv.Atoi(rule[len("maxlen="):])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%q: expected a positive number", rule)
+			}
+			p.MaxLen = n
+		default:
+			return nil, fmt.Errorf("unknown rule %q", rule)
+		}
+	}
+	if *p == (fusefrontend.NamePolicy{}) {
+		return nil, fmt.Errorf("no rules")
+	}
+	return p, nil
+}
+
+// parseXattrPassthrough parses the "-xattr-passthrough" argument, a
+// comma-separated list of xattr name prefixes. Only the "user." namespace is
+// supported, and "user.gocryptfs." is reserved.
+// Testcases in TestParseXattrPassthrough().
+func parseXattrPassthrough(s string) ([]string, error) {
+	var prefixes []string
+	for _, prefix := range strings.Split(s, ",") {
+		if prefix == "" {
+			return nil, fmt.Errorf("empty prefix")
+		}
+		if !strings.HasPrefix(prefix, "user.") {
+			return nil, fmt.Errorf("%q: only \"user.\" xattrs are supported", prefix)
+		}
+		if strings.HasPrefix(prefix, "user.gocryptfs.") {
+			return nil, fmt.Errorf("%q: \"user.gocryptfs.\" is reserved", prefix)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parsePermBits parses an octal set of permission bits like "022". The
+// empty string means no bits.
+// Testcases in TestParsePermBits().
+func parsePermBits(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("not an octal number")
+	}
+	if bits&^0777 != 0 {
+		return 0, fmt.Errorf("only the permission bits 0777 are allowed")
+	}
+	return uint32(bits), nil
+}
+
+// parseTime parses a point in time given in RFC 3339 format, like
+// "2017-01-01T00:00:00Z", or as seconds since the Unix epoch.
+func parseTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("neither RFC 3339 nor Unix seconds")
+	}
+	return t, nil
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix
+// (powers of 1024), like "500M".
+func parseSize(s string) (uint64, error) {
+	size := strings.ToUpper(s)
+	var mult uint64 = 1
+	if len(size) > 0 {
+		if shift := strings.IndexByte("KMGT", size[len(size)-1]); shift >= 0 {
+			mult = 1 << (10 * uint(shift+1))
+			size = size[:len(size)-1]
+		}
+	}
+	n, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size")
+	}
+	if n > (1<<64-1)/mult {
+		return 0, fmt.Errorf("size too large")
+	}
+	return n * mult, nil
+}
+
 // prettyArgs pretty-prints the command-line arguments.
 func prettyArgs() string {
 	pa := fmt.Sprintf("%q", os.Args[1:])
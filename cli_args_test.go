@@ -69,3 +69,88 @@ func TestPrefixOArgs(t *testing.T) {
 		}
 	}
 }
+
+// TestParseQuotas checks the "-quota" parsing
+func TestParseQuotas(t *testing.T) {
+	q, err := parseQuotas("photos=10G,/a/b/=500m,.=1,tmp=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{
+		"photos": 10 << 30,
+		"a/b":    500 << 20,
+		"":       1,
+		"tmp":    0,
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("want=%v got=%v", want, q)
+	}
+	for _, s := range []string{"", "photos", "a=", "a=1X", "a=-1", "a=99999999999T", "a=1,a/=2"} {
+		if _, err := parseQuotas(s); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+}
+
+// TestParseDirectIO checks the "-direct-io" parsing
+func TestParseDirectIO(t *testing.T) {
+	p, err := parseDirectIO("*.log,proc/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*.log", "proc/status"}; !reflect.DeepEqual(p, want) {
+		t.Errorf("want=%v got=%v", want, p)
+	}
+	for _, s := range []string{"", "a,", "[", "a,b[-"} {
+		if _, err := parseDirectIO(s); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+}
+
+func TestParseNamePolicy(t *testing.T) {
+	p, err := parseNamePolicy("ascii,maxlen=8,regex=[a-z]+(,[0-9])?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.ASCII || p.NoSpace || p.MaxLen != 8 || p.Regexp == nil {
+		t.Errorf("wrong policy: %+v", p)
+	}
+	if p.Check("abc,1") != nil || p.Check("abc,12") == nil || p.Check("xabcdefgh") == nil {
+		t.Errorf("regex=%q is not applied to the whole name", p.Regexp)
+	}
+	for _, s := range []string{",", "ascii,", "foo", "maxlen=0", "maxlen=x", "regex=["} {
+		if _, err := parseNamePolicy(s); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+}
+
+func TestParseXattrPassthrough(t *testing.T) {
+	prefixes, err := parseXattrPassthrough("user.xdg.,user.app.tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prefixes, []string{"user.xdg.", "user.app.tag"}) {
+		t.Errorf("wrong prefixes: %q", prefixes)
+	}
+	for _, s := range []string{",", "user.a,", "trusted.foo", "security.", "user.gocryptfs.foo"} {
+		if _, err := parseXattrPassthrough(s); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+}
+
+func TestParsePermBits(t *testing.T) {
+	for s, want := range map[string]uint32{"": 0, "0": 0, "022": 022, "777": 0777, "0040": 040} {
+		bits, err := parsePermBits(s)
+		if err != nil || bits != want {
+			t.Errorf("%q: want %#o, got %#o, err=%v", s, want, bits, err)
+		}
+	}
+	for _, s := range []string{"8", "abc", "-1", "1000", "04755"} {
+		if _, err := parsePermBits(s); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+}
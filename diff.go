@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// differ compares the plaintext views of two filesystems
+type differ struct {
+	a       *fusefrontend.FS
+	b       *fusefrontend.FS
+	context *fuse.Context
+	// Number of paths that differ
+	diffs int
+	// Errors skipped because of "-keep-going"
+	errs fileErrors
+}
+
+// diffDirs compares the plaintext trees of CIPHERDIR and "dirB" and prints
+// every path that differs, as soon as it is found. Both filesystems are
+// unlocked with the same options, so they need the same password.
+//
+// This is called when you pass the "-diff" option.
+func diffDirs(args *argContainer, dirB string) {
+	dirB, _ = filepath.Abs(dirB)
+	if err := checkDir(dirB); err != nil {
+		tlog.Fatal.Printf("Invalid CIPHERDIR_B: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	argsB := *args
+	argsB.cipherdir = dirB
+	argsB.config = filepath.Join(dirB, configfile.ConfDefaultName)
+	argsB._configCustom = false
+	d := differ{
+		a:       newCheckFS(args, "-diff"),
+		b:       newCheckFS(&argsB, "-diff"),
+		context: &fuse.Context{},
+		errs:    fileErrors{keepGoing: args.keepgoing},
+	}
+	if err := d.diffDir(""); err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Other)
+	}
+	if d.errs.n > 0 {
+		tlog.Fatal.Printf("-diff: %d files could not be compared", d.errs.n)
+		os.Exit(exitcodes.FilesFailed)
+	}
+	if d.diffs > 0 {
+		os.Exit(exitcodes.Diff)
+	}
+	os.Exit(0)
+}
+
+// report prints that "path" differs in the ways listed in "what".
+func (d *differ) report(path string, what ...string) {
+	d.diffs++
+	fmt.Printf("%s: %s\n", path, strings.Join(what, ", "))
+}
+
+// names returns the sorted entry names of the plaintext directory "dir".
+func names(fs *fusefrontend.FS, dir string, context *fuse.Context) ([]string, error) {
+	entries, status := fs.OpenDir(dir, context)
+	if !status.Ok() {
+		return nil, fmt.Errorf("OpenDir %q: %v", dir, status)
+	}
+	n := make([]string, len(entries))
+	for i, e := range entries {
+		n[i] = e.Name
+	}
+	sort.Strings(n)
+	return n, nil
+}
+
+// diffDir recursively compares the plaintext directory "dir".
+func (d *differ) diffDir(dir string) error {
+	namesA, err := names(d.a, dir, d.context)
+	if err != nil {
+		return err
+	}
+	namesB, err := names(d.b, dir, d.context)
+	if err != nil {
+		return err
+	}
+	// Walk both sorted lists in parallel
+	for len(namesA) > 0 || len(namesB) > 0 {
+		if len(namesB) == 0 || len(namesA) > 0 && namesA[0] < namesB[0] {
+			d.report(filepath.Join(dir, namesA[0]), "only in A")
+			namesA = namesA[1:]
+			continue
+		}
+		if len(namesA) == 0 || namesB[0] < namesA[0] {
+			d.report(filepath.Join(dir, namesB[0]), "only in B")
+			namesB = namesB[1:]
+			continue
+		}
+		path := filepath.Join(dir, namesA[0])
+		namesA = namesA[1:]
+		namesB = namesB[1:]
+		if err = d.errs.skip(d.diffEntry(path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffEntry compares "path", which exists in both filesystems, and descends
+// into it if it is a directory in both.
+func (d *differ) diffEntry(path string) error {
+	a, status := d.a.GetAttr(path, d.context)
+	if !status.Ok() {
+		return fmt.Errorf("GetAttr %q: %v", path, status)
+	}
+	b, status := d.b.GetAttr(path, d.context)
+	if !status.Ok() {
+		return fmt.Errorf("GetAttr %q: %v", path, status)
+	}
+	what, err := d.compare(path, a, b)
+	if err != nil {
+		return err
+	}
+	if len(what) > 0 {
+		d.report(path, what...)
+	}
+	if a.IsDir() && b.IsDir() {
+		return d.diffDir(path)
+	}
+	return nil
+}
+
+// compare returns how the entry "path" differs between the filesystems,
+// given its attributes "a" and "b". The content of regular files is only
+// read if they have the same size, but a different mtime.
+func (d *differ) compare(path string, a *fuse.Attr, b *fuse.Attr) ([]string, error) {
+	if a.Mode&syscall.S_IFMT != b.Mode&syscall.S_IFMT {
+		return []string{"type"}, nil
+	}
+	var what []string
+	if a.Mode&07777 != b.Mode&07777 {
+		what = append(what, "mode")
+	}
+	if a.Owner != b.Owner {
+		what = append(what, "owner")
+	}
+	sameMtime := a.Mtime == b.Mtime && a.Mtimensec == b.Mtimensec
+	// Timestamps cannot be set on symlinks, so copies never have the same
+	if !sameMtime && !a.IsSymlink() {
+		what = append(what, "mtime")
+	}
+	switch {
+	case a.IsRegular():
+		if a.Size != b.Size {
+			what = append(what, "content")
+		} else if !sameMtime {
+			equal, err := d.sameContent(path, a.Size)
+			if err != nil {
+				return nil, err
+			}
+			if !equal {
+				what = append(what, "content")
+			}
+		}
+	case a.IsSymlink():
+		targetA, status := d.a.Readlink(path, d.context)
+		if !status.Ok() {
+			return nil, fmt.Errorf("Readlink %q: %v", path, status)
+		}
+		targetB, status := d.b.Readlink(path, d.context)
+		if !status.Ok() {
+			return nil, fmt.Errorf("Readlink %q: %v", path, status)
+		}
+		if targetA != targetB {
+			what = append(what, "target")
+		}
+	case !a.IsDir():
+		if a.Rdev != b.Rdev {
+			what = append(what, "device")
+		}
+	}
+	return what, nil
+}
+
+// sameContent reads the regular file "path", which is "size" bytes big in
+// both filesystems, and returns true if the content is the same. It stops at
+// the first difference.
+func (d *differ) sameContent(path string, size uint64) (bool, error) {
+	fa, status := d.a.Open(path, uint32(os.O_RDONLY), d.context)
+	if !status.Ok() {
+		return false, fmt.Errorf("Open %q: %v", path, status)
+	}
+	defer fa.Release()
+	fb, status := d.b.Open(path, uint32(os.O_RDONLY), d.context)
+	if !status.Ok() {
+		return false, fmt.Errorf("Open %q: %v", path, status)
+	}
+	defer fb.Release()
+	bufA := make([]byte, fuse.MAX_KERNEL_WRITE)
+	bufB := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off := uint64(0); off < size; {
+		dataA, err := readAt(fa, bufA, off)
+		if err != nil {
+			return false, fmt.Errorf("Read %q at %d: %v", path, off, err)
+		}
+		dataB, err := readAt(fb, bufB, off)
+		if err != nil {
+			return false, fmt.Errorf("Read %q at %d: %v", path, off, err)
+		}
+		if !bytes.Equal(dataA, dataB) {
+			return false, nil
+		}
+		if len(dataA) == 0 {
+			break
+		}
+		off += uint64(len(dataA))
+	}
+	return true, nil
+}
+
+// readAt reads from "f" at "off" into "buf" and returns the data.
+func readAt(f nodefs.File, buf []byte, off uint64) ([]byte, error) {
+	res, status := f.Read(buf, int64(off))
+	if !status.Ok() {
+		return nil, status
+	}
+	data, status := res.Bytes(buf)
+	if !status.Ok() {
+		return nil, status
+	}
+	return data, nil
+}
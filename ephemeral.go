@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Directories that usually are on tmpfs, in order of preference.
+// XDG_RUNTIME_DIR is private to the user, /dev/shm is shared.
+var memDirs = []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"}
+
+// ephemeralCipherdir creates an empty ciphertext directory on tmpfs and
+// returns its path.
+func ephemeralCipherdir(plaintextnames bool) (string, error) {
+	for _, parent := range memDirs {
+		if parent == "" {
+			continue
+		}
+		if mem, _ := syscallcompat.IsMemoryFS(parent); !mem {
+			continue
+		}
+		dir, err := ioutil.TempDir(parent, "gocryptfs-ephemeral-")
+		if err != nil {
+			return "", err
+		}
+		if !plaintextnames {
+			err = nametransform.WriteDirIV(nil, dir)
+			if err != nil {
+				os.RemoveAll(dir)
+				return "", err
+			}
+		}
+		return dir, nil
+	}
+	return "", fmt.Errorf("none of %q is on tmpfs", memDirs)
+}
+
+// mountEphemeral mounts a new, empty filesystem whose ciphertext is kept on
+// tmpfs and whose master key is random and never stored. Everything is gone
+// once it is unmounted.
+//
+// This is called when you pass the "-ephemeral" option.
+func mountEphemeral(args *argContainer) int {
+	dir, err := ephemeralCipherdir(args.plaintextnames)
+	if err != nil {
+		tlog.Fatal.Printf("-ephemeral: cannot create CIPHERDIR: %v", err)
+		return exitcodes.CipherDir
+	}
+	defer os.RemoveAll(dir)
+	tlog.Debug.Printf("-ephemeral: CIPHERDIR is %s", dir)
+	args.cipherdir = dir
+	args.config = ""
+	return doMount(args)
+}
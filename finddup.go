@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// findDupWorkers is the number of directories "-finddup" reads, and the
+// number of files it hashes, in parallel
+const findDupWorkers = 4
+
+// dupFinder finds regular files with the same plaintext content
+type dupFinder struct {
+	fs      *fusefrontend.FS
+	context *fuse.Context
+	// Candidates by size. Only files of the same size can be duplicates.
+	bySize map[uint64][]string
+	// Inode numbers seen so far, to skip further hard links
+	inos map[uint64]bool
+}
+
+// findDups prints the groups of regular files in CIPHERDIR that have the
+// same plaintext content. Each group is printed as one path per line,
+// followed by an empty line. Empty files and further hard links to a file
+// that has already been seen are ignored.
+//
+// This is called when you pass the "-finddup" option.
+func findDups(args *argContainer) {
+	d := dupFinder{
+		fs:      newCheckFS(args, "-finddup"),
+		context: &fuse.Context{},
+		bySize:  make(map[uint64][]string),
+		inos:    make(map[uint64]bool),
+	}
+	err := d.fs.WalkPlain("", findDupWorkers, nil, d.add)
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Other)
+	}
+	groups, err := d.groups()
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Other)
+	}
+	var wasted uint64
+	for _, g := range groups {
+		for _, path := range g.paths {
+			fmt.Println(path)
+		}
+		fmt.Println()
+		wasted += uint64(len(g.paths)-1) * g.size
+	}
+	tlog.Info.Printf("%d groups of duplicates, %d bytes could be saved", len(groups), wasted)
+	os.Exit(0)
+}
+
+// add is called by WalkPlain for every path and remembers the regular
+// files.
+func (d *dupFinder) add(path string) error {
+	a, status := d.fs.GetAttr(path, d.context)
+	if !status.Ok() {
+		return fmt.Errorf("GetAttr %q: %v", path, status)
+	}
+	if !a.IsRegular() || a.Size == 0 || d.inos[a.Ino] {
+		return nil
+	}
+	d.inos[a.Ino] = true
+	d.bySize[a.Size] = append(d.bySize[a.Size], path)
+	return nil
+}
+
+// dupGroup is a set of files with the same content
+type dupGroup struct {
+	size  uint64
+	paths []string
+}
+
+// byFirstPath sorts groups by their first path
+type byFirstPath []dupGroup
+
+func (g byFirstPath) Len() int           { return len(g) }
+func (g byFirstPath) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g byFirstPath) Less(i, j int) bool { return g[i].paths[0] < g[j].paths[0] }
+
+// groups hashes the content of all files that share their size with
+// another file, using findDupWorkers goroutines, and returns the groups of
+// two or more files with the same hash, sorted by path.
+func (d *dupFinder) groups() ([]dupGroup, error) {
+	type key struct {
+		size uint64
+		sum  [sha256.Size]byte
+	}
+	type job struct {
+		path string
+		size uint64
+	}
+	jobs := make(chan job)
+	var mu sync.Mutex
+	var firstErr error
+	byHash := make(map[key][]string)
+	var wg sync.WaitGroup
+	for i := 0; i < findDupWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum, err := d.hash(j.path, j.size)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				k := key{j.size, sum}
+				byHash[k] = append(byHash[k], j.path)
+				mu.Unlock()
+			}
+		}()
+	}
+	for size, paths := range d.bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		for _, p := range paths {
+			jobs <- job{p, size}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	var groups []dupGroup
+	for k, paths := range byHash {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		groups = append(groups, dupGroup{size: k.size, paths: paths})
+	}
+	sort.Sort(byFirstPath(groups))
+	return groups, nil
+}
+
+// hash returns the SHA256 of the plaintext content of the regular file
+// "path", which is "size" bytes big. The file is read block by block.
+func (d *dupFinder) hash(path string, size uint64) (sum [sha256.Size]byte, err error) {
+	f, status := d.fs.Open(path, uint32(os.O_RDONLY), d.context)
+	if !status.Ok() {
+		return sum, fmt.Errorf("Open %q: %v", path, status)
+	}
+	defer f.Release()
+	h := sha256.New()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off := uint64(0); off < size; {
+		data, err := readAt(f, buf, off)
+		if err != nil {
+			return sum, fmt.Errorf("Read %q at %d: %v", path, off, err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		h.Write(data)
+		off += uint64(len(data))
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
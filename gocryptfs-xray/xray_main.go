@@ -60,8 +60,13 @@ func main() {
 
 func dumpMasterKey(fn string) {
 	tlog.Info.Enabled = false
-	pw := readpassword.Once("")
-	masterkey, _, err := configfile.LoadConfFile(fn, pw)
+	_, cf, err := configfile.LoadConfFile(fn, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitcodes.Exit(err)
+	}
+	pw := readpassword.Once("", "")
+	masterkey, err := cf.DecryptMasterKey(pw)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		exitcodes.Exit(err)
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// healthCheck checks that the gocryptfs mount at "mountpoint" is alive and
+// answering requests, and exits with exitcodes.HealthCheck if it is not, or
+// if it does not answer within "timeout". It is meant for container
+// liveness probes and does not need the password.
+// This is called when you pass the "-healthcheck" option.
+func healthCheck(mountpoint string, timeout time.Duration) {
+	done := make(chan error, 1)
+	go func() {
+		done <- probeMount(mountpoint)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			tlog.Fatal.Printf("Unhealthy: %v", err)
+			os.Exit(exitcodes.HealthCheck)
+		}
+	case <-time.After(timeout):
+		// The goroutine may be stuck in the kernel. We exit anyway, the
+		// FUSE request is aborted when our process dies.
+		tlog.Fatal.Printf("Unhealthy: no response within %v", timeout)
+		os.Exit(exitcodes.HealthCheck)
+	}
+	tlog.Info.Printf("Healthy")
+	os.Exit(0)
+}
+
+// probeMount checks that "mountpoint" is a mountpoint and that listing it
+// works. Stat results may come from the kernel's attribute cache, but
+// opening and reading a directory always reaches the filesystem daemon.
+func probeMount(mountpoint string) error {
+	var st, parentSt syscall.Stat_t
+	err := syscall.Stat(mountpoint, &st)
+	if err != nil {
+		return err
+	}
+	err = syscall.Stat(filepath.Join(mountpoint, ".."), &parentSt)
+	if err != nil {
+		return err
+	}
+	if st.Dev == parentSt.Dev {
+		return fmt.Errorf("%q is not mounted", mountpoint)
+	}
+	dir, err := os.Open(mountpoint)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -8,7 +8,9 @@ import (
 
 const tUsage = "" +
 	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
-	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
+	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n" +
+	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT -- CMD [ARGS...]\n" +
+	"  or   " + tlog.ProgramName + " -healthcheck MOUNTPOINT\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
 func helpShort() {
@@ -31,6 +33,7 @@ Common Options (use -hh to show all):
   -masterkey         Mount with explicit master key instead of password
   -nonempty          Allow mounting over non-empty directory
   -nosyslog          Do not redirect log messages to syslog
+  -passenv           Read password from environment variable
   -passfile          Read password from file
   -passwd            Change password
   -plaintextnames    Do not encrypt file names (with -init)
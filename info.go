@@ -37,6 +37,21 @@ func info(filename string) {
 	// Pretty-print
 	fmt.Printf("Creator:      %s\n", cf.Creator)
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
+	if cf.KeyFile != "" {
+		fmt.Printf("KeyFile:      %s\n", cf.KeyFile)
+	}
+	if cf.KeyProvider != "" {
+		fmt.Printf("KeyProvider:  %s\n", cf.KeyProvider)
+	}
+	if cf.NamePadding != 0 {
+		fmt.Printf("NamePadding:  %d\n", cf.NamePadding)
+	}
+	if cf.GCMIVBits != 0 {
+		fmt.Printf("GCMParams:    IV=%d bits\n", cf.GCMIVBits)
+	}
+	if cf.Label != "" {
+		fmt.Printf("Label:        %s\n", cf.Label)
+	}
 	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
 	s := cf.ScryptObject
 	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
@@ -32,21 +32,45 @@ func initDir(args *argContainer) {
 			os.Exit(exitcodes.Init)
 		}
 	}
-	// Choose password for config file
-	if args.extpass == "" {
-		tlog.Info.Printf("Choose a password for protecting your files.")
+	// Choose password for config file. Not needed if the master key goes
+	// into a key file or is wrapped by a key provider.
+	var password string
+	if args.keyfile == "" && args.keyprovider == "" {
+		if args.extpass == "" && args.passenv == "" {
+			tlog.Info.Printf("Choose a password for protecting your files.")
+		}
+		password = readpassword.Twice(args.extpass, args.passenv, args.allowemptypassword)
+		readpassword.CheckTrailingGarbage()
 	}
-	password := readpassword.Twice(args.extpass)
-	readpassword.CheckTrailingGarbage()
 	creator := tlog.ProgramName + " " + GitVersion
-	err = configfile.CreateConfFile(args.config, password, args.plaintextnames, args.scryptn, creator, args.aessiv, args.devrandom)
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename:       args.config,
+		Password:       password,
+		PlaintextNames: args.plaintextnames,
+		LogN:           args.scryptn,
+		ScryptR:        args.scryptr,
+		ScryptP:        args.scryptp,
+		Creator:        creator,
+		AESSIV:         args.aessiv,
+		Devrandom:      args.devrandom,
+		Compress:       args.compress,
+		NFCNames:       args.nfcnames,
+		KeyFile:        args.keyfile,
+		KeyProvider:    args.keyprovider,
+		EncryptedDirIV: args.encrypteddiriv,
+		CipherDir:      args.cipherdir,
+		NamePadding:    args.namepadding,
+		Label:          args.label,
+		SymlinkFiles:   args.symlinkfiles,
+		GCMIVBits:      args.gcmivbits,
+	})
 	if err != nil {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.WriteConf)
 	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv
-	// in the root dir
-	if !args.plaintextnames && !args.reverse {
+	// in the root dir. CreateConfFile has already written an encrypted one.
+	if !args.plaintextnames && !args.reverse && !args.encrypteddiriv {
 		err = nametransform.WriteDirIV(nil, args.cipherdir)
 		if err != nil {
 			tlog.Fatal.Println(err)
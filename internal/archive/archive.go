@@ -0,0 +1,369 @@
+// Package archive gives random access to the files in a tar or zip archive,
+// for mounting an archived ciphertext directory without extracting it.
+//
+// Tar archives must not be compressed, as there is no way to seek in a
+// compressed tar stream. Members of zip archives that are stored without
+// compression are read directly. Compressed zip members are decompressed
+// from the start, which is fine for sequential reads, but slow for random
+// access.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MaxReadFileSize is the largest entry that ReadFile and symlinks in zip
+// archives may have. The sizes come from the archive and are not trusted, so
+// they are checked before allocating the buffer. The files that gocryptfs
+// reads whole (config file, diriv, long name files, symlink targets) are
+// much smaller.
+const MaxReadFileSize = 64 * 1024
+
+// Entry is a file, directory or symlink in the archive.
+type Entry struct {
+	// Path relative to the archive root, without leading or trailing
+	// slashes. The root directory is "".
+	Path string
+	// Type and permission bits
+	Mode os.FileMode
+	// Size of the content of regular files
+	Size    int64
+	ModTime time.Time
+	// Owner from tar archives. Zip archives do not store one, so it is the
+	// owner of the archive file.
+	Uid, Gid int
+	// Target of symlinks
+	Linkname string
+
+	// Directory entries, sorted by name
+	children []*Entry
+	// Tar archives: offset of the content in the archive file
+	offset int64
+	// Zip archives
+	zipFile *zip.File
+}
+
+// Archive is an opened tar or zip archive.
+type Archive struct {
+	f       *os.File
+	entries map[string]*Entry
+}
+
+// Open opens and indexes the tar or zip archive "name".
+func Open(name string) (*Archive, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &Archive{
+		f:       f,
+		entries: make(map[string]*Entry),
+	}
+	root := &Entry{Mode: os.ModeDir | 0755, ModTime: fi.ModTime()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		root.Uid, root.Gid = int(st.Uid), int(st.Gid)
+	}
+	a.entries[""] = root
+	if zr, err := zip.NewReader(f, fi.Size()); err == nil {
+		err = a.indexZip(zr, root)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else if err = a.indexTar(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a zip or uncompressed tar archive: %v", name, err)
+	}
+	for _, e := range a.entries {
+		sort.Sort(byPath(e.children))
+	}
+	return a, nil
+}
+
+// Close closes the archive file.
+func (a *Archive) Close() error {
+	return a.f.Close()
+}
+
+// Lookup returns the entry at "p", which is relative to the archive root.
+func (a *Archive) Lookup(p string) (*Entry, bool) {
+	e, ok := a.entries[clean(p)]
+	return e, ok
+}
+
+// ReadDir returns the entries of the directory "dir", sorted by name.
+func (a *Archive) ReadDir(dir string) ([]*Entry, error) {
+	e, ok := a.Lookup(dir)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if !e.Mode.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", dir)
+	}
+	return e.children, nil
+}
+
+// Name returns the last path component of the entry.
+func (e *Entry) Name() string {
+	return path.Base(e.Path)
+}
+
+// Open returns a reader for the content of the regular file "e".
+func (a *Archive) Open(e *Entry) (io.ReaderAt, error) {
+	if !e.Mode.IsRegular() {
+		return nil, fmt.Errorf("%q is not a regular file", e.Path)
+	}
+	if e.zipFile == nil {
+		return io.NewSectionReader(a.f, e.offset, e.Size), nil
+	}
+	if e.zipFile.Method == zip.Store {
+		off, err := e.zipFile.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(a.f, off, e.Size), nil
+	}
+	return &zipReaderAt{f: e.zipFile}, nil
+}
+
+// ReadFile returns the whole content of the regular file "p", which must not
+// be larger than MaxReadFileSize.
+func (a *Archive) ReadFile(p string) ([]byte, error) {
+	e, ok := a.Lookup(p)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if e.Size > MaxReadFileSize {
+		return nil, fmt.Errorf("%q is too big: %d bytes", e.Path, e.Size)
+	}
+	r, err := a.Open(e)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, e.Size)
+	n, err := r.ReadAt(buf, 0)
+	if err == io.EOF && int64(n) == e.Size {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// add inserts "e" and creates the parent directories that the archive does
+// not list explicitly. A later explicit entry replaces an implicit one.
+func (a *Archive) add(e *Entry, root *Entry) error {
+	e.Path = clean(e.Path)
+	if e.Path == "" {
+		if e.Mode.IsDir() {
+			root.Mode, root.ModTime, root.Uid, root.Gid = e.Mode, e.ModTime, e.Uid, e.Gid
+			return nil
+		}
+		return fmt.Errorf("invalid entry name")
+	}
+	if old, ok := a.entries[e.Path]; ok {
+		if !old.Mode.IsDir() || !e.Mode.IsDir() {
+			return fmt.Errorf("duplicate entry %q", e.Path)
+		}
+		// Fill in the implicit directory
+		old.Mode, old.ModTime, old.Uid, old.Gid = e.Mode, e.ModTime, e.Uid, e.Gid
+		return nil
+	}
+	parentPath := dir(e.Path)
+	parent, ok := a.entries[parentPath]
+	if !ok {
+		parent = &Entry{Path: parentPath, Mode: os.ModeDir | 0755, ModTime: root.ModTime, Uid: root.Uid, Gid: root.Gid}
+		if err := a.add(parent, root); err != nil {
+			return err
+		}
+	} else if !parent.Mode.IsDir() {
+		return fmt.Errorf("%q: parent is not a directory", e.Path)
+	}
+	parent.children = append(parent.children, e)
+	a.entries[e.Path] = e
+	return nil
+}
+
+// indexTar reads all tar headers and remembers where the contents are.
+func (a *Archive) indexTar() error {
+	root := a.entries[""]
+	cr := &countingReader{r: a.f}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		e := &Entry{
+			Path:    hdr.Name,
+			Mode:    hdr.FileInfo().Mode(),
+			ModTime: hdr.ModTime,
+			Uid:     hdr.Uid,
+			Gid:     hdr.Gid,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			e.Size = hdr.Size
+			e.offset = cr.n
+		case tar.TypeDir:
+		case tar.TypeSymlink:
+			e.Linkname = hdr.Linkname
+		case tar.TypeLink:
+			target, ok := a.entries[clean(hdr.Linkname)]
+			if !ok || !target.Mode.IsRegular() {
+				return fmt.Errorf("%q: hard link target %q not found", hdr.Name, hdr.Linkname)
+			}
+			e.Mode = target.Mode
+			e.Size = target.Size
+			e.offset = target.offset
+		case tar.TypeGNUSparse:
+			return fmt.Errorf("%q: sparse files are not supported", hdr.Name)
+		default:
+			// Device nodes, FIFOs: there is no content to serve
+			continue
+		}
+		if err = a.add(e, root); err != nil {
+			return err
+		}
+	}
+	// A file that is not a tar archive usually fails in Next(), but an
+	// empty or all-zero file looks like an empty archive
+	if len(a.entries) == 1 {
+		return fmt.Errorf("no entries")
+	}
+	return nil
+}
+
+// indexZip adds the members of "zr".
+func (a *Archive) indexZip(zr *zip.Reader, root *Entry) error {
+	for _, zf := range zr.File {
+		fi := zf.FileInfo()
+		e := &Entry{
+			Path:    zf.Name,
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+			Uid:     root.Uid,
+			Gid:     root.Gid,
+		}
+		switch {
+		case e.Mode.IsDir():
+		case e.Mode&os.ModeSymlink != 0:
+			link, err := readZipFile(zf)
+			if err != nil {
+				return err
+			}
+			e.Linkname = string(link)
+		case e.Mode.IsRegular():
+			e.Size = int64(zf.UncompressedSize64)
+			e.zipFile = zf
+		default:
+			continue
+		}
+		if err := a.add(e, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readZipFile returns the whole content of "zf", which must not be larger
+// than MaxReadFileSize.
+func readZipFile(zf *zip.File) ([]byte, error) {
+	if zf.UncompressedSize64 > MaxReadFileSize {
+		return nil, fmt.Errorf("%q is too big: %d bytes", zf.Name, zf.UncompressedSize64)
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf := make([]byte, zf.UncompressedSize64)
+	_, err = io.ReadFull(rc, buf)
+	return buf, err
+}
+
+// zipReaderAt reads a compressed zip member. It keeps the decompressor open
+// and only starts over when asked for an offset before the current one.
+type zipReaderAt struct {
+	f   *zip.File
+	mu  sync.Mutex
+	rc  io.ReadCloser
+	pos int64
+}
+
+// ReadAt implements io.ReaderAt.
+func (z *zipReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.rc == nil || off < z.pos {
+		if z.rc != nil {
+			z.rc.Close()
+		}
+		rc, err := z.f.Open()
+		if err != nil {
+			return 0, err
+		}
+		z.rc, z.pos = rc, 0
+	}
+	if off > z.pos {
+		n, err := io.CopyN(ioutil.Discard, z.rc, off-z.pos)
+		z.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(z.rc, p)
+	z.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// countingReader counts the bytes that have been read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// clean turns "./a/b/" and "/a/b" into "a/b", and "." into "".
+func clean(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// dir is like path.Dir, but returns "" instead of ".".
+func dir(p string) string {
+	d := path.Dir(p)
+	if d == "." {
+		return ""
+	}
+	return d
+}
+
+type byPath []*Entry
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// content is large enough to span several tar blocks and to make random
+// access into a compressed zip member non-trivial.
+var content = func() []byte {
+	b := make([]byte, 100000)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}()
+
+func writeTar(t *testing.T) string {
+	f, err := ioutil.TempFile("", "gocryptfs-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	mtime := time.Unix(1500000000, 0)
+	for _, h := range []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime},
+		{Name: "./small", Typeflag: tar.TypeReg, Mode: 0600, Size: 5, ModTime: mtime, Uid: 1234},
+		{Name: "./a/b/big", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), ModTime: mtime},
+		{Name: "./a/", Typeflag: tar.TypeDir, Mode: 0711, ModTime: mtime},
+		{Name: "./a/link", Typeflag: tar.TypeSymlink, Linkname: "b/big", ModTime: mtime},
+		{Name: "./hard", Typeflag: tar.TypeLink, Linkname: "./small", ModTime: mtime},
+	} {
+		if err = tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		switch h.Name {
+		case "./small":
+			tw.Write([]byte("hello"))
+		case "./a/b/big":
+			tw.Write(content)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func writeZip(t *testing.T) string {
+	f, err := ioutil.TempFile("", "gocryptfs-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	add := func(name string, method uint16, mode os.FileMode, data []byte) {
+		h := &zip.FileHeader{Name: name, Method: method}
+		h.SetMode(mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	add("small", zip.Store, 0600, []byte("hello"))
+	add("a/b/big", zip.Deflate, 0644, content)
+	add("a/link", zip.Store, os.ModeSymlink|0777, []byte("b/big"))
+	add("hard", zip.Store, 0600, []byte("hello"))
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// TestArchive checks the index and random access reads for tar and zip.
+func TestArchive(t *testing.T) {
+	for _, name := range []string{writeTar(t), writeZip(t)} {
+		defer os.Remove(name)
+		a, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		entries, err := a.ReadDir("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if len(names) != 3 || names[0] != "a" || names[1] != "hard" || names[2] != "small" {
+			t.Errorf("root: wrong entries %q", names)
+		}
+		if e, ok := a.Lookup("a/b"); !ok || !e.Mode.IsDir() {
+			t.Error("implicit directory a/b is missing")
+		}
+		if e, ok := a.Lookup("/a/link"); !ok || e.Mode&os.ModeSymlink == 0 || e.Linkname != "b/big" {
+			t.Errorf("wrong symlink: %+v", e)
+		}
+		for _, p := range []string{"small", "hard"} {
+			data, err := a.ReadFile(p)
+			if err != nil || string(data) != "hello" {
+				t.Errorf("%s: %q %v", p, data, err)
+			}
+		}
+		if _, err = a.ReadFile("a/b/big"); err == nil {
+			t.Errorf("%s: ReadFile accepted a file above MaxReadFileSize", name)
+		}
+		e, _ := a.Lookup("a/b/big")
+		r, err := a.Open(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Backwards, so that the zip reader has to start over
+		for _, off := range []int64{90000, 70000, 0, 99990} {
+			buf := make([]byte, 100)
+			n, err := r.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], content[off:off+int64(n)]) {
+				t.Errorf("%s: wrong content at %d", name, off)
+			}
+			if off == 99990 && (n != 10 || err != io.EOF) {
+				t.Errorf("%s: read at the end: n=%d err=%v", name, n, err)
+			}
+		}
+		if _, ok := a.Lookup("missing"); ok {
+			t.Error("found a missing entry")
+		}
+	}
+}
+
+// TestNotAnArchive checks that other files are rejected.
+func TestNotAnArchive(t *testing.T) {
+	f, err := ioutil.TempFile("", "gocryptfs-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(bytes.Repeat([]byte("not an archive "), 100))
+	f.Close()
+	if _, err = Open(f.Name()); err == nil {
+		t.Error("should have failed")
+	}
+}
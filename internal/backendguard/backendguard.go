@@ -0,0 +1,280 @@
+// Package backendguard wraps a pathfs.FileSystem and detects when the
+// backing directory disappears while mounted: it has been removed, renamed
+// or replaced, or the device it is on has gone away. From then on, every
+// operation fails with EIO instead of a mix of ENOENT, ENOTDIR and ESTALE
+// that looks like a normal, empty filesystem to applications. The mount can
+// still be unmounted as usual.
+//
+// To keep the normal case free of extra syscalls and locks, the backing
+// directory is only checked when an operation fails, and operations never
+// wait for each other.
+package backendguard
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// logf reports that the backing directory is gone. This goes to the info
+// log: the mount stays up in a defined state, and "-wpanic" should not take
+// it down while the user still has files open.
+var logf = tlog.Info.Printf
+
+// FS returns EIO for all operations on the wrapped pathfs.FileSystem once
+// the backing directory is gone.
+type FS struct {
+	pathfs.FileSystem
+	// Path of the backing directory
+	dir string
+	// Device and inode number of the backing directory at mount time
+	dev, ino uint64
+	// Set to 1 once the backing directory is gone. It is not cleared again,
+	// so that a different directory that shows up at the same path is never
+	// written to. Accessed atomically.
+	gone int32
+}
+
+var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
+
+// NewFS wraps "fs", whose backing directory is "dir".
+func NewFS(fs pathfs.FileSystem, dir string) (*FS, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return nil, err
+	}
+	return &FS{
+		FileSystem: fs,
+		dir:        dir,
+		dev:        uint64(st.Dev),
+		ino:        uint64(st.Ino),
+	}, nil
+}
+
+// Gone returns true if the backing directory has disappeared.
+func (fs *FS) Gone() bool {
+	return atomic.LoadInt32(&fs.gone) != 0
+}
+
+// check returns "code", or EIO if the backing directory is gone. Only the
+// errors a vanished directory can cause trigger a check.
+func (fs *FS) check(code fuse.Status) fuse.Status {
+	switch syscall.Errno(code) {
+	case syscall.ENOENT, syscall.ENOTDIR, syscall.ESTALE, syscall.ENODEV, syscall.ENXIO, syscall.EIO:
+	default:
+		return code
+	}
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	var st syscall.Stat_t
+	err := syscall.Stat(fs.dir, &st)
+	if err == nil && uint64(st.Dev) == fs.dev && uint64(st.Ino) == fs.ino {
+		return code
+	}
+	if !atomic.CompareAndSwapInt32(&fs.gone, 0, 1) {
+		// Another operation got here first and has logged it
+		return fuse.EIO
+	}
+	if err == nil {
+		logf("backing directory %q has been replaced, failing all operations with EIO. Please unmount.", fs.dir)
+	} else {
+		logf("backing directory %q is gone (%v), failing all operations with EIO. Please unmount.", fs.dir, err)
+	}
+	return fuse.EIO
+}
+
+// GetAttr implements pathfs.Filesystem.
+func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if fs.Gone() {
+		return nil, fuse.EIO
+	}
+	a, code := fs.FileSystem.GetAttr(name, context)
+	return a, fs.check(code)
+}
+
+// Chmod implements pathfs.Filesystem.
+func (fs *FS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Chmod(name, mode, context))
+}
+
+// Chown implements pathfs.Filesystem.
+func (fs *FS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Chown(name, uid, gid, context))
+}
+
+// Utimens implements pathfs.Filesystem.
+func (fs *FS) Utimens(name string, a *time.Time, m *time.Time, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Utimens(name, a, m, context))
+}
+
+// Truncate implements pathfs.Filesystem.
+func (fs *FS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Truncate(name, size, context))
+}
+
+// Access implements pathfs.Filesystem.
+func (fs *FS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Access(name, mode, context))
+}
+
+// Link implements pathfs.Filesystem.
+func (fs *FS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Link(oldName, newName, context))
+}
+
+// Mkdir implements pathfs.Filesystem.
+func (fs *FS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Mkdir(name, mode, context))
+}
+
+// Mknod implements pathfs.Filesystem.
+func (fs *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Mknod(name, mode, dev, context))
+}
+
+// Rename implements pathfs.Filesystem.
+func (fs *FS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Rename(oldName, newName, context))
+}
+
+// Rmdir implements pathfs.Filesystem.
+func (fs *FS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Rmdir(name, context))
+}
+
+// Unlink implements pathfs.Filesystem.
+func (fs *FS) Unlink(name string, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Unlink(name, context))
+}
+
+// GetXAttr implements pathfs.Filesystem.
+func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if fs.Gone() {
+		return nil, fuse.EIO
+	}
+	data, code := fs.FileSystem.GetXAttr(name, attr, context)
+	return data, fs.check(code)
+}
+
+// ListXAttr implements pathfs.Filesystem.
+func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if fs.Gone() {
+		return nil, fuse.EIO
+	}
+	attrs, code := fs.FileSystem.ListXAttr(name, context)
+	return attrs, fs.check(code)
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.RemoveXAttr(name, attr, context))
+}
+
+// SetXAttr implements pathfs.Filesystem.
+func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.SetXAttr(name, attr, data, flags, context))
+}
+
+// Open implements pathfs.Filesystem. Files that are already open keep
+// working as long as the backing storage lets them.
+func (fs *FS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if fs.Gone() {
+		return nil, fuse.EIO
+	}
+	f, code := fs.FileSystem.Open(name, flags, context)
+	return f, fs.check(code)
+}
+
+// Create implements pathfs.Filesystem.
+func (fs *FS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if fs.Gone() {
+		return nil, fuse.EIO
+	}
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	return f, fs.check(code)
+}
+
+// OpenDir implements pathfs.Filesystem.
+func (fs *FS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if fs.Gone() {
+		return nil, fuse.EIO
+	}
+	entries, code := fs.FileSystem.OpenDir(name, context)
+	return entries, fs.check(code)
+}
+
+// Symlink implements pathfs.Filesystem.
+func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	if fs.Gone() {
+		return fuse.EIO
+	}
+	return fs.check(fs.FileSystem.Symlink(target, linkName, context))
+}
+
+// Readlink implements pathfs.Filesystem.
+func (fs *FS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if fs.Gone() {
+		return "", fuse.EIO
+	}
+	target, code := fs.FileSystem.Readlink(name, context)
+	return target, fs.check(code)
+}
+
+// StatFs implements pathfs.Filesystem.
+func (fs *FS) StatFs(name string) *fuse.StatfsOut {
+	if fs.Gone() {
+		return nil
+	}
+	out := fs.FileSystem.StatFs(name)
+	if out == nil {
+		// No error code to look at, but this is the call "df" makes
+		fs.check(fuse.EIO)
+	}
+	return out
+}
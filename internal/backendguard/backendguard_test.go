@@ -0,0 +1,82 @@
+package backendguard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// captureLog replaces logf and returns the logged lines. Call the returned
+// function to restore logf.
+func captureLog(lines *[]string) func() {
+	orig := logf
+	logf = func(format string, v ...interface{}) {
+		*lines = append(*lines, fmt.Sprintf(format, v...))
+	}
+	return func() { logf = orig }
+}
+
+// TestGone checks that errors are passed through while the backing
+// directory is there, that everything fails with EIO once it has been
+// renamed away, and that this stays so when it comes back.
+func TestGone(t *testing.T) {
+	var lines []string
+	defer captureLog(&lines)()
+	parent, err := ioutil.TempDir("", "gocryptfs-backendguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := parent + "/backing"
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFS(pathfs.NewLoopbackFileSystem(dir), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("foo", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code := fs.GetAttr("missing", ctx); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", code)
+	}
+	if fs.Gone() || len(lines) != 0 {
+		t.Fatalf("gone=%v, log: %v", fs.Gone(), lines)
+	}
+
+	if err = os.Rename(dir, parent+"/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := fs.GetAttr("foo", ctx); code != fuse.EIO {
+		t.Errorf("GetAttr: want EIO, got %v", code)
+	}
+	if !fs.Gone() || len(lines) != 1 {
+		t.Fatalf("gone=%v, log: %v", fs.Gone(), lines)
+	}
+	if _, code := fs.OpenDir("", ctx); code != fuse.EIO {
+		t.Errorf("OpenDir: want EIO, got %v", code)
+	}
+	if _, code := fs.Create("bar", uint32(os.O_WRONLY), 0600, ctx); code != fuse.EIO {
+		t.Errorf("Create: want EIO, got %v", code)
+	}
+
+	// A new directory at the same path must not be used
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if code := fs.Mkdir("baz", 0700, ctx); code != fuse.EIO {
+		t.Errorf("Mkdir: want EIO, got %v", code)
+	}
+	if _, err = os.Stat(dir + "/baz"); !os.IsNotExist(err) {
+		t.Errorf("the replacement directory was written to: %v", err)
+	}
+	if len(lines) != 1 {
+		t.Errorf("should only be logged once: %v", lines)
+	}
+}
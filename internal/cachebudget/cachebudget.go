@@ -0,0 +1,152 @@
+// Package cachebudget implements a memory budget that is shared by all
+// caches of a mount ("-cache-size").
+//
+// Each cache registers an Account and charges the (estimated) size of the
+// entries it stores. When the total goes over the limit, Trim() empties the
+// biggest caches until the total is below the limit again.
+package cachebudget
+
+import (
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// EntryOverhead is a rough estimate of the memory a cache entry needs
+// besides the strings and byte slices it holds: map bucket, string and
+// slice headers, struct fields.
+const EntryOverhead = 64
+
+// Budget is the memory budget of one mount
+type Budget struct {
+	sync.Mutex
+	// Maximum number of bytes the caches may use
+	limit uint64
+	// Sum of the "used" fields of all accounts
+	used     uint64
+	accounts []*Account
+	// Number of times a cache has been emptied by Trim()
+	evictions uint64
+}
+
+// Account tracks the memory used by one cache
+type Account struct {
+	budget *Budget
+	// Name of the cache, for debug messages and Stats()
+	name string
+	// Bytes charged by this cache. Protected by budget.Mutex.
+	used uint64
+	// evict empties the cache. It must Release() everything and must not
+	// be called with any lock held.
+	evict func()
+}
+
+// Stats is a snapshot of the budget
+type Stats struct {
+	Limit, Used, Evictions uint64
+	// Used bytes per cache name
+	PerCache map[string]uint64
+}
+
+// New returns a budget of "limit" bytes.
+func New(limit uint64) *Budget {
+	return &Budget{limit: limit}
+}
+
+// Register adds a cache to the budget. "evict" is called by Trim() to
+// empty the cache. Register on a nil Budget returns a nil Account, which
+// ignores all calls, so caches work the same without a budget.
+func (b *Budget) Register(name string, evict func()) *Account {
+	if b == nil {
+		return nil
+	}
+	a := &Account{budget: b, name: name, evict: evict}
+	b.Lock()
+	b.accounts = append(b.accounts, a)
+	b.Unlock()
+	return a
+}
+
+// Charge records that the cache now uses "n" more bytes. The caller should
+// call Trim() once it has dropped its locks.
+func (a *Account) Charge(n uint64) {
+	if a == nil {
+		return
+	}
+	b := a.budget
+	b.Lock()
+	a.used += n
+	b.used += n
+	b.Unlock()
+}
+
+// Release records that the cache now uses "n" fewer bytes.
+func (a *Account) Release(n uint64) {
+	if a == nil {
+		return
+	}
+	b := a.budget
+	b.Lock()
+	if n > a.used {
+		tlog.Warn.Printf("cachebudget: %s: releasing %d bytes, but only %d are charged", a.name, n, a.used)
+		n = a.used
+	}
+	a.used -= n
+	b.used -= n
+	b.Unlock()
+}
+
+// Trim empties the biggest caches until the budget is kept again. It must
+// not be called with any cache lock held, as evicting takes the lock of
+// the evicted cache.
+func (a *Account) Trim() {
+	if a == nil {
+		return
+	}
+	b := a.budget
+	for {
+		b.Lock()
+		if b.used <= b.limit {
+			b.Unlock()
+			return
+		}
+		var victim *Account
+		for _, c := range b.accounts {
+			if victim == nil || c.used > victim.used {
+				victim = c
+			}
+		}
+		if victim == nil || victim.used == 0 {
+			b.Unlock()
+			return
+		}
+		before := victim.used
+		b.evictions++
+		b.Unlock()
+		tlog.Debug.Printf("cachebudget: evicting %s (%d bytes)", victim.name, before)
+		victim.evict()
+		b.Lock()
+		// Give up if evicting did not free anything, we would loop forever
+		stuck := victim.used >= before
+		b.Unlock()
+		if stuck {
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the budget.
+func (b *Budget) Stats() Stats {
+	b.Lock()
+	defer b.Unlock()
+	st := Stats{
+		Limit:     b.limit,
+		Used:      b.used,
+		Evictions: b.evictions,
+		PerCache:  make(map[string]uint64),
+	}
+	for _, a := range b.accounts {
+		st.PerCache[a.name] += a.used
+	}
+	return st
+}
@@ -0,0 +1,62 @@
+package cachebudget
+
+import (
+	"testing"
+)
+
+// fakeCache charges a fixed size per entry
+type fakeCache struct {
+	account *Account
+	entries int
+}
+
+func (c *fakeCache) add(n int) {
+	c.entries += n
+	c.account.Charge(uint64(n) * 100)
+	c.account.Trim()
+}
+
+func (c *fakeCache) evict() {
+	c.account.Release(uint64(c.entries) * 100)
+	c.entries = 0
+}
+
+func TestBudget(t *testing.T) {
+	b := New(1000)
+	c1 := &fakeCache{}
+	c1.account = b.Register("c1", c1.evict)
+	c2 := &fakeCache{}
+	c2.account = b.Register("c2", c2.evict)
+	c1.add(6)
+	c2.add(3)
+	if st := b.Stats(); st.Used != 900 || st.Evictions != 0 {
+		t.Fatalf("under the limit: %+v", st)
+	}
+	// Going over the limit evicts the biggest cache, even if it is not the
+	// one that is growing
+	c2.add(2)
+	st := b.Stats()
+	if st.Used != 500 || st.Evictions != 1 || c1.entries != 0 || c2.entries != 5 {
+		t.Fatalf("after eviction: %+v", st)
+	}
+	if st.PerCache["c1"] != 0 || st.PerCache["c2"] != 500 {
+		t.Errorf("wrong per-cache usage: %v", st.PerCache)
+	}
+	// A single cache that is bigger than the budget evicts itself
+	c2.add(20)
+	if st = b.Stats(); st.Used != 0 || st.Evictions != 2 {
+		t.Errorf("oversized cache: %+v", st)
+	}
+}
+
+// TestNilBudget checks that caches work without a budget.
+func TestNilBudget(t *testing.T) {
+	var b *Budget
+	c := &fakeCache{}
+	c.account = b.Register("c", c.evict)
+	if c.account != nil {
+		t.Fatal("nil budget should give a nil account")
+	}
+	c.add(1000)
+	c.evict()
+}
@@ -0,0 +1,23 @@
+// Package changewatch reports changes to the files in a directory tree, no
+// matter which process has made them. It is used by "-notify-changes" to
+// tell the kernel about changes to the backing directory.
+package changewatch
+
+// Op says what kind of change an Event is
+type Op int
+
+const (
+	// Entry - the path has been created, deleted or renamed
+	Entry Op = iota
+	// Attr - the attributes of the path have changed
+	Attr
+	// Content - the file has been written to
+	Content
+)
+
+// Event is a change to "Path", which is relative to the watched directory.
+// The watched directory itself is "".
+type Event struct {
+	Path string
+	Op   Op
+}
@@ -0,0 +1,16 @@
+package changewatch
+
+import (
+	"errors"
+)
+
+// Watcher is not implemented on macOS
+type Watcher struct{}
+
+// New returns an error on macOS, which has no inotify.
+func New(root string, fn func(Event)) (*Watcher, error) {
+	return nil, errors.New("watching for changes is not supported on macOS")
+}
+
+// Close does nothing on macOS.
+func (w *Watcher) Close() {}
@@ -0,0 +1,178 @@
+package changewatch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// inotify events we are interested in. IN_MODIFY would fire on every
+// write(), we only want to hear about a file once the writer closes it.
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_DONT_FOLLOW | syscall.IN_ONLYDIR
+
+// Watcher watches a directory tree with inotify. inotify is not recursive,
+// so there is one watch per directory, and directories that are created
+// later are added as they show up.
+type Watcher struct {
+	fd   int
+	root string
+	fn   func(Event)
+	// mu protects "wds" and "closed"
+	mu sync.Mutex
+	// wds maps watch descriptors to relative directory paths
+	wds    map[int32]string
+	closed bool
+}
+
+// New starts watching the directory tree at "root" and calls "fn" for every
+// change, one at a time, from a background goroutine.
+//
+// A directory that is renamed inside the tree is picked up under its new
+// name, one that is moved out of the tree keeps reporting under its old name.
+func New(root string, fn func(Event)) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		fd:   fd,
+		root: root,
+		fn:   fn,
+		wds:  make(map[int32]string),
+	}
+	err = w.addTree("")
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go w.loop()
+	return w, nil
+}
+
+// addTree adds watches for the directory "dir" and all directories below.
+func (w *Watcher) addTree(dir string) error {
+	path := filepath.Join(w.root, dir)
+	wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+	if err == syscall.ENOSPC {
+		return &os.PathError{Op: "inotify_add_watch", Path: path,
+			Err: syscall.Errno(syscall.ENOSPC)}
+	} else if err != nil {
+		// Deleted or replaced in the meantime
+		return nil
+	}
+	w.mu.Lock()
+	w.wds[int32(wd)] = dir
+	w.mu.Unlock()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	entries, _ := f.Readdir(-1)
+	f.Close()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		err = w.addTree(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loop reads inotify events until Close is called.
+func (w *Watcher) loop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		w.mu.Lock()
+		closed := w.closed
+		w.mu.Unlock()
+		if closed {
+			syscall.Close(w.fd)
+			return
+		}
+		if err != nil {
+			tlog.Warn.Printf("changewatch: read: %v", err)
+			syscall.Close(w.fd)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			end := start + int(ev.Len)
+			// The name is padded with NUL bytes
+			name := strings.TrimRight(string(buf[start:end]), "\x00")
+			w.handle(ev.Wd, ev.Mask, name)
+			off = end
+		}
+	}
+}
+
+// handle turns one inotify event into a call to "fn".
+func (w *Watcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		tlog.Warn.Printf("changewatch: inotify queue overflow, changes have been lost")
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.wds[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.wds, wd)
+	}
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+	if name == "" {
+		// Event on the watched directory itself
+		if mask&syscall.IN_ATTRIB != 0 {
+			w.fn(Event{Path: dir, Op: Attr})
+		}
+		return
+	}
+	path := filepath.Join(dir, name)
+	switch {
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		if mask&syscall.IN_ISDIR != 0 {
+			if err := w.addTree(path); err != nil {
+				tlog.Warn.Printf("changewatch: %v", err)
+			}
+		}
+		w.fn(Event{Path: path, Op: Entry})
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		w.fn(Event{Path: path, Op: Entry})
+	case mask&syscall.IN_CLOSE_WRITE != 0:
+		w.fn(Event{Path: path, Op: Content})
+	case mask&syscall.IN_ATTRIB != 0:
+		w.fn(Event{Path: path, Op: Attr})
+	}
+}
+
+// Close stops watching. "fn" may still be called for events that have
+// already been read.
+func (w *Watcher) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	// Removing a watch queues an IN_IGNORED event, which wakes up loop(),
+	// which then closes the inotify fd.
+	for wd := range w.wds {
+		syscall.InotifyRmWatch(w.fd, uint32(wd))
+		break
+	}
+}
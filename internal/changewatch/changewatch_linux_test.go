@@ -0,0 +1,64 @@
+package changewatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWatcher makes changes in a directory that is created after the
+// watch has been set up, and checks that every one of them is reported.
+func TestWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "gocryptfs-changewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	events := make(chan Event, 100)
+	w, err := New(root, func(ev Event) {
+		events <- ev
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// expect waits for "want", skipping other events
+	expect := func(want Event) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no event %+v", want)
+			}
+		}
+	}
+	if err = os.Mkdir(filepath.Join(root, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	expect(Event{Path: "dir", Op: Entry})
+	file := filepath.Join(root, "dir", "file")
+	if err = ioutil.WriteFile(file, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect(Event{Path: "dir/file", Op: Entry})
+	expect(Event{Path: "dir/file", Op: Content})
+	if err = os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect(Event{Path: "dir/file", Op: Attr})
+	if err = os.Rename(file, filepath.Join(root, "file2")); err != nil {
+		t.Fatal(err)
+	}
+	expect(Event{Path: "dir/file", Op: Entry})
+	expect(Event{Path: "file2", Op: Entry})
+	if err = os.Remove(filepath.Join(root, "file2")); err != nil {
+		t.Fatal(err)
+	}
+	expect(Event{Path: "file2", Op: Entry})
+}
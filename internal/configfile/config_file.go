@@ -8,10 +8,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"unicode"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 import "os"
@@ -34,7 +36,7 @@ type ConfFile struct {
 	// technical info is contained in FeatureFlags.
 	Creator string
 	// EncryptedKey holds an encrypted AES key, unlocked using a password
-	// hashed with scrypt
+	// hashed with scrypt, or wrapped by the key provider
 	EncryptedKey []byte
 	// ScryptObject stores parameters for scrypt hashing (key derivation)
 	ScryptObject ScryptKDF
@@ -45,6 +47,26 @@ type ConfFile struct {
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
 	// stored in the superblock.
 	FeatureFlags []string
+	// KeyFile is the path to the key file holding the raw master key. Only
+	// used if the "KeyFile" feature flag is set. EncryptedKey and
+	// ScryptObject are unused in this case.
+	KeyFile string `json:",omitempty"`
+	// KeyProvider is the URI of the key that wraps the master key. Only
+	// used if the "KeyProvider" feature flag is set. The URI scheme selects
+	// the KeyProvider implementation.
+	KeyProvider string `json:",omitempty"`
+	// KeyCheck is a known plaintext block encrypted with the master key from
+	// the key file or key provider. It allows to detect a wrong key.
+	KeyCheck []byte `json:",omitempty"`
+	// NamePadding is the length class of encrypted names in bytes. Only
+	// used if the "NamePadding" feature flag is set.
+	NamePadding int `json:",omitempty"`
+	// Label is a human-readable description of the filesystem. Not secret,
+	// and not protected against modification.
+	Label string `json:",omitempty"`
+	// GCMIVBits is the GCM IV length of the file content in bits. Only used
+	// if the "GCMParams" feature flag is set.
+	GCMIVBits int `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -64,45 +86,166 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateArgs exists because the argument list to CreateConfFile has
+// become too long.
+type CreateArgs struct {
+	Filename       string
+	Password       string
+	PlaintextNames bool
+	LogN           int
+	Creator        string
+	AESSIV         bool
+	Devrandom      bool
+	Compress       bool
+	// NFCNames normalizes file names to Unicode NFC before encryption.
+	// Ignored with PlaintextNames.
+	NFCNames bool
+	// KeyFile, if not empty, stores the master key in a new key file at
+	// this path instead of encrypting it with Password.
+	KeyFile string
+	// KeyProvider, if not empty, is the URI of the key that the key provider
+	// wraps the master key with. Password is not used.
+	KeyProvider string
+	// EncryptedDirIV encrypts the gocryptfs.diriv files. Ignored with
+	// PlaintextNames. As encrypting it needs the master key, CreateConfFile
+	// then also writes the root gocryptfs.diriv into CipherDir.
+	EncryptedDirIV bool
+	CipherDir      string
+	// ScryptR and ScryptP are the scrypt r and p parameters. Zero selects
+	// the default.
+	ScryptR int
+	ScryptP int
+	// NamePadding, if not zero, pads file names to a multiple of this many
+	// bytes before encryption. Ignored with PlaintextNames.
+	NamePadding int
+	// Label is stored as ConfFile.Label
+	Label string
+	// SymlinkFiles stores symlinks as regular files holding the encrypted
+	// target.
+	SymlinkFiles bool
+	// GCMIVBits selects the GCM IV length of the file content, zero selects
+	// the default. See cryptocore.CheckGCMIVBits.
+	GCMIVBits int
+}
+
 // CreateConfFile - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func CreateConfFile(filename string, password string, plaintextNames bool, logN int, creator string, aessiv bool, devrandom bool) error {
+// "args.Password" and write it to "args.Filename".
+// Uses scrypt with cost parameter args.LogN.
+func CreateConfFile(args *CreateArgs) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
+	if err := CheckLabel(args.Label); err != nil {
+		return err
+	}
+	cf.Label = args.Label
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagEMENames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
+		if args.NFCNames {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagNFCNames])
+		}
+		if args.EncryptedDirIV {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagEncryptedDirIV])
+		}
+		if args.NamePadding > 0 {
+			if err := nametransform.CheckNamePadding(args.NamePadding); err != nil {
+				return err
+			}
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagNamePadding])
+			cf.NamePadding = args.NamePadding
+		}
 	}
-	if aessiv {
+	if args.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
+	if args.Compress {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagCompression])
+	}
+	if args.SymlinkFiles {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagSymlinkFiles])
+	}
+	if args.GCMIVBits != 0 {
+		if err := cryptocore.CheckGCMIVBits(args.GCMIVBits); err != nil {
+			return err
+		}
+		// Only record parameters that differ from the defaults, so that
+		// older versions can still mount the other filesystems
+		if args.GCMIVBits != contentenc.DefaultIVBits {
+			if args.AESSIV {
+				return fmt.Errorf("GCM parameters cannot be changed with AES-SIV")
+			}
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMParams])
+			cf.GCMIVBits = args.GCMIVBits
+		}
+	}
 
 	// Generate new random master key
 	var key []byte
-	if devrandom {
+	if args.Devrandom {
 		key = randBytesDevRandom(cryptocore.KeyLen)
 	} else {
 		key = cryptocore.RandBytes(cryptocore.KeyLen)
 	}
 
-	// Encrypt it using the password
-	// This sets ScryptObject and EncryptedKey
-	// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-	cf.EncryptKey(key, password, logN)
+	if args.KeyProvider != "" {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagKeyProvider])
+		err := cf.wrapKey(args.KeyProvider, key)
+		if err != nil {
+			return err
+		}
+	} else if args.KeyFile != "" {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagKeyFile])
+		cf.KeyFile = args.KeyFile
+		cf.KeyCheck = keyCheck(key)
+		err := writeKeyFile(args.KeyFile, key)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Encrypt it using the password
+		// This sets ScryptObject and EncryptedKey
+		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
+		cf.EncryptKey(key, args.Password, ScryptParams{LogN: args.LogN, R: args.ScryptR, P: args.ScryptP})
+	}
 
 	// Write file to disk
-	return cf.WriteFile()
+	err := cf.WriteFile()
+	if err != nil {
+		return err
+	}
+	if cf.IsFeatureFlagSet(FlagEncryptedDirIV) {
+		nt := nametransform.New(nil, false, false, false)
+		nt.SetDirIVCipher(cryptocore.NewDirIVAEAD(key))
+		return nt.WriteDirIV(nil, args.CipherDir)
+	}
+	return nil
+}
+
+// maxLabelLen is the maximum length of ConfFile.Label in bytes
+const maxLabelLen = 255
+
+// CheckLabel returns an error if "label" is too long or contains control
+// characters like newlines, which would mess up "-info" and the logs.
+func CheckLabel(label string) error {
+	if len(label) > maxLabelLen {
+		return fmt.Errorf("label is longer than %d bytes", maxLabelLen)
+	}
+	for _, r := range label {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("label contains control character %q", r)
+		}
+	}
+	return nil
 }
 
 // LoadConfFile - read config file from disk and decrypt the
@@ -112,18 +255,24 @@ func CreateConfFile(filename string, password string, plaintextNames bool, logN
 // If "password" is empty, the config file is read
 // but the key is not decrypted (returns nil in its place).
 func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
-	var cf ConfFile
-	cf.filename = filename
-
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
 		fmt.Printf("LoadConfFile: ReadFile: %#v\n", err)
 		return nil, nil, err
 	}
+	return ParseConfFile(js, filename, password)
+}
+
+// ParseConfFile is like LoadConfFile, but takes the content of the config
+// file in "js". Used when the config file is not on disk, like when mounting
+// an archive. "filename" is where WriteFile() would write it to.
+func ParseConfFile(js []byte, filename string, password string) ([]byte, *ConfFile, error) {
+	var cf ConfFile
+	cf.filename = filename
 
 	// Unmarshal
-	err = json.Unmarshal(js, &cf)
+	err := json.Unmarshal(js, &cf)
 	if err != nil {
 		tlog.Warn.Printf("Failed to unmarshal config file")
 		return nil, nil, err
@@ -168,12 +317,37 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 
 		return nil, nil, fmt.Errorf("Deprecated filesystem")
 	}
-	if password == "" {
+	if cf.IsFeatureFlagSet(FlagNamePadding) {
+		if err = nametransform.CheckNamePadding(cf.NamePadding); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cf.IsFeatureFlagSet(FlagGCMParams) {
+		if err = cryptocore.CheckGCMIVBits(cf.GCMIVBits); err != nil {
+			return nil, nil, err
+		}
+		if cf.IsFeatureFlagSet(FlagAESSIV) {
+			return nil, nil, fmt.Errorf("GCM parameters cannot be used with AES-SIV")
+		}
+	}
+	if password == "" || !cf.UsesPassword() {
 		// We have validated the config file, but without a password we cannot
 		// decrypt the master key. Return only the parsed config.
+		// With a key file, the caller has to call LoadKeyFile(), with a key
+		// provider UnwrapKey().
 		return nil, &cf, nil
 	}
+	key, err := cf.DecryptMasterKey(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &cf, nil
+}
 
+// DecryptMasterKey decrypts the master key using "password". Unlike
+// LoadConfFile, it also works with an empty password, which filesystems
+// created with "-allow-empty-password" have.
+func (cf *ConfFile) DecryptMasterKey(password string) ([]byte, error) {
 	// Generate derived key from password
 	scryptHash := cf.ScryptObject.DeriveKey(password)
 
@@ -186,19 +360,36 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 	tlog.Warn.Enabled = true
 	if err != nil {
 		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+		if password == "" {
+			// Most likely the user just hit enter
+			return nil, exitcodes.NewErr("Password is empty.", exitcodes.PasswordEmpty)
+		}
+		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
 	}
+	return key, nil
+}
 
-	return key, &cf, err
+// UsesPassword returns false if the master key is stored in a key file or
+// wrapped by a key provider instead of being encrypted with a password.
+func (cf *ConfFile) UsesPassword() bool {
+	return !cf.IsFeatureFlagSet(FlagKeyFile) && !cf.IsFeatureFlagSet(FlagKeyProvider)
+}
+
+// ContentIVBits returns the GCM IV length of the file content in bits.
+func (cf *ConfFile) ContentIVBits() int {
+	if cf.IsFeatureFlagSet(FlagGCMParams) {
+		return cf.GCMIVBits
+	}
+	return contentenc.DefaultIVBits
 }
 
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
 // and store it in cf.EncryptedKey.
-// Uses scrypt with cost parameter logN and stores the scrypt parameters in
+// Uses scrypt with the cost parameters "params" and stores them in
 // cf.ScryptObject.
-func (cf *ConfFile) EncryptKey(key []byte, password string, logN int) {
+func (cf *ConfFile) EncryptKey(key []byte, password string, params ScryptParams) {
 	// Generate derived key from password
-	cf.ScryptObject = NewScryptKDF(logN)
+	cf.ScryptObject = NewScryptKDFParams(params)
 	scryptHash := cf.ScryptObject.DeriveKey(password)
 
 	// Lock master key using password-based key
@@ -249,6 +440,6 @@ func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
 		IVLen = contentenc.DefaultIVBits
 	}
 	cc := cryptocore.New(scryptHash, cryptocore.BackendGoGCM, IVLen, useHKDF, false)
-	ce := contentenc.New(cc, 4096, false)
+	ce := contentenc.New(cc, 4096, false, false)
 	return ce
 }
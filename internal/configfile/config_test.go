@@ -1,7 +1,10 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
@@ -60,7 +63,12 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", false, false)
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,14 +89,26 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", false, true)
+	err := CreateConfFile(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  "test",
+		LogN:      10,
+		Creator:   "test",
+		Devrandom: true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", true, 10, "test", false, false)
+	err := CreateConfFile(&CreateArgs{
+		Filename:       "config_test/tmp.conf",
+		Password:       "test",
+		PlaintextNames: true,
+		LogN:           10,
+		Creator:        "test",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,7 +129,13 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", true, false)
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test",
+		AESSIV:   true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,6 +148,119 @@ func TestCreateConfFileAESSIV(t *testing.T) {
 	}
 }
 
+func TestCreateConfFileCompression(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test",
+		Compress: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagCompression) {
+		t.Error("Compression flag should be set but is not")
+	}
+}
+
+func TestCreateConfFileKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := dir + "/key"
+	err = CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		LogN:     10,
+		Creator:  "test",
+		KeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No password needed
+	_, c, err := LoadConfFile("config_test/tmp.conf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagKeyFile) {
+		t.Error("KeyFile flag should be set but is not")
+	}
+	if c.KeyFile != keyFile {
+		t.Errorf("wrong KeyFile: %q", c.KeyFile)
+	}
+	if len(c.EncryptedKey) != 0 {
+		t.Error("EncryptedKey should be empty")
+	}
+	key, err := c.LoadKeyFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Explicit path gives the same result
+	key2, err := c.LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Error("keys differ")
+	}
+	// Refuse to overwrite an existing key file
+	err = CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp2.conf",
+		LogN:     10,
+		Creator:  "test",
+		KeyFile:  keyFile,
+	})
+	if err == nil {
+		t.Error("overwriting the key file should have failed")
+	}
+	os.Remove("config_test/tmp2.conf")
+}
+
+func TestLoadKeyFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		LogN:     10,
+		Creator:  "test",
+		KeyFile:  dir + "/key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Missing
+	_, err = c.LoadKeyFile(dir + "/missing")
+	if err == nil {
+		t.Error("missing key file should fail")
+	}
+	// Wrong length
+	ioutil.WriteFile(dir+"/short", make([]byte, 16), 0600)
+	_, err = c.LoadKeyFile(dir + "/short")
+	if err == nil {
+		t.Error("short key file should fail")
+	}
+	// Wrong key
+	ioutil.WriteFile(dir+"/wrong", make([]byte, 32), 0600)
+	_, err = c.LoadKeyFile(dir + "/wrong")
+	if err == nil {
+		t.Error("wrong key should fail")
+	}
+}
+
 func TestIsFeatureFlagKnown(t *testing.T) {
 	// Test a few hardcoded values
 	testKnownFlags := []string{"DirIV", "PlaintextNames", "EMENames", "GCMIV128", "LongNames", "AESSIV"}
@@ -143,3 +282,121 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestEmptyPassword(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		LogN:     10,
+		Creator:  "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("config_test/tmp.conf")
+	_, c, err := LoadConfFile("config_test/tmp.conf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.DecryptMasterKey(""); err != nil {
+		t.Errorf("empty password should work: %v", err)
+	}
+	if _, err = c.DecryptMasterKey("test"); err == nil {
+		t.Error("wrong password should fail")
+	}
+	_, c, err = LoadConfFile("config_test/v2.conf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hitting enter on a normal filesystem gives a helpful message
+	_, err = c.DecryptMasterKey("")
+	if err == nil || err.Error() != "Password is empty." {
+		t.Errorf("want empty password error, got %v", err)
+	}
+}
+
+// TestLabel stores a label and reads it back. Config files without a label
+// still load.
+func TestLabel(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: "test",
+		LogN:     10,
+		Creator:  "test",
+		Label:    "Backup disk ä",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "Backup disk ä" {
+		t.Errorf("wrong label %q", c.Label)
+	}
+	_, c, err = LoadConfFile("config_test/v2.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "" {
+		t.Errorf("old config file should have no label, got %q", c.Label)
+	}
+	for _, l := range []string{"a\nb", "\t", string(bytes.Repeat([]byte("x"), maxLabelLen+1))} {
+		if CheckLabel(l) == nil {
+			t.Errorf("label %q should have been rejected", l)
+		}
+	}
+}
+
+// TestCreateConfFileGCMParams checks that GCM parameters are recorded only
+// if they differ from the defaults, and that unsafe ones are rejected.
+func TestCreateConfFileGCMParams(t *testing.T) {
+	for _, tc := range []struct {
+		ivBits int
+		// wantFlag is true if the parameters must be recorded
+		wantFlag bool
+	}{
+		{96, true},
+		{128, false},
+		{0, false},
+	} {
+		err := CreateConfFile(&CreateArgs{
+			Filename:  "config_test/tmp.conf",
+			Password:  "test",
+			LogN:      10,
+			Creator:   "test",
+			GCMIVBits: tc.ivBits,
+		})
+		if err != nil {
+			t.Fatalf("%d: %v", tc.ivBits, err)
+		}
+		_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.IsFeatureFlagSet(FlagGCMParams) != tc.wantFlag {
+			t.Errorf("%d: wrong GCMParams flag", tc.ivBits)
+		}
+		wantIVBits := 128
+		if tc.ivBits != 0 {
+			wantIVBits = tc.ivBits
+		}
+		if c.ContentIVBits() != wantIVBits {
+			t.Errorf("%d: ContentIVBits=%d", tc.ivBits, c.ContentIVBits())
+		}
+	}
+	unsafe := []CreateArgs{
+		{GCMIVBits: 64},
+		{GCMIVBits: 256},
+		{GCMIVBits: 96, AESSIV: true},
+	}
+	for _, a := range unsafe {
+		a.Filename = "config_test/tmp.conf"
+		a.Password = "test"
+		a.LogN = 10
+		a.Creator = "test"
+		if CreateConfFile(&a) == nil {
+			t.Errorf("%d (AESSIV=%v) should have been rejected", a.GCMIVBits, a.AESSIV)
+		}
+	}
+}
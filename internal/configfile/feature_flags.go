@@ -25,6 +25,30 @@ const (
 	// Note that this flag does not change the password hashing algorithm
 	// which always is scrypt.
 	FlagHKDF
+	// FlagCompression enables per-block compression of file content before
+	// encryption.
+	FlagCompression
+	// FlagKeyFile indicates that the master key is stored in a separate key
+	// file instead of being encrypted with a password.
+	FlagKeyFile
+	// FlagNFCNames indicates that file names are normalized to Unicode NFC
+	// before they are encrypted.
+	FlagNFCNames
+	// FlagKeyProvider indicates that the master key is wrapped by an
+	// external key provider instead of a password.
+	FlagKeyProvider
+	// FlagEncryptedDirIV indicates that the gocryptfs.diriv files are
+	// encrypted and authenticated with a key derived from the master key.
+	FlagEncryptedDirIV
+	// FlagNamePadding indicates that file names are padded to a multiple of
+	// ConfFile.NamePadding bytes before they are encrypted.
+	FlagNamePadding
+	// FlagSymlinkFiles indicates that symlinks are stored as regular files
+	// holding the encrypted target instead of as backing symlinks.
+	FlagSymlinkFiles
+	// FlagGCMParams indicates that file content uses the GCM IV length in
+	// ConfFile.GCMIVBits instead of the default.
+	FlagGCMParams
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -37,6 +61,14 @@ var knownFlags = map[flagIota]string{
 	FlagAESSIV:         "AESSIV",
 	FlagRaw64:          "Raw64",
 	FlagHKDF:           "HKDF",
+	FlagCompression:    "Compression",
+	FlagKeyFile:        "KeyFile",
+	FlagNFCNames:       "NFCNames",
+	FlagKeyProvider:    "KeyProvider",
+	FlagEncryptedDirIV: "EncryptedDirIV",
+	FlagNamePadding:    "NamePadding",
+	FlagSymlinkFiles:   "SymlinkFiles",
+	FlagGCMParams:      "GCMParams",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
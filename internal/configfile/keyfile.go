@@ -0,0 +1,69 @@
+package configfile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// keyCheckPlaintext is encrypted with the master key to get KeyCheck
+var keyCheckPlaintext = make([]byte, 16)
+
+// keyCheck returns the KeyCheck value for master key "key".
+func keyCheck(key []byte) []byte {
+	ce := getKeyEncrypter(key, true)
+	return ce.EncryptBlock(keyCheckPlaintext, 0, nil)
+}
+
+// writeKeyFile writes the raw master key "key" to a new file "filename".
+// Fails if the file already exists.
+func writeKeyFile(filename string, key []byte) error {
+	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(key)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	err = fd.Sync()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// LoadKeyFile reads the master key from the key file "filename" and checks
+// it against KeyCheck. If "filename" is empty, the path stored in the config
+// file is used.
+func (cf *ConfFile) LoadKeyFile(filename string) ([]byte, error) {
+	if !cf.IsFeatureFlagSet(FlagKeyFile) {
+		return nil, exitcodes.NewErr("This filesystem does not use a key file", exitcodes.Usage)
+	}
+	if filename == "" {
+		filename = cf.KeyFile
+	}
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Cannot read key file: %v", err), exitcodes.KeyFile)
+	}
+	if len(key) != cryptocore.KeyLen {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Key file %q has length %d but we require length %d",
+			filename, len(key), cryptocore.KeyLen), exitcodes.KeyFile)
+	}
+	ce := getKeyEncrypter(key, true)
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on a wrong key
+	pt, err := ce.DecryptBlock(cf.KeyCheck, 0, nil)
+	tlog.Warn.Enabled = true
+	if err != nil || !bytes.Equal(pt, keyCheckPlaintext) {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Key file %q contains the wrong key", filename), exitcodes.KeyFile)
+	}
+	return key, nil
+}
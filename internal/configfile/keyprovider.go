@@ -0,0 +1,108 @@
+package configfile
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// KeyProvider wraps and unwraps the master key using an external key
+// management system (KMS) or hardware security module (HSM), instead of a
+// password and scrypt.
+//
+// Providers are compiled in and register themselves with
+// RegisterKeyProvider(), typically from an init() function in a file that
+// is selected with a build tag.
+type KeyProvider interface {
+	// Wrap encrypts the master key "key" with the key identified by "uri".
+	// The result is stored in the config file as EncryptedKey.
+	// Called on "-init".
+	Wrap(uri string, key []byte) (wrapped []byte, err error)
+	// Unwrap reverses Wrap. Called on every mount.
+	Unwrap(uri string, wrapped []byte) (key []byte, err error)
+}
+
+var (
+	keyProviders     = map[string]KeyProvider{}
+	keyProvidersLock sync.Mutex
+)
+
+// RegisterKeyProvider makes "p" available for key provider URIs starting
+// with "scheme://". Panics if the scheme is already taken.
+func RegisterKeyProvider(scheme string, p KeyProvider) {
+	keyProvidersLock.Lock()
+	defer keyProvidersLock.Unlock()
+	if _, ok := keyProviders[scheme]; ok {
+		log.Panicf("RegisterKeyProvider: scheme %q is already registered", scheme)
+	}
+	keyProviders[scheme] = p
+}
+
+// getKeyProvider returns the provider that handles "uri".
+func getKeyProvider(uri string) (KeyProvider, error) {
+	i := strings.Index(uri, "://")
+	if i <= 0 {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Invalid key provider URI %q, want SCHEME://...", uri),
+			exitcodes.KeyProvider)
+	}
+	keyProvidersLock.Lock()
+	p := keyProviders[uri[:i]]
+	keyProvidersLock.Unlock()
+	if p == nil {
+		return nil, exitcodes.NewErr(fmt.Sprintf("No key provider for %q is compiled in", uri[:i]),
+			exitcodes.KeyProvider)
+	}
+	return p, nil
+}
+
+// UnwrapKey fetches the master key from the key provider recorded in the
+// config file and checks it against KeyCheck.
+func (cf *ConfFile) UnwrapKey() ([]byte, error) {
+	if !cf.IsFeatureFlagSet(FlagKeyProvider) {
+		return nil, exitcodes.NewErr("This filesystem does not use a key provider", exitcodes.Usage)
+	}
+	p, err := getKeyProvider(cf.KeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.Unwrap(cf.KeyProvider, cf.EncryptedKey)
+	if err != nil {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Key provider %q: %v", cf.KeyProvider, err),
+			exitcodes.KeyProvider)
+	}
+	if len(key) != cryptocore.KeyLen {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Key provider %q returned %d bytes but we require %d",
+			cf.KeyProvider, len(key), cryptocore.KeyLen), exitcodes.KeyProvider)
+	}
+	ce := getKeyEncrypter(key, true)
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on a wrong key
+	pt, err := ce.DecryptBlock(cf.KeyCheck, 0, nil)
+	tlog.Warn.Enabled = true
+	if err != nil || !bytes.Equal(pt, keyCheckPlaintext) {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Key provider %q returned the wrong key", cf.KeyProvider),
+			exitcodes.KeyProvider)
+	}
+	return key, nil
+}
+
+// wrapKey stores "key" wrapped by the key provider "uri" in cf.
+func (cf *ConfFile) wrapKey(uri string, key []byte) error {
+	p, err := getKeyProvider(uri)
+	if err != nil {
+		return err
+	}
+	wrapped, err := p.Wrap(uri, key)
+	if err != nil {
+		return exitcodes.NewErr(fmt.Sprintf("Key provider %q: %v", uri, err), exitcodes.KeyProvider)
+	}
+	cf.KeyProvider = uri
+	cf.EncryptedKey = wrapped
+	cf.KeyCheck = keyCheck(key)
+	return nil
+}
@@ -0,0 +1,93 @@
+package configfile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+// fakeKMS "wraps" keys by XORing them with the last byte of the URI
+type fakeKMS struct{}
+
+func (fakeKMS) xor(uri string, in []byte) []byte {
+	out := make([]byte, len(in))
+	for i := range in {
+		out[i] = in[i] ^ uri[len(uri)-1]
+	}
+	return out
+}
+
+func (k fakeKMS) Wrap(uri string, key []byte) ([]byte, error) {
+	return k.xor(uri, key), nil
+}
+
+func (k fakeKMS) Unwrap(uri string, wrapped []byte) ([]byte, error) {
+	if uri == "fake://offline" {
+		return nil, errors.New("KMS is offline")
+	}
+	return k.xor(uri, wrapped), nil
+}
+
+func init() {
+	RegisterKeyProvider("fake", fakeKMS{})
+}
+
+func TestCreateConfFileKeyProvider(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{
+		Filename:    "config_test/tmp.conf",
+		LogN:        10,
+		Creator:     "test",
+		KeyProvider: "fake://key1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("config_test/tmp.conf")
+	// No password needed
+	_, c, err := LoadConfFile("config_test/tmp.conf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagKeyProvider) {
+		t.Error("KeyProvider flag should be set but is not")
+	}
+	if c.UsesPassword() {
+		t.Error("UsesPassword should be false")
+	}
+	if c.KeyProvider != "fake://key1" {
+		t.Errorf("wrong KeyProvider: %q", c.KeyProvider)
+	}
+	key, err := c.UnwrapKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key, c.EncryptedKey) {
+		t.Error("key was stored unwrapped")
+	}
+	// A different key (here: the last URI byte) is detected by KeyCheck
+	c.KeyProvider = "fake://key2"
+	if _, err = c.UnwrapKey(); err == nil {
+		t.Error("wrong key should fail")
+	}
+	// Provider errors are passed on
+	c.KeyProvider = "fake://offline"
+	if _, err = c.UnwrapKey(); err == nil {
+		t.Error("offline KMS should fail")
+	}
+}
+
+func TestKeyProviderUnknown(t *testing.T) {
+	for _, uri := range []string{"nosuchkms://key1", "key1", "://key1"} {
+		err := CreateConfFile(&CreateArgs{
+			Filename:    "config_test/tmp.conf",
+			LogN:        10,
+			Creator:     "test",
+			KeyProvider: uri,
+		})
+		if err == nil {
+			os.Remove("config_test/tmp.conf")
+			t.Errorf("%q: should have failed", uri)
+		}
+	}
+}
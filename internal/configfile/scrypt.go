@@ -1,9 +1,13 @@
 package configfile
 
 import (
+	"bufio"
+	"fmt"
 	"log"
 	"math"
 	"os"
+	"strconv"
+	"strings"
 
 	"golang.org/x/crypto/scrypt"
 
@@ -29,8 +33,102 @@ const (
 	scryptMinLogN = 10
 	// We always generate 32-byte salts. Anything smaller than that is rejected.
 	scryptMinSaltLen = 32
+	// scryptMaxLogN is the highest logN we accept for new config files.
+	// logN=28 needs 32GB of memory with r=8.
+	scryptMaxLogN = 28
 )
 
+// ScryptParams are the scrypt cost parameters that can be chosen on "-init".
+type ScryptParams struct {
+	// LogN = log2(N), the CPU/memory cost parameter
+	LogN int
+	// R is the block size parameter
+	R int
+	// P is the parallelization parameter
+	P int
+}
+
+// Names of the scrypt presets for "-scrypt-preset"
+const (
+	ScryptPresetFast     = "fast"
+	ScryptPresetDefault  = "default"
+	ScryptPresetParanoid = "paranoid"
+)
+
+// scryptPresets are the parameter sets for "-scrypt-preset"
+var scryptPresets = map[string]ScryptParams{
+	// 16MB, about 1/4 of the time of "default"
+	ScryptPresetFast: {LogN: 14, R: 8, P: 1},
+	// 64MB, the same as without a preset
+	ScryptPresetDefault: {LogN: ScryptDefaultLogN, R: 8, P: 1},
+	// 512MB, 16 times the time of "default"
+	ScryptPresetParanoid: {LogN: 19, R: 8, P: 2},
+}
+
+// ScryptPreset returns the parameters of the preset called "name".
+func ScryptPreset(name string) (ScryptParams, error) {
+	p, ok := scryptPresets[name]
+	if !ok {
+		return p, fmt.Errorf("unknown scrypt preset %q, known presets: %s, %s, %s",
+			name, ScryptPresetFast, ScryptPresetDefault, ScryptPresetParanoid)
+	}
+	return p, nil
+}
+
+// MemoryBytes returns how much memory scrypt needs with these parameters.
+func (p ScryptParams) MemoryBytes() uint64 {
+	return 128 * uint64(p.R) << uint(p.LogN)
+}
+
+// String returns the parameters like "logN=16 r=8 p=1".
+func (p ScryptParams) String() string {
+	return fmt.Sprintf("logN=%d r=%d p=%d", p.LogN, p.R, p.P)
+}
+
+// Validate checks that the parameters are within the limits that we accept
+// for new config files, and that scrypt will not run out of memory on this
+// machine.
+func (p ScryptParams) Validate() error {
+	if p.LogN < scryptMinLogN || p.LogN > scryptMaxLogN {
+		return fmt.Errorf("scrypt logN=%d is outside of the allowed range %d-%d", p.LogN, scryptMinLogN, scryptMaxLogN)
+	}
+	if p.R < scryptMinR || p.P < scryptMinP {
+		return fmt.Errorf("scrypt r=%d or p=%d is below the minimum r=%d, p=%d", p.R, p.P, scryptMinR, scryptMinP)
+	}
+	// Limit from the scrypt paper, enforced by scrypt.Key()
+	if uint64(p.R)*uint64(p.P) >= 1<<30 {
+		return fmt.Errorf("scrypt r*p=%d is too large", p.R*p.P)
+	}
+	if avail, ok := availableMemory(); ok && p.MemoryBytes() > avail {
+		return fmt.Errorf("scrypt needs %d MB of memory, but only %d MB are available",
+			p.MemoryBytes()>>20, avail>>20)
+	}
+	return nil
+}
+
+// availableMemory returns the "MemAvailable" value from /proc/meminfo in
+// bytes. Returns false if it is not known, like on MacOS.
+func availableMemory() (uint64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// MemAvailable:    3941872 kB
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return kb << 10, true
+		}
+	}
+	return 0, false
+}
+
 // ScryptKDF is an instance of the scrypt key deriviation function.
 type ScryptKDF struct {
 	// Salt is the random salt that is passed to scrypt
@@ -60,6 +158,25 @@ func NewScryptKDF(logN int) ScryptKDF {
 	return s
 }
 
+// NewScryptKDFParams is like NewScryptKDF, but also sets R and P. Zero values
+// select the defaults.
+func NewScryptKDFParams(p ScryptParams) ScryptKDF {
+	s := NewScryptKDF(p.LogN)
+	if p.R > 0 {
+		s.R = p.R
+	}
+	if p.P > 0 {
+		s.P = p.P
+	}
+	return s
+}
+
+// Params returns the cost parameters, for reusing them with
+// NewScryptKDFParams.
+func (s *ScryptKDF) Params() ScryptParams {
+	return ScryptParams{LogN: s.LogN(), R: s.R, P: s.P}
+}
+
 // DeriveKey returns a new key from a supplied password.
 func (s *ScryptKDF) DeriveKey(pw string) []byte {
 	s.validateParams()
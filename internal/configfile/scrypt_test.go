@@ -58,3 +58,79 @@ func BenchmarkScrypt16(b *testing.B) {
 func BenchmarkScrypt17(b *testing.B) {
 	benchmarkScryptN(17, b)
 }
+
+func TestScryptPresets(t *testing.T) {
+	want := map[string]ScryptParams{
+		ScryptPresetFast:     {LogN: 14, R: 8, P: 1},
+		ScryptPresetDefault:  {LogN: 16, R: 8, P: 1},
+		ScryptPresetParanoid: {LogN: 19, R: 8, P: 2},
+	}
+	for name, w := range want {
+		p, err := ScryptPreset(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != w {
+			t.Errorf("%s: want %+v, got %+v", name, w, p)
+		}
+		if testing.Short() && p.LogN > ScryptDefaultLogN {
+			continue
+		}
+		// Unlocking must work with a config file created with the preset
+		err = CreateConfFile(&CreateArgs{
+			Filename: "config_test/tmp.conf",
+			Password: "test",
+			LogN:     p.LogN,
+			ScryptR:  p.R,
+			ScryptP:  p.P,
+			Creator:  "test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, c, err := LoadConfFile("config_test/tmp.conf", "test")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := c.ScryptObject.Params(); got != p {
+			t.Errorf("%s: stored parameters %+v", name, got)
+		}
+	}
+	if _, err := ScryptPreset("turbo"); err == nil {
+		t.Error("unknown preset was accepted")
+	}
+	if s := (ScryptParams{LogN: 16, R: 8, P: 1}).String(); s != "logN=16 r=8 p=1" {
+		t.Errorf("wrong String(): %q", s)
+	}
+}
+
+func TestScryptParamsValidate(t *testing.T) {
+	good := []ScryptParams{
+		{LogN: 10, R: 8, P: 1},
+		{LogN: 16, R: 16, P: 4},
+	}
+	for _, p := range good {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%+v: %v", p, err)
+		}
+	}
+	bad := []ScryptParams{
+		{LogN: 9, R: 8, P: 1},
+		{LogN: 29, R: 8, P: 1},
+		{LogN: 16, R: 4, P: 1},
+		{LogN: 16, R: 8, P: 0},
+		{LogN: 10, R: 1 << 15, P: 1 << 15},
+	}
+	for _, p := range bad {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v should have been rejected", p)
+		}
+	}
+	// More memory than any test machine has
+	if avail, ok := availableMemory(); ok {
+		p := ScryptParams{LogN: 28, R: 1 << 10, P: 1}
+		if p.MemoryBytes() > avail && p.Validate() == nil {
+			t.Errorf("%+v should have been rejected, %d bytes available", p, avail)
+		}
+	}
+}
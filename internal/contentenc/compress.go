@@ -0,0 +1,203 @@
+package contentenc
+
+// Optional per-block compression ("-compress" on "-init").
+//
+// Compressed filesystems keep the fixed block layout, so random access and
+// the size-mapping helpers in offsets.go keep working unchanged. Every
+// ciphertext block still occupies a fixed-size slot on disk:
+//
+//   nonce | sealedLen (uint16, big endian) | AEAD(flag | payload) | zero padding
+//
+// "flag" tells if "payload" is deflate-compressed (blockDeflated) or stored
+// as-is (blockStored). Blocks that do not shrink are stored. "sealedLen" is
+// not encrypted, but tampering with it makes the AEAD authentication fail.
+// The zero padding is turned into a file hole by the caller (see
+// PaddingOffset), which is where the space savings come from.
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// CompressedBS is the plaintext block size used on filesystems with
+	// compression enabled. Larger blocks compress better and allow punching
+	// whole filesystem pages out of the zero padding.
+	CompressedBS = 32768
+	// compressLenLen is the length of the cleartext "sealedLen" field
+	compressLenLen = 2
+	// compressFlagLen is the length of the encrypted per-block flag
+	compressFlagLen = 1
+	// compressOverhead is the additional per-block overhead of compressed
+	// filesystems
+	compressOverhead = compressLenLen + compressFlagLen
+)
+
+const (
+	// blockStored marks a block that is stored uncompressed
+	blockStored = 0
+	// blockDeflated marks a deflate-compressed block
+	blockDeflated = 1
+)
+
+// flate.NewWriter allocates about 1 MB of state, so we recycle the writers.
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			log.Panic(err)
+		}
+		return w
+	},
+}
+
+// deflateBlock compresses "in". Returns nil if the result would not be
+// smaller than the input.
+func deflateBlock(in []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(in))
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Panicf("deflateBlock: %v", err)
+	}
+	if buf.Len() >= len(in) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// inflateBlock decompresses "in" into "out" and returns the filled part of
+// "out". Fails if the decompressed data does not fit into "out".
+func inflateBlock(in []byte, out []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(in))
+	defer r.Close()
+	n, err := io.ReadFull(r, out)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return out[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// "out" is full. There must not be any data left.
+	var extra [1]byte
+	if m, _ := r.Read(extra[:]); m > 0 {
+		return nil, errors.New("decompressed block is too large")
+	}
+	return out, nil
+}
+
+// Compressed returns true if per-block compression is enabled.
+func (be *ContentEnc) Compressed() bool {
+	return be.compress
+}
+
+// doEncryptBlockCompressed is the compressed-mode variant of doEncryptBlock.
+// The output has the same length as the uncompressed output would have.
+func (be *ContentEnc) doEncryptBlockCompressed(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
+	payload := make([]byte, compressFlagLen, compressFlagLen+len(plaintext))
+	if c := deflateBlock(plaintext); c != nil {
+		payload[0] = blockDeflated
+		payload = append(payload, c...)
+	} else {
+		payload[0] = blockStored
+		payload = append(payload, plaintext...)
+	}
+	aData := concatAD(blockNo, fileID)
+	cBlock := be.cBlockPool.Get()
+	copy(cBlock, nonce)
+	cBlock = cBlock[0 : len(nonce)+compressLenLen]
+	sealed := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, payload, aData)
+	sealedLen := len(sealed) - len(nonce) - compressLenLen
+	binary.BigEndian.PutUint16(sealed[len(nonce):], uint16(sealedLen))
+	// Zero-pad to the length an uncompressed block would have
+	outLen := len(plaintext) + int(be.cipherBS-be.plainBS)
+	if len(sealed) > outLen {
+		log.Panicf("unexpected ciphertext length: plaintext=%d, ciphertext=%d", len(plaintext), len(sealed))
+	}
+	usedLen := len(sealed)
+	sealed = sealed[:outLen]
+	for i := usedLen; i < outLen; i++ {
+		sealed[i] = 0
+	}
+	return sealed
+}
+
+// decryptBlockCompressed is the compressed-mode variant of DecryptBlock.
+// "ciphertext" has already been checked for holes and all-zero nonces.
+func (be *ContentEnc) decryptBlockCompressed(ciphertext []byte, blockNo uint64, fileID []byte) ([]byte, error) {
+	overhead := int(be.cipherBS - be.plainBS)
+	if len(ciphertext) <= overhead {
+		tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
+		return nil, errors.New("Block is too short")
+	}
+	plainLen := len(ciphertext) - overhead
+	ivLen := be.cryptoCore.IVLen
+	nonce := ciphertext[:ivLen]
+	sealedLen := int(binary.BigEndian.Uint16(ciphertext[ivLen:]))
+	sealed := ciphertext[ivLen+compressLenLen:]
+	if sealedLen > len(sealed) {
+		tlog.Warn.Printf("DecryptBlock: corrupt length field %d, len=%d", sealedLen, len(ciphertext))
+		return nil, errors.New("corrupt length field")
+	}
+	sealed = sealed[:sealedLen]
+	aData := concatAD(blockNo, fileID)
+	payload, err := be.cryptoCore.AEADCipher.Open(nil, nonce, sealed, aData)
+	if err != nil {
+		tlog.Warn.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertext))
+		tlog.Debug.Println(hex.Dump(ciphertext))
+		return nil, err
+	}
+	if len(payload) < compressFlagLen {
+		return nil, errors.New("missing compression flag")
+	}
+	plaintext := be.pBlockPool.Get()
+	switch payload[0] {
+	case blockStored:
+		plaintext = plaintext[:copy(plaintext, payload[compressFlagLen:])]
+		if len(payload)-compressFlagLen > len(plaintext) {
+			err = errors.New("stored block is too large")
+		}
+	case blockDeflated:
+		plaintext, err = inflateBlock(payload[compressFlagLen:], plaintext)
+	default:
+		err = errors.New("unknown compression flag")
+	}
+	if err == nil && len(plaintext) != plainLen {
+		err = errors.New("plaintext length mismatch")
+	}
+	if err != nil {
+		tlog.Warn.Printf("DecryptBlock: block #%d: %v", blockNo, err)
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// PaddingOffset returns the offset inside the ciphertext block "cBlock"
+// where the zero padding of a compressed block starts. The padding does not
+// carry any data and can be deallocated. For uncompressed filesystems, this
+// is always len(cBlock).
+func (be *ContentEnc) PaddingOffset(cBlock []byte) int {
+	ivLen := be.cryptoCore.IVLen
+	if !be.compress || len(cBlock) < ivLen+compressLenLen {
+		return len(cBlock)
+	}
+	used := ivLen + compressLenLen + int(binary.BigEndian.Uint16(cBlock[ivLen:]))
+	if used > len(cBlock) {
+		return len(cBlock)
+	}
+	return used
+}
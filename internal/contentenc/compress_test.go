@@ -0,0 +1,77 @@
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func newCompressed() *ContentEnc {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	return New(cc, CompressedBS, false, true)
+}
+
+// Encrypt and decrypt compressible and incompressible blocks of different
+// sizes and check that the ciphertext length does not depend on the content.
+func TestCompressRoundTrip(t *testing.T) {
+	ce := newCompressed()
+	fileID := make([]byte, headerIDLen)
+	compressible := bytes.Repeat([]byte("hello world "), CompressedBS)
+	incompressible := cryptocore.RandBytes(CompressedBS)
+	for _, in := range [][]byte{compressible, incompressible} {
+		for _, l := range []int{1, 100, 4096, CompressedBS - 1, CompressedBS} {
+			pBlock := in[:l]
+			cBlock := ce.EncryptBlock(pBlock, 7, fileID)
+			if len(cBlock) != l+int(ce.BlockOverhead()) {
+				t.Errorf("l=%d: wrong ciphertext length %d", l, len(cBlock))
+			}
+			out, err := ce.DecryptBlock(cBlock, 7, fileID)
+			if err != nil {
+				t.Fatalf("l=%d: %v", l, err)
+			}
+			if !bytes.Equal(out, pBlock) {
+				t.Errorf("l=%d: content mismatch", l)
+			}
+		}
+	}
+}
+
+// Compressible blocks must leave zero padding that can be deallocated,
+// incompressible blocks must not.
+func TestCompressPadding(t *testing.T) {
+	ce := newCompressed()
+	fileID := make([]byte, headerIDLen)
+	cBlock := ce.EncryptBlock(make([]byte, CompressedBS), 0, fileID)
+	padOff := ce.PaddingOffset(cBlock)
+	if padOff > len(cBlock)/2 {
+		t.Errorf("zero block did not compress: padOff=%d", padOff)
+	}
+	for _, v := range cBlock[padOff:] {
+		if v != 0 {
+			t.Fatal("padding is not zero")
+		}
+	}
+	cBlock = ce.EncryptBlock(cryptocore.RandBytes(CompressedBS), 0, fileID)
+	if ce.PaddingOffset(cBlock) != len(cBlock) {
+		t.Errorf("random block should be stored without padding")
+	}
+}
+
+// Modifying the cleartext length field or the block number must be detected.
+func TestCompressTamper(t *testing.T) {
+	ce := newCompressed()
+	fileID := make([]byte, headerIDLen)
+	pBlock := bytes.Repeat([]byte{'x'}, 1000)
+	cBlock := ce.EncryptBlock(pBlock, 0, fileID)
+	_, err := ce.DecryptBlock(cBlock, 1, fileID)
+	if err == nil {
+		t.Error("wrong block number was not detected")
+	}
+	cBlock[ce.cryptoCore.IVLen+1]--
+	_, err = ce.DecryptBlock(cBlock, 0, fileID)
+	if err == nil {
+		t.Error("modified length field was not detected")
+	}
+}
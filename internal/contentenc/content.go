@@ -53,6 +53,8 @@ type ContentEnc struct {
 	allZeroNonce []byte
 	// Force decode even if integrity check fails (openSSL only)
 	forceDecode bool
+	// Compress blocks before encryption (see compress.go)
+	compress bool
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
@@ -70,8 +72,11 @@ type ContentEnc struct {
 }
 
 // New returns an initialized ContentEnc instance.
-func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
+func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool, compress bool) *ContentEnc {
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
+	if compress {
+		cipherBS += compressOverhead
+	}
 	// Take IV and GHASH overhead into account.
 	cReqSize := int(fuse.MAX_KERNEL_WRITE / plainBS * cipherBS)
 	// An unaligned read (could happen with O_DIRECT?) may touch one
@@ -87,6 +92,7 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		allZeroBlock: make([]byte, cipherBS),
 		allZeroNonce: make([]byte, cc.IVLen),
 		forceDecode:  forceDecode,
+		compress:     compress,
 		cBlockPool:   newBPool(int(cipherBS)),
 		CReqPool:     newBPool(cReqSize),
 		pBlockPool:   newBPool(int(plainBS)),
@@ -175,6 +181,9 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 		// http://www.spinics.net/lists/kernel/msg2370127.html
 		return nil, errors.New("all-zero nonce")
 	}
+	if be.compress {
+		return be.decryptBlockCompressed(ciphertext, blockNo, fileID)
+	}
 	ciphertextOrig := ciphertext
 	ciphertext = ciphertext[be.cryptoCore.IVLen:]
 
@@ -280,6 +289,9 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 	if len(nonce) != be.cryptoCore.IVLen {
 		log.Panic("wrong nonce length")
 	}
+	if be.compress {
+		return be.doEncryptBlockCompressed(plaintext, blockNo, fileID, nonce)
+	}
 	// Block is authenticated with block number and file ID
 	aData := concatAD(blockNo, fileID)
 	// Get a cipherBS-sized block of memory, copy the nonce into it and truncate to
@@ -1,6 +1,9 @@
 package contentenc
 
 import (
+	"bytes"
+	"math"
+	"syscall"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -24,7 +27,7 @@ func TestSplitRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 		parts := f.ExplodePlainRange(r.offset, r.length)
@@ -52,7 +55,7 @@ func TestCiphertextRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 
@@ -75,7 +78,7 @@ func TestCiphertextRange(t *testing.T) {
 func TestBlockNo(t *testing.T) {
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	b := f.CipherOffToBlockNo(788)
 	if b != 0 {
@@ -94,3 +97,101 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// TestMaxPlainSize checks that MaxPlainSize is the largest plaintext size
+// whose ciphertext size fits into an int64.
+func TestMaxPlainSize(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	for _, compress := range []bool{false, true} {
+		f := New(cc, DefaultBS, false, compress)
+		max := f.MaxPlainSize()
+		if c := f.PlainSizeToCipherSize(max); c > math.MaxInt64 {
+			t.Errorf("compress=%v: cipher size %d of max plain size %d overflows int64", compress, c, max)
+		}
+		if c := f.PlainSizeToCipherSize(max + 1); c <= math.MaxInt64 {
+			t.Errorf("compress=%v: max plain size %d is not the largest: %d fits", compress, max, max+1)
+		}
+	}
+}
+
+// TestCheckRange checks that offsets near the int64 and uint64 limits are
+// rejected with EFBIG instead of wrapping around.
+func TestCheckRange(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	max := f.MaxPlainSize()
+	plain := []struct {
+		offset, length uint64
+		ok             bool
+	}{
+		{0, 0, true},
+		{0, max, true},
+		{max, 0, true},
+		{max - 10, 10, true},
+		{max - 10, 11, false},
+		{max + 1, 0, false},
+		{math.MaxInt64, 1, false},
+		{math.MaxUint64, 1, false},
+		{1, math.MaxUint64, false},
+	}
+	for _, r := range plain {
+		err := f.CheckPlainRange(r.offset, r.length)
+		if r.ok && err != nil {
+			t.Errorf("CheckPlainRange(%d, %d): unexpected error %v", r.offset, r.length, err)
+		}
+		if !r.ok && err != syscall.EFBIG {
+			t.Errorf("CheckPlainRange(%d, %d): want EFBIG, got %v", r.offset, r.length, err)
+		}
+	}
+	if err := f.CheckCipherRange(math.MaxInt64-10, 10); err != nil {
+		t.Error(err)
+	}
+	if err := f.CheckCipherRange(math.MaxInt64-10, 11); err != syscall.EFBIG {
+		t.Errorf("want EFBIG, got %v", err)
+	}
+	if err := f.CheckCipherRange(math.MaxUint64, 1); err != syscall.EFBIG {
+		t.Errorf("want EFBIG, got %v", err)
+	}
+}
+
+// TestGCMParamsRoundTrip encrypts and decrypts blocks with all supported
+// GCM IV lengths and checks that the block size takes the IV into account.
+func TestGCMParamsRoundTrip(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	for _, ivBits := range []int{96, 128} {
+		if err := cryptocore.CheckGCMIVBits(ivBits); err != nil {
+			t.Fatal(err)
+		}
+		cc := cryptocore.New(key, cryptocore.BackendGoGCM, ivBits, true, false)
+		f := New(cc, DefaultBS, false, false)
+		if f.CipherBS() != DefaultBS+uint64(ivBits/8)+cryptocore.AuthTagLen {
+			t.Errorf("%d bits: wrong CipherBS %d", ivBits, f.CipherBS())
+		}
+		fileID := make([]byte, 16)
+		plain := bytes.Repeat([]byte("x"), DefaultBS)
+		ciphertext := f.EncryptBlock(plain, 3, fileID)
+		if uint64(len(ciphertext)) != f.CipherBS() {
+			t.Errorf("%d bits: wrong ciphertext length %d", ivBits, len(ciphertext))
+		}
+		dec, err := f.DecryptBlock(ciphertext, 3, fileID)
+		if err != nil {
+			t.Fatalf("%d bits: %v", ivBits, err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Errorf("%d bits: wrong plaintext", ivBits)
+		}
+		// A filesystem must be read with the parameters it was written with
+		other := 224 - ivBits
+		cc2 := cryptocore.New(key, cryptocore.BackendGoGCM, other, true, false)
+		if _, err = New(cc2, DefaultBS, false, false).DecryptBlock(ciphertext, 3, fileID); err == nil {
+			t.Errorf("%d bits: decrypting with %d-bit IVs should fail", ivBits, other)
+		}
+	}
+	for _, ivBits := range []int{64, 112, 256} {
+		if cryptocore.CheckGCMIVBits(ivBits) == nil {
+			t.Errorf("IV %d bits should have been rejected", ivBits)
+		}
+	}
+}
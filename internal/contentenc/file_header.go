@@ -17,6 +17,10 @@ import (
 const (
 	// CurrentVersion is the current On-Disk-Format version
 	CurrentVersion = 2
+	// SymlinkVersion is the "Version" of files that store a symlink target
+	// instead of file content (SymlinkFiles feature flag). The high bit
+	// tells them apart from regular files.
+	SymlinkVersion = 0x8000 | CurrentVersion
 
 	headerVersionLen = 2  // uint16
 	headerIDLen      = 16 // 128 bit random file id
@@ -32,7 +36,7 @@ type FileHeader struct {
 
 // Pack - serialize fileHeader object
 func (h *FileHeader) Pack() []byte {
-	if len(h.ID) != headerIDLen || h.Version != CurrentVersion {
+	if len(h.ID) != headerIDLen || (h.Version != CurrentVersion && h.Version != SymlinkVersion) {
 		log.Panic("FileHeader object not properly initialized")
 	}
 	buf := make([]byte, HeaderLen)
@@ -47,14 +51,30 @@ var allZeroFileID = make([]byte, headerIDLen)
 
 // ParseHeader - parse "buf" into fileHeader object
 func ParseHeader(buf []byte) (*FileHeader, error) {
+	return parseHeader(buf, CurrentVersion)
+}
+
+// ParseSymlinkHeader is like ParseHeader, but for the header of a file that
+// stores a symlink target.
+func ParseSymlinkHeader(buf []byte) (*FileHeader, error) {
+	return parseHeader(buf, SymlinkVersion)
+}
+
+// IsSymlinkHeader returns true if "buf" starts with the version field of a
+// symlink header.
+func IsSymlinkHeader(buf []byte) bool {
+	return len(buf) >= headerVersionLen && binary.BigEndian.Uint16(buf) == SymlinkVersion
+}
+
+func parseHeader(buf []byte, version uint16) (*FileHeader, error) {
 	if len(buf) != HeaderLen {
 		tlog.Warn.Printf("ParseHeader: invalid length: want %d bytes, got %d. Returning EINVAL.", HeaderLen, len(buf))
 		return nil, syscall.EINVAL
 	}
 	var h FileHeader
 	h.Version = binary.BigEndian.Uint16(buf[0:headerVersionLen])
-	if h.Version != CurrentVersion {
-		tlog.Warn.Printf("ParseHeader: invalid version: want %d, got %d. Returning EINVAL.", CurrentVersion, h.Version)
+	if h.Version != version {
+		tlog.Warn.Printf("ParseHeader: invalid version: want %d, got %d. Returning EINVAL.", version, h.Version)
 		return nil, syscall.EINVAL
 	}
 	h.ID = buf[headerVersionLen:]
@@ -72,3 +92,11 @@ func RandomHeader() *FileHeader {
 	h.ID = cryptocore.RandBytes(headerIDLen)
 	return &h
 }
+
+// RandomSymlinkHeader is like RandomHeader, but for a file that stores a
+// symlink target.
+func RandomSymlinkHeader() *FileHeader {
+	h := RandomHeader()
+	h.Version = SymlinkVersion
+	return h
+}
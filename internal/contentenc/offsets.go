@@ -2,11 +2,51 @@ package contentenc
 
 import (
 	"log"
+	"math"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 // Contentenc methods that translate offsets between ciphertext and plaintext
+//
+// The conversions below do not check for overflow. Offsets and sizes that
+// come from outside must be validated with CheckPlainRange or
+// CheckCipherRange first, which guarantees that all resulting ciphertext
+// offsets fit into an int64 (the largest file size the kernel supports).
+
+// MaxPlainSize returns the largest plaintext file size whose ciphertext
+// size fits into an int64.
+func (be *ContentEnc) MaxPlainSize() uint64 {
+	avail := uint64(math.MaxInt64) - HeaderLen
+	// Full blocks
+	n := avail / be.cipherBS
+	plainSize := n * be.plainBS
+	// A partial last block needs the full per-block overhead
+	if rest := avail - n*be.cipherBS; rest > be.BlockOverhead() {
+		plainSize += rest - be.BlockOverhead()
+	}
+	return plainSize
+}
+
+// CheckPlainRange returns EFBIG if the plaintext range offset...offset+length
+// does not fit into a file of MaxPlainSize bytes.
+func (be *ContentEnc) CheckPlainRange(offset uint64, length uint64) error {
+	max := be.MaxPlainSize()
+	if offset > max || length > max-offset {
+		return syscall.EFBIG
+	}
+	return nil
+}
+
+// CheckCipherRange returns EFBIG if the ciphertext range
+// offset...offset+length does not fit into an int64.
+func (be *ContentEnc) CheckCipherRange(offset uint64, length uint64) error {
+	if offset > math.MaxInt64 || length > math.MaxInt64-offset {
+		return syscall.EFBIG
+	}
+	return nil
+}
 
 // PlainOffToBlockNo converts a plaintext offset to the ciphertext block number.
 func (be *ContentEnc) PlainOffToBlockNo(plainOffset uint64) uint64 {
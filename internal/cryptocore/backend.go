@@ -0,0 +1,57 @@
+package cryptocore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+// backendNames are the names returned by AEADTypeEnum.String and accepted
+// by ParseAEADType.
+var backendNames = map[AEADTypeEnum]string{
+	BackendOpenSSL: "openssl",
+	BackendGoGCM:   "gogcm",
+	BackendAESSIV:  "aessiv",
+}
+
+// String returns the name of the backend, like "aessiv".
+func (a AEADTypeEnum) String() string {
+	if name, ok := backendNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("AEADTypeEnum(%d)", int(a))
+}
+
+// ParseAEADType parses a backend name as returned by AEADTypeEnum.String.
+// Case is ignored.
+func ParseAEADType(s string) (AEADTypeEnum, error) {
+	for a, name := range backendNames {
+		if strings.EqualFold(s, name) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown crypto backend %q, known backends: openssl, gogcm, aessiv", s)
+}
+
+// ValidateBackend checks that the backend "a" can be used in the given mode.
+// Reverse mode uses deterministic nonces and is only secure with AES-SIV.
+// Decoding corrupt blocks ("forceDecode") is only implemented by OpenSSL.
+func ValidateBackend(a AEADTypeEnum, reverse bool, forceDecode bool) error {
+	if _, ok := backendNames[a]; !ok {
+		return fmt.Errorf("unknown crypto backend %v", a)
+	}
+	if reverse && forceDecode {
+		return fmt.Errorf("reverse mode does not support forcedecode")
+	}
+	if forceDecode && a != BackendOpenSSL {
+		return fmt.Errorf("forcedecode requires the openssl backend, not %v", a)
+	}
+	if reverse && a != BackendAESSIV {
+		return fmt.Errorf("reverse mode requires the aessiv backend, %v is insecure with deterministic nonces", a)
+	}
+	if a == BackendOpenSSL && stupidgcm.BuiltWithoutOpenssl {
+		return fmt.Errorf("the openssl backend is not available, gocryptfs was compiled without openssl support")
+	}
+	return nil
+}
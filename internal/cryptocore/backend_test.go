@@ -0,0 +1,61 @@
+package cryptocore
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+func TestAEADTypeString(t *testing.T) {
+	for _, a := range []AEADTypeEnum{BackendOpenSSL, BackendGoGCM, BackendAESSIV} {
+		b, err := ParseAEADType(a.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != b {
+			t.Errorf("%v: round trip gave %v", a, b)
+		}
+	}
+	if a, err := ParseAEADType("AESSIV"); err != nil || a != BackendAESSIV {
+		t.Errorf("parsing should ignore case: %v %v", a, err)
+	}
+	for _, s := range []string{"", "gcm", "aes-siv"} {
+		if _, err := ParseAEADType(s); err == nil {
+			t.Errorf("%q should have been rejected", s)
+		}
+	}
+	if s := AEADTypeEnum(99).String(); s != "AEADTypeEnum(99)" {
+		t.Errorf("wrong name for unknown backend: %q", s)
+	}
+}
+
+func TestValidateBackend(t *testing.T) {
+	testCases := []struct {
+		a           AEADTypeEnum
+		reverse     bool
+		forceDecode bool
+		ok          bool
+	}{
+		{BackendGoGCM, false, false, true},
+		{BackendOpenSSL, false, false, !stupidgcm.BuiltWithoutOpenssl},
+		{BackendAESSIV, false, false, true},
+		{BackendAESSIV, true, false, true},
+		{BackendOpenSSL, false, true, !stupidgcm.BuiltWithoutOpenssl},
+		// Reverse mode needs AES-SIV
+		{BackendGoGCM, true, false, false},
+		{BackendOpenSSL, true, false, false},
+		// forcedecode needs OpenSSL
+		{BackendGoGCM, false, true, false},
+		{BackendAESSIV, false, true, false},
+		{BackendAESSIV, true, true, false},
+		{AEADTypeEnum(0), false, false, false},
+		{AEADTypeEnum(99), false, false, false},
+	}
+	for _, tc := range testCases {
+		err := ValidateBackend(tc.a, tc.reverse, tc.forceDecode)
+		if (err == nil) != tc.ok {
+			t.Errorf("%v reverse=%v forceDecode=%v: want ok=%v, got err=%v",
+				tc.a, tc.reverse, tc.forceDecode, tc.ok, err)
+		}
+	}
+}
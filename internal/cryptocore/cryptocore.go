@@ -46,6 +46,19 @@ type CryptoCore struct {
 	IVLen       int
 }
 
+// CheckGCMIVBits returns an error if "ivBits" is not a safe GCM nonce length
+// for file content.
+//
+// Nonces are random, so they must be at least 96 bits long to make
+// collisions unlikely. 128 bits give more margin, 96 bits are what most
+// other tools use.
+func CheckGCMIVBits(ivBits int) error {
+	if ivBits != 96 && ivBits != 128 {
+		return fmt.Errorf("GCM IV length of %d bits is not supported, use 96 or 128", ivBits)
+	}
+	return nil
+}
+
 // New returns a new CryptoCore object or panics.
 //
 // Even though the "GCMIV128" feature flag is now mandatory, we must still
@@ -129,3 +142,16 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 		IVLen:       IVLen,
 	}
 }
+
+// Wipe tries to wipe secret keys from memory by overwriting them with zeros
+// (where the backend supports it) and dropping the references to the cipher
+// objects. The CryptoCore must not be used afterwards.
+func (c *CryptoCore) Wipe() {
+	if w, ok := c.AEADCipher.(interface {
+		Wipe()
+	}); ok {
+		w.Wipe()
+	}
+	c.AEADCipher = nil
+	c.EMECipher = nil
+}
@@ -0,0 +1,25 @@
+package cryptocore
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// hkdfInfoFingerprint is the HKDF "info" string for KeyFingerprint
+const hkdfInfoFingerprint = "gocryptfs master key fingerprint"
+
+// fingerprintLen is the length of the fingerprint in bytes
+const fingerprintLen = 16
+
+// KeyFingerprint returns a fingerprint of "masterkey" that can be shown to
+// the user to check if two filesystems use the same master key. It is
+// derived using HKDF, so it does not reveal anything about the key itself.
+// The result looks like "1a2b3c4d-1a2b3c4d-1a2b3c4d-1a2b3c4d".
+func KeyFingerprint(masterkey []byte) string {
+	h := hex.EncodeToString(hkdfDerive(masterkey, hkdfInfoFingerprint, fingerprintLen))
+	var chunks []string
+	for i := 0; i < len(h); i += 8 {
+		chunks = append(chunks, h[i:i+8])
+	}
+	return strings.Join(chunks, "-")
+}
@@ -0,0 +1,20 @@
+package cryptocore
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestKeyFingerprint checks that the fingerprint is stable and differs
+// between keys.
+func TestKeyFingerprint(t *testing.T) {
+	master0 := bytes.Repeat([]byte{0x00}, KeyLen)
+	master1 := bytes.Repeat([]byte{0x01}, KeyLen)
+	// These values must not change, users may have written them down
+	if fp := KeyFingerprint(master0); fp != "1c138b9a-c7bb4071-d6541398-56a3d639" {
+		t.Errorf("master0: wrong fingerprint %q", fp)
+	}
+	if fp := KeyFingerprint(master1); fp != "14f25e92-d10daff5-9f2910fd-d224b316" {
+		t.Errorf("master1: wrong fingerprint %q", fp)
+	}
+}
@@ -1,6 +1,8 @@
 package cryptocore
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/sha256"
 	"log"
 
@@ -13,8 +15,24 @@ const (
 	hkdfInfoEMENames   = "EME filename encryption"
 	hkdfInfoGCMContent = "AES-GCM file content encryption"
 	hkdfInfoSIVContent = "AES-SIV file content encryption"
+	hkdfInfoDirIV      = "AES-GCM DirIV encryption"
 )
 
+// NewDirIVAEAD returns the AES-GCM cipher with 128-bit nonces that encrypts
+// the gocryptfs.diriv files when the EncryptedDirIV feature flag is set.
+// The key is derived from "masterkey" using HKDF.
+func NewDirIVAEAD(masterkey []byte) cipher.AEAD {
+	blockCipher, err := aes.NewCipher(hkdfDerive(masterkey, hkdfInfoDirIV, KeyLen))
+	if err != nil {
+		log.Panic(err)
+	}
+	aead, err := cipher.NewGCMWithNonceSize(blockCipher, 16)
+	if err != nil {
+		log.Panic(err)
+	}
+	return aead
+}
+
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
 // HKDF-SHA256 (RFC 5869).
 // It returns the derived bytes or panics.
@@ -6,8 +6,17 @@ import (
 	"log"
 )
 
-// RandBytes gets "n" random bytes from /dev/urandom or panics
+// RandBytes gets "n" random bytes from /dev/urandom or panics. See
+// SeedForTests for the exception.
 func RandBytes(n int) []byte {
+	if s := getSeeded(); s != nil {
+		return s.read(n)
+	}
+	return urandomBytes(n)
+}
+
+// urandomBytes gets "n" random bytes from /dev/urandom or panics
+func urandomBytes(n int) []byte {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
 	if err != nil {
@@ -28,5 +37,8 @@ type nonceGenerator struct {
 
 // Get a random "nonceLen"-byte nonce
 func (n *nonceGenerator) Get() []byte {
+	if s := getSeeded(); s != nil {
+		return s.read(n.nonceLen)
+	}
 	return randPrefetcher.read(n.nonceLen)
 }
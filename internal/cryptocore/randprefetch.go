@@ -48,7 +48,9 @@ func (r *randPrefetcherT) read(want int) (out []byte) {
 
 func (r *randPrefetcherT) refillWorker() {
 	for {
-		r.refill <- RandBytes(prefetchN)
+		// Not RandBytes: the prefetched bytes must never come from
+		// SeedForTests, which would make their order depend on timing.
+		r.refill <- urandomBytes(prefetchN)
 	}
 }
 
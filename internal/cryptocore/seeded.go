@@ -0,0 +1,69 @@
+package cryptocore
+
+// Deterministic randomness for tests
+//
+// End-to-end tests want to compare complete volumes against each other or
+// against golden files. SeedForTests replaces every source of randomness
+// (master key, scrypt salt, DirIVs, file IDs, nonces) with a stream that only
+// depends on the seed, so that the same operations produce byte-identical
+// ciphertext.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"flag"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// seededRand is an AES-CTR keystream keyed with the hash of the seed
+type seededRand struct {
+	sync.Mutex
+	stream cipher.Stream
+}
+
+// seeded holds the active *seededRand, or a nil *seededRand
+var seeded atomic.Value
+
+func init() {
+	seeded.Store((*seededRand)(nil))
+}
+
+// SeedForTests makes all random bytes a deterministic function of "seed".
+// A nil seed switches back to real randomness. Calling it again with the
+// same seed restarts the stream from the beginning.
+//
+// The produced "random" bytes are public knowledge, so this is a disaster
+// outside of tests. It panics unless it is called from a "go test" binary.
+func SeedForTests(seed []byte) {
+	if flag.Lookup("test.v") == nil {
+		log.Panic("SeedForTests: refusing to use predictable randomness outside of tests")
+	}
+	if seed == nil {
+		seeded.Store((*seededRand)(nil))
+		return
+	}
+	key := sha256.Sum256(seed)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		log.Panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	seeded.Store(&seededRand{stream: cipher.NewCTR(block, iv)})
+}
+
+// getSeeded returns the active seeded stream, or nil.
+func getSeeded() *seededRand {
+	return seeded.Load().(*seededRand)
+}
+
+// read returns the next "n" bytes of the stream
+func (s *seededRand) read(n int) []byte {
+	b := make([]byte, n)
+	s.Lock()
+	s.stream.XORKeyStream(b, b)
+	s.Unlock()
+	return b
+}
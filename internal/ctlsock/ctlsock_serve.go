@@ -3,14 +3,16 @@
 package ctlsock
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -20,10 +22,154 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// TrashInterface is implemented by backends that support "-trash".
+type TrashInterface interface {
+	// TrashEnabled returns false if the mount has been started without
+	// "-trash"
+	TrashEnabled() bool
+	TrashList() (string, error)
+	TrashRestore(string) (string, error)
+	TrashEmpty() error
+}
+
+// OpenFilesInterface is implemented by backends that can list their open
+// files.
+type OpenFilesInterface interface {
+	OpenFiles() (string, error)
+}
+
+// WriteIntentInterface is implemented by backends that support
+// "-write-intent".
+type WriteIntentInterface interface {
+	DurableSize(string) (uint64, error)
+}
+
+// StatInterface is implemented by backends that support the batch "Stat"
+// request.
+type StatInterface interface {
+	// StatPaths returns the attributes of the plaintext paths. errs[i] is
+	// the error for paths[i].
+	StatPaths(paths []string) (attrs []StatAttr, errs []error)
+}
+
+// ListPathsInterface is implemented by backends that support the
+// "ListPaths" request.
+type ListPathsInterface interface {
+	// ListPaths calls "fn" for every plaintext path below the directory
+	// "prefix". It stops and returns the error if "fn" returns one.
+	ListPaths(prefix string, fn func(path string) error) error
+}
+
+// CapabilitiesInterface is implemented by backends that support the
+// "Capabilities" request.
+type CapabilitiesInterface interface {
+	Capabilities() Capabilities
+}
+
+// AccessInterface is implemented by backends that support the "Access"
+// request.
+type AccessInterface interface {
+	// CheckAccess returns nil if the user "uid", with the primary group
+	// "gid" and the supplementary groups "groups", would get the
+	// permissions "mode" on the plaintext path "path", and EACCES if not.
+	CheckAccess(path string, uid uint32, gid uint32, groups []uint32, mode uint32) error
+}
+
+// SyncInterface is implemented by backends that support the "SyncAll"
+// request.
+type SyncInterface interface {
+	// SyncAll returns once all data and metadata written through the mount
+	// is durable.
+	SyncAll() error
+}
+
+// SnapshotInterface is implemented by backends that support "-cow-snapshots".
+type SnapshotInterface interface {
+	// SnapshotsEnabled returns false if the mount has been started without
+	// "-cow-snapshots"
+	SnapshotsEnabled() bool
+	Snapshot(string) (string, error)
+	SnapshotList() (string, error)
+	SnapshotDelete(string) error
+}
+
+// AccessRequest asks whether a user would get access to a path
+type AccessRequest struct {
+	// Plaintext path
+	Path string
+	// User and groups to check for
+	Uid, Gid uint32
+	Groups   []uint32
+	// Mode is a combination of R_OK (4), W_OK (2) and X_OK (1), like in
+	// access(2). 0 only checks that the path can be reached.
+	Mode uint32
+}
+
+// Capabilities describes how the mounted filesystem behaves, for
+// applications that adapt to it
+type Capabilities struct {
+	// CaseSensitive is false if names are looked up case-insensitively,
+	// "-caseinsensitive"
+	CaseSensitive bool
+}
+
+// StatAttr holds the attributes of one path of a "Stat" request
+type StatAttr struct {
+	// Plaintext size in bytes
+	Size uint64
+	// File type and permission bits as in stat(2)
+	Mode uint32
+	// Modification time in seconds and nanoseconds since the Unix epoch
+	Mtime     uint64
+	Mtimensec uint32
+}
+
+// StatEntry is the result for one path of a "Stat" request
+type StatEntry struct {
+	// Path as it was passed in the request
+	Path string
+	StatAttr
+	// ErrNo, ErrText and ErrCode are set like in ResponseStruct if this
+	// path could not be stat'ed
+	ErrNo   int32
+	ErrText string
+	ErrCode int32
+}
+
 // RequestStruct is sent by a client
 type RequestStruct struct {
 	EncryptPath string
 	DecryptPath string
+	// TrashList requests a list of the objects in the trash
+	TrashList bool
+	// TrashRestore restores the trashed object with this ID
+	TrashRestore string
+	// TrashEmpty requests permanently deleting the contents of the trash
+	TrashEmpty bool
+	// OpenFiles requests a list of the currently open files
+	OpenFiles bool
+	// DurableSize requests the size of the durable prefix of this file
+	DurableSize string
+	// Stat requests the attributes of these files
+	Stat []string
+	// ListPaths requests all plaintext paths below this directory. Use "/"
+	// for the whole filesystem.
+	ListPaths string
+	// Capabilities requests the capabilities of the filesystem
+	Capabilities bool
+	// Access asks whether a user would get access to a path, without
+	// accessing it
+	Access *AccessRequest
+	// SyncAll requests making everything written so far durable. The
+	// response is sent when it is done.
+	SyncAll bool
+	// Snapshot takes a snapshot with this name and returns its ciphertext
+	// directory
+	Snapshot string
+	// SnapshotList requests a list of the snapshots
+	SnapshotList bool
+	// SnapshotDelete deletes the snapshot with this name
+	SnapshotDelete string
 }
 
 // ResponseStruct is sent by us as response to a request
@@ -36,9 +182,82 @@ type ResponseStruct struct {
 	ErrNo int32
 	// ErrText is a detailed error message.
 	ErrText string
+	// ErrCode is one of the ErrCode* constants. Unlike ErrNo, it is the
+	// same on all operating systems and is set for all errors.
+	ErrCode int32
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Stat has one entry per path of a "Stat" request
+	Stat []StatEntry `json:",omitempty"`
+	// Paths holds a batch of paths of a "ListPaths" request
+	Paths []string `json:",omitempty"`
+	// Capabilities is the result of a "Capabilities" request
+	Capabilities *Capabilities `json:",omitempty"`
+	// Granted is the result of an "Access" request
+	Granted *bool `json:",omitempty"`
+	// More is true if more responses to the same request follow
+	More bool `json:",omitempty"`
+}
+
+// Values of ResponseStruct.ErrCode. Where a matching exit code exists,
+// they have the same value.
+const (
+	// ErrCodeOK - success
+	ErrCodeOK = 0
+	// ErrCodeBadRequest - the request is malformed or ambiguous
+	ErrCodeBadRequest = exitcodes.Usage
+	// ErrCodeOther - any other error, see ErrText
+	ErrCodeOther = exitcodes.Other
+	// ErrCodeNotFound - the path does not exist
+	ErrCodeNotFound = exitcodes.FindPath
+	// ErrCodeDecrypt - a path component could not be decrypted
+	ErrCodeDecrypt = 100
+	// ErrCodeNotSupported - this mount does not support the request
+	ErrCodeNotSupported = 101
+)
+
+// requestError is an error with a specific ErrCode
+type requestError struct {
+	code int32
+	text string
+}
+
+func (e *requestError) Error() string {
+	return e.text
+}
+
+// badRequest returns an ErrCodeBadRequest error
+func badRequest(text string) error {
+	return &requestError{ErrCodeBadRequest, text}
+}
+
+// notSupported returns an ErrCodeNotSupported error
+func notSupported(text string) error {
+	return &requestError{ErrCodeNotSupported, text}
+}
+
+// errCode returns the ErrCode for "err"
+func errCode(err error) int32 {
+	if err == nil {
+		return ErrCodeOK
+	}
+	if re, ok := err.(*requestError); ok {
+		return re.code
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if _, ok := err.(base64.CorruptInputError); ok {
+		return ErrCodeDecrypt
+	}
+	switch err {
+	case syscall.ENOENT:
+		return ErrCodeNotFound
+	case syscall.EBADMSG:
+		return ErrCodeDecrypt
+	}
+	return ErrCodeOther
 }
 
 type ctlSockHandler struct {
@@ -101,7 +320,7 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 		err = json.Unmarshal(buf, &in)
 		if err != nil {
 			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
-			err = errors.New("JSON Unmarshal error: " + err.Error())
+			err = badRequest("JSON Unmarshal error: " + err.Error())
 			sendResponse(conn, err, "", "")
 			continue
 		}
@@ -115,15 +334,51 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 	var err error
 	var inPath, outPath, clean, warnText string
+	if in.TrashList || in.TrashRestore != "" || in.TrashEmpty {
+		ch.handleTrashRequest(in, conn)
+		return
+	}
+	if in.OpenFiles {
+		ch.handleOpenFilesRequest(in, conn)
+		return
+	}
+	if in.DurableSize != "" {
+		ch.handleDurableSizeRequest(in, conn)
+		return
+	}
+	if in.Stat != nil {
+		ch.handleStatRequest(in, conn)
+		return
+	}
+	if in.ListPaths != "" {
+		ch.handleListPathsRequest(in, conn)
+		return
+	}
+	if in.Capabilities {
+		ch.handleCapabilitiesRequest(in, conn)
+		return
+	}
+	if in.Access != nil {
+		ch.handleAccessRequest(in, conn)
+		return
+	}
+	if in.SyncAll {
+		ch.handleSyncAllRequest(in, conn)
+		return
+	}
+	if in.Snapshot != "" || in.SnapshotList || in.SnapshotDelete != "" {
+		ch.handleSnapshotRequest(in, conn)
+		return
+	}
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
-		err = errors.New("Ambigous")
+		err = badRequest("Ambigous")
 		sendResponse(conn, err, "", "")
 		return
 	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
-		err = errors.New("Empty input")
+		err = badRequest("Empty input")
 		sendResponse(conn, err, "", "")
 		return
 	}
@@ -140,7 +395,7 @@ func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 	}
 	// Error out if the canonical path is now empty
 	if clean == "" {
-		err = errors.New("Empty input after canonicalization")
+		err = badRequest("Empty input after canonicalization")
 		sendResponse(conn, err, "", warnText)
 		return
 	}
@@ -153,6 +408,246 @@ func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 	sendResponse(conn, err, outPath, warnText)
 }
 
+// handleTrashRequest handles the trash-related requests
+func (ch *ctlSockHandler) handleTrashRequest(in *RequestStruct, conn *net.UnixConn) {
+	trash, ok := ch.fs.(TrashInterface)
+	if !ok {
+		sendResponse(conn, notSupported("Trash is not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	if !trash.TrashEnabled() {
+		sendResponse(conn, notSupported("Trash is disabled, mount with -trash"), "", "")
+		return
+	}
+	var result string
+	var err error
+	if in.TrashList {
+		result, err = trash.TrashList()
+	} else if in.TrashRestore != "" {
+		result, err = trash.TrashRestore(in.TrashRestore)
+	} else {
+		err = trash.TrashEmpty()
+	}
+	sendResponse(conn, err, result, "")
+}
+
+// handleOpenFilesRequest handles the "OpenFiles" request
+func (ch *ctlSockHandler) handleOpenFilesRequest(in *RequestStruct, conn *net.UnixConn) {
+	of, ok := ch.fs.(OpenFilesInterface)
+	if !ok {
+		sendResponse(conn, notSupported("Listing open files is not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	result, err := of.OpenFiles()
+	sendResponse(conn, err, result, "")
+}
+
+// handleSyncAllRequest handles the "SyncAll" request
+func (ch *ctlSockHandler) handleSyncAllRequest(in *RequestStruct, conn *net.UnixConn) {
+	si, ok := ch.fs.(SyncInterface)
+	if !ok {
+		sendResponse(conn, notSupported("SyncAll is not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	sendResponse(conn, si.SyncAll(), "", "")
+}
+
+// handleSnapshotRequest handles the snapshot-related requests
+func (ch *ctlSockHandler) handleSnapshotRequest(in *RequestStruct, conn *net.UnixConn) {
+	snap, ok := ch.fs.(SnapshotInterface)
+	if !ok {
+		sendResponse(conn, notSupported("Snapshots are not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	if !snap.SnapshotsEnabled() {
+		sendResponse(conn, notSupported("Snapshots are disabled, mount with -cow-snapshots"), "", "")
+		return
+	}
+	var result string
+	var err error
+	if in.Snapshot != "" {
+		result, err = snap.Snapshot(in.Snapshot)
+	} else if in.SnapshotList {
+		result, err = snap.SnapshotList()
+	} else {
+		err = snap.SnapshotDelete(in.SnapshotDelete)
+	}
+	sendResponse(conn, err, result, "")
+}
+
+// handleDurableSizeRequest handles the "DurableSize" request
+func (ch *ctlSockHandler) handleDurableSizeRequest(in *RequestStruct, conn *net.UnixConn) {
+	wi, ok := ch.fs.(WriteIntentInterface)
+	if !ok {
+		sendResponse(conn, notSupported("Write intent records are not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	clean := SanitizePath(in.DurableSize)
+	var warnText string
+	if clean != in.DurableSize {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", in.DurableSize, clean)
+	}
+	size, err := wi.DurableSize(clean)
+	if err != nil {
+		sendResponse(conn, err, "", warnText)
+		return
+	}
+	sendResponse(conn, nil, strconv.FormatUint(size, 10), warnText)
+}
+
+// handleStatRequest handles the "Stat" request
+func (ch *ctlSockHandler) handleStatRequest(in *RequestStruct, conn *net.UnixConn) {
+	si, ok := ch.fs.(StatInterface)
+	if !ok {
+		sendResponse(conn, notSupported("Stat is not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	clean := make([]string, len(in.Stat))
+	for i, p := range in.Stat {
+		clean[i] = SanitizePath(p)
+	}
+	attrs, errs := si.StatPaths(clean)
+	msg := ResponseStruct{
+		Stat: make([]StatEntry, len(in.Stat)),
+	}
+	for i := range msg.Stat {
+		e := &msg.Stat[i]
+		e.Path = in.Stat[i]
+		if errs[i] != nil {
+			e.ErrNo = errNo(errs[i])
+			e.ErrText = errs[i].Error()
+			e.ErrCode = errCode(errs[i])
+			continue
+		}
+		e.StatAttr = attrs[i]
+	}
+	writeResponse(conn, &msg)
+}
+
+// handleCapabilitiesRequest handles the "Capabilities" request
+func (ch *ctlSockHandler) handleCapabilitiesRequest(in *RequestStruct, conn *net.UnixConn) {
+	ci, ok := ch.fs.(CapabilitiesInterface)
+	if !ok {
+		sendResponse(conn, notSupported("Capabilities is not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	c := ci.Capabilities()
+	writeResponse(conn, &ResponseStruct{Capabilities: &c})
+}
+
+// handleAccessRequest handles the "Access" request. A denied access is a
+// successful request with Granted set to false, errors like a missing
+// path are reported as usual.
+func (ch *ctlSockHandler) handleAccessRequest(in *RequestStruct, conn *net.UnixConn) {
+	ai, ok := ch.fs.(AccessInterface)
+	if !ok {
+		sendResponse(conn, notSupported("Access is not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	a := in.Access
+	if a.Mode&^7 != 0 {
+		sendResponse(conn, badRequest(fmt.Sprintf("Invalid mode %#o", a.Mode)), "", "")
+		return
+	}
+	clean := SanitizePath(a.Path)
+	var warnText string
+	if clean != a.Path {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", a.Path, clean)
+	}
+	err := ai.CheckAccess(clean, a.Uid, a.Gid, a.Groups, a.Mode)
+	if err != nil && err != syscall.EACCES && err != syscall.EPERM {
+		sendResponse(conn, err, "", warnText)
+		return
+	}
+	granted := err == nil
+	writeResponse(conn, &ResponseStruct{Granted: &granted, WarnText: warnText})
+}
+
+// listPathsBatch is the maximum number of paths in one "ListPaths" response
+const listPathsBatch = 1000
+
+// handleListPathsRequest handles the "ListPaths" request. The paths are
+// streamed as a series of responses, all but the last one have "More" set.
+// The walk stops when the client closes the connection.
+func (ch *ctlSockHandler) handleListPathsRequest(in *RequestStruct, conn *net.UnixConn) {
+	lp, ok := ch.fs.(ListPathsInterface)
+	if !ok {
+		sendResponse(conn, notSupported("ListPaths is not supported"), "", "")
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, badRequest("Ambigous"), "", "")
+		return
+	}
+	clean := SanitizePath(in.ListPaths)
+	var warnText string
+	if clean != in.ListPaths && in.ListPaths != "/" {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", in.ListPaths, clean)
+	}
+	var batch []string
+	err := lp.ListPaths(clean, func(path string) error {
+		batch = append(batch, path)
+		if len(batch) < listPathsBatch {
+			return nil
+		}
+		err := writeResponse(conn, &ResponseStruct{Paths: batch, More: true})
+		batch = nil
+		return err
+	})
+	msg := ResponseStruct{
+		Paths:    batch,
+		WarnText: warnText,
+	}
+	if err != nil {
+		msg.ErrText = err.Error()
+		msg.ErrCode = errCode(err)
+		msg.ErrNo = errNo(err)
+	}
+	writeResponse(conn, &msg)
+}
+
+// errNo returns the error number of "err", or -1 if it is not known
+func errNo(err error) int32 {
+	if pe, ok := err.(*os.PathError); ok {
+		if se, ok := pe.Err.(syscall.Errno); ok {
+			return int32(se)
+		}
+	}
+	return -1
+}
+
 // sendResponse sends a JSON response message
 func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
 	msg := ResponseStruct{
@@ -161,18 +656,18 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 	}
 	if err != nil {
 		msg.ErrText = err.Error()
-		msg.ErrNo = -1
-		// Try to extract the actual error number
-		if pe, ok := err.(*os.PathError); ok {
-			if se, ok := pe.Err.(syscall.Errno); ok {
-				msg.ErrNo = int32(se)
-			}
-		}
+		msg.ErrCode = errCode(err)
+		msg.ErrNo = errNo(err)
 	}
+	writeResponse(conn, &msg)
+}
+
+// writeResponse marshals "msg" and writes it to "conn"
+func writeResponse(conn *net.UnixConn, msg *ResponseStruct) error {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
-		return
+		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	jsonMsg = append(jsonMsg, '\n')
@@ -180,4 +675,5 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Write failed: %v", err)
 	}
+	return err
 }
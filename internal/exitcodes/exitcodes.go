@@ -61,6 +61,25 @@ const (
 	// Profiler - error occoured when trying to write cpu or memory profile or
 	// execution trace
 	Profiler = 25
+	// KeyFile - the key file ("-keyfile") could not be read or does not
+	// contain the right key
+	KeyFile = 26
+	// CheckFailed - "-check" found a corrupt file name or content block
+	CheckFailed = 27
+	// KeyProvider - the key provider ("-keyprovider") is not compiled in,
+	// failed, or returned the wrong key
+	KeyProvider = 28
+	// HealthCheck - "-healthcheck" found the mount dead or unresponsive
+	HealthCheck = 29
+	// FindPath - the plaintext path passed to "-findpath" does not exist or
+	// could not be encrypted
+	FindPath = 30
+	// RunCommand - the command passed after "--" could not be run
+	RunCommand = 31
+	// Diff - "-diff" has found differences between the two filesystems
+	Diff = 32
+	// FilesFailed - with "-keep-going", some files could not be processed
+	FilesFailed = 33
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -0,0 +1,218 @@
+package fusefrontend
+
+// POSIX ACL aware permission checks ("-acl")
+//
+// With "-allow_other", the kernel checks the permissions for us
+// ("default_permissions"), but it only looks at the mode bits. go-fuse does
+// not negotiate FUSE_POSIX_ACL, so ACLs set on the backing files are
+// ignored, and users that have been granted access through an ACL are
+// locked out. With "-acl", the filesystem is mounted without
+// "default_permissions" and ACLFS checks the permissions itself. It
+// evaluates the "system.posix_acl_access" attribute of the backing files
+// like the kernel does, see acl(5).
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+const (
+	// aclXattr is the extended attribute that stores the access ACL
+	aclXattr = "system.posix_acl_access"
+	// The binary format is a 4-byte version header followed by 8-byte
+	// entries, all little-endian. See include/uapi/linux/posix_acl_xattr.h.
+	aclVersion   = 2
+	aclHeaderLen = 4
+	aclEntryLen  = 8
+	// Entry tags
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+	// Permission bits, as in the mode and in ACL entries
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// aclEntry is one entry of a POSIX ACL. "id" is only used by aclUser and
+// aclGroup entries.
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// parseACL parses an ACL in the binary format used by aclXattr.
+func parseACL(buf []byte) ([]aclEntry, error) {
+	if len(buf) < aclHeaderLen || (len(buf)-aclHeaderLen)%aclEntryLen != 0 ||
+		binary.LittleEndian.Uint32(buf) != aclVersion {
+		return nil, syscall.EINVAL
+	}
+	var acl []aclEntry
+	for b := buf[aclHeaderLen:]; len(b) > 0; b = b[aclEntryLen:] {
+		acl = append(acl, aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return acl, nil
+}
+
+// readACL returns the access ACL of the backing file "cPath" (absolute
+// path), or nil if it has none.
+func readACL(cPath string) ([]aclEntry, error) {
+	for {
+		sz, err := syscallcompat.Lgetxattr(cPath, aclXattr, nil)
+		if err == syscall.ENODATA || err == syscall.ENOTSUP {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		n, err := syscallcompat.Lgetxattr(cPath, aclXattr, buf)
+		if err == syscall.ERANGE {
+			// The ACL has grown in between, try again
+			continue
+		} else if err == syscall.ENODATA {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return parseACL(buf[:n])
+	}
+}
+
+// caller is the user a FUSE request comes from.
+type caller struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+// newCaller returns the caller of the request "context".
+func newCaller(context *fuse.Context) *caller {
+	return &caller{
+		uid:    context.Owner.Uid,
+		gid:    context.Owner.Gid,
+		groups: callerGroups(context.Pid),
+	}
+}
+
+// callerGroups returns the supplementary groups of the process "pid". FUSE
+// does not pass them, so we read them from /proc. If that fails, the
+// caller only gets access through its primary group.
+func callerGroups(pid uint32) []uint32 {
+	if pid == 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	var groups []uint32
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, f := range strings.Fields(line[len("Groups:"):]) {
+			g, err := strconv.ParseUint(f, 10, 32)
+			if err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+	return groups
+}
+
+// inGroup returns true if "gid" is the primary or a supplementary group of
+// the caller.
+func (c *caller) inGroup(gid uint32) bool {
+	if c.gid == gid {
+		return true
+	}
+	for _, g := range c.groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPerm returns nil if the caller has all "want" permissions (permRead,
+// permWrite, permExec) on a file with the attributes "st" and the access
+// ACL "acl" (nil if it has none), and EACCES otherwise.
+func checkPerm(c *caller, st *syscall.Stat_t, acl []aclEntry, want uint32) error {
+	if c.uid == 0 {
+		// Like CAP_DAC_OVERRIDE: executing a file needs at least one x bit
+		if want&permExec == 0 || st.Mode&syscall.S_IFMT == syscall.S_IFDIR || st.Mode&0111 != 0 {
+			return nil
+		}
+		return syscall.EACCES
+	}
+	var perm uint32
+	if c.uid == st.Uid {
+		// The aclUserObj entry is the same as the owner bits
+		perm = st.Mode >> 6 & 7
+	} else if acl != nil {
+		return checkACL(c, st, acl, want)
+	} else if c.inGroup(st.Gid) {
+		perm = st.Mode >> 3 & 7
+	} else {
+		perm = st.Mode & 7
+	}
+	if perm&want != want {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+// checkACL implements the access check algorithm from acl(5) for
+// everybody but the owner of the file.
+func checkACL(c *caller, st *syscall.Stat_t, acl []aclEntry, want uint32) error {
+	mask := uint32(7)
+	for _, e := range acl {
+		if e.tag == aclMask {
+			mask = uint32(e.perm)
+		}
+	}
+	for _, e := range acl {
+		if e.tag == aclUser && e.id == c.uid {
+			if uint32(e.perm)&mask&want != want {
+				return syscall.EACCES
+			}
+			return nil
+		}
+	}
+	// Access is granted if any matching group entry grants it
+	groupMatch := false
+	for _, e := range acl {
+		if !(e.tag == aclGroupObj && c.inGroup(st.Gid) || e.tag == aclGroup && c.inGroup(e.id)) {
+			continue
+		}
+		if uint32(e.perm)&mask&want == want {
+			return nil
+		}
+		groupMatch = true
+	}
+	if groupMatch {
+		return syscall.EACCES
+	}
+	for _, e := range acl {
+		if e.tag == aclOther && uint32(e.perm)&want == want {
+			return nil
+		}
+	}
+	return syscall.EACCES
+}
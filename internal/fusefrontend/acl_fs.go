@@ -0,0 +1,438 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// fmodeExec is set in the open flags when the kernel opens a file for
+// execve(2) (__FMODE_EXEC in include/linux/fs.h).
+const fmodeExec = 0x20
+
+// ACLFS wraps FS and checks the permissions of the caller before passing
+// requests on, taking POSIX ACLs into account. See acl.go.
+type ACLFS struct {
+	*FS
+}
+
+var _ pathfs.FileSystem = &ACLFS{} // Verify that interface is implemented.
+
+// NewACLFS returns "fs" wrapped in an ACLFS.
+func NewACLFS(fs *FS) *ACLFS {
+	return &ACLFS{fs}
+}
+
+// aclStat returns the attributes and the access ACL (nil if it has none)
+// of the backing file of "path".
+func (fs *ACLFS) aclStat(path string) (*syscall.Stat_t, []aclEntry, error) {
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var st syscall.Stat_t
+	if err = syscall.Lstat(cPath, &st); err != nil {
+		return nil, nil, err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		// Symlinks have no ACLs, and their permissions are never checked
+		return &st, nil, nil
+	}
+	acl, err := readACL(cPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &st, acl, nil
+}
+
+// checkSearch checks that the caller may search all directories on the
+// way to "path".
+func (fs *ACLFS) checkSearch(c *caller, path string) error {
+	if path == "" {
+		return nil
+	}
+	dir := nametransform.Dir(path)
+	if err := fs.checkSearch(c, dir); err != nil {
+		return err
+	}
+	st, acl, err := fs.aclStat(dir)
+	if err != nil {
+		return err
+	}
+	return checkPerm(c, st, acl, permExec)
+}
+
+// check checks that the caller may reach "path" and has the "want"
+// permissions on it. Returns the attributes of "path".
+func (fs *ACLFS) check(c *caller, path string, want uint32) (*syscall.Stat_t, error) {
+	if err := fs.checkSearch(c, path); err != nil {
+		return nil, err
+	}
+	st, acl, err := fs.aclStat(path)
+	if err != nil {
+		return nil, err
+	}
+	return st, checkPerm(c, st, acl, want)
+}
+
+// checkCreate checks that the caller may create "path".
+func (fs *ACLFS) checkCreate(c *caller, path string) error {
+	_, err := fs.check(c, nametransform.Dir(path), permWrite|permExec)
+	return err
+}
+
+// checkDelete checks that the caller may remove "path" from its directory.
+// In a sticky directory, only the owners of the directory and of the file
+// may do that.
+func (fs *ACLFS) checkDelete(c *caller, path string) error {
+	dirSt, err := fs.check(c, nametransform.Dir(path), permWrite|permExec)
+	if err != nil {
+		return err
+	}
+	st, _, err := fs.aclStat(path)
+	if err != nil {
+		return err
+	}
+	if dirSt.Mode&syscall.S_ISVTX != 0 && c.uid != 0 && c.uid != dirSt.Uid && c.uid != st.Uid {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// checkOwner returns EPERM if the caller is neither "uid" nor root.
+func checkOwner(c *caller, uid uint32) error {
+	if c.uid != 0 && c.uid != uid {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// checkChown checks that the caller may change the owner of a file owned by
+// "st" to "uid" and "gid" (^uint32(0) means unchanged). Only root may give
+// files away, the owner may only change the group to one of its own.
+func checkChown(c *caller, st *syscall.Stat_t, uid uint32, gid uint32) error {
+	if c.uid == 0 {
+		return nil
+	}
+	if c.uid != st.Uid || uid != ^uint32(0) && uid != st.Uid ||
+		gid != ^uint32(0) && gid != st.Gid && !c.inGroup(gid) {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// openWant returns the permissions that opening a file with "flags" needs.
+func openWant(flags uint32) uint32 {
+	var want uint32
+	switch int(flags) & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		want = permRead
+	case syscall.O_WRONLY:
+		want = permWrite
+	default:
+		want = permRead | permWrite
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		want |= permWrite
+	}
+	if flags&fmodeExec != 0 {
+		want |= permExec
+	}
+	return want
+}
+
+// GetAttr implements pathfs.Filesystem.
+func (fs *ACLFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if err := fs.checkSearch(newCaller(context), name); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return fs.FS.GetAttr(name, context)
+}
+
+// Access implements pathfs.Filesystem.
+func (fs *ACLFS) Access(path string, mode uint32, context *fuse.Context) fuse.Status {
+	if fs.isFiltered(path) {
+		return fuse.EPERM
+	}
+	_, err := fs.check(newCaller(context), path, mode&7)
+	return fuse.ToStatus(err)
+}
+
+// Open implements pathfs.Filesystem.
+func (fs *ACLFS) Open(path string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	c := newCaller(context)
+	if _, err := fs.check(c, path, openWant(flags)); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	f, code := fs.FS.Open(path, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &aclFile{File: f, c: c, flags: flags}, fuse.OK
+}
+
+// Create implements pathfs.Filesystem.
+func (fs *ACLFS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	c := newCaller(context)
+	if err := fs.checkCreate(c, path); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	f, code := fs.FS.Create(path, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &aclFile{File: f, c: c, flags: flags}, fuse.OK
+}
+
+// OpenDir implements pathfs.Filesystem.
+func (fs *ACLFS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if _, err := fs.check(newCaller(context), dirName, permRead); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return fs.FS.OpenDir(dirName, context)
+}
+
+// Readlink implements pathfs.Filesystem.
+func (fs *ACLFS) Readlink(path string, context *fuse.Context) (string, fuse.Status) {
+	if err := fs.checkSearch(newCaller(context), path); err != nil {
+		return "", fuse.ToStatus(err)
+	}
+	return fs.FS.Readlink(path, context)
+}
+
+// GetXAttr implements pathfs.Filesystem. Reading an extended attribute
+// needs read permission, like on a local filesystem.
+func (fs *ACLFS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if _, err := fs.check(newCaller(context), name, permRead); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return fs.FS.GetXAttr(name, attr, context)
+}
+
+// ListXAttr implements pathfs.Filesystem.
+func (fs *ACLFS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if _, err := fs.check(newCaller(context), name, permRead); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return fs.FS.ListXAttr(name, context)
+}
+
+// SetXAttr implements pathfs.Filesystem. Changing an extended attribute
+// needs write permission.
+func (fs *ACLFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if _, err := fs.check(newCaller(context), name, permWrite); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.SetXAttr(name, attr, data, flags, context)
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (fs *ACLFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if _, err := fs.check(newCaller(context), name, permWrite); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.RemoveXAttr(name, attr, context)
+}
+
+// Chmod implements pathfs.Filesystem.
+func (fs *ACLFS) Chmod(path string, mode uint32, context *fuse.Context) fuse.Status {
+	c := newCaller(context)
+	st, err := fs.check(c, path, 0)
+	if err == nil {
+		err = checkOwner(c, st.Uid)
+	}
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if c.uid != 0 && !c.inGroup(st.Gid) {
+		// Like the kernel, drop setgid if the caller is not in the group
+		mode &^= syscall.S_ISGID
+	}
+	return fs.FS.Chmod(path, mode, context)
+}
+
+// Chown implements pathfs.Filesystem.
+func (fs *ACLFS) Chown(path string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	c := newCaller(context)
+	st, err := fs.check(c, path, 0)
+	if err == nil {
+		err = checkChown(c, st, uid, gid)
+	}
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Chown(path, uid, gid, context)
+}
+
+// Truncate implements pathfs.Filesystem.
+func (fs *ACLFS) Truncate(path string, offset uint64, context *fuse.Context) fuse.Status {
+	if _, err := fs.check(newCaller(context), path, permWrite); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Truncate(path, offset, context)
+}
+
+// Utimens implements pathfs.Filesystem. Setting the times needs write
+// permission or ownership. We cannot tell a "touch" that sets them to the
+// current time from one that sets explicit times, so write permission is
+// always enough.
+func (fs *ACLFS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Context) fuse.Status {
+	c := newCaller(context)
+	st, err := fs.check(c, path, 0)
+	if err == nil && checkOwner(c, st.Uid) != nil {
+		_, err = fs.check(c, path, permWrite)
+	}
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Utimens(path, a, m, context)
+}
+
+// Mkdir implements pathfs.Filesystem.
+func (fs *ACLFS) Mkdir(newPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if err := fs.checkCreate(newCaller(context), newPath); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Mkdir(newPath, mode, context)
+}
+
+// Mknod implements pathfs.Filesystem.
+func (fs *ACLFS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if err := fs.checkCreate(newCaller(context), path); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Mknod(path, mode, dev, context)
+}
+
+// Symlink implements pathfs.Filesystem.
+func (fs *ACLFS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	if err := fs.checkCreate(newCaller(context), linkName); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Symlink(target, linkName, context)
+}
+
+// Link implements pathfs.Filesystem.
+func (fs *ACLFS) Link(oldPath string, newPath string, context *fuse.Context) fuse.Status {
+	c := newCaller(context)
+	err := fs.checkSearch(c, oldPath)
+	if err == nil {
+		err = fs.checkCreate(c, newPath)
+	}
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Link(oldPath, newPath, context)
+}
+
+// Unlink implements pathfs.Filesystem.
+func (fs *ACLFS) Unlink(path string, context *fuse.Context) fuse.Status {
+	if err := fs.checkDelete(newCaller(context), path); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Unlink(path, context)
+}
+
+// Rmdir implements pathfs.Filesystem.
+func (fs *ACLFS) Rmdir(path string, context *fuse.Context) fuse.Status {
+	if err := fs.checkDelete(newCaller(context), path); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Rmdir(path, context)
+}
+
+// Rename implements pathfs.Filesystem. A directory that moves to another
+// parent must also be writeable, as its ".." entry changes.
+func (fs *ACLFS) Rename(oldPath string, newPath string, context *fuse.Context) fuse.Status {
+	c := newCaller(context)
+	err := fs.checkDelete(c, oldPath)
+	if err == nil {
+		err = fs.checkCreate(c, newPath)
+	}
+	if err == nil {
+		if _, _, err2 := fs.aclStat(newPath); err2 == nil {
+			// Replacing an existing entry is like deleting it
+			err = fs.checkDelete(c, newPath)
+		}
+	}
+	if err == nil && nametransform.Dir(oldPath) != nametransform.Dir(newPath) {
+		var st *syscall.Stat_t
+		if st, _, err = fs.aclStat(oldPath); err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			_, err = fs.check(c, oldPath, permWrite)
+		}
+	}
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fs.FS.Rename(oldPath, newPath, context)
+}
+
+// aclFile wraps the files opened through ACLFS. Changing the attributes
+// through a file handle must be checked as well, as the kernel leaves that
+// to us. The handle does not tell who is calling, so we check the user that
+// has opened the file.
+type aclFile struct {
+	nodefs.File
+	c *caller
+	// The flags the file has been opened with
+	flags uint32
+}
+
+// writable returns true if the file has been opened for writing.
+func (f *aclFile) writable() bool {
+	return int(f.flags)&syscall.O_ACCMODE != syscall.O_RDONLY
+}
+
+// owner returns the owner of the file.
+func (f *aclFile) owner() (*syscall.Stat_t, fuse.Status) {
+	var a fuse.Attr
+	if code := f.File.GetAttr(&a); !code.Ok() {
+		return nil, code
+	}
+	return &syscall.Stat_t{Uid: a.Owner.Uid, Gid: a.Owner.Gid}, fuse.OK
+}
+
+// Chmod implements nodefs.File.
+func (f *aclFile) Chmod(mode uint32) fuse.Status {
+	st, code := f.owner()
+	if !code.Ok() {
+		return code
+	}
+	if err := checkOwner(f.c, st.Uid); err != nil {
+		return fuse.ToStatus(err)
+	}
+	if f.c.uid != 0 && !f.c.inGroup(st.Gid) {
+		mode &^= syscall.S_ISGID
+	}
+	return f.File.Chmod(mode)
+}
+
+// Chown implements nodefs.File.
+func (f *aclFile) Chown(uid uint32, gid uint32) fuse.Status {
+	st, code := f.owner()
+	if !code.Ok() {
+		return code
+	}
+	if err := checkChown(f.c, st, uid, gid); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return f.File.Chown(uid, gid)
+}
+
+// Utimens implements nodefs.File. A handle that has been opened for
+// writing is enough to set the times, like above.
+func (f *aclFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	st, code := f.owner()
+	if !code.Ok() {
+		return code
+	}
+	if checkOwner(f.c, st.Uid) != nil && !f.writable() {
+		return fuse.EPERM
+	}
+	return f.File.Utimens(a, m)
+}
@@ -0,0 +1,193 @@
+package fusefrontend
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// packACL returns "acl" in the binary format used by aclXattr.
+func packACL(acl []aclEntry) []byte {
+	buf := make([]byte, aclHeaderLen+len(acl)*aclEntryLen)
+	binary.LittleEndian.PutUint32(buf, aclVersion)
+	for i, e := range acl {
+		b := buf[aclHeaderLen+i*aclEntryLen:]
+		binary.LittleEndian.PutUint16(b, e.tag)
+		binary.LittleEndian.PutUint16(b[2:], e.perm)
+		binary.LittleEndian.PutUint32(b[4:], e.id)
+	}
+	return buf
+}
+
+// TestCheckPerm checks the ACL evaluation against the rules in acl(5).
+func TestCheckPerm(t *testing.T) {
+	const none = ^uint32(0)
+	st := &syscall.Stat_t{Mode: syscall.S_IFREG | 0640, Uid: 1, Gid: 10}
+	acl := []aclEntry{
+		{aclUserObj, 6, none},
+		{aclUser, 4, 100},
+		{aclUser, 6, 101},
+		{aclGroupObj, 4, none},
+		{aclGroup, 0, 20},
+		{aclGroup, 6, 30},
+		{aclMask, 4, none},
+		{aclOther, 0, none},
+	}
+	testCases := []struct {
+		c    caller
+		want uint32
+		ok   bool
+	}{
+		{caller{uid: 1}, permRead | permWrite, true},
+		{caller{uid: 100}, permRead, true},
+		{caller{uid: 100}, permWrite, false},
+		// Limited by the mask
+		{caller{uid: 101}, permWrite, false},
+		{caller{uid: 5, gid: 10}, permRead, true},
+		{caller{uid: 5, gid: 20}, permRead, false},
+		// Any matching group entry is enough
+		{caller{uid: 5, gid: 20, groups: []uint32{30}}, permRead, true},
+		{caller{uid: 5, gid: 99}, permRead, false},
+		{caller{uid: 0}, permRead | permWrite, true},
+		{caller{uid: 0}, permExec, false},
+	}
+	for i, tc := range testCases {
+		err := checkPerm(&tc.c, st, acl, tc.want)
+		if (err == nil) != tc.ok {
+			t.Errorf("case %d: uid=%d want=%d: %v", i, tc.c.uid, tc.want, err)
+		}
+	}
+}
+
+// TestACLFS sets an ACL on a backing file and checks that a user that is
+// only granted access through the ACL gets it, and that other users do not.
+func TestACLFS(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	// Let everybody into the cipherdir
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	afs := NewACLFS(fs)
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	const none = ^uint32(0)
+	acl := packACL([]aclEntry{
+		{aclUserObj, 6, none},
+		{aclUser, 4, 12345},
+		{aclGroupObj, 0, none},
+		{aclMask, 4, none},
+		{aclOther, 0, none},
+	})
+	cPath, err := fs.getBackingPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Setxattr(cPath, aclXattr, acl, 0); err != nil {
+		t.Skipf("cannot set ACL: %v", err)
+	}
+	granted := &fuse.Context{Owner: fuse.Owner{Uid: 12345, Gid: 12345}}
+	other := &fuse.Context{Owner: fuse.Owner{Uid: 23456, Gid: 23456}}
+
+	if code = afs.Access("foo", permRead, granted); !code.Ok() {
+		t.Errorf("granted user: Access(R_OK): %v", code)
+	}
+	f, code = afs.Open("foo", uint32(os.O_RDONLY), granted)
+	if !code.Ok() {
+		t.Errorf("granted user: Open(O_RDONLY): %v", code)
+	} else {
+		f.Release()
+	}
+	if code = afs.Access("foo", permWrite, granted); code != fuse.EACCES {
+		t.Errorf("granted user: Access(W_OK): want EACCES, got %v", code)
+	}
+	if code = afs.Chmod("foo", 0644, granted); code != fuse.EPERM {
+		t.Errorf("granted user: Chmod: want EPERM, got %v", code)
+	}
+	if code = afs.Access("foo", permRead, other); code != fuse.EACCES {
+		t.Errorf("other user: Access(R_OK): want EACCES, got %v", code)
+	}
+	if _, code = afs.Open("foo", uint32(os.O_RDONLY), other); code != fuse.EACCES {
+		t.Errorf("other user: Open(O_RDONLY): want EACCES, got %v", code)
+	}
+	if _, code = afs.Create("bar", uint32(os.O_WRONLY), 0600, other); code != fuse.EACCES {
+		t.Errorf("other user: Create: want EACCES, got %v", code)
+	}
+	// Extended attributes need the same permissions as the content
+	if _, code = afs.GetXAttr("foo", "user.foo", granted); code == fuse.EACCES {
+		t.Errorf("granted user: GetXAttr: got EACCES")
+	}
+	if code = afs.SetXAttr("foo", "user.foo", []byte("x"), 0, granted); code != fuse.EACCES {
+		t.Errorf("granted user: SetXAttr: want EACCES, got %v", code)
+	}
+	if code = afs.RemoveXAttr("foo", "user.foo", granted); code != fuse.EACCES {
+		t.Errorf("granted user: RemoveXAttr: want EACCES, got %v", code)
+	}
+	if _, code = afs.GetXAttr("foo", "user.foo", other); code != fuse.EACCES {
+		t.Errorf("other user: GetXAttr: want EACCES, got %v", code)
+	}
+	if _, code = afs.ListXAttr("foo", other); code != fuse.EACCES {
+		t.Errorf("other user: ListXAttr: want EACCES, got %v", code)
+	}
+}
+
+// TestCheckAccess checks the dry-run permission check of the ctlsock
+// "Access" request for different users.
+func TestCheckAccess(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("private", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, path := range []string{"file", "private/file"} {
+		f, code := fs.Create(path, uint32(os.O_WRONLY), 0640, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+		if code = fs.Chmod(path, 0640, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	uid := uint32(os.Getuid())
+	gid := uint32(os.Getgid())
+	const stranger = 23456
+	testCases := []struct {
+		path    string
+		uid     uint32
+		gid     uint32
+		groups  []uint32
+		mode    uint32
+		granted bool
+	}{
+		{"file", uid, gid, nil, permRead | permWrite, true},
+		{"file", uid, gid, nil, permExec, false},
+		{"file", stranger, gid, nil, permRead, true},
+		{"file", stranger, gid, nil, permWrite, false},
+		{"file", stranger, stranger, nil, permRead, false},
+		{"file", stranger, stranger, []uint32{gid}, permRead, true},
+		{"file", stranger, stranger, nil, 0, true},
+		{"file", 0, 0, nil, permRead | permWrite, true},
+		{"private/file", uid, gid, nil, permRead, true},
+		{"private/file", stranger, gid, nil, permRead, false},
+	}
+	for i, tc := range testCases {
+		err := fs.CheckAccess(tc.path, tc.uid, tc.gid, tc.groups, tc.mode)
+		if tc.granted && err != nil || !tc.granted && err != syscall.EACCES {
+			t.Errorf("case %d: %q uid=%d mode=%d: %v", i, tc.path, tc.uid, tc.mode, err)
+		}
+	}
+	if err := fs.CheckAccess("missing", uid, gid, nil, permRead); err != syscall.ENOENT {
+		t.Errorf("missing path: want ENOENT, got %v", err)
+	}
+}
@@ -1,8 +1,12 @@
 package fusefrontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 )
 
 // Args is a container for arguments that are passed from main() to fusefrontend
@@ -39,4 +43,116 @@ type Args struct {
 	SerializeReads bool
 	// Force decode even if integrity check fails (openSSL only)
 	ForceDecode bool
+	// Compress blocks before encryption.
+	// Corresponds to the Compression feature flag.
+	Compress bool
+	// Move deleted files and directories to the trash directory instead of
+	// deleting them, "-trash"
+	Trash bool
+	// Fsync the backing directories after every operation that changes them,
+	// "-dirsync"
+	DirSync bool
+	// Fall back to a case-insensitive match when a name does not exist,
+	// "-caseinsensitive"
+	CaseInsensitive bool
+	// Normalize file names to Unicode NFC before encrypting them.
+	// Corresponds to the NFCNames feature flag.
+	NFCNames bool
+	// Encrypt and authenticate the gocryptfs.diriv files.
+	// Corresponds to the EncryptedDirIV feature flag.
+	EncryptedDirIV bool
+	// Pad names to a multiple of this many bytes before encrypting them, 0
+	// if disabled. Corresponds to the NamePadding feature flag.
+	NamePadding int
+	// GCM IV length of the file content in bits, zero means
+	// contentenc.DefaultIVBits. Corresponds to the GCMParams feature flag.
+	IVBits int
+	// Longest ciphertext name the backing filesystem can store,
+	// "-max-name-length". Longer names are stored as long names, or
+	// rejected with ENAMETOOLONG without them. Zero means 255.
+	NameMax int
+	// Store symlinks as regular files that hold the encrypted target.
+	// Corresponds to the SymlinkFiles feature flag.
+	SymlinkFiles bool
+	// When reads update the access time, "-atime", "-relatime", "-noatime".
+	// The zero value leaves it to the kernel.
+	Atime AtimeMode
+	// What directory listings do with entries whose names cannot be
+	// decrypted, "-invalid-names"
+	InvalidNames InvalidNamesPolicy
+	// Do not trust cached DirIVs because other clients may modify the
+	// CIPHERDIR, "-network-backend"
+	NetworkBackend bool
+	// Check cached DirIVs against the gocryptfs.diriv files on disk before
+	// every use, "-paranoid-diriv"
+	ParanoidDirIV bool
+	// Per-directory limits in plaintext bytes, "-quota". Maps relative
+	// plaintext directory paths ("" is the root) to the limit.
+	Quotas map[string]uint64
+	// Plaintext paths whose caches are warmed after mounting, "-preload".
+	// See FS.StartPreload.
+	Preload []string
+	// Patterns of plaintext paths that bypass the kernel page cache,
+	// "-direct-io". See FS.directIO.
+	DirectIO []string
+	// Mirror all changes of Cipherdir to this directory (absolute path),
+	// "-replica". Empty disables replication. See FS.StartReplicator.
+	Replica string
+	// Check the whole tree in the background this often, "-scrub-interval".
+	// Zero disables the scrubber.
+	ScrubInterval time.Duration
+	// Maximum read rate of the scrubber in bytes per second, "-scrub-bwlimit"
+	ScrubBandwidth uint64
+	// Record the durable size of each file on fsync, "-write-intent"
+	WriteIntent bool
+	// Store the SHA-256 of the content in an xattr, "-checksum". See
+	// checksum.go.
+	Checksum bool
+	// Rules for the names of newly created files, directories and links,
+	// "-name-policy". nil allows all names.
+	NamePolicy *NamePolicy
+	// Enable "user." xattrs. Names with one of these prefixes are stored
+	// unencrypted, all others encrypted, "-xattr-passthrough". See xattr.go.
+	XattrPassthrough []string
+	// Permission bits that are cleared ("-create-umask") and set
+	// ("-force-mode") on newly created files, directories and device nodes
+	CreateUmask, ForceMode uint32
+	// Maximum plaintext size of a file in bytes, "-max-file-size". 0 means
+	// no limit.
+	MaxFileSize uint64
+	// Memory budget of all caches in bytes, "-cache-size". 0 means no limit.
+	CacheSize uint64
+	// Report this time as atime, mtime and ctime of everything,
+	// "-force-time". nil reports the real timestamps.
+	ForceTime *time.Time
+	// Retry reads and writes of file content after transient errors of the
+	// backing filesystem, "-retry" and "-retry-delay"
+	Retry syscallcompat.RetryPolicy
+	// Copy files that are shared with a snapshot before changing them,
+	// "-cow-snapshots". See snapshot.go.
+	Snapshots bool
+	// Reverse mode only: name of the only file in Cipherdir that is
+	// visible, when CIPHERDIR is a file instead of a directory
+	SingleFile string
+}
+
+// SetFeatureFlags sets the fields that describe the on-disk format from the
+// feature flags in "cf". They override whatever was set before, because
+// a filesystem must be read the way it was written.
+func (args *Args) SetFeatureFlags(cf *configfile.ConfFile) {
+	args.PlaintextNames = cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+	args.Raw64 = cf.IsFeatureFlagSet(configfile.FlagRaw64)
+	args.HKDF = cf.IsFeatureFlagSet(configfile.FlagHKDF)
+	args.Compress = cf.IsFeatureFlagSet(configfile.FlagCompression)
+	args.NFCNames = cf.IsFeatureFlagSet(configfile.FlagNFCNames)
+	args.EncryptedDirIV = cf.IsFeatureFlagSet(configfile.FlagEncryptedDirIV)
+	args.SymlinkFiles = cf.IsFeatureFlagSet(configfile.FlagSymlinkFiles)
+	args.NamePadding = 0
+	if cf.IsFeatureFlagSet(configfile.FlagNamePadding) {
+		args.NamePadding = cf.NamePadding
+	}
+	args.IVBits = cf.ContentIVBits()
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		args.CryptoBackend = cryptocore.BackendAESSIV
+	}
 }
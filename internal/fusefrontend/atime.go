@@ -0,0 +1,116 @@
+package fusefrontend
+
+// Access time handling. By default, the kernel updates the atime of the
+// backing files according to the mount options of the backing filesystem.
+// With "-atime", "-relatime" or "-noatime", the backing files are opened with
+// O_NOATIME where possible, so reading them does not touch their atime.
+// Instead, Read() updates the atime according to the policy.
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// AtimeMode selects when reads update the access time
+type AtimeMode int
+
+const (
+	// AtimeKernel leaves the atime to the kernel and the mount options of
+	// the backing filesystem. This is the default.
+	AtimeKernel AtimeMode = iota
+	// AtimeRelative updates the atime if it is older than mtime, or more
+	// than a day old, like the "relatime" mount option, "-relatime"
+	AtimeRelative
+	// AtimeStrict updates the atime on every read, "-atime"
+	AtimeStrict
+	// AtimeNone never updates the atime, "-noatime"
+	AtimeNone
+)
+
+// relatimeMaxAge is how old the atime may get before relatime updates it
+// even if it is newer than mtime and ctime.
+const relatimeMaxAge = 24 * time.Hour
+
+// openBackingFile opens "cRelPath" below the cipherdir like os.OpenFile,
+// adding O_NOATIME unless the kernel handles the atime. O_NOATIME is only
+// allowed for the owner of the file, otherwise we fall back to a normal open
+// and the kernel handles the atime.
+func (fs *FS) openBackingFile(cRelPath string, flags int) (*os.File, error) {
+	if syscallcompat.O_NOATIME != 0 && fs.args.Atime != AtimeKernel {
+		f, err := fs.openBackingFileAt(cRelPath, flags|syscallcompat.O_NOATIME)
+		if err == nil || err.(*os.PathError).Err != syscall.EPERM {
+			return f, err
+		}
+	}
+	return fs.openBackingFileAt(cRelPath, flags)
+}
+
+// openBackingFileAt is os.OpenFile on "cRelPath" below the cipherdir. If
+// the absolute path is longer than PATH_MAX, it opens the file relative to
+// its backing directory instead. Symlinks are not followed.
+func (fs *FS) openBackingFileAt(cRelPath string, flags int) (*os.File, error) {
+	cPath := filepath.Join(fs.args.Cipherdir, cRelPath)
+	flags |= syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Open(cPath, flags, 0)
+	if err == syscall.ENAMETOOLONG {
+		var dirfd *os.File
+		dirfd, err = fs.openBackingDir(nametransform.Dir(cRelPath))
+		if err != nil {
+			return nil, err
+		}
+		fd, err = syscallcompat.Openat(int(dirfd.Fd()), filepath.Base(cRelPath), flags, 0)
+		dirfd.Close()
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: cPath, Err: err}
+	}
+	return os.NewFile(uintptr(fd), cPath), nil
+}
+
+// relatimeNeedsUpdate implements the relatime rule. Unlike the kernel, we
+// do not look at the ctime: setting the atime of the backing file also
+// bumps its ctime, so the rule would fire on every read.
+func relatimeNeedsUpdate(a *fuse.Attr, now time.Time) bool {
+	atime := time.Unix(int64(a.Atime), int64(a.Atimensec))
+	mtime := time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+	if !atime.After(mtime) {
+		return true
+	}
+	return now.Sub(atime) >= relatimeMaxAge
+}
+
+// updateAtime sets the atime of the backing file to the current time if
+// the atime policy says so. Called after a successful read. The caller must
+// hold fdLock.
+func (f *file) updateAtime() {
+	mode := f.fs.args.Atime
+	if mode == AtimeKernel || mode == AtimeNone {
+		return
+	}
+	now := time.Now()
+	if mode == AtimeRelative {
+		var st syscall.Stat_t
+		err := syscall.Fstat(f.intFd(), &st)
+		if err != nil {
+			return
+		}
+		var a fuse.Attr
+		a.FromStat(&st)
+		if !relatimeNeedsUpdate(&a, now) {
+			return
+		}
+	}
+	// A nil mtime is passed as UTIME_OMIT and stays unchanged
+	status := f.loopbackFile.Utimens(&now, nil)
+	if !status.Ok() {
+		tlog.Debug.Printf("ino%d: updateAtime: %v", f.qIno.Ino, status)
+	}
+}
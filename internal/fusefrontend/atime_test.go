@@ -0,0 +1,94 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// readAndGetAtime sets the backing atime and mtime of "foo", reads it
+// through the FS and returns the new backing atime.
+func readAndGetAtime(t *testing.T, fs *FS, atime time.Time, mtime time.Time) time.Time {
+	cPath, err := fs.getBackingPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(cPath, atime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, code := fs.Open("foo", uint32(os.O_RDONLY), &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	buf := make([]byte, 100)
+	if _, code = f.Read(buf, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	var st syscall.Stat_t
+	err = syscall.Stat(cPath, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	return time.Unix(int64(a.Atime), int64(a.Atimensec))
+}
+
+// newAtimeTestFS creates an FS with a non-empty file "foo".
+func newAtimeTestFS(t *testing.T, mode AtimeMode) (*FS, string) {
+	fs, dir := newTestFS(t, Args{Atime: mode})
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("hello"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	return fs, dir
+}
+
+func TestNoatime(t *testing.T) {
+	fs, dir := newAtimeTestFS(t, AtimeNone)
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	// atime older than mtime and older than a day: relatime would update
+	if a := readAndGetAtime(t, fs, old, old.Add(time.Hour)); !a.Equal(old) {
+		t.Errorf("noatime: atime changed from %v to %v", old, a)
+	}
+}
+
+func TestRelatime(t *testing.T) {
+	fs, dir := newAtimeTestFS(t, AtimeRelative)
+	defer os.RemoveAll(dir)
+	now := time.Now().Truncate(time.Second)
+	// Recent atime newer than mtime: no update
+	atime := now.Add(-time.Hour)
+	if a := readAndGetAtime(t, fs, atime, now.Add(-2*time.Hour)); !a.Equal(atime) {
+		t.Errorf("recent atime > mtime: atime changed from %v to %v", atime, a)
+	}
+	// atime older than mtime: update
+	if a := readAndGetAtime(t, fs, atime, now.Add(-time.Minute)); a.Before(now) {
+		t.Errorf("atime < mtime: atime was not updated: %v", a)
+	}
+	// atime older than a day: update
+	atime = now.Add(-25 * time.Hour)
+	if a := readAndGetAtime(t, fs, atime, now.Add(-48*time.Hour)); a.Before(now) {
+		t.Errorf("day-old atime: atime was not updated: %v", a)
+	}
+}
+
+func TestStrictAtime(t *testing.T) {
+	fs, dir := newAtimeTestFS(t, AtimeStrict)
+	defer os.RemoveAll(dir)
+	now := time.Now().Truncate(time.Second)
+	// Recent atime newer than mtime: relatime would not update
+	if a := readAndGetAtime(t, fs, now.Add(-time.Hour), now.Add(-2*time.Hour)); a.Before(now) {
+		t.Errorf("atime was not updated: %v", a)
+	}
+}
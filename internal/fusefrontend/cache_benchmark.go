@@ -0,0 +1,118 @@
+package fusefrontend
+
+// Measure the DirIV cache on a real tree, "-benchmark-cache"
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform/dirivcache"
+)
+
+// zipfSkew is the skew of the synthetic access pattern. A few paths get most
+// of the accesses, like the hot set of a real workload.
+const zipfSkew = 1.2
+
+// CacheBenchmark is the result of BenchmarkDirIVCache for one capacity
+type CacheBenchmark struct {
+	// Capacity of each cache shard
+	MaxEntries int
+	// Number of paths resolved
+	Lookups int
+	// Cache counters after the run. Entries is the number of directories
+	// that were left in the cache.
+	dirivcache.Stats
+	// Percentiles of the time it took to resolve one path
+	P50, P90, P99, Max time.Duration
+}
+
+// HitRatio returns the fraction of cache lookups that found the parent
+// directory of the path, so no DirIV had to be read from disk.
+func (b CacheBenchmark) HitRatio() float64 {
+	n := b.Hits + b.Misses
+	if n == 0 {
+		return 0
+	}
+	return float64(b.Hits) / float64(n)
+}
+
+// BenchmarkDirIVCache resolves the plaintext paths in "pattern" to their
+// ciphertext paths, in order, with a DirIV cache of "maxEntries" entries
+// per shard that starts out empty. Returns the cache counters and the
+// latency percentiles. The parent directories of the paths have to exist.
+// The cache keeps the capacity afterwards, so this is meant for an FS that
+// is not mounted.
+func (fs *FS) BenchmarkDirIVCache(pattern []string, maxEntries int) (CacheBenchmark, error) {
+	if fs.args.PlaintextNames {
+		return CacheBenchmark{}, errors.New("plaintextnames: there are no DirIVs to cache")
+	}
+	c := &fs.nameTransform.DirIVCache
+	c.SetMaxEntries(maxEntries)
+	c.Clear()
+	fs.direntCache.clear()
+	c.ResetStats()
+	lat := make(durations, 0, len(pattern))
+	for _, path := range pattern {
+		t0 := time.Now()
+		if _, err := fs.encryptPath(path); err != nil {
+			return CacheBenchmark{}, &os.PathError{Op: "resolve", Path: path, Err: err}
+		}
+		lat = append(lat, time.Since(t0))
+	}
+	b := CacheBenchmark{
+		MaxEntries: maxEntries,
+		Lookups:    len(pattern),
+		Stats:      c.Stats(),
+	}
+	if len(lat) > 0 {
+		sort.Sort(lat)
+		b.P50 = lat.percentile(50)
+		b.P90 = lat.percentile(90)
+		b.P99 = lat.percentile(99)
+		b.Max = lat[len(lat)-1]
+	}
+	return b, nil
+}
+
+// SyntheticAccessPattern returns "n" plaintext paths of the tree, for
+// BenchmarkDirIVCache. The paths are drawn from a Zipf distribution over
+// all files and directories in a random order, so a few paths are accessed
+// often and most rarely. The same "seed" gives the same pattern.
+func (fs *FS) SyntheticAccessPattern(n int, seed int64) ([]string, error) {
+	var paths []string
+	err := fs.WalkPlain("", listPathsWorkers, nil, func(path string) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("the tree is empty")
+	}
+	// WalkPlain returns the paths in no particular order
+	sort.Strings(paths)
+	r := rand.New(rand.NewSource(seed))
+	perm := r.Perm(len(paths))
+	zipf := rand.NewZipf(r, zipfSkew, 1, uint64(len(paths)-1))
+	pattern := make([]string, n)
+	for i := range pattern {
+		pattern[i] = paths[perm[zipf.Uint64()]]
+	}
+	return pattern, nil
+}
+
+// durations sorts latencies
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+
+// percentile returns the "p"th percentile of the sorted latencies
+func (d durations) percentile(p int) time.Duration {
+	return d[(len(d)-1)*p/100]
+}
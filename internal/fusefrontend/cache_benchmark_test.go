@@ -0,0 +1,75 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestBenchmarkDirIVCache runs the benchmark on a synthetic tree with a
+// tiny and a big cache and checks that the counters add up, that the big
+// cache does better, and that the latency percentiles are ordered.
+func TestBenchmarkDirIVCache(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 5; j++ {
+			sub := fmt.Sprintf("d%d/s%d", i, j)
+			if j == 0 {
+				if code := fs.Mkdir(fmt.Sprintf("d%d", i), 0700, ctx); !code.Ok() {
+					t.Fatal(code)
+				}
+			}
+			if code := fs.Mkdir(sub, 0700, ctx); !code.Ok() {
+				t.Fatal(code)
+			}
+			f, code := fs.Create(sub+"/file", uint32(os.O_WRONLY), 0600, ctx)
+			if !code.Ok() {
+				t.Fatal(code)
+			}
+			f.Release()
+		}
+	}
+	const n = 2000
+	pattern, err := fs.SyntheticAccessPattern(n, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pattern) != n {
+		t.Fatalf("pattern has %d paths, want %d", len(pattern), n)
+	}
+	again, _ := fs.SyntheticAccessPattern(n, 1)
+	if !reflect.DeepEqual(pattern, again) {
+		t.Error("the same seed gave a different pattern")
+	}
+	small, err := fs.BenchmarkDirIVCache(pattern, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, err := fs.BenchmarkDirIVCache(pattern, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []CacheBenchmark{small, big} {
+		if b.Lookups != n || b.Hits+b.Misses != n {
+			t.Errorf("maxEntries=%d: lookups=%d hits=%d misses=%d", b.MaxEntries, b.Lookups, b.Hits, b.Misses)
+		}
+		if b.P50 > b.P90 || b.P90 > b.P99 || b.P99 > b.Max || b.Max == 0 {
+			t.Errorf("maxEntries=%d: bad percentiles %v %v %v %v", b.MaxEntries, b.P50, b.P90, b.P99, b.Max)
+		}
+	}
+	if big.Evictions != 0 || big.Entries == 0 {
+		t.Errorf("big cache: evictions=%d entries=%d", big.Evictions, big.Entries)
+	}
+	if small.Evictions == 0 {
+		t.Error("small cache: no evictions")
+	}
+	// The tree has 60 directories, the big cache misses each about once
+	if big.HitRatio() < 0.9 || big.HitRatio() <= small.HitRatio() {
+		t.Errorf("hit ratios: small=%.3f big=%.3f", small.HitRatio(), big.HitRatio())
+	}
+}
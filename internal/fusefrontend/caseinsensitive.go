@@ -0,0 +1,158 @@
+package fusefrontend
+
+// Optional case-insensitive name lookup ("-caseinsensitive")
+//
+// When a plaintext path does not exist, every component that does not exist
+// is replaced by the directory entry that matches it case-insensitively.
+// As names are encrypted, finding that entry means decrypting the whole
+// directory. The decrypted names are cached per directory and the cache
+// entry is invalidated when the mtime of the ciphertext directory changes.
+// Names that do not match anything are passed through unchanged, so newly
+// created files keep their original case.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cachebudget"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// ciCacheMaxDirs is the maximum number of directories in the cache. When
+// it is reached, the cache is cleared.
+const ciCacheMaxDirs = 1000
+
+// ciDir holds the case-folded names of one directory
+type ciDir struct {
+	// mtime of the ciphertext directory when the names were read
+	mtime time.Time
+	// names maps the case-folded name to the real name
+	names map[string]string
+}
+
+// ciCache caches ciDir entries by plaintext directory path
+type ciCache struct {
+	sync.Mutex
+	dirs map[string]*ciDir
+	// Memory budget share ("-cache-size") and what we have charged to it
+	account *cachebudget.Account
+	bytes   uint64
+}
+
+// size returns what "d" costs in the memory budget
+func (d *ciDir) size(dir string) uint64 {
+	n := uint64(len(dir)) + cachebudget.EntryOverhead
+	for k, v := range d.names {
+		n += uint64(len(k)+len(v)) + cachebudget.EntryOverhead
+	}
+	return n
+}
+
+// clear empties the cache.
+func (c *ciCache) clear() {
+	c.Lock()
+	c.dirs = nil
+	c.account.Release(c.bytes)
+	c.bytes = 0
+	c.Unlock()
+}
+
+// foldCase returns the case-folded form of "name" that is used for
+// comparisons.
+func foldCase(name string) string {
+	return strings.ToLower(name)
+}
+
+// plainPathExists returns true if the plaintext path "plainPath" exists
+// exactly as given.
+func (fs *FS) plainPathExists(plainPath string) bool {
+	cPath, err := fs.encryptPathExact(plainPath)
+	if err != nil {
+		return false
+	}
+	_, err = os.Lstat(filepath.Join(fs.args.Cipherdir, cPath))
+	return err == nil
+}
+
+// lookupFolded returns the name of the entry in the plaintext directory "dir"
+// that matches "name" case-insensitively.
+func (fs *FS) lookupFolded(dir string, name string) (string, bool) {
+	cDir, err := fs.encryptPathExact(dir)
+	if err != nil {
+		return "", false
+	}
+	fi, err := os.Stat(filepath.Join(fs.args.Cipherdir, cDir))
+	if err != nil {
+		return "", false
+	}
+	fs.ciCache.Lock()
+	d := fs.ciCache.dirs[dir]
+	fs.ciCache.Unlock()
+	if d == nil || !d.mtime.Equal(fi.ModTime()) {
+		entries, status := fs.OpenDir(dir, &fuse.Context{})
+		if !status.Ok() {
+			return "", false
+		}
+		d = &ciDir{
+			mtime: fi.ModTime(),
+			names: make(map[string]string, len(entries)),
+		}
+		for _, e := range entries {
+			// If several names fold to the same string, use the smallest one
+			// so the result is deterministic
+			f := foldCase(e.Name)
+			if old, ok := d.names[f]; !ok || e.Name < old {
+				d.names[f] = e.Name
+			}
+		}
+		c := &fs.ciCache
+		c.Lock()
+		if c.dirs == nil || len(c.dirs) >= ciCacheMaxDirs {
+			c.dirs = make(map[string]*ciDir)
+			c.account.Release(c.bytes)
+			c.bytes = 0
+		}
+		if old := c.dirs[dir]; old != nil {
+			n := old.size(dir)
+			c.account.Release(n)
+			c.bytes -= n
+		}
+		c.dirs[dir] = d
+		n := d.size(dir)
+		c.account.Charge(n)
+		c.bytes += n
+		c.Unlock()
+		c.account.Trim()
+	}
+	real, ok := d.names[foldCase(name)]
+	return real, ok
+}
+
+// foldPath returns the existing plaintext path that matches "plainPath"
+// case-insensitively. Components that do not match anything are kept as-is.
+func (fs *FS) foldPath(plainPath string) string {
+	if plainPath == "" || fs.plainPathExists(plainPath) {
+		return plainPath
+	}
+	parts := strings.Split(plainPath, "/")
+	dir := ""
+	for i, p := range parts {
+		next := filepath.Join(dir, p)
+		if !fs.plainPathExists(next) {
+			real, ok := fs.lookupFolded(dir, p)
+			if !ok {
+				// No match. Keep the rest of the path as it is.
+				return filepath.Join(append([]string{dir}, parts[i:]...)...)
+			}
+			next = filepath.Join(dir, real)
+		}
+		dir = next
+	}
+	tlog.Debug.Printf("foldPath: %q -> %q", plainPath, dir)
+	return dir
+}
@@ -0,0 +1,95 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestCaseInsensitive(t *testing.T) {
+	fs, dir := newTestFS(t, Args{CaseInsensitive: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+
+	if code := fs.Mkdir("Sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	f, code := fs.Create("Sub/Foo.txt", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Write([]byte("hello"), 0)
+	f.Release()
+	// Open with different case
+	f, code = fs.Open("sub/foo.TXT", uint32(os.O_RDONLY), ctx)
+	if !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	buf := make([]byte, 10)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	out, _ := res.Bytes(buf)
+	if string(out) != "hello" {
+		t.Errorf("wrong content %q", out)
+	}
+	f.Release()
+	// Creating a name that differs only in case hits the existing file
+	_, code = fs.Create("SUB/foo.txt", uint32(os.O_WRONLY|os.O_EXCL), 0600, ctx)
+	if code != fuse.Status(syscall.EEXIST) {
+		t.Errorf("Create: want EEXIST, got %v", code)
+	}
+	// A new file keeps its case, and listing preserves the original case
+	f, code = fs.Create("sub/NewFile", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	entries, code := fs.OpenDir("SUB", ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	if len(names) != 2 || !names["Foo.txt"] || !names["NewFile"] {
+		t.Errorf("wrong listing: %v", names)
+	}
+	entries, code = fs.OpenDir("", ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(entries) != 1 || entries[0].Name != "Sub" {
+		t.Errorf("wrong listing: %v", entries)
+	}
+	// Stat and delete through the folded name
+	if _, code = fs.GetAttr("sub/newfile", ctx); !code.Ok() {
+		t.Errorf("GetAttr: %v", code)
+	}
+	if code = fs.Unlink("sub/NEWFILE", ctx); !code.Ok() {
+		t.Errorf("Unlink: %v", code)
+	}
+	if _, code = fs.GetAttr("sub/newfile", ctx); code != fuse.ENOENT {
+		t.Errorf("GetAttr after Unlink: want ENOENT, got %v", code)
+	}
+}
+
+// TestCaseSensitiveDefault makes sure that lookups are case-sensitive
+// without "-caseinsensitive".
+func TestCaseSensitiveDefault(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("Foo.txt", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if _, code = fs.GetAttr("foo.txt", ctx); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", code)
+	}
+}
@@ -0,0 +1,148 @@
+package fusefrontend
+
+// Integrity check of a single file ("-check") or of a whole tree ("-verify")
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// CheckBlockError is returned by CheckFile when a content block fails
+// authentication.
+type CheckBlockError struct {
+	// Block is the number of the first bad block
+	Block uint64
+	// Status is what reading the block returned
+	Status fuse.Status
+}
+
+func (e *CheckBlockError) Error() string {
+	return fmt.Sprintf("block %d: %s", e.Block, e.Status.String())
+}
+
+// CheckFile authenticates the name and the content of the regular file
+// "path" (relative to the mountpoint). It returns the number of content
+// blocks that were checked successfully. If a block fails, checking stops
+// and the error is a *CheckBlockError.
+func (fs *FS) CheckFile(path string) (blocks uint64, err error) {
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	if path == "" {
+		return 0, &os.PathError{Op: "check", Path: "/", Err: syscall.EISDIR}
+	}
+	context := &fuse.Context{}
+	// The name must decrypt correctly when listing the parent directory.
+	// OpenDir drops names that fail to decrypt and long names whose ".name"
+	// file is corrupt.
+	parent := filepath.Dir(path)
+	if parent == "." {
+		parent = ""
+	}
+	entries, status := fs.OpenDir(parent, context)
+	if !status.Ok() {
+		return 0, &os.PathError{Op: "opendir", Path: parent, Err: syscall.Errno(status)}
+	}
+	found := false
+	name := filepath.Base(path)
+	for _, e := range entries {
+		if e.Name == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, &os.PathError{Op: "check name", Path: path, Err: syscall.ENOENT}
+	}
+	a, status := fs.GetAttr(path, context)
+	if !status.Ok() {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: syscall.Errno(status)}
+	}
+	if !a.IsRegular() {
+		return 0, &os.PathError{Op: "check", Path: path, Err: syscall.EINVAL}
+	}
+	return fs.checkContent(path, a.Size)
+}
+
+// checkContent authenticates all content blocks of the regular file "path"
+// of plaintext size "size".
+func (fs *FS) checkContent(path string, size uint64) (blocks uint64, err error) {
+	f, status := fs.Open(path, uint32(os.O_RDONLY), &fuse.Context{})
+	if !status.Ok() {
+		return 0, &os.PathError{Op: "open", Path: path, Err: syscall.Errno(status)}
+	}
+	defer f.Release()
+	bs := fs.contentEnc.PlainBS()
+	buf := make([]byte, bs)
+	for off := uint64(0); off < size; off += bs {
+		_, status = f.Read(buf, int64(off))
+		if !status.Ok() {
+			return blocks, &CheckBlockError{Block: off / bs, Status: status}
+		}
+		blocks++
+	}
+	return blocks, nil
+}
+
+// VerifyResult is returned by VerifyTree.
+type VerifyResult struct {
+	// Number of checked files, directories, symlinks and content blocks
+	Files, Dirs, Symlinks, Blocks uint64
+	// Errors has one entry for each problem that was found
+	Errors []string
+}
+
+// VerifyTree authenticates the names, symlink targets and file contents of
+// the whole tree below the directory "dir" (relative to the mountpoint).
+// Like CheckFile, it works on the backing files and does not need a mount.
+// Checking continues after errors.
+func (fs *FS) VerifyTree(dir string) *VerifyResult {
+	res := &VerifyResult{}
+	fs.verifyDir(strings.Trim(filepath.Clean("/"+dir), "/"), res)
+	return res
+}
+
+func (r *VerifyResult) errorf(format string, v ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, v...))
+}
+
+// verifyDir is the recursive worker for VerifyTree.
+func (fs *FS) verifyDir(dir string, res *VerifyResult) {
+	context := &fuse.Context{}
+	res.Dirs++
+	entries, invalid, status := fs.openDir(dir)
+	if len(invalid) > 0 {
+		res.errorf("%s/: %d entries with invalid names", dir, len(invalid))
+	}
+	if !status.Ok() {
+		res.errorf("%s/: opendir: %s", dir, status.String())
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name)
+		a, status := fs.GetAttr(path, context)
+		if !status.Ok() {
+			res.errorf("%s: stat: %s", path, status.String())
+			continue
+		}
+		switch {
+		case a.IsDir():
+			fs.verifyDir(path, res)
+		case a.IsRegular():
+			res.Files++
+			blocks, err := fs.checkContent(path, a.Size)
+			res.Blocks += blocks
+			if err != nil {
+				res.errorf("%s: %v", path, err)
+			}
+		case a.IsSymlink():
+			res.Symlinks++
+			if _, status = fs.Readlink(path, context); !status.Ok() {
+				res.errorf("%s: readlink: %s", path, status.String())
+			}
+		}
+	}
+}
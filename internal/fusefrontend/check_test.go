@@ -0,0 +1,62 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestVerifyTree builds a small tree without mounting, verifies it, corrupts
+// one content block and checks that VerifyTree finds it.
+func TestVerifyTree(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	f, code := fs.Create("sub/foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(make([]byte, 10000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if code = fs.Symlink("sub/foo", "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	res := fs.VerifyTree("")
+	if len(res.Errors) != 0 {
+		t.Fatalf("intact tree: %v", res.Errors)
+	}
+	if res.Dirs != 2 || res.Files != 1 || res.Blocks != 3 || res.Symlinks != 1 {
+		t.Errorf("wrong counts: %+v", res)
+	}
+
+	// Corrupt the second block
+	cPath, err := fs.getBackingPath("sub/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cf.WriteAt([]byte{0xaa, 0xbb}, 18+4128+100)
+	cf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = fs.VerifyTree("")
+	if len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "sub/foo: block 1") {
+		t.Errorf("corrupt block not reported correctly: %v", res.Errors)
+	}
+	// The symlink is still checked after the error
+	if res.Symlinks != 1 {
+		t.Errorf("symlink was not checked: %+v", res)
+	}
+}
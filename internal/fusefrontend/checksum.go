@@ -0,0 +1,185 @@
+package fusefrontend
+
+// Content checksums ("-checksum")
+//
+// The SHA-256 of the plaintext content of a regular file is stored,
+// encrypted, in an xattr of its backing file and is presented as the
+// read-only xattr "user.gocryptfs.sha256", in lowercase hex. The first
+// write to a file removes the stored checksum, and it is computed again
+// when the last writable file handle is closed. So if a file has a
+// checksum, it matches the content written through the mount. Changes
+// made directly in CIPHERDIR are not detected.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// checksumXattr is the xattr that presents the checksum in the mount
+	checksumXattr = "user.gocryptfs.sha256"
+	// checksumBackingXattr stores the encrypted checksum on the backing file
+	checksumBackingXattr = "user.gocryptfs.checksum"
+	// checksumBlockNo is the block number used as associated data when
+	// encrypting the checksum. No content block gets that far, so the
+	// value cannot be swapped with a block of the file.
+	checksumBlockNo = ^uint64(0)
+)
+
+// checksumBeforeWrite must be called before modifying the file content. It
+// removes the stored checksum, once until it has been computed again. The
+// caller must hold the ContentLock.
+func (f *file) checksumBeforeWrite() fuse.Status {
+	e := f.fileTableEntry
+	if !f.fs.args.Checksum || e.ChecksumStale {
+		return fuse.OK
+	}
+	err := syscallcompat.Fremovexattr(f.intFd(), checksumBackingXattr)
+	if err != nil && err != syscall.ENODATA {
+		tlog.Warn.Printf("ino%d: checksum: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	e.ChecksumStale = true
+	return fuse.OK
+}
+
+// checksumOnRelease computes and stores the checksum when the last
+// writable file handle is closed and the file has changed or has no
+// checksum yet. Errors are logged, the file simply has no checksum then.
+func (f *file) checksumOnRelease() {
+	e := f.fileTableEntry
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	if openfiletable.Writers(f.qIno) > 1 {
+		return
+	}
+	if !e.ChecksumStale {
+		if _, err := syscallcompat.Fgetxattr(f.intFd(), checksumBackingXattr, nil); err == nil {
+			return
+		}
+	}
+	sum, err := f.plainSHA256()
+	if err != nil {
+		tlog.Warn.Printf("ino%d: checksum: %v", f.qIno.Ino, err)
+		return
+	}
+	fileID, err := f.fileID()
+	if err != nil {
+		tlog.Warn.Printf("ino%d: checksum: %v", f.qIno.Ino, err)
+		return
+	}
+	value := f.contentEnc.EncryptBlock(sum, checksumBlockNo, fileID)
+	if err = syscallcompat.Fsetxattr(f.intFd(), checksumBackingXattr, value, 0); err != nil {
+		tlog.Warn.Printf("ino%d: checksum: %v", f.qIno.Ino, err)
+		return
+	}
+	e.ChecksumStale = false
+}
+
+// plainSHA256 returns the SHA-256 of the plaintext content.
+func (f *file) plainSHA256() ([]byte, error) {
+	h := sha256.New()
+	for off := uint64(0); ; {
+		data, status := f.doRead(nil, off, fuse.MAX_KERNEL_WRITE)
+		if !status.Ok() {
+			return nil, syscall.Errno(status)
+		}
+		if len(data) == 0 {
+			return h.Sum(nil), nil
+		}
+		h.Write(data)
+		off += uint64(len(data))
+	}
+}
+
+// fileID returns the file ID from the header, or nil if the file is empty.
+func (f *file) fileID() ([]byte, error) {
+	e := f.fileTableEntry
+	e.HeaderLock.RLock()
+	defer e.HeaderLock.RUnlock()
+	if e.ID != nil {
+		return e.ID, nil
+	}
+	id, err := f.readFileID()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return id, err
+}
+
+// readChecksum returns the stored checksum in hex, or ENODATA if there is
+// none.
+func (f *file) readChecksum() ([]byte, error) {
+	e := f.fileTableEntry
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	if e.ChecksumStale {
+		return nil, syscall.ENODATA
+	}
+	buf := make([]byte, 256)
+	n, err := syscallcompat.Fgetxattr(f.intFd(), checksumBackingXattr, buf)
+	if err != nil {
+		return nil, err
+	}
+	fileID, err := f.fileID()
+	if err != nil {
+		return nil, err
+	}
+	sum, err := f.contentEnc.DecryptBlock(buf[:n], checksumBlockNo, fileID)
+	if err != nil || len(sum) != sha256.Size {
+		tlog.Warn.Printf("ino%d: checksum: cannot decrypt: %v", f.qIno.Ino, err)
+		return nil, syscall.EIO
+	}
+	return []byte(hex.EncodeToString(sum)), nil
+}
+
+// getChecksumXAttr returns the value of the checksum xattr of "path".
+func (fs *FS) getChecksumXAttr(path string, context *fuse.Context) ([]byte, fuse.Status) {
+	f, status := fs.openChecksumFile(path, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	defer f.Release()
+	value, err := f.readChecksum()
+	return value, fuse.ToStatus(err)
+}
+
+// hasChecksumXAttr returns true if "path" has a checksum.
+func (fs *FS) hasChecksumXAttr(path string, context *fuse.Context) (bool, fuse.Status) {
+	f, status := fs.openChecksumFile(path, context)
+	if status == fuse.ENODATA {
+		return false, fuse.OK
+	} else if !status.Ok() {
+		return false, status
+	}
+	defer f.Release()
+	_, err := f.readChecksum()
+	return err == nil, fuse.OK
+}
+
+// openChecksumFile opens the regular file "path" for reading its
+// checksum. Returns ENODATA for everything else, as only regular files
+// have a checksum.
+func (fs *FS) openChecksumFile(path string, context *fuse.Context) (*file, fuse.Status) {
+	a, status := fs.GetAttr(path, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	if !a.IsRegular() {
+		return nil, fuse.ENODATA
+	}
+	f, status := fs.openFile(path, uint32(os.O_RDONLY))
+	if !status.Ok() {
+		return nil, status
+	}
+	return f.(*file), fuse.OK
+}
@@ -0,0 +1,63 @@
+package fusefrontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestChecksum writes a file, checks the checksum xattr after closing it,
+// modifies the file and checks that the checksum goes away while the file
+// is open for writing and is updated after closing it.
+func TestChecksum(t *testing.T) {
+	fs, dir := newTestFS(t, Args{Checksum: true})
+	defer os.RemoveAll(dir)
+	if err := CheckWriteIntent(dir); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	ctx := &fuse.Context{}
+	check := func(want string) {
+		sum := sha256.Sum256([]byte(want))
+		value, code := fs.GetXAttr("foo", checksumXattr, ctx)
+		if !code.Ok() {
+			t.Fatalf("GetXAttr: %v", code)
+		}
+		if string(value) != hex.EncodeToString(sum[:]) {
+			t.Errorf("wrong checksum %q for content %q", value, want)
+		}
+		names, code := fs.ListXAttr("foo", ctx)
+		if !code.Ok() || len(names) != 1 || names[0] != checksumXattr {
+			t.Errorf("ListXAttr: %v %v", names, code)
+		}
+	}
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("hello"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	check("hello")
+
+	f, code = fs.Open("foo", uint32(os.O_RDWR), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte(", world"), 5); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = fs.GetXAttr("foo", checksumXattr, ctx); code != fuse.ENODATA {
+		t.Errorf("GetXAttr while writing: want ENODATA, got %v", code)
+	}
+	f.Release()
+	check("hello, world")
+
+	// Other attributes do not exist
+	if _, code = fs.GetXAttr("foo", "user.foo", ctx); code != fuse.ENODATA {
+		t.Errorf("GetXAttr user.foo: want ENODATA, got %v", code)
+	}
+}
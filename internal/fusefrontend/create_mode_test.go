@@ -0,0 +1,46 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestCreateMode creates a file, a directory and a fifo with "-create-umask"
+// and "-force-mode" and checks the modes of the backing files.
+func TestCreateMode(t *testing.T) {
+	fs, dir := newTestFS(t, Args{CreateUmask: 0027, ForceMode: 0040})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0606, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if code = fs.Mkdir("dir", 0707, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Mknod("fifo", syscall.S_IFIFO|0666, 0, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	want := map[string]uint32{
+		"file": 0640,
+		"dir":  0740,
+		"fifo": 0640,
+	}
+	for path, mode := range want {
+		cPath, err := fs.getBackingPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st syscall.Stat_t
+		if err = syscall.Lstat(cPath, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode&0777 != mode {
+			t.Errorf("%s: want mode %#o, got %#o", path, mode, st.Mode&0777)
+		}
+	}
+}
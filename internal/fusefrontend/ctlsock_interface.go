@@ -1,15 +1,22 @@
 package fusefrontend
 
 import (
-	"fmt"
 	"path"
 	"strings"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 var _ ctlsock.Interface = &FS{} // Verify that interface is implemented.
+var _ ctlsock.OpenFilesInterface = &FS{}
+var _ ctlsock.WriteIntentInterface = &FS{}
+var _ ctlsock.StatInterface = &FS{}
+var _ ctlsock.CapabilitiesInterface = &FS{}
+var _ ctlsock.AccessInterface = &FS{}
+var _ ctlsock.SyncInterface = &FS{}
 
 // EncryptPath implements ctlsock.Backend
 func (fs *FS) EncryptPath(plainPath string) (string, error) {
@@ -25,22 +32,22 @@ func (fs *FS) DecryptPath(cipherPath string) (string, error) {
 	parts := strings.Split(cipherPath, "/")
 	wd := fs.args.Cipherdir
 	for _, part := range parts {
-		dirIV, err := nametransform.ReadDirIV(wd)
+		dirIV, err := fs.nameTransform.ReadDirIV(wd)
 		if err != nil {
-			fmt.Printf("ReadDirIV: %v\n", err)
+			tlog.Debug.Printf("DecryptPath: ReadDirIV: %v", err)
 			return "", err
 		}
 		longPart := part
 		if nametransform.IsLongContent(part) {
 			longPart, err = nametransform.ReadLongName(wd + "/" + part)
 			if err != nil {
-				fmt.Printf("ReadLongName: %v\n", err)
+				tlog.Debug.Printf("DecryptPath: ReadLongName: %v", err)
 				return "", err
 			}
 		}
 		name, err := fs.nameTransform.DecryptName(longPart, dirIV)
 		if err != nil {
-			fmt.Printf("DecryptName: %v\n", err)
+			tlog.Debug.Printf("DecryptPath: DecryptName: %v", err)
 			return "", err
 		}
 		plainPath = path.Join(plainPath, name)
@@ -48,3 +55,23 @@ func (fs *FS) DecryptPath(cipherPath string) (string, error) {
 	}
 	return plainPath, nil
 }
+
+// Capabilities implements ctlsock.CapabilitiesInterface
+func (fs *FS) Capabilities() ctlsock.Capabilities {
+	return ctlsock.Capabilities{
+		CaseSensitive: !fs.args.CaseInsensitive,
+	}
+}
+
+// CheckAccess implements ctlsock.AccessInterface. It runs the permission
+// checks of "-acl", whether "-acl" is active or not: the user needs search
+// permission on all parent directories, and the mode bits and the access
+// ACL of "path" must grant "mode".
+func (fs *FS) CheckAccess(path string, uid uint32, gid uint32, groups []uint32, mode uint32) error {
+	if fs.isFiltered(path) {
+		return syscall.EPERM
+	}
+	c := &caller{uid: uid, gid: gid, groups: groups}
+	_, err := NewACLFS(fs).check(c, path, mode)
+	return err
+}
@@ -0,0 +1,43 @@
+package fusefrontend
+
+// Bypass the kernel page cache for selected files, "-direct-io"
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// directIO returns true if the plaintext path "path" matches one of the
+// "-direct-io" patterns. Like in .gitignore, a pattern without a slash is
+// matched against the file name, a pattern with a slash against the whole
+// path.
+func (fs *FS) directIO(path string) bool {
+	for _, p := range fs.args.DirectIO {
+		name := path
+		if !strings.Contains(p, "/") {
+			name = filepath.Base(path)
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheHint wraps the newly opened file "f" so that the kernel does not
+// cache its content if "path" is selected by "-direct-io". Every read then
+// reaches us and returns what is currently in the backing file, even if it
+// has been changed through another mount or directly in CIPHERDIR.
+func (fs *FS) cacheHint(path string, f nodefs.File) nodefs.File {
+	if !fs.directIO(path) {
+		return f
+	}
+	return &nodefs.WithFlags{
+		File:        f,
+		Description: "direct-io",
+		FuseFlags:   fuse.FOPEN_DIRECT_IO,
+	}
+}
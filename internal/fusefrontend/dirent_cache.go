@@ -0,0 +1,92 @@
+package fusefrontend
+
+// Ciphertext names of the last listed directory
+//
+// Listing a directory is usually followed by a GetAttr for every entry:
+// "ls -l" does it, and so does the kernel's READDIRPLUS, which go-fuse
+// serves by calling Lookup (and thus GetAttr) per entry. OpenDir has just
+// decrypted all names, so we remember which ciphertext name belongs to
+// which plaintext name and skip encrypting the names again.
+//
+// Encrypting a name is a pure function of the name and the DirIV, so an
+// entry stays valid as long as the directory has the same DirIV. We check
+// that against the DirIV cache, which is cleared on renames and deletes.
+// Attributes are not cached, pathfs does not tell us whether the kernel
+// asked for READDIRPLUS, and stat'ing every entry would slow down a plain
+// "ls".
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/cachebudget"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/nametransform/dirivcache"
+)
+
+// direntCacheMaxEntries is the largest directory we cache. Bigger ones are
+// not worth the memory.
+const direntCacheMaxEntries = 5000
+
+// direntCache holds the names of one directory
+type direntCache struct {
+	sync.Mutex
+	// Relative plaintext and ciphertext path of the directory
+	dir, cDir string
+	// DirIV of the directory
+	iv []byte
+	// names maps plaintext names to ciphertext names. nil if the cache is
+	// empty.
+	names map[string]string
+	// Memory budget share ("-cache-size") and what we have charged to it
+	account *cachebudget.Account
+	bytes   uint64
+}
+
+// store replaces the cache contents with "names".
+func (c *direntCache) store(dir string, cDir string, iv []byte, names map[string]string) {
+	var n uint64
+	for k, v := range names {
+		n += uint64(len(k)+len(v)) + cachebudget.EntryOverhead
+	}
+	c.Lock()
+	c.dir = dir
+	c.cDir = cDir
+	c.iv = iv
+	c.names = names
+	c.account.Release(c.bytes)
+	c.account.Charge(n)
+	c.bytes = n
+	c.Unlock()
+	if n > 0 {
+		c.account.Trim()
+	}
+}
+
+// clear empties the cache.
+func (c *direntCache) clear() {
+	c.store("", "", nil, nil)
+}
+
+// lookup returns the relative ciphertext path of "plainPath" if it is an
+// entry of the cached directory and the directory still has the same DirIV.
+func (c *direntCache) lookup(plainPath string, ivCache *dirivcache.DirIVCache) (string, bool) {
+	dir := nametransform.Dir(plainPath)
+	c.Lock()
+	if c.names == nil || c.dir != dir {
+		c.Unlock()
+		return "", false
+	}
+	cName, ok := c.names[filepath.Base(plainPath)]
+	iv, cDir := c.iv, c.cDir
+	c.Unlock()
+	if !ok {
+		return "", false
+	}
+	curIV, curCDir := ivCache.Lookup(dir)
+	if curIV == nil || !bytes.Equal(curIV, iv) || curCDir != cDir {
+		return "", false
+	}
+	return filepath.Join(cDir, cName), true
+}
@@ -0,0 +1,160 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestDirentCache checks that paths found in the cache are the same as
+// encrypting them, and that renaming the directory invalidates the cache.
+func TestDirentCache(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("d", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	names := []string{"a", "b", strings.Repeat("x", 250)}
+	for _, n := range names {
+		f, code := fs.Create("d/"+n, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	want := make(map[string]string)
+	for _, n := range names {
+		cPath, err := fs.nameTransform.EncryptPathDirIV("d/"+n, fs.args.Cipherdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[n] = cPath
+	}
+	if _, code := fs.OpenDir("d", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, n := range names {
+		cPath, ok := fs.direntCache.lookup("d/"+n, &fs.nameTransform.DirIVCache)
+		if !ok {
+			t.Errorf("%q: not in the cache", n)
+		} else if cPath != want[n] {
+			t.Errorf("%q: cache has %q, want %q", n, cPath, want[n])
+		}
+	}
+	if _, ok := fs.direntCache.lookup("d/nonexistent", &fs.nameTransform.DirIVCache); ok {
+		t.Error("nonexistent entry found in the cache")
+	}
+	// Renaming the directory and creating a new one with the same name
+	// gives a different DirIV
+	if code := fs.Rename("d", "d2", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Mkdir("d", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code := fs.GetAttr("d/a", ctx); code != fuse.ENOENT {
+		t.Errorf("stale cache entry: want ENOENT, got %v", code)
+	}
+	if a, code := fs.GetAttr("d2/a", ctx); !code.Ok() || !a.IsRegular() {
+		t.Errorf("d2/a: %v %v", a, code)
+	}
+}
+
+// benchmarkLsL lists a directory with 1000 files and gets the attributes of
+// every entry, like "ls -l" or READDIRPLUS. With cache=false, the cache is
+// cleared after listing the directory, which is how it was before the
+// cache existed.
+func benchmarkLsL(b *testing.B, cache bool) {
+	fs, dir := newTestFS(b, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("d", 0700, ctx); !code.Ok() {
+		b.Fatal(code)
+	}
+	for i := 0; i < 1000; i++ {
+		f, code := fs.Create(fmt.Sprintf("d/file%04d", i), uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			b.Fatal(code)
+		}
+		f.Release()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entries, code := fs.OpenDir("d", ctx)
+		if !code.Ok() {
+			b.Fatal(code)
+		}
+		if !cache {
+			fs.direntCache.clear()
+		}
+		for _, e := range entries {
+			if _, code = fs.GetAttr("d/"+e.Name, ctx); !code.Ok() {
+				b.Fatal(code)
+			}
+		}
+	}
+}
+
+func BenchmarkLsLUncached(b *testing.B) {
+	benchmarkLsL(b, false)
+}
+
+func BenchmarkLsLCached(b *testing.B) {
+	benchmarkLsL(b, true)
+}
+
+// TestCacheBudget fills the DirIV, dirent and case-insensitivity caches with
+// a tiny "-cache-size" budget and checks that they stay within it.
+func TestCacheBudget(t *testing.T) {
+	const limit = 4000
+	fs, dir := newTestFS(t, Args{CacheSize: limit, CaseInsensitive: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	seen := make(map[string]bool)
+	check := func() {
+		st := fs.cacheBudget.Stats()
+		if st.Used > limit {
+			t.Fatalf("over budget: %+v", st)
+		}
+		for name, used := range st.PerCache {
+			if used > 0 {
+				seen[name] = true
+			}
+		}
+	}
+	for i := 0; i < 20; i++ {
+		d := fmt.Sprintf("dir%02d", i)
+		if code := fs.Mkdir(d, 0700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+		for j := 0; j < 10; j++ {
+			f, code := fs.Create(fmt.Sprintf("%s/file%02d", d, j), uint32(os.O_WRONLY), 0600, ctx)
+			if !code.Ok() {
+				t.Fatal(code)
+			}
+			f.Release()
+			check()
+		}
+		if _, code := fs.OpenDir(d, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+		check()
+		// Goes through the case-insensitivity cache
+		if _, code := fs.GetAttr(strings.ToUpper(d)+"/FILE01", ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+		check()
+	}
+	for _, name := range []string{"diriv", "dirent", "caseinsensitive"} {
+		if !seen[name] {
+			t.Errorf("cache %q was never used", name)
+		}
+	}
+	if st := fs.cacheBudget.Stats(); st.Evictions == 0 {
+		t.Errorf("no evictions: %+v", st)
+	}
+}
@@ -0,0 +1,75 @@
+package fusefrontend
+
+// Optional directory fsync ("-dirsync").
+//
+// Without it, a crash shortly after a create or rename can lose the directory
+// entry even though the file content has already been fsync'ed by the
+// application. With "-dirsync", every operation that changes a directory
+// fsyncs the backing directory, and the gocryptfs.diriv and ".name" files
+// written along the way, before it returns.
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// syncFd is used for all fsync calls of "-dirsync", Fsync and SyncAll. The
+// tests replace it to record which files and directories were synced.
+var syncFd = syscall.Fsync
+
+// syncFileAt fsyncs the file "name" inside "dirfd".
+func syncFileAt(dirfd *os.File, name string) error {
+	fd, err := syscallcompat.Openat(int(dirfd.Fd()), name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syncFd(fd)
+}
+
+// syncEntry makes the directory entry "cName" in "dirfd" durable if
+// "-dirsync" is enabled. The ".name" file of a long name is synced as well.
+// Also use this after deleting "cName".
+func (fs *FS) syncEntry(dirfd *os.File, cName string) error {
+	if !fs.args.DirSync {
+		return nil
+	}
+	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		err := syncFileAt(dirfd, cName+nametransform.LongNameSuffix)
+		if err != nil && err != syscall.ENOENT {
+			tlog.Warn.Printf("syncEntry: %s: %v", cName, err)
+			return err
+		}
+	}
+	err := syncFd(int(dirfd.Fd()))
+	if err != nil {
+		tlog.Warn.Printf("syncEntry: fsync of %q failed: %v", dirfd.Name(), err)
+	}
+	return err
+}
+
+// syncNewDir makes the freshly created directory "cName" in "dirfd",
+// including its gocryptfs.diriv, durable if "-dirsync" is enabled.
+func (fs *FS) syncNewDir(dirfd *os.File, cName string) error {
+	if !fs.args.DirSync {
+		return nil
+	}
+	if !fs.args.PlaintextNames {
+		err := syncFileAt(dirfd, filepath.Join(cName, nametransform.DirIVFilename))
+		if err != nil {
+			tlog.Warn.Printf("syncNewDir: %s: %v", cName, err)
+			return err
+		}
+		err = syncFileAt(dirfd, cName)
+		if err != nil {
+			tlog.Warn.Printf("syncNewDir: %s: %v", cName, err)
+			return err
+		}
+	}
+	return fs.syncEntry(dirfd, cName)
+}
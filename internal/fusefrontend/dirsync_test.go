@@ -0,0 +1,125 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// spySyncFd replaces syncFd with a function that records the path of
+// every synced file descriptor. Call the returned function to restore
+// syncFd.
+func spySyncFd(synced *[]string) func() {
+	orig := syncFd
+	syncFd = func(fd int) error {
+		path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		if err != nil {
+			path = fmt.Sprintf("fd%d", fd)
+		}
+		*synced = append(*synced, path)
+		return orig(fd)
+	}
+	return func() { syncFd = orig }
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// TestDirSync checks that create, rename and unlink fsync the affected
+// backing directories in "-dirsync" mode.
+func TestDirSync(t *testing.T) {
+	fs, dir := newTestFS(t, Args{DirSync: true})
+	defer os.RemoveAll(dir)
+	var synced []string
+	defer spySyncFd(&synced)()
+	ctx := &fuse.Context{}
+
+	if code := fs.Mkdir("sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	cSub, err := fs.getBackingPath("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(synced, dir) || !contains(synced, cSub) ||
+		!contains(synced, cSub+"/"+nametransform.DirIVFilename) {
+		t.Errorf("Mkdir: missing fsync: %v", synced)
+	}
+
+	synced = nil
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if !contains(synced, dir) {
+		t.Errorf("Create: CIPHERDIR was not synced: %v", synced)
+	}
+
+	synced = nil
+	if code = fs.Rename("foo", "sub/bar", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if !contains(synced, dir) || !contains(synced, cSub) {
+		t.Errorf("Rename: missing fsync: %v", synced)
+	}
+
+	synced = nil
+	if code = fs.Unlink("sub/bar", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if !contains(synced, cSub) {
+		t.Errorf("Unlink: missing fsync: %v", synced)
+	}
+
+	// A long name also syncs its ".name" file
+	synced = nil
+	long := strings.Repeat("x", 200)
+	f, code = fs.Create(long, uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	cLong, err := fs.getBackingPath(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(synced, cLong+nametransform.LongNameSuffix) || !contains(synced, dir) {
+		t.Errorf("Create long name: missing fsync: %v", synced)
+	}
+}
+
+// TestDirSyncOff checks that nothing is synced without "-dirsync".
+func TestDirSyncOff(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	var synced []string
+	defer spySyncFd(&synced)()
+	ctx := &fuse.Context{}
+
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if code = fs.Rename("foo", "bar", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Unlink("bar", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(synced) != 0 {
+		t.Errorf("unexpected fsync calls: %v", synced)
+	}
+}
@@ -24,6 +24,11 @@ import (
 
 var _ nodefs.File = &file{} // Verify that interface is implemented.
 
+// preadFile and pwriteFile do all reads and writes of backing file content.
+// The tests replace them to inject errors.
+var preadFile = (*os.File).ReadAt
+var pwriteFile = (*os.File).WriteAt
+
 // File - based on loopbackFile in go-fuse/fuse/nodefs/files.go
 type file struct {
 	fd *os.File
@@ -52,6 +57,18 @@ type file struct {
 	lastOpCount uint64
 	// Parent filesystem
 	fs *FS
+	// Quota that applies to the file, or nil
+	quota *quota
+	// The file handle was opened for writing
+	writable bool
+	// lockMu protects lockOwners
+	lockMu sync.Mutex
+	// lockOwners are the owners that have taken locks through this handle.
+	// Their locks are released in Release().
+	lockOwners map[uint64]struct{}
+	// lockCancel is closed by Release() to give up on SetLkw calls that
+	// are still waiting
+	lockCancel chan struct{}
 	// We embed a nodefs.NewDefaultFile() that returns ENOSYS for every operation we
 	// have not implemented. This prevents build breakage when the go-fuse library
 	// adds new methods to the nodefs.File interface.
@@ -76,16 +93,70 @@ func NewFile(fd *os.File, fs *FS) (nodefs.File, fuse.Status) {
 		fileTableEntry: e,
 		loopbackFile:   nodefs.NewLoopbackFile(fd),
 		fs:             fs,
+		lockCancel:     make(chan struct{}),
 		File:           nodefs.NewDefaultFile(),
 	}, fuse.OK
 }
 
+// newFile is NewFile plus the state that needs the plaintext "path" and the
+// open "flags": the quota, the writer count in the open file table, and the
+// entry in the list of open files.
+func (fs *FS) newFile(fd *os.File, path string, flags uint32) (nodefs.File, fuse.Status) {
+	fuseFile, status := NewFile(fd, fs)
+	if !status.Ok() {
+		return nil, status
+	}
+	f := fuseFile.(*file)
+	f.quota = fs.quotaFor(path)
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		f.writable = true
+		openfiletable.RegisterWriter(f.qIno)
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		// The backing file has already been truncated
+		f.fileTableEntry.ContentLock.Lock()
+		status = f.intentBeforeWrite(0)
+		if status.Ok() {
+			status = f.checksumBeforeWrite()
+		}
+		f.fileTableEntry.ContentLock.Unlock()
+		if !status.Ok() {
+			f.Release()
+			return nil, status
+		}
+	}
+	fs.openFiles.add(f, path, flags)
+	return f, fuse.OK
+}
+
 // intFd - return the backing file descriptor as an integer. Used for debug
 // messages.
 func (f *file) intFd() int {
 	return int(f.fd.Fd())
 }
 
+// readAt reads from the backing file at "off", retrying transient errors
+// according to "-retry".
+func (f *file) readAt(buf []byte, off int64) (n int, err error) {
+	err = f.fs.args.Retry.Do(func() error {
+		var err2 error
+		n, err2 = preadFile(f.fd, buf, off)
+		return err2
+	})
+	return n, err
+}
+
+// writeAt writes to the backing file at "off", retrying transient errors
+// according to "-retry".
+func (f *file) writeAt(buf []byte, off int64) (n int, err error) {
+	err = f.fs.args.Retry.Do(func() error {
+		var err2 error
+		n, err2 = pwriteFile(f.fd, buf, off)
+		return err2
+	})
+	return n, err
+}
+
 // readFileID loads the file header from disk and extracts the file ID.
 // Returns io.EOF if the file is empty.
 func (f *file) readFileID() ([]byte, error) {
@@ -94,9 +165,11 @@ func (f *file) readFileID() ([]byte, error) {
 	// This makes File ID poisoning more difficult.
 	readLen := contentenc.HeaderLen + 1
 	buf := make([]byte, readLen)
-	n, err := f.fd.ReadAt(buf, 0)
+	n, err := f.readAt(buf, 0)
 	if err != nil {
-		if err == io.EOF && n != 0 {
+		// A header-only file is empty, so we only warn if the header itself
+		// is incomplete
+		if err == io.EOF && n != 0 && n < contentenc.HeaderLen {
 			tlog.Warn.Printf("ino%d: readFileID: incomplete file, got %d instead of %d bytes",
 				f.qIno.Ino, n, readLen)
 		}
@@ -125,7 +198,7 @@ func (f *file) createHeader() (fileID []byte, err error) {
 		}
 	}
 	// Actually write header
-	_, err = f.fd.WriteAt(buf, 0)
+	_, err = f.writeAt(buf, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -142,6 +215,15 @@ func (f *file) createHeader() (fileID []byte, err error) {
 // Called by Read() for normal reading,
 // by Write() and Truncate() for Read-Modify-Write
 func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Status) {
+	// No file can extend beyond MaxPlainSize, so there is nothing to read
+	// there.
+	if f.contentEnc.CheckPlainRange(off, length) != nil {
+		max := f.contentEnc.MaxPlainSize()
+		if off >= max {
+			return dst, fuse.OK
+		}
+		length = max - off
+	}
 	// Make sure we have the file ID.
 	f.fileTableEntry.HeaderLock.RLock()
 	if f.fileTableEntry.ID == nil {
@@ -151,8 +233,9 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 		f.fileTableEntry.HeaderLock.Lock()
 		tmpID, err := f.readFileID()
 		if err == io.EOF {
+			// Empty or header-only file
 			f.fileTableEntry.HeaderLock.Unlock()
-			return nil, fuse.OK
+			return dst, fuse.OK
 		}
 		if err != nil {
 			f.fileTableEntry.HeaderLock.Unlock()
@@ -175,7 +258,7 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 	ciphertext := f.fs.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
+	n, err := f.readAt(ciphertext, int64(alignedOffset))
 	// We don't care if the file ID changes after we have read the data. Drop the lock.
 	f.fileTableEntry.HeaderLock.RUnlock()
 	if err != nil && err != io.EOF {
@@ -249,6 +332,7 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 	if status != fuse.OK {
 		return nil, status
 	}
+	f.updateAtime()
 
 	tlog.Debug.Printf("ino%d: Read: status %v, returning %d bytes", f.qIno.Ino, status, len(out))
 	return fuse.ReadResultData(out), status
@@ -291,7 +375,9 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	toEncrypt := make([][]byte, len(blocks))
 	for i, b := range blocks {
 		blockData := dataBuf.Next(int(b.Length))
-		// Incomplete block -> Read-Modify-Write
+		// Incomplete block -> Read-Modify-Write. Complete, block-aligned
+		// blocks replace the old content entirely, so we encrypt them directly
+		// without reading the old block first.
 		if b.IsPartial() {
 			// Read
 			oldData, status := f.doRead(nil, b.BlockPlainOff(), f.contentEnc.PlainBS())
@@ -322,7 +408,10 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		}
 	}
 	// Write
-	_, err = f.fd.WriteAt(ciphertext, cOff)
+	_, err = f.writeAt(ciphertext, cOff)
+	if err == nil && f.contentEnc.Compressed() {
+		err = f.punchPadding(ciphertext, cOff)
+	}
 	// Return memory to CReqPool
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
@@ -332,6 +421,28 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	return uint32(len(data)), fuse.OK
 }
 
+// punchPadding deallocates the zero padding of the compressed ciphertext
+// blocks in "ciphertext" that has just been written to offset "cOff".
+func (f *file) punchPadding(ciphertext []byte, cOff int64) error {
+	cipherBS := int(f.contentEnc.CipherBS())
+	for i := 0; i < len(ciphertext); i += cipherBS {
+		end := i + cipherBS
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		padOff := i + f.contentEnc.PaddingOffset(ciphertext[i:end])
+		// Padding smaller than a page cannot free any space
+		if end-padOff < os.Getpagesize() {
+			continue
+		}
+		err := syscallcompat.PunchHole(f.intFd(), cOff+int64(padOff), int64(end-padOff))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // isConsecutiveWrite returns true if the current write
 // directly (in time and space) follows the last write.
 // This is an optimisation for streaming writes on NFS where a
@@ -346,6 +457,7 @@ func (f *file) isConsecutiveWrite(off int64) bool {
 //
 // If the write creates a hole, pads the file to the next block boundary.
 func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	defer f.fs.snapshotRLock()()
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -355,19 +467,40 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 		tlog.Warn.Printf("ino%d fh%d: Write on released file", f.qIno.Ino, f.intFd())
 		return 0, fuse.EBADF
 	}
+	if off < 0 {
+		return 0, fuse.EINVAL
+	}
+	if err := f.contentEnc.CheckPlainRange(uint64(off), uint64(len(data))); err != nil {
+		return 0, fuse.ToStatus(err)
+	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if status := f.intentBeforeWrite(uint64(off)); !status.Ok() {
+		return 0, status
+	}
+	if status := f.checksumBeforeWrite(); !status.Ok() {
+		return 0, status
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
+	if status := f.maxSizeOK(uint64(off) + uint64(len(data))); !status.Ok() {
+		return 0, status
+	}
+	quotaDone, status := f.quotaResize(uint64(off)+uint64(len(data)), true)
+	if !status.Ok() {
+		return 0, status
+	}
 	if !f.isConsecutiveWrite(off) {
-		status := f.writePadHole(off)
+		status = f.writePadHole(off)
 		if !status.Ok() {
+			quotaDone(false)
 			return 0, status
 		}
 	}
 	n, status := f.doWrite(data, off)
+	quotaDone(status.Ok())
 	if status.Ok() {
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
@@ -381,11 +514,30 @@ func (f *file) Release() {
 	if f.released {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
+	if f.writable && f.fs.args.Checksum {
+		f.checksumOnRelease()
+	}
 	f.fd.Close()
 	f.released = true
 	f.fdLock.Unlock()
+	f.unlockAll()
 
+	if f.writable {
+		openfiletable.UnregisterWriter(f.qIno)
+	}
 	openfiletable.Unregister(f.qIno)
+	if f.writable {
+		f.replicate()
+	}
+	f.fs.openFiles.remove(f)
+}
+
+// replicate queues the file for mirroring to "-replica", under its
+// current name.
+func (f *file) replicate() {
+	if path, ok := f.fs.openFiles.path(f); ok {
+		f.fs.replicate(path)
+	}
 }
 
 // Flush - FUSE call
@@ -409,7 +561,21 @@ func (f *file) Fsync(flags int) (code fuse.Status) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	return fuse.ToStatus(syscall.Fsync(int(f.fd.Fd())))
+	if f.fs.args.WriteIntent && f.writable && !f.released {
+		// Writes must not extend the file between syncing and recording the
+		// durable size
+		f.fileTableEntry.ContentLock.Lock()
+		defer f.fileTableEntry.ContentLock.Unlock()
+		if err := syncFd(f.intFd()); err != nil {
+			return fuse.ToStatus(err)
+		}
+		return f.intentCommit()
+	}
+	err := syncFd(int(f.fd.Fd()))
+	if err == nil && f.writable {
+		f.replicate()
+	}
+	return fuse.ToStatus(err)
 }
 
 func (f *file) Chmod(mode uint32) fuse.Status {
@@ -444,12 +610,14 @@ func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
 	if f.fs.args.ForceOwner != nil {
 		a.Owner = *f.fs.args.ForceOwner
 	}
+	f.fs.forceTime(a)
 
 	return fuse.OK
 }
 
+// Utimens - FUSE call. The times are set with nanosecond precision.
 func (f *file) Utimens(a *time.Time, m *time.Time) fuse.Status {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
-	return f.loopbackFile.Utimens(a, m)
+	return fuse.ToStatus(syscallcompat.Futimens(f.intFd(), a, m))
 }
@@ -45,14 +45,41 @@ func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 		return fuse.Status(syscall.EOPNOTSUPP)
 	}
 
+	defer f.fs.snapshotRLock()()
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
 		return fuse.EBADF
 	}
+	if err := f.contentEnc.CheckPlainRange(off, sz); err != nil {
+		return fuse.ToStatus(err)
+	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	if mode == FALLOC_FL_KEEP_SIZE {
+		return f.allocate(off, sz, mode)
+	}
+	if status := f.intentBeforeWrite(off + sz); !status.Ok() {
+		return status
+	}
+	if status := f.checksumBeforeWrite(); !status.Ok() {
+		return status
+	}
+	// Check the limits before allocating anything
+	if status := f.maxSizeOK(off + sz); !status.Ok() {
+		return status
+	}
+	quotaDone, status := f.quotaResize(off+sz, true)
+	if !status.Ok() {
+		return status
+	}
+	status = f.allocate(off, sz, mode)
+	quotaDone(status.Ok())
+	return status
+}
 
+// allocate implements Allocate. The caller must hold the ContentLock.
+func (f *file) allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
 	lastBlock := blocks[len(blocks)-1]
@@ -93,6 +120,7 @@ func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 
 // Truncate - FUSE call
 func (f *file) Truncate(newSize uint64) fuse.Status {
+	defer f.fs.snapshotRLock()()
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -100,8 +128,31 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 		tlog.Warn.Printf("ino%d fh%d: Truncate on released file", f.qIno.Ino, f.intFd())
 		return fuse.EBADF
 	}
+	if err := f.contentEnc.CheckPlainRange(newSize, 0); err != nil {
+		return fuse.ToStatus(err)
+	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	if status := f.intentBeforeWrite(newSize); !status.Ok() {
+		return status
+	}
+	if status := f.checksumBeforeWrite(); !status.Ok() {
+		return status
+	}
+	if status := f.maxSizeOK(newSize); !status.Ok() {
+		return status
+	}
+	quotaDone, status := f.quotaResize(newSize, false)
+	if !status.Ok() {
+		return status
+	}
+	status = f.truncate(newSize)
+	quotaDone(status.Ok())
+	return status
+}
+
+// truncate implements Truncate. The caller must hold the ContentLock.
+func (f *file) truncate(newSize uint64) fuse.Status {
 	var err error
 	// Common case first: Truncate to zero
 	if newSize == 0 {
@@ -0,0 +1,117 @@
+package fusefrontend
+
+// FUSE operations GetLk, SetLk and SetLkw on file handles
+// i.e. fcntl(F_GETLK, F_SETLK, F_SETLKW) and flock
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+// lkFlock is FUSE_LK_FLOCK. It is set in the lock flags when the kernel
+// forwards a flock() call instead of an fcntl() call.
+const lkFlock = 1
+
+// lockTable returns the table that is responsible for lock requests with
+// "flags".
+func (f *file) lockTable(flags uint32) *openfiletable.LockTable {
+	if flags&lkFlock != 0 {
+		return &f.fileTableEntry.Flocks
+	}
+	return &f.fileTableEntry.PosixLocks
+}
+
+// addLockOwner remembers that "owner" takes locks through this handle.
+func (f *file) addLockOwner(owner uint64) {
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+	if f.lockOwners == nil {
+		f.lockOwners = make(map[uint64]struct{})
+	}
+	f.lockOwners[owner] = struct{}{}
+}
+
+// unlockAll gives up on waiting SetLkw calls and releases the locks that
+// were taken through this handle. Called by Release().
+//
+// The kernel sends the lock owner with FLUSH and RELEASE, but the nodefs API
+// of the vendored go-fuse does not pass it on, so the owners are recorded
+// here instead. POSIX locks are therefore released when the last file
+// descriptor of the handle is closed, not already on the first close(). A
+// waiter whose process has been killed does not keep waiting, and can not
+// take a lock that nobody would ever release.
+func (f *file) unlockAll() {
+	close(f.lockCancel)
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+	for owner := range f.lockOwners {
+		f.fileTableEntry.PosixLocks.UnlockAll(owner)
+		f.fileTableEntry.Flocks.UnlockAll(owner)
+	}
+	f.lockOwners = nil
+}
+
+// checkReleased returns EBADF if Release() has already been called.
+func (f *file) checkReleased() fuse.Status {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return fuse.EBADF
+	}
+	return fuse.OK
+}
+
+// GetLk - FUSE call for fcntl(F_GETLK)
+//
+// Locks are only coordinated between users of this mount. They are not
+// passed on to the backing files.
+func (f *file) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) fuse.Status {
+	if status := f.checkReleased(); !status.Ok() {
+		return status
+	}
+	c := f.lockTable(flags).Conflict(owner, lk.Start, lk.End, lk.Typ)
+	if c == nil {
+		*out = *lk
+		out.Typ = syscall.F_UNLCK
+		return fuse.OK
+	}
+	*out = fuse.FileLock{Start: c.Start, End: c.End, Typ: c.Typ, Pid: c.Pid}
+	return fuse.OK
+}
+
+// SetLk - FUSE call for fcntl(F_SETLK) and non-blocking flock
+//
+// fdLock is held so Release() cannot miss the new lock.
+func (f *file) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return fuse.EBADF
+	}
+	f.addLockOwner(owner)
+	l := openfiletable.Lock{Owner: owner, Start: lk.Start, End: lk.End, Typ: lk.Typ, Pid: lk.Pid}
+	if !f.lockTable(flags).TryLock(l) {
+		return fuse.EAGAIN
+	}
+	return fuse.OK
+}
+
+// SetLkw - FUSE call for fcntl(F_SETLKW) and blocking flock
+//
+// We do not hold fdLock while waiting so a concurrent Release() of another
+// handle is not blocked. Release() of this handle cancels the wait, and
+// Wait() checks for that before taking the lock.
+func (f *file) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	if status := f.checkReleased(); !status.Ok() {
+		return status
+	}
+	f.addLockOwner(owner)
+	l := openfiletable.Lock{Owner: owner, Start: lk.Start, End: lk.End, Typ: lk.Typ, Pid: lk.Pid}
+	if !f.lockTable(flags).Wait(l, f.lockCancel) {
+		return fuse.Status(syscall.EINTR)
+	}
+	return fuse.OK
+}
@@ -0,0 +1,143 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestLockContention checks that an exclusive lock held through one file
+// handle is seen by a second handle: SetLk fails, GetLk reports the lock
+// and SetLkw blocks until the lock is released.
+func TestLockContention(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f1, code := fs.Create("foo", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f1.Release()
+	f2, code := fs.Open("foo", uint32(os.O_RDWR), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f2.Release()
+	h1 := f1.(*file)
+	h2 := f2.(*file)
+	const owner1, owner2 = 1, 2
+
+	// Byte-range lock on 100...199
+	lk := fuse.FileLock{Start: 100, End: 199, Typ: syscall.F_WRLCK, Pid: 1}
+	if code = h1.SetLk(owner1, &lk, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Non-overlapping range is free
+	free := fuse.FileLock{Start: 200, End: 299, Typ: syscall.F_WRLCK}
+	if code = h2.SetLk(owner2, &free, 0); !code.Ok() {
+		t.Errorf("non-overlapping lock: %v", code)
+	}
+	// Whole-file lock conflicts
+	whole := fuse.FileLock{Start: 0, End: ^uint64(0), Typ: syscall.F_RDLCK}
+	if code = h2.SetLk(owner2, &whole, 0); code != fuse.EAGAIN {
+		t.Errorf("want EAGAIN, got %v", code)
+	}
+	var out fuse.FileLock
+	if code = h2.GetLk(owner2, &whole, 0, &out); !code.Ok() {
+		t.Fatal(code)
+	}
+	if out.Typ != syscall.F_WRLCK || out.Start != 100 || out.End != 199 || out.Pid != 1 {
+		t.Errorf("GetLk returned wrong lock: %+v", out)
+	}
+	// flock() locks are independent of fcntl() locks
+	if code = h2.SetLk(owner2, &whole, lkFlock); !code.Ok() {
+		t.Errorf("flock: %v", code)
+	}
+
+	// SetLkw blocks until owner1 unlocks
+	done := make(chan fuse.Status)
+	go func() {
+		done <- h2.SetLkw(owner2, &whole, 0)
+	}()
+	select {
+	case code = <-done:
+		t.Fatalf("SetLkw did not block: %v", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock := fuse.FileLock{Start: 0, End: ^uint64(0), Typ: syscall.F_UNLCK}
+	if code = h1.SetLk(owner1, &unlock, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	select {
+	case code = <-done:
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetLkw did not return after unlock")
+	}
+	// Now owner2 holds a read lock, so owner1 can read-lock but not write-lock
+	rd := fuse.FileLock{Start: 0, End: 10, Typ: syscall.F_RDLCK}
+	if code = h1.SetLk(owner1, &rd, 0); !code.Ok() {
+		t.Errorf("shared read lock: %v", code)
+	}
+	if code = h1.SetLk(owner1, &lk, 0); code != fuse.EAGAIN {
+		t.Errorf("want EAGAIN, got %v", code)
+	}
+}
+
+// TestLockRelease checks that Release() gives up on a waiting SetLkw and
+// drops the locks that were taken through the handle.
+func TestLockRelease(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f1, code := fs.Create("foo", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f2, code := fs.Open("foo", uint32(os.O_RDWR), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f3, code := fs.Open("foo", uint32(os.O_RDWR), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f3.Release()
+	h1 := f1.(*file)
+	h2 := f2.(*file)
+	h3 := f3.(*file)
+	const owner1, owner2, owner3 = 1, 2, 3
+	whole := fuse.FileLock{Start: 0, End: ^uint64(0), Typ: syscall.F_WRLCK}
+	for _, flags := range []uint32{0, lkFlock} {
+		if code = h1.SetLk(owner1, &whole, flags); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+
+	done := make(chan fuse.Status)
+	go func() {
+		done <- h2.SetLkw(owner2, &whole, 0)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	f2.Release()
+	select {
+	case code = <-done:
+		if code.Ok() {
+			t.Error("SetLkw took the lock for a released handle")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetLkw did not return after Release")
+	}
+
+	f1.Release()
+	for _, flags := range []uint32{0, lkFlock} {
+		if code = h3.SetLk(owner3, &whole, flags); !code.Ok() {
+			t.Errorf("flags=%d: lock was not released: %v", flags, code)
+		}
+	}
+}
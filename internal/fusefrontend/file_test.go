@@ -0,0 +1,245 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// TestWriteFullBlockNoRMW checks that overwriting a complete, block-aligned
+// block does not read the old block: a write to a corrupted block succeeds
+// if it covers the whole block, but fails if it needs Read-Modify-Write.
+func TestWriteFullBlockNoRMW(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	bs := contentenc.DefaultBS
+	content := bytes.Repeat([]byte("x"), 3*bs)
+	if _, code = f.Write(content, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Corrupt block #1 on disk
+	cPath, err := fs.getBackingPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cBlock1 := int64(fs.contentEnc.BlockNoToCipherOff(1))
+	_, err = cf.WriteAt([]byte{0xaa, 0xbb, 0xcc}, cBlock1+100)
+	cf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A partial write has to read the corrupt block
+	if _, code = f.Write([]byte("y"), int64(bs)+10); code != fuse.EIO {
+		t.Errorf("partial write: want EIO, got %v", code)
+	}
+	// A full-block write does not
+	full := bytes.Repeat([]byte("z"), bs)
+	if _, code = f.Write(full, int64(bs)); !code.Ok() {
+		t.Fatalf("full-block write: %v", code)
+	}
+	copy(content[bs:], full)
+	buf := make([]byte, len(content))
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	out, _ := res.Bytes(buf)
+	if !bytes.Equal(out, content) {
+		t.Error("content mismatch")
+	}
+}
+
+// TestHugeOffsets checks that offsets near the int64 limit are rejected with
+// EFBIG instead of overflowing in the ciphertext offset calculation.
+func TestHugeOffsets(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	f, code := fs.Create("foo", uint32(os.O_RDWR), 0600, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, code = f.Write([]byte("x"), math.MaxInt64-10); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Write: want EFBIG, got %v", code)
+	}
+	if code = f.Truncate(math.MaxUint64); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Truncate: want EFBIG, got %v", code)
+	}
+	res, code := f.Read(make([]byte, 100), math.MaxInt64-10)
+	if !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	if res.Size() != 0 {
+		t.Errorf("Read: want no data, got %d bytes", res.Size())
+	}
+	var a fuse.Attr
+	if code = f.GetAttr(&a); !code.Ok() || a.Size != 0 {
+		t.Errorf("file was modified: size=%d, code=%v", a.Size, code)
+	}
+}
+
+// TestReadHoles checks that reading empty files, header-only files and the
+// holes in sparse files returns zeros or nothing, but never an error.
+func TestReadHoles(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	// Any warning about a hole is a bug
+	tlog.Warn.Wpanic = true
+	defer func() { tlog.Warn.Wpanic = false }()
+	ctx := &fuse.Context{}
+	bs := uint64(contentenc.DefaultBS)
+	read := func(f nodefs.File, off uint64, length int) []byte {
+		buf := make([]byte, length)
+		res, code := f.Read(buf, int64(off))
+		if !code.Ok() {
+			t.Fatalf("Read off=%d len=%d: %v", off, length, code)
+		}
+		data, _ := res.Bytes(buf)
+		return data
+	}
+	// Empty file without header
+	f1, code := fs.Create("empty", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f1.Release()
+	for _, off := range []uint64{0, 1, bs, 1000 * bs} {
+		if data := read(f1, off, 100); len(data) != 0 {
+			t.Errorf("empty file, off=%d: got %d bytes", off, len(data))
+		}
+	}
+	// Header-only file
+	f2, code := fs.Create("header", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f2.Release()
+	ff2 := f2.(*file)
+	ff2.fileTableEntry.HeaderLock.Lock()
+	_, err := ff2.createHeader()
+	ff2.fileTableEntry.HeaderLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []uint64{0, 1, bs, 1000 * bs} {
+		if data := read(f2, off, 100); len(data) != 0 {
+			t.Errorf("header-only file, off=%d: got %d bytes", off, len(data))
+		}
+	}
+	// Sparse file: data in block 0 and block 10, a hole in between
+	f3, code := fs.Create("sparse", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f3.Release()
+	if _, code = f3.Write([]byte("head"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f3.Write([]byte("tail"), int64(10*bs)); !code.Ok() {
+		t.Fatal(code)
+	}
+	zeros := make([]byte, 3*bs)
+	for _, off := range []uint64{4, 100, bs, bs + 1, 5*bs - 7, 7 * bs} {
+		if data := read(f3, off, int(3*bs)); !bytes.Equal(data, zeros) {
+			t.Errorf("sparse file, off=%d: hole does not read as zeros", off)
+		}
+	}
+	// Reads that span data and the hole
+	if data := read(f3, 0, 8); !bytes.Equal(data, []byte("head\x00\x00\x00\x00")) {
+		t.Errorf("sparse file: wrong head: %q", data)
+	}
+	if data := read(f3, 10*bs-4, 100); !bytes.Equal(data, []byte("\x00\x00\x00\x00tail")) {
+		t.Errorf("sparse file: wrong tail: %q", data)
+	}
+	// Beyond the end
+	if data := read(f3, 10*bs+4, 100); len(data) != 0 {
+		t.Errorf("sparse file: read beyond end returned %d bytes", len(data))
+	}
+}
+
+// TestRetryTransient injects errors into the backing file I/O and checks
+// that transient errors are retried within the "-retry" budget, while other
+// errors fail at once.
+func TestRetryTransient(t *testing.T) {
+	retry := syscallcompat.RetryPolicy{Max: 3, Delay: time.Millisecond}
+	fs, dir := newTestFS(t, Args{Retry: retry})
+	defer os.RemoveAll(dir)
+	defer func() {
+		preadFile = (*os.File).ReadAt
+		pwriteFile = (*os.File).WriteAt
+	}()
+	// failing returns a pread or pwrite that fails with "err" "n" times, then
+	// succeeds, and counts its calls in "calls"
+	failing := func(orig func(*os.File, []byte, int64) (int, error), err error, n int, calls *int) func(*os.File, []byte, int64) (int, error) {
+		return func(fd *os.File, buf []byte, off int64) (int, error) {
+			*calls++
+			if *calls <= n {
+				return 0, &os.PathError{Op: "pread", Path: fd.Name(), Err: err}
+			}
+			return orig(fd, buf, off)
+		}
+	}
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	content := []byte("hello world")
+	var calls int
+	pwriteFile = failing((*os.File).WriteAt, syscall.ETIMEDOUT, 2, &calls)
+	if _, code = f.Write(content, 0); !code.Ok() {
+		t.Fatalf("write: %v", code)
+	}
+	pwriteFile = (*os.File).WriteAt
+	buf := make([]byte, 100)
+	for _, tc := range []struct {
+		err       error
+		fails     int
+		ok        bool
+		wantCalls int
+	}{
+		// Succeeds within the budget
+		{syscall.EIO, retry.Max, true, 0},
+		// Gives up after the last retry
+		{syscall.EIO, retry.Max + 1, false, retry.Max + 1},
+		// Not transient, not retried
+		{syscall.EACCES, 1, false, 1},
+	} {
+		calls = 0
+		preadFile = failing((*os.File).ReadAt, tc.err, tc.fails, &calls)
+		res, code := f.Read(buf, 0)
+		preadFile = (*os.File).ReadAt
+		if code.Ok() != tc.ok {
+			t.Errorf("%v x%d: want ok=%v, got %v", tc.err, tc.fails, tc.ok, code)
+			continue
+		}
+		if tc.ok {
+			if data, _ := res.Bytes(buf); !bytes.Equal(data, content) {
+				t.Errorf("%v x%d: wrong content %q", tc.err, tc.fails, data)
+			}
+		} else if calls != tc.wantCalls {
+			t.Errorf("%v x%d: want %d calls, got %d", tc.err, tc.fails, tc.wantCalls, calls)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestForceTime checks that with "-force-time", everything reports the
+// configured time, while writes still reach the backing file and update
+// its real mtime.
+func TestForceTime(t *testing.T) {
+	forced := time.Unix(1500000000, 0)
+	fs, dir := newTestFS(t, Args{ForceTime: &forced})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	checkTimes := func(what string, a *fuse.Attr) {
+		if a.Atime != uint64(forced.Unix()) || a.Mtime != uint64(forced.Unix()) ||
+			a.Ctime != uint64(forced.Unix()) || a.Atimensec != 0 || a.Mtimensec != 0 || a.Ctimensec != 0 {
+			t.Errorf("%s: wrong times: atime=%d mtime=%d ctime=%d", what, a.Atime, a.Mtime, a.Ctime)
+		}
+	}
+	if code := fs.Mkdir("dir", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	f, code := fs.Create("dir/foo", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	content := []byte("hello world")
+	if _, code = f.Write(content, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, path := range []string{"", "dir", "dir/foo"} {
+		a, code := fs.GetAttr(path, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		checkTimes(path, a)
+	}
+	var a fuse.Attr
+	if code = f.GetAttr(&a); !code.Ok() {
+		t.Fatal(code)
+	}
+	checkTimes("file handle", &a)
+	if a.Size != uint64(len(content)) {
+		t.Errorf("wrong size %d", a.Size)
+	}
+	buf := make([]byte, 100)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if data, _ := res.Bytes(buf); !bytes.Equal(data, content) {
+		t.Errorf("wrong content %q", data)
+	}
+	// The backing file has its real mtime
+	cPath, err := fs.getBackingPath("dir/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.ModTime().Equal(forced) {
+		t.Error("the forced time has been written to the backing file")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 
+	"github.com/rfjakob/gocryptfs/internal/cachebudget"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
@@ -36,29 +37,94 @@ type FS struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Crypto backend of nameTransform and contentEnc, kept for Wipe()
+	cryptoCore *cryptocore.CryptoCore
 	// This lock is used by openWriteOnlyFile() to block concurrent opens while
 	// it relaxes the permissions on a file.
 	openWriteOnlyLock sync.RWMutex
+	// Decrypted directory listings for "-caseinsensitive"
+	ciCache ciCache
+	// Per-directory quotas, "-quota"
+	quotas []*quota
+	// Background integrity scrubber, "-scrub-interval"
+	scrub scrubber
+	// Background cache warmup, "-preload"
+	preload preloader
+	// Background mirroring to a second directory, "-replica"
+	replica replicator
+	// Open file handles, for the ctlsock "OpenFiles" request
+	openFiles openFiles
+	// Ciphertext names of the last listed directory
+	direntCache direntCache
+	// Decrypted long names of recently listed directories
+	lnCache lnCache
+	// Memory budget of the caches, "-cache-size". nil if unlimited.
+	cacheBudget *cachebudget.Budget
+	// Snapshot lock and inodes, "-cow-snapshots"
+	snapshots snapshotState
 }
 
 var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
 
 // NewFS returns a new encrypted FUSE overlay filesystem.
 func NewFS(masterkey []byte, args Args) *FS {
-	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, contentenc.DefaultIVBits, args.HKDF, args.ForceDecode)
-	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS, args.ForceDecode)
-	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64)
+	ivBits := contentenc.DefaultIVBits
+	if args.IVBits != 0 {
+		ivBits = args.IVBits
+	}
+	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, ivBits, args.HKDF, args.ForceDecode)
+	plainBS := uint64(contentenc.DefaultBS)
+	if args.Compress {
+		plainBS = contentenc.CompressedBS
+	}
+	contentEnc := contentenc.New(cryptoCore, plainBS, args.ForceDecode, args.Compress)
+	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64, args.NFCNames)
+	if args.NetworkBackend {
+		nameTransform.SetNetworkBackend()
+	}
+	if args.ParanoidDirIV {
+		nameTransform.SetParanoidDirIV()
+	}
+	if args.EncryptedDirIV {
+		nameTransform.SetDirIVCipher(cryptocore.NewDirIVAEAD(masterkey))
+	}
+	if args.NamePadding > 0 {
+		nameTransform.SetNamePadding(args.NamePadding)
+	}
+	if args.NameMax > 0 {
+		nameTransform.SetNameMax(args.NameMax)
+	}
 
 	if args.SerializeReads {
 		serialize_reads.InitSerializer()
 	}
 
-	return &FS{
+	fs := &FS{
 		FileSystem:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: nameTransform,
 		contentEnc:    contentEnc,
-	}
+		cryptoCore:    cryptoCore,
+	}
+	if args.CacheSize > 0 {
+		fs.cacheBudget = cachebudget.New(args.CacheSize)
+		nameTransform.DirIVCache.SetBudget(fs.cacheBudget)
+		fs.direntCache.account = fs.cacheBudget.Register("dirent", fs.direntCache.clear)
+		fs.ciCache.account = fs.cacheBudget.Register("caseinsensitive", fs.ciCache.clear)
+		fs.lnCache.account = fs.cacheBudget.Register("longname", fs.lnCache.clear)
+	}
+	fs.initQuotas()
+	fs.initSnapshots()
+	return fs
+}
+
+// Wipe tries to wipe the encryption keys from memory. It is called after the
+// filesystem has been unmounted, the FS must not be used afterwards.
+func (fs *FS) Wipe() {
+	fs.stopScrubber()
+	fs.stopPreload()
+	fs.stopReplicator()
+	fs.cryptoCore.Wipe()
 }
 
 // GetAttr implements pathfs.Filesystem.
@@ -72,10 +138,22 @@ func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Stat
 		return nil, fuse.ToStatus(err)
 	}
 	a, status := fs.FileSystem.GetAttr(cName, context)
+	if status == fuse.Status(syscall.ENAMETOOLONG) {
+		// The backing path is longer than PATH_MAX
+		var st syscall.Stat_t
+		if err = syscallcompat.LstatLong(fs.args.Cipherdir, cName, &st); err == nil {
+			a = &fuse.Attr{}
+			a.FromStat(&st)
+		}
+		status = fuse.ToStatus(err)
+	}
 	if a == nil {
 		tlog.Debug.Printf("FS.GetAttr failed: %s", status.String())
 		return a, status
 	}
+	if a.IsRegular() && fs.isSymlinkFile(cName, a.Size) {
+		a.Mode = syscall.S_IFLNK | 0777
+	}
 	if a.IsRegular() {
 		a.Size = fs.contentEnc.CipherSizeToPlainSize(a.Size)
 	} else if a.IsSymlink() {
@@ -85,9 +163,18 @@ func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Stat
 	if fs.args.ForceOwner != nil {
 		a.Owner = *fs.args.ForceOwner
 	}
+	fs.forceTime(a)
 	return a, status
 }
 
+// forceTime replaces the timestamps in "a" by the "-force-time" setting,
+// if there is one. The backing files keep their real timestamps.
+func (fs *FS) forceTime(a *fuse.Attr) {
+	if t := fs.args.ForceTime; t != nil {
+		a.SetTimes(t, t, t)
+	}
+}
+
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
 // wants to the flags we internally use to open the backing file.
 func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
@@ -104,21 +191,38 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 
 // Open implements pathfs.Filesystem.
 func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	fuseFile, status = fs.openFile(path, flags)
+	if !status.Ok() {
+		return nil, status
+	}
+	return fs.cacheHint(path, fuseFile), fuse.OK
+}
+
+// openFile opens the plaintext file "path" and returns the *file, without
+// the wrapper that "-direct-io" may add in Open.
+func (fs *FS) openFile(path string, flags uint32) (fuseFile nodefs.File, status fuse.Status) {
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		defer fs.snapshotRLock()()
+		if err := fs.cowBreak(path); err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+	}
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	fs.openWriteOnlyLock.RLock()
 	defer fs.openWriteOnlyLock.RUnlock()
 
 	newFlags := fs.mangleOpenFlags(flags)
-	cPath, err := fs.getBackingPath(path)
+	cRelPath, err := fs.encryptPath(path)
 	if err != nil {
-		tlog.Debug.Printf("Open: getBackingPath: %v", err)
+		tlog.Debug.Printf("Open: encryptPath: %v", err)
 		return nil, fuse.ToStatus(err)
 	}
+	cPath := filepath.Join(fs.args.Cipherdir, cRelPath)
 	tlog.Debug.Printf("Open: %s", cPath)
-	f, err := os.OpenFile(cPath, newFlags, 0)
+	f, err := fs.openBackingFile(cRelPath, newFlags)
 	if err != nil {
 		sysErr := err.(*os.PathError).Err
 		if sysErr == syscall.EMFILE {
@@ -127,19 +231,19 @@ func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile n
 			tlog.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", cPath, lim.Cur)
 		}
 		if sysErr == syscall.EACCES && (int(flags)&os.O_WRONLY > 0) {
-			return fs.openWriteOnlyFile(cPath, newFlags)
+			return fs.openWriteOnlyFile(path, cRelPath, newFlags)
 		}
 		return nil, fuse.ToStatus(err)
 	}
-	return NewFile(f, fs)
+	return fs.newFile(f, path, flags)
 }
 
 // Due to RMW, we always need read permissions on the backing file. This is a
 // problem if the file permissions do not allow reading (i.e. 0200 permissions).
 // This function works around that problem by chmod'ing the file, obtaining a fd,
 // and chmod'ing it back.
-func (fs *FS) openWriteOnlyFile(cPath string, newFlags int) (fuseFile nodefs.File, status fuse.Status) {
-	woFd, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+func (fs *FS) openWriteOnlyFile(path string, cRelPath string, newFlags int) (fuseFile nodefs.File, status fuse.Status) {
+	woFd, err := fs.openBackingFileAt(cRelPath, os.O_WRONLY)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -148,7 +252,8 @@ func (fs *FS) openWriteOnlyFile(cPath string, newFlags int) (fuseFile nodefs.Fil
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	perms := fi.Mode().Perm()
+	// fi.Mode().Perm() would lose the setuid, setgid and sticky bits
+	perms := uint32(fi.Sys().(*syscall.Stat_t).Mode) & 07777
 	// Verify that we don't have read permissions
 	if perms&0400 != 0 {
 		tlog.Warn.Printf("openWriteOnlyFile: unexpected permissions %#o, returning EPERM", perms)
@@ -162,76 +267,112 @@ func (fs *FS) openWriteOnlyFile(cPath string, newFlags int) (fuseFile nodefs.Fil
 		fs.openWriteOnlyLock.RLock()
 	}()
 	// Relax permissions and revert on return
-	err = woFd.Chmod(perms | 0400)
+	err = syscall.Fchmod(int(woFd.Fd()), perms|0400)
 	if err != nil {
 		tlog.Warn.Printf("openWriteOnlyFile: changing permissions failed: %v", err)
 		return nil, fuse.ToStatus(err)
 	}
 	defer func() {
-		err2 := woFd.Chmod(perms)
+		err2 := syscall.Fchmod(int(woFd.Fd()), perms)
 		if err2 != nil {
 			tlog.Warn.Printf("openWriteOnlyFile: reverting permissions failed: %v", err2)
 		}
 	}()
-	rwFd, err := os.OpenFile(cPath, newFlags, 0)
+	rwFd, err := fs.openBackingFile(cRelPath, newFlags)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	return NewFile(rwFd, fs)
+	// We only get here for O_WRONLY opens
+	return fs.newFile(rwFd, path, syscall.O_WRONLY)
 }
 
 // Create implements pathfs.Filesystem.
 func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
-	if fs.isFiltered(path) {
+	if fs.isFilteredCreate(path) {
 		return nil, fuse.EPERM
 	}
+	if !fs.namePolicyOK(path) {
+		return nil, fuse.EINVAL
+	}
+	defer fs.snapshotRLock()()
 	newFlags := fs.mangleOpenFlags(flags)
-	cPath, err := fs.getBackingPath(path)
+	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-
-	var fd *os.File
-	cName := filepath.Base(cPath)
+	defer dirfd.Close()
+	cPath := filepath.Join(dirfd.Name(), cName)
+	mode = fs.createMode(mode)
 
 	// Handle long file name
 	if nametransform.IsLongContent(cName) {
-		var dirfd *os.File
-		dirfd, err = os.Open(filepath.Dir(cPath))
-		if err != nil {
-			return nil, fuse.ToStatus(err)
-		}
-		defer dirfd.Close()
-
 		// Create ".name"
 		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
 		if err != nil {
 			return nil, fuse.ToStatus(err)
 		}
-
-		// Create content
-		var fdRaw int
-		fdRaw, err = syscallcompat.Openat(int(dirfd.Fd()), cName, newFlags|os.O_CREATE|os.O_EXCL, mode)
-		if err != nil {
+	}
+	// Create content. Openat keeps the setuid, setgid and sticky bits in
+	// "mode", which os.OpenFile would drop.
+	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), cName, newFlags|os.O_CREATE|os.O_EXCL|syscall.O_CLOEXEC, mode)
+	if err != nil {
+		if nametransform.IsLongContent(cName) {
 			nametransform.DeleteLongName(dirfd, cName)
-			return nil, fuse.ToStatus(err)
-		}
-		fd = os.NewFile(uintptr(fdRaw), cName)
-	} else {
-		// Normal (short) file name
-		fd, err = os.OpenFile(cPath, newFlags|os.O_CREATE|os.O_EXCL, os.FileMode(mode))
-		if err != nil {
-			return nil, fuse.ToStatus(err)
 		}
+		return nil, fuse.ToStatus(err)
 	}
+	fd := os.NewFile(uintptr(fdRaw), cPath)
 	// Set owner
 	if fs.args.PreserveOwner {
 		err = fd.Chown(int(context.Owner.Uid), int(context.Owner.Gid))
 		if err != nil {
 			tlog.Warn.Printf("Create: fd.Chown failed: %v", err)
 		}
+		// Chown has cleared the setuid and setgid bits
+		if mode&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+			err = syscall.Fchmod(int(fd.Fd()), mode&07777)
+			if err != nil {
+				tlog.Warn.Printf("Create: Fchmod failed: %v", err)
+			}
+		}
+	}
+	err = fs.syncEntry(dirfd, cName)
+	if err != nil {
+		fd.Close()
+		return nil, fuse.ToStatus(err)
+	}
+	fs.replicate(path)
+	fuseFile, code = fs.newFile(fd, path, flags)
+	if !code.Ok() {
+		return nil, code
+	}
+	return fs.cacheHint(path, fuseFile), fuse.OK
+}
+
+// createMode applies "-create-umask" and "-force-mode" to the mode of a
+// new file, directory or device node.
+func (fs *FS) createMode(mode uint32) uint32 {
+	return mode&^fs.args.CreateUmask | fs.args.ForceMode
+}
+
+// setModeAt sets the mode of the new backing file or directory "cName" in
+// "dirfd" to "mode", including the setuid, setgid and sticky bits that
+// mkdir(2) ignores and chown(2) clears. A directory keeps the setgid bit it
+// has inherited from its parent, like on a local filesystem.
+func setModeAt(dirfd int, cName string, mode uint32) error {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
 	}
-	return NewFile(fd, fs)
+	mode &= 07777
+	if uint32(st.Mode)&syscall.S_IFMT == syscall.S_IFDIR {
+		mode |= uint32(st.Mode) & syscall.S_ISGID
+	}
+	if uint32(st.Mode)&07777 == mode {
+		return nil
+	}
+	return syscallcompat.Fchmodat(dirfd, cName, mode, unix.AT_SYMLINK_NOFOLLOW)
 }
 
 // Chmod implements pathfs.Filesystem.
@@ -239,14 +380,21 @@ func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	defer fs.snapshotRLock()()
 	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	if err = fs.cowBreakAt(dirfd, cName); err != nil {
+		return fuse.ToStatus(err)
+	}
 	// os.Chmod goes through the "syscallMode" translation function that messes
 	// up the suid and sgid bits. So use a syscall directly.
 	err = syscallcompat.Fchmodat(int(dirfd.Fd()), cName, mode, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		fs.replicate(path)
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -255,11 +403,15 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	defer fs.snapshotRLock()()
 	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	if err = fs.cowBreakAt(dirfd, cName); err != nil {
+		return fuse.ToStatus(err)
+	}
 	code = fuse.ToStatus(syscallcompat.Fchownat(int(dirfd.Fd()), cName, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW))
 	if !code.Ok() {
 		return code
@@ -272,19 +424,32 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 		dirIVPath := filepath.Join(cName, nametransform.DirIVFilename)
 		syscallcompat.Fchownat(int(dirfd.Fd()), dirIVPath, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW)
 	}
+	fs.replicate(path)
 	return fuse.OK
 }
 
+// Only explain once why device nodes cannot be created
+var mknodDeviceInfoOnce sync.Once
+
 // Mknod implements pathfs.Filesystem.
+//
+// Creates FIFOs, sockets, device nodes and empty regular files. The backing
+// node has the same type, only its name is encrypted. Creating device nodes
+// needs CAP_MKNOD, so an unprivileged gocryptfs gets EPERM.
 func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
+	if fs.isFilteredCreate(path) {
 		return fuse.EPERM
 	}
+	if !fs.namePolicyOK(path) {
+		return fuse.EINVAL
+	}
+	defer fs.snapshotRLock()()
 	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	mode = fs.createMode(mode)
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
@@ -301,6 +466,13 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 		err = syscallcompat.Mknodat(int(dirfd.Fd()), cName, mode, int(dev))
 	}
 	if err != nil {
+		typ := mode & syscall.S_IFMT
+		if err == syscall.EPERM && (typ == syscall.S_IFCHR || typ == syscall.S_IFBLK) {
+			mknodDeviceInfoOnce.Do(func() {
+				tlog.Info.Printf("Mknod %q: creating device nodes requires root (CAP_MKNOD) "+
+					"and a backing filesystem that allows them, returning EPERM", path)
+			})
+		}
 		return fuse.ToStatus(err)
 	}
 	// Set owner
@@ -310,8 +482,15 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 		if err != nil {
 			tlog.Warn.Printf("Mknod: Fchownat failed: %v", err)
 		}
+		if mode&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+			err = setModeAt(int(dirfd.Fd()), cName, mode)
+			if err != nil {
+				tlog.Warn.Printf("Mknod: setModeAt failed: %v", err)
+			}
+		}
 	}
-	return fuse.OK
+	fs.replicate(path)
+	return fuse.ToStatus(fs.syncEntry(dirfd, cName))
 }
 
 // Truncate implements pathfs.Filesystem.
@@ -328,16 +507,26 @@ func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code
 	return code
 }
 
-// Utimens implements pathfs.Filesystem.
+// Utimens implements pathfs.Filesystem. The times are set with nanosecond
+// precision.
 func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Context) (code fuse.Status) {
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
-	cPath, err := fs.encryptPath(path)
+	defer fs.snapshotRLock()()
+	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fs.FileSystem.Utimens(cPath, a, m, context)
+	defer dirfd.Close()
+	if err = fs.cowBreakAt(dirfd, cName); err != nil {
+		return fuse.ToStatus(err)
+	}
+	err = syscallcompat.Utimensat(int(dirfd.Fd()), cName, a, m, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		fs.replicate(path)
+	}
+	return fuse.ToStatus(err)
 }
 
 // StatFs implements pathfs.Filesystem.
@@ -345,20 +534,41 @@ func (fs *FS) StatFs(path string) *fuse.StatfsOut {
 	if fs.isFiltered(path) {
 		return nil
 	}
-	cPath, err := fs.encryptPath(path)
+	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return nil
 	}
-	return fs.FileSystem.StatFs(cPath)
+	defer dirfd.Close()
+	// Symlinks and files we cannot read cannot be opened, use the parent
+	// directory for them. It is on the same filesystem unless "path" is
+	// a mount point inside CIPHERDIR.
+	fd := int(dirfd.Fd())
+	if fd2, err := syscallcompat.Openat(fd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0); err == nil {
+		defer syscall.Close(fd2)
+		fd = fd2
+	}
+	var st syscall.Statfs_t
+	if err = syscall.Fstatfs(fd, &st); err != nil {
+		return nil
+	}
+	out := &fuse.StatfsOut{}
+	out.FromStatfsT(&st)
+	return out
 }
 
 // Readlink implements pathfs.Filesystem.
 func (fs *FS) Readlink(path string, context *fuse.Context) (out string, status fuse.Status) {
-	cPath, err := fs.getBackingPath(path)
+	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return "", fuse.ToStatus(err)
 	}
-	cTarget, err := os.Readlink(cPath)
+	defer dirfd.Close()
+	cTarget, err := syscallcompat.Readlinkat(int(dirfd.Fd()), cName)
+	if fs.args.SymlinkFiles && err == syscall.EINVAL {
+		// Not a symlink, may be a symlink file
+		target, err := fs.readSymlinkFile(dirfd, cName)
+		return target, fuse.ToStatus(err)
+	}
 	if err != nil {
 		return "", fuse.ToStatus(err)
 	}
@@ -384,43 +594,60 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	defer fs.snapshotRLock()()
 	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	// Moving the file to the trash also frees its quota
+	var freed uint64
+	q := fs.quotaFor(path)
+	if q != nil {
+		freed = fs.quotaFileSize(dirfd, cName)
+	}
 	// Delete content
-	err = syscallcompat.Unlinkat(int(dirfd.Fd()), cName, 0)
+	if fs.args.Trash {
+		err = fs.moveToTrash(dirfd, cName, path)
+	} else {
+		err = syscallcompat.Unlinkat(int(dirfd.Fd()), cName, 0)
+	}
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	if q != nil {
+		q.release(freed)
+	}
 	// Delete ".name" file
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = nametransform.DeleteLongName(dirfd, cName)
 		if err != nil {
 			tlog.Warn.Printf("Unlink: could not delete .name file: %v", err)
+			return fuse.ToStatus(err)
 		}
 	}
-	return fuse.ToStatus(err)
+	fs.replicate(path)
+	if fs.args.Trash {
+		fs.replicateCipher(TrashDirName)
+	}
+	return fuse.ToStatus(fs.syncEntry(dirfd, cName))
 }
 
 // Symlink implements pathfs.Filesystem.
 func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (code fuse.Status) {
 	tlog.Debug.Printf("Symlink(\"%s\", \"%s\")", target, linkName)
-	if fs.isFiltered(linkName) {
+	if fs.isFilteredCreate(linkName) {
 		return fuse.EPERM
 	}
+	if !fs.namePolicyOK(linkName) {
+		return fuse.EINVAL
+	}
+	defer fs.snapshotRLock()()
 	dirfd, cName, err := fs.openBackingPath(linkName)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
-	var cTarget string = target
-	if !fs.args.PlaintextNames {
-		// Symlinks are encrypted like file contents (GCM) and base64-encoded
-		cBinTarget := fs.contentEnc.EncryptBlock([]byte(target), 0, nil)
-		cTarget = fs.nameTransform.B64.EncodeToString(cBinTarget)
-	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = fs.nameTransform.WriteLongName(dirfd, cName, linkName)
@@ -428,13 +655,13 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 			return fuse.ToStatus(err)
 		}
 		// Create "gocryptfs.longfile." symlink
-		err = syscallcompat.Symlinkat(cTarget, int(dirfd.Fd()), cName)
+		err = fs.createSymlink(int(dirfd.Fd()), cName, target)
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cName)
 		}
 	} else {
 		// Create symlink
-		err = syscallcompat.Symlinkat(cTarget, int(dirfd.Fd()), cName)
+		err = fs.createSymlink(int(dirfd.Fd()), cName, target)
 	}
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -447,97 +674,134 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 			tlog.Warn.Printf("Symlink: Fchownat failed: %v", err)
 		}
 	}
-	return fuse.OK
+	fs.replicate(linkName)
+	return fuse.ToStatus(fs.syncEntry(dirfd, cName))
 }
 
 // Rename implements pathfs.Filesystem.
+//
+// The new name is encrypted with the DirIV of the destination directory, so
+// moving a file to another directory renames the backing file to a
+// completely different name. For long names, the destination .name file is
+// written before and the source .name file is deleted after the backing
+// file has been renamed, so the file has a .name file at all times.
 func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
+	if fs.isFilteredCreate(newPath) {
 		return fuse.EPERM
 	}
-	cOldPath, err := fs.getBackingPath(oldPath)
+	if !fs.namePolicyOK(newPath) {
+		return fuse.EINVAL
+	}
+	if !fs.quotaRenameOK(oldPath, newPath) {
+		return fuse.Status(syscall.EXDEV)
+	}
+	defer fs.snapshotRLock()()
+	oldDirFd, cOldName, err := fs.openBackingPath(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	cNewPath, err := fs.getBackingPath(newPath)
+	defer oldDirFd.Close()
+	newDirFd, cNewName, err := fs.openBackingPath(newPath)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	defer newDirFd.Close()
+	// An overwritten file frees its quota
+	var freed uint64
+	q := fs.quotaFor(newPath)
+	if q != nil {
+		freed = fs.quotaFileSize(newDirFd, cNewName)
+	}
 	// The Rename may cause a directory to take the place of another directory.
 	// That directory may still be in the DirIV cache, clear it.
 	fs.nameTransform.DirIVCache.Clear()
 
-	// Handle long source file name
-	var oldDirFd *os.File
-	var finalOldDirFd int
-	var finalOldPath = cOldPath
-	cOldName := filepath.Base(cOldPath)
-	if nametransform.IsLongContent(cOldName) {
-		oldDirFd, err = os.Open(filepath.Dir(cOldPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer oldDirFd.Close()
-		finalOldDirFd = int(oldDirFd.Fd())
-		// Use relative path
-		finalOldPath = cOldName
-	}
-	// Handle long destination file name
-	var newDirFd *os.File
-	var finalNewDirFd int
-	var finalNewPath = cNewPath
-	cNewName := filepath.Base(cNewPath)
-	if nametransform.IsLongContent(cNewName) {
-		newDirFd, err = os.Open(filepath.Dir(cNewPath))
-		if err != nil {
-			return fuse.ToStatus(err)
-		}
-		defer newDirFd.Close()
-		finalNewDirFd = int(newDirFd.Fd())
-		// Use relative path
-		finalNewPath = cNewName
+	// Did we create the destination .name file? Only then we delete it on error.
+	var createdName bool
+	newLong := nametransform.IsLongContent(cNewName)
+	if newLong {
 		// Create destination .name file
 		err = fs.nameTransform.WriteLongName(newDirFd, cNewName, newPath)
 		// Failure to write the .name file is expected when the target path already
 		// exists. Since hashes are pretty unique, there is no need to modify the
-		// file anyway. We still set newDirFd to nil to ensure that we do not delete
-		// the file on error.
-		if err == syscall.EEXIST {
-			newDirFd = nil
-		} else if err != nil {
+		// file anyway.
+		if err == nil {
+			createdName = true
+		} else if err != syscall.EEXIST {
 			return fuse.ToStatus(err)
 		}
 	}
 	// Actual rename
-	tlog.Debug.Printf("Renameat oldfd=%d oldpath=%s newfd=%d newpath=%s\n", finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
-	err = syscallcompat.Renameat(finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
-	if err == syscall.ENOTEMPTY || err == syscall.EEXIST {
+	tlog.Debug.Printf("Renameat oldfd=%d oldname=%s newfd=%d newname=%s\n", oldDirFd.Fd(), cOldName, newDirFd.Fd(), cNewName)
+	err = syscallcompat.Renameat(int(oldDirFd.Fd()), cOldName, int(newDirFd.Fd()), cNewName)
+	if err == syscall.EXDEV {
+		// Source and destination are on different filesystems inside
+		// CIPHERDIR, for example because of a mount point. Applications
+		// fall back to copy and delete on EXDEV, so it must get through
+		// unchanged, and nothing may be left behind at the destination.
+		tlog.Debug.Printf("Rename: %q and %q are on different devices", oldPath, newPath)
+	} else if err == syscall.ENOTEMPTY || err == syscall.EEXIST {
 		// If an empty directory is overwritten we will always get an error as
 		// the "empty" directory will still contain gocryptfs.diriv.
 		// Interestingly, ext4 returns ENOTEMPTY while xfs returns EEXIST.
 		// We handle that by trying to fs.Rmdir() the target directory and trying
 		// again.
 		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
-		if fs.Rmdir(newPath, context) == fuse.OK {
-			err = syscallcompat.Renameat(finalOldDirFd, finalOldPath, finalNewDirFd, finalNewPath)
+		if fs.rmdir(newPath) == fuse.OK {
+			err = nil
+			// Rmdir has deleted the .name file the target directory shared
+			// with us
+			if newLong && !createdName {
+				err = fs.nameTransform.WriteLongName(newDirFd, cNewName, newPath)
+				createdName = err == nil
+			}
+			if err == nil {
+				err = syscallcompat.Renameat(int(oldDirFd.Fd()), cOldName, int(newDirFd.Fd()), cNewName)
+			}
 		}
 	}
 	if err != nil {
-		if newDirFd != nil {
+		if createdName {
 			// Roll back .name creation
 			nametransform.DeleteLongName(newDirFd, cNewName)
 		}
 		return fuse.ToStatus(err)
 	}
-	if oldDirFd != nil {
-		nametransform.DeleteLongName(oldDirFd, cOldName)
+	// Renaming a file onto itself, or onto another hard link to it, succeeds
+	// without doing anything. The source still exists then and needs its
+	// .name file.
+	if nametransform.IsLongContent(cOldName) {
+		var st unix.Stat_t
+		if syscallcompat.Fstatat(int(oldDirFd.Fd()), cOldName, &st, unix.AT_SYMLINK_NOFOLLOW) == syscall.ENOENT {
+			nametransform.DeleteLongName(oldDirFd, cOldName)
+		}
 	}
-	return fuse.OK
+	if q != nil {
+		q.release(freed)
+	}
+	fs.openFiles.rename(oldPath, newPath)
+	fs.replicate(oldPath, newPath)
+	err = fs.syncEntry(newDirFd, cNewName)
+	if err == nil && filepath.Dir(oldPath) != filepath.Dir(newPath) {
+		err = fs.syncEntry(oldDirFd, cOldName)
+	}
+	return fuse.ToStatus(err)
 }
 
 // Link implements pathfs.Filesystem.
 func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
+	if fs.isFilteredCreate(newPath) {
+		return fuse.EPERM
+	}
+	if !fs.namePolicyOK(newPath) {
+		return fuse.EINVAL
+	}
+	if !fs.quotaRenameOK(oldPath, newPath) {
+		return fuse.Status(syscall.EXDEV)
+	}
+	if fs.args.Snapshots {
+		// Copy on write copies one name at a time, which would split the
+		// hard link. See snapshot.go.
 		return fuse.EPERM
 	}
 	oldDirFd, cOldName, err := fs.openBackingPath(oldPath)
@@ -565,7 +829,11 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 		// Create regular link
 		err = syscallcompat.Linkat(int(oldDirFd.Fd()), cOldName, int(newDirFd.Fd()), cNewName, 0)
 	}
-	return fuse.ToStatus(err)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	fs.replicate(newPath)
+	return fuse.ToStatus(fs.syncEntry(newDirFd, cNewName))
 }
 
 // Access implements pathfs.Filesystem.
@@ -573,29 +841,10 @@ func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
-	cPath, err := fs.getBackingPath(path)
+	dirfd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fuse.ToStatus(syscall.Access(cPath, mode))
-}
-
-// GetXAttr implements pathfs.Filesystem.
-func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-// SetXAttr implements pathfs.Filesystem.
-func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
-}
-
-// ListXAttr implements pathfs.Filesystem.
-func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-// RemoveXAttr implements pathfs.Filesystem.
-func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
+	defer dirfd.Close()
+	return fuse.ToStatus(syscallcompat.Faccessat(int(dirfd.Fd()), cName, mode))
 }
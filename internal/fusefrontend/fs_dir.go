@@ -4,7 +4,6 @@ package fusefrontend
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -40,7 +39,7 @@ func (fs *FS) mkdirWithIv(dirfd *os.File, cName string, mode uint32) error {
 		return err
 	}
 	// Create gocryptfs.diriv
-	err = nametransform.WriteDirIV(dirfd, cName)
+	err = fs.nameTransform.WriteDirIV(dirfd, cName)
 	if err != nil {
 		err2 := syscallcompat.Unlinkat(int(dirfd.Fd()), cName, unix.AT_REMOVEDIR)
 		if err2 != nil {
@@ -52,16 +51,31 @@ func (fs *FS) mkdirWithIv(dirfd *os.File, cName string, mode uint32) error {
 
 // Mkdir implements pathfs.FileSystem
 func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(newPath) {
+	if fs.isFilteredCreate(newPath) {
 		return fuse.EPERM
 	}
+	if !fs.namePolicyOK(newPath) {
+		return fuse.EINVAL
+	}
+	defer fs.snapshotRLock()()
 	dirfd, cName, err := fs.openBackingPath(newPath)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	mode = fs.createMode(mode)
 	if fs.args.PlaintextNames {
 		err = syscallcompat.Mkdirat(int(dirfd.Fd()), cName, mode)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		// mkdir(2) ignores the setuid and setgid bits
+		if mode&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+			err = setModeAt(int(dirfd.Fd()), cName, mode)
+			if err != nil {
+				tlog.Warn.Printf("Mkdir: setModeAt failed: %v", err)
+			}
+		}
 		// Set owner
 		if fs.args.PreserveOwner {
 			err = syscallcompat.Fchownat(int(dirfd.Fd()), cName, int(context.Owner.Uid),
@@ -70,7 +84,8 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 				tlog.Warn.Printf("Mkdir: Fchownat failed: %v", err)
 			}
 		}
-		return fuse.ToStatus(err)
+		fs.replicate(newPath)
+		return fuse.ToStatus(fs.syncNewDir(dirfd, cName))
 	}
 
 	// We need write and execute permissions to create gocryptfs.diriv
@@ -97,11 +112,12 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 			return fuse.ToStatus(err)
 		}
 	}
-	// Set permissions back to what the user wanted
-	if origMode != mode {
-		err = syscallcompat.Fchmodat(int(dirfd.Fd()), cName, origMode, unix.AT_SYMLINK_NOFOLLOW)
+	// Set permissions back to what the user wanted. mkdir(2) also ignores
+	// the setuid and setgid bits.
+	if origMode != mode || origMode&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+		err = setModeAt(int(dirfd.Fd()), cName, origMode)
 		if err != nil {
-			tlog.Warn.Printf("Mkdir: Fchmodat failed: %v", err)
+			tlog.Warn.Printf("Mkdir: setModeAt failed: %v", err)
 		}
 	}
 	// Set owner
@@ -117,65 +133,68 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 			tlog.Warn.Printf("Mkdir: Fchownat 2 failed: %v", err)
 		}
 	}
-	return fuse.OK
-}
-
-// haveDsstore return true if one of the entries in "names" is ".DS_Store".
-func haveDsstore(names []string) bool {
-	for _, n := range names {
-		if n == dsStoreName {
-			return true
-		}
-	}
-	return false
+	fs.replicate(newPath)
+	return fuse.ToStatus(fs.syncNewDir(dirfd, cName))
 }
 
 // Rmdir implements pathfs.FileSystem
 func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
-	cPath, err := fs.getBackingPath(path)
+	defer fs.snapshotRLock()()
+	return fs.rmdir(path)
+}
+
+// rmdir is Rmdir without the snapshot lock, for Rename, which already holds
+// it.
+func (fs *FS) rmdir(path string) (code fuse.Status) {
+	defer func() {
+		if code.Ok() {
+			fs.replicate(path)
+			if fs.args.Trash {
+				fs.replicateCipher(TrashDirName)
+			}
+		}
+	}()
+	parentDirFd, cName, err := fs.openBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	defer parentDirFd.Close()
 	if fs.args.PlaintextNames {
-		err = syscall.Rmdir(cPath)
-		return fuse.ToStatus(err)
-	}
-	parentDir := filepath.Dir(cPath)
-	parentDirFd, err := os.Open(parentDir)
-	if err != nil {
+		if fs.args.Trash {
+			return fs.rmdirToTrash(path, parentDirFd, cName)
+		}
+		err = syscallcompat.Unlinkat(int(parentDirFd.Fd()), cName, unix.AT_REMOVEDIR)
+		if err == nil {
+			err = fs.syncEntry(parentDirFd, cName)
+		}
 		return fuse.ToStatus(err)
 	}
-	defer parentDirFd.Close()
+	cPath := filepath.Join(parentDirFd.Name(), cName)
 
-	cName := filepath.Base(cPath)
 	dirfdRaw, err := syscallcompat.Openat(int(parentDirFd.Fd()), cName,
 		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err == syscall.EACCES {
 		// We need permission to read and modify the directory
 		tlog.Debug.Printf("Rmdir: handling EACCESS")
-		// TODO use syscall.Fstatat once it is available in Go
-		var fi os.FileInfo
-		fi, err = os.Lstat(cPath)
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(int(parentDirFd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW)
 		if err != nil {
 			tlog.Debug.Printf("Rmdir: Stat: %v", err)
 			return fuse.ToStatus(err)
 		}
-		origMode := fi.Mode()
-		// TODO use syscall.Chmodat once it is available in Go
-		err = os.Chmod(cPath, origMode|0700)
+		origMode := uint32(st.Mode) & 07777
+		err = syscallcompat.Fchmodat(int(parentDirFd.Fd()), cName, origMode|0700, unix.AT_SYMLINK_NOFOLLOW)
 		if err != nil {
 			tlog.Debug.Printf("Rmdir: Chmod failed: %v", err)
 			return fuse.ToStatus(err)
 		}
 		// Retry open
-		var st syscall.Stat_t
-		syscall.Lstat(cPath, &st)
 		dirfdRaw, err = syscallcompat.Openat(int(parentDirFd.Fd()), cName,
 			syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
 		// Undo the chmod if removing the directory failed
 		defer func() {
 			if code != fuse.OK {
-				err = os.Chmod(cPath, origMode)
+				err = syscallcompat.Fchmodat(int(parentDirFd.Fd()), cName, origMode, unix.AT_SYMLINK_NOFOLLOW)
 				if err != nil {
 					tlog.Warn.Printf("Rmdir: Chmod rollback failed: %v", err)
 				}
@@ -189,22 +208,18 @@ func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
 	dirfd := os.NewFile(uintptr(dirfdRaw), cName)
 	defer dirfd.Close()
 retry:
-	// Check directory contents
-	children, err := dirfd.Readdirnames(10)
-	if err == io.EOF {
-		// The directory is empty
-		tlog.Warn.Printf("Rmdir: %q: gocryptfs.diriv is missing", cPath)
-		return fuse.ToStatus(syscall.Rmdir(cPath))
-	}
+	// Check directory contents. We only need to find one entry besides
+	// gocryptfs.diriv, not read the whole directory.
+	child, err := syscallcompat.FirstDirEntry(int(dirfd.Fd()), nametransform.DirIVFilename)
 	if err != nil {
-		tlog.Warn.Printf("Rmdir: Readdirnames: %v", err)
+		tlog.Warn.Printf("Rmdir: FirstDirEntry: %v", err)
 		return fuse.ToStatus(err)
 	}
 	// MacOS sprinkles .DS_Store files everywhere. This is hard to avoid for
 	// users, so handle it transparently here.
-	if runtime.GOOS == "darwin" && len(children) <= 2 && haveDsstore(children) {
+	if runtime.GOOS == "darwin" && child == dsStoreName {
 		ds := filepath.Join(cPath, dsStoreName)
-		err = syscall.Unlink(ds)
+		err = syscallcompat.Unlinkat(int(dirfd.Fd()), dsStoreName, 0)
 		if err != nil {
 			tlog.Warn.Printf("Rmdir: failed to delete blocking file %q: %v", ds, err)
 			return fuse.ToStatus(err)
@@ -214,9 +229,21 @@ retry:
 	}
 	// If the directory is not empty besides gocryptfs.diriv, do not even
 	// attempt the dance around gocryptfs.diriv.
-	if len(children) > 1 {
+	if child != "" {
 		return fuse.ToStatus(syscall.ENOTEMPTY)
 	}
+	if fs.args.Trash {
+		// The directory is moved including its gocryptfs.diriv
+		err = fs.moveToTrash(parentDirFd, cName, path)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		if nametransform.IsLongContent(cName) {
+			nametransform.DeleteLongName(parentDirFd, cName)
+		}
+		fs.nameTransform.DirIVCache.Clear()
+		return fuse.ToStatus(fs.syncEntry(parentDirFd, cName))
+	}
 	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
 	tmpName := fmt.Sprintf("gocryptfs.diriv.rmdir.%d", cryptocore.RandUint64())
 	tlog.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
@@ -226,6 +253,11 @@ retry:
 	defer fs.dirIVLock.Unlock()
 	err = syscallcompat.Renameat(int(dirfd.Fd()), nametransform.DirIVFilename,
 		int(parentDirFd.Fd()), tmpName)
+	if err == syscall.ENOENT {
+		// The directory is empty
+		tlog.Warn.Printf("Rmdir: %q: gocryptfs.diriv is missing", cPath)
+		return fuse.ToStatus(syscallcompat.Unlinkat(int(parentDirFd.Fd()), cName, unix.AT_REMOVEDIR))
+	}
 	if err != nil {
 		tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
 			nametransform.DirIVFilename, tmpName, err)
@@ -254,40 +286,126 @@ retry:
 	}
 	// The now-deleted directory may have been in the DirIV cache. Clear it.
 	fs.nameTransform.DirIVCache.Clear()
-	return fuse.OK
+	return fuse.ToStatus(fs.syncEntry(parentDirFd, cName))
+}
+
+// rmdirToTrash is the plaintextnames-mode Rmdir for "-trash". As Rmdir,
+// it only accepts empty directories.
+func (fs *FS) rmdirToTrash(path string, parentDirFd *os.File, cName string) fuse.Status {
+	dirfd, err := syscallcompat.Openat(int(parentDirFd.Fd()), cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	child, err := syscallcompat.FirstDirEntry(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if child != "" {
+		return fuse.ToStatus(syscall.ENOTEMPTY)
+	}
+	err = fs.moveToTrash(parentDirFd, cName, path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fuse.ToStatus(fs.syncEntry(parentDirFd, cName))
 }
 
 // If syscallcompat.HaveGetdents is false we will warn once about it
 var haveGetdentsWarnOnce sync.Once
 
+// InvalidNamesPolicy selects what directory listings do with entries whose
+// names cannot be decrypted, "-invalid-names"
+type InvalidNamesPolicy int
+
+const (
+	// InvalidNamesSkip logs and leaves out the entries. If all entries of a
+	// directory are invalid, the listing fails with EIO. This is the
+	// default.
+	InvalidNamesSkip InvalidNamesPolicy = iota
+	// InvalidNamesRaw lists the entries under their ciphertext names
+	InvalidNamesRaw
+	// InvalidNamesFail fails the whole listing with EIO
+	InvalidNamesFail
+)
+
 // OpenDir implements pathfs.FileSystem
+//
+// go-fuse's pathfs wants the whole listing at once and serves the kernel's
+// readdir calls from it, so a huge directory is held in memory until it is
+// closed. Streaming it with the offset cookies (see ReadDirChunk) would need
+// the raw FUSE API.
 func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	tlog.Debug.Printf("OpenDir(%s)", dirName)
+	plain, invalid, status := fs.openDir(dirName)
+	if !status.Ok() || len(invalid) == 0 {
+		return plain, status
+	}
+	switch fs.args.InvalidNames {
+	case InvalidNamesRaw:
+		plain = append(plain, invalid...)
+	case InvalidNamesFail:
+		return nil, fuse.EIO
+	default:
+		if len(plain) == 0 {
+			// Don't let the user stare on an empty directory. Report that
+			// things went wrong.
+			tlog.Warn.Printf("OpenDir %q: all %d entries were invalid, returning EIO",
+				dirName, len(invalid))
+			return nil, fuse.EIO
+		}
+	}
+	return plain, fuse.OK
+}
+
+// openDir reads and decrypts the directory "dirName". Entries that cannot
+// be decrypted are logged and returned in "invalid", with their ciphertext
+// names.
+func (fs *FS) openDir(dirName string) (plain []fuse.DirEntry, invalid []fuse.DirEntry, status fuse.Status) {
 	cDirName, err := fs.encryptPath(dirName)
 	if err != nil {
-		return nil, fuse.ToStatus(err)
+		return nil, nil, fuse.ToStatus(err)
 	}
 	// Read ciphertext directory
 	cDirAbsPath := filepath.Join(fs.args.Cipherdir, cDirName)
 	var cipherEntries []fuse.DirEntry
-	var status fuse.Status
-	fd, err := syscall.Open(cDirAbsPath, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	fd, err := syscallcompat.OpenLong(fs.args.Cipherdir, cDirName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, nil, fuse.ToStatus(err)
+	}
+	// The DirIV and the long names are read relative to this fd. If the
+	// directory is renamed concurrently, we still read from the directory
+	// we have listed.
+	dirfd := os.NewFile(uintptr(fd), cDirAbsPath)
+	defer dirfd.Close()
+	// The mtime validates the long name cache. Get it before reading the
+	// directory, so we never miss a change.
+	dirFi, err := dirfd.Stat()
 	if err != nil {
-		return nil, fuse.ToStatus(err)
+		return nil, nil, fuse.ToStatus(err)
 	}
-	defer syscall.Close(fd)
 	cipherEntries, err = syscallcompat.Getdents(fd)
 	if err != nil {
-		return nil, fuse.ToStatus(err)
+		return nil, nil, fuse.ToStatus(err)
 	}
 	// Get DirIV (stays nil if PlaintextNames is used)
 	var cachedIV []byte
 	if !fs.args.PlaintextNames {
-		cachedIV, _ = fs.nameTransform.DirIVCache.Lookup(dirName)
+		// With "-network-backend", always read the DirIV from disk. This is
+		// cheap compared to reading the directory itself.
+		if !fs.args.NetworkBackend {
+			cachedIV, _ = fs.nameTransform.DirIVCache.Lookup(dirName)
+		}
+		if cachedIV != nil {
+			// With "-paranoid-diriv", the cached DirIV must match the file
+			if err = fs.nameTransform.CheckDirIVAt(dirfd, cachedIV); err != nil {
+				return nil, nil, fuse.ToStatus(err)
+			}
+		}
 		if cachedIV == nil {
 			// Read the DirIV from disk and store it in the cache
 			fs.dirIVLock.RLock()
-			cachedIV, err = nametransform.ReadDirIV(cDirAbsPath)
+			cachedIV, err = fs.nameTransform.ReadDirIVAt(dirfd)
 			if err != nil {
 				fs.dirIVLock.RUnlock()
 				// This can happen during normal operation when the directory has
@@ -295,73 +413,168 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 				// gocryptfs.diriv is missing due to an error, so log the event
 				// at "info" level.
 				tlog.Info.Printf("OpenDir: %v", err)
-				return nil, fuse.ToStatus(err)
+				return nil, nil, fuse.ToStatus(err)
 			}
 			fs.nameTransform.DirIVCache.Store(dirName, cachedIV, cDirName)
 			fs.dirIVLock.RUnlock()
 		}
 	}
-	// Decrypted directory entries
-	var plain []fuse.DirEntry
-	var errorCount int
+	// Remember the ciphertext names for the GetAttr calls that usually
+	// follow, see direntCache. "-network-backend" and "-paranoid-diriv" have
+	// to check the DirIV on every lookup and cannot use the cache.
+	var names map[string]string
+	if !fs.args.PlaintextNames && !fs.args.NetworkBackend && !fs.args.ParanoidDirIV && len(cipherEntries) <= direntCacheMaxEntries {
+		names = make(map[string]string, len(cipherEntries))
+	}
+	// Decrypted long names, see lnCache. "-network-backend" cannot trust the
+	// mtime and does not cache them.
+	var longNames, newLongNames map[string]string
+	if fs.args.LongNames && !fs.args.PlaintextNames && !fs.args.NetworkBackend {
+		longNames = fs.lnCache.lookup(cDirName, dirFi.ModTime(), cachedIV)
+		if longNames == nil {
+			newLongNames = make(map[string]string)
+		}
+	}
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "" && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
-			continue
-		}
-		if fs.args.PlaintextNames {
-			plain = append(plain, cipherEntries[i])
+		name, skip, err := fs.decryptDirEntry(dirfd, dirName, cName, cachedIV, longNames)
+		if skip {
 			continue
 		}
-		if cName == nametransform.DirIVFilename {
-			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
-			continue
-		}
-		// Handle long file name
-		isLong := nametransform.LongNameNone
-		if fs.args.LongNames {
-			isLong = nametransform.NameType(cName)
-		}
-		if isLong == nametransform.LongNameContent {
-			cNameLong, err := nametransform.ReadLongName(filepath.Join(cDirAbsPath, cName))
-			if err != nil {
-				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
-					cDirName, cName, err)
-				errorCount++
-				continue
-			}
-			cName = cNameLong
-		} else if isLong == nametransform.LongNameFilename {
-			// ignore "gocryptfs.longname.*.name"
-			continue
-		}
-		name, err := fs.nameTransform.DecryptName(cName, cachedIV)
 		if err != nil {
 			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
 				cDirName, cName, err)
 			if runtime.GOOS == "darwin" && cName == dsStoreName {
 				// MacOS creates lots of these files. Log the warning but don't
-				// increment errorCount - does not warrant returning EIO.
+				// report them - does not warrant returning EIO.
 				continue
 			}
-			errorCount++
+			invalid = append(invalid, cipherEntries[i])
 			continue
 		}
+		if fs.args.SymlinkFiles && cipherEntries[i].Mode == syscall.S_IFREG {
+			cipherEntries[i].Mode = fs.direntMode(filepath.Join(cDirName, cName))
+		}
+		if names != nil {
+			names[name] = cName
+		}
+		if newLongNames != nil && nametransform.IsLongContent(cName) {
+			newLongNames[cName] = name
+		}
 		// Override the ciphertext name with the plaintext name but reuse the rest
 		// of the structure
 		cipherEntries[i].Name = name
 		plain = append(plain, cipherEntries[i])
 	}
+	if names != nil {
+		fs.direntCache.store(dirName, cDirName, cachedIV, names)
+	}
+	if len(newLongNames) > 0 {
+		fs.lnCache.store(cDirName, dirFi.ModTime(), cachedIV, newLongNames)
+	}
+	return plain, invalid, fuse.OK
+}
 
-	if errorCount > 0 && len(plain) == 0 {
-		// Don't let the user stare on an empty directory. Report that things went
-		// wrong.
-		tlog.Warn.Printf("OpenDir %q: all %d entries were invalid, returning EIO",
-			cDirName, errorCount)
-		status = fuse.EIO
+// decryptDirEntry returns the plaintext name of the entry "cName" of the
+// ciphertext directory "dirfd", which is the plaintext directory "dirName"
+// and has the DirIV "iv". "skip" is true for the files gocryptfs uses
+// internally, which are not shown. "longNames" holds already decrypted long
+// names and may be nil.
+func (fs *FS) decryptDirEntry(dirfd *os.File, dirName string, cName string, iv []byte, longNames map[string]string) (name string, skip bool, err error) {
+	if dirName == "" && (cName == configfile.ConfDefaultName || fs.isTrashDir(cName) || fs.isSnapshotDir(cName)) {
+		// silently ignore "gocryptfs.conf" and the trash and snapshot
+		// directories in the top level dir
+		return "", true, nil
+	}
+	if fs.args.PlaintextNames {
+		return cName, false, nil
+	}
+	if cName == nametransform.DirIVFilename {
+		// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
+		return "", true, nil
 	}
+	if fs.args.LongNames {
+		switch nametransform.NameType(cName) {
+		case nametransform.LongNameFilename:
+			// ignore "gocryptfs.longname.*.name"
+			return "", true, nil
+		case nametransform.LongNameContent:
+			if name, ok := longNames[cName]; ok {
+				return name, false, nil
+			}
+			cName, err = fs.nameTransform.ReadLongNameAt(dirfd, cName)
+			if err != nil {
+				return "", false, fmt.Errorf("Could not read .name: %v", err)
+			}
+		}
+	}
+	name, err = fs.nameTransform.DecryptName(cName, iv)
+	return name, false, err
+}
 
-	return plain, status
+// ReadDirChunk returns up to "max" entries of the plaintext directory
+// "dirName", starting at "cookie". The cookie is 0 for the first call and
+// the returned "next" for the following ones. An empty result means that
+// the end has been reached.
+//
+// Unlike OpenDir, only one chunk of the directory is in memory at a time,
+// and the first entries come back quickly even for huge directories. The
+// cookies are those of the backing filesystem (see
+// syscallcompat.GetdentsChunk), so a listing that goes on after the
+// directory has changed neither skips nor repeats the entries that have
+// been there all along. The FUSE readdir path cannot use this, as go-fuse's
+// pathfs needs the complete listing from OpenDir.
+func (fs *FS) ReadDirChunk(dirName string, cookie int64, max int) (plain []fuse.DirEntry, next int64, status fuse.Status) {
+	cDirName, err := fs.encryptPath(dirName)
+	if err != nil {
+		return nil, cookie, fuse.ToStatus(err)
+	}
+	cDirAbsPath := filepath.Join(fs.args.Cipherdir, cDirName)
+	fd, err := syscallcompat.OpenLong(fs.args.Cipherdir, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, cookie, fuse.ToStatus(err)
+	}
+	dirfd := os.NewFile(uintptr(fd), cDirAbsPath)
+	defer dirfd.Close()
+	var iv []byte
+	if !fs.args.PlaintextNames {
+		iv, err = fs.nameTransform.ReadDirIVAt(dirfd)
+		if err != nil {
+			return nil, cookie, fuse.ToStatus(err)
+		}
+	}
+	for len(plain) < max {
+		cipherEntries, n, err := syscallcompat.GetdentsChunk(fd, cookie, max-len(plain))
+		if err != nil {
+			return nil, cookie, fuse.ToStatus(err)
+		}
+		if len(cipherEntries) == 0 {
+			break
+		}
+		cookie = n
+		for _, e := range cipherEntries {
+			cName := e.Name
+			name, skip, err := fs.decryptDirEntry(dirfd, dirName, cName, iv, nil)
+			if skip {
+				continue
+			}
+			if err != nil {
+				tlog.Warn.Printf("ReadDirChunk %q: invalid entry %q: %v", cDirName, cName, err)
+				if fs.args.InvalidNames == InvalidNamesFail {
+					return nil, cookie, fuse.EIO
+				}
+				if fs.args.InvalidNames == InvalidNamesRaw {
+					plain = append(plain, e)
+				}
+				continue
+			}
+			if fs.args.SymlinkFiles && e.Mode == syscall.S_IFREG {
+				e.Mode = fs.direntMode(filepath.Join(cDirName, cName))
+			}
+			e.Name = name
+			plain = append(plain, e)
+		}
+	}
+	return plain, cookie, fuse.OK
 }
@@ -0,0 +1,250 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// TestReadDirChunk reads a large directory in small chunks while files are
+// created and deleted in between, and checks that every file that exists
+// all the time is returned exactly once.
+func TestReadDirChunk(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	create := func(name string) {
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	const nFiles = 500
+	long := strings.Repeat("l", 200)
+	name := func(i int) string {
+		if i%5 == 0 {
+			return fmt.Sprintf("%d-%s", i, long)
+		}
+		return fmt.Sprintf("%d", i)
+	}
+	for i := 0; i < nFiles; i++ {
+		create(name(i))
+	}
+	// tmpfs only has stable offsets since Linux 6.6
+	onTmpfs, _ := syscallcompat.IsMemoryFS(dir)
+	seen := make(map[string]int)
+	var cookie int64
+	for i := 0; ; i++ {
+		entries, next, code := fs.ReadDirChunk("", cookie, 7)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if len(entries) > 7 {
+			t.Fatalf("chunk of %d entries", len(entries))
+		}
+		cookie = next
+		for _, e := range entries {
+			seen[e.Name]++
+		}
+		if !onTmpfs && i%10 == 0 {
+			create(fmt.Sprintf("tmp%d", i))
+			fs.Unlink(fmt.Sprintf("tmp%d", i-10), ctx)
+		}
+	}
+	for i := 0; i < nFiles; i++ {
+		if n := seen[name(i)]; n != 1 {
+			t.Errorf("%.10q returned %d times", name(i), n)
+		}
+	}
+	for n, count := range seen {
+		if count != 1 {
+			t.Errorf("%.10q returned %d times", n, count)
+		}
+		if strings.HasPrefix(n, "gocryptfs.") {
+			t.Errorf("internal file %q is listed", n)
+		}
+	}
+}
+
+// TestDeepTree creates a directory tree whose backing path is much longer
+// than PATH_MAX and checks that the files at the bottom can be created,
+// read, renamed, listed and deleted.
+func TestDeepTree(t *testing.T) {
+	for _, args := range []Args{{}, {PlaintextNames: true}, {PlaintextNames: true, Trash: true}} {
+		testDeepTree(t, args)
+	}
+}
+
+func testDeepTree(t *testing.T, args Args) {
+	fs, dir := newTestFS(t, args)
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	const depth = 300
+	var dirs []string
+	path := ""
+	for i := 0; i < depth; i++ {
+		path = strings.TrimPrefix(path+"/dddddddddddddddd", "/")
+		if code := fs.Mkdir(path, 0700, ctx); !code.Ok() {
+			t.Fatalf("%+v: Mkdir at depth %d: %v", args, i, code)
+		}
+		dirs = append(dirs, path)
+	}
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cPath) <= 4096 {
+		t.Fatalf("backing path is only %d bytes long", len(cPath))
+	}
+	file := path + "/file"
+	f, code := fs.Create(file, uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	content := []byte("at the bottom")
+	if _, code = f.Write(content, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	// Cold caches, so the DirIVs have to be read from disk again
+	fs.nameTransform.DirIVCache.Clear()
+	fs.direntCache.clear()
+	a, code := fs.GetAttr(file, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if a.Size != uint64(len(content)) {
+		t.Errorf("wrong size %d", a.Size)
+	}
+	f, code = fs.Open(file, uint32(os.O_RDONLY), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	res, code := f.Read(make([]byte, 100), 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(nil)
+	if string(data) != string(content) {
+		t.Errorf("wrong content %q", data)
+	}
+	f.Release()
+	// The operations that work on the path instead of a file handle
+	if code = fs.Chmod(file, 0640, ctx); !code.Ok() {
+		t.Errorf("Chmod: %v", code)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if code = fs.Utimens(file, nil, &mtime, ctx); !code.Ok() {
+		t.Errorf("Utimens: %v", code)
+	}
+	if code = fs.Access(file, syscall.R_OK, ctx); !code.Ok() {
+		t.Errorf("Access: %v", code)
+	}
+	if code = fs.Truncate(file, 2, ctx); !code.Ok() {
+		t.Errorf("Truncate: %v", code)
+	}
+	if a, code = fs.GetAttr(file, ctx); !code.Ok() || a.Size != 2 || a.Mode&07777 != 0640 || a.Mtime != uint64(mtime.Unix()) {
+		t.Errorf("wrong attributes after Chmod, Utimens and Truncate: %v %v", a, code)
+	}
+	if fs.StatFs(file) == nil {
+		t.Errorf("StatFs failed")
+	}
+	// A long name exercises the .name file handling of Rename
+	renamed := path + "/" + strings.Repeat("r", 200)
+	if code = fs.Rename(file, renamed, ctx); !code.Ok() {
+		t.Errorf("Rename: %v", code)
+	}
+	if code = fs.Rename(renamed, file, ctx); !code.Ok() {
+		t.Errorf("Rename back: %v", code)
+	}
+	link := path + "/link"
+	if code = fs.Symlink("file", link, ctx); !code.Ok() {
+		t.Errorf("Symlink: %v", code)
+	}
+	if target, code := fs.Readlink(link, ctx); !code.Ok() || target != "file" {
+		t.Errorf("Readlink: %q %v", target, code)
+	}
+	entries, code := fs.OpenDir(path, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(entries) != 2 {
+		t.Errorf("wrong entries %v", entries)
+	}
+	for _, name := range []string{file, link} {
+		if code = fs.Unlink(name, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if code = fs.Rmdir(dirs[i], ctx); !code.Ok() {
+			t.Fatalf("%+v: Rmdir at depth %d: %v", args, i, code)
+		}
+	}
+}
+
+// TestInvalidNames puts an entry with an undecryptable name next to a valid
+// file and lists the directory with each -invalid-names policy.
+func TestInvalidNames(t *testing.T) {
+	const bogus = "invalid!name"
+	for _, policy := range []InvalidNamesPolicy{InvalidNamesSkip, InvalidNamesRaw, InvalidNamesFail} {
+		fs, dir := newTestFS(t, Args{InvalidNames: policy})
+		ctx := &fuse.Context{}
+		f, code := fs.Create("good", uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+		if err := ioutil.WriteFile(filepath.Join(dir, bogus), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		names := func(entries []fuse.DirEntry) map[string]bool {
+			m := make(map[string]bool)
+			for _, e := range entries {
+				m[e.Name] = true
+			}
+			return m
+		}
+		entries, code := fs.OpenDir("", ctx)
+		chunk, _, chunkCode := fs.ReadDirChunk("", 0, 100)
+		switch policy {
+		case InvalidNamesSkip:
+			if !code.Ok() || !reflect.DeepEqual(names(entries), map[string]bool{"good": true}) {
+				t.Errorf("skip: OpenDir returned %v %v", entries, code)
+			}
+			if !chunkCode.Ok() || !reflect.DeepEqual(names(chunk), map[string]bool{"good": true}) {
+				t.Errorf("skip: ReadDirChunk returned %v %v", chunk, chunkCode)
+			}
+		case InvalidNamesRaw:
+			want := map[string]bool{"good": true, bogus: true}
+			if !code.Ok() || !reflect.DeepEqual(names(entries), want) {
+				t.Errorf("raw: OpenDir returned %v %v", entries, code)
+			}
+			if !chunkCode.Ok() || !reflect.DeepEqual(names(chunk), want) {
+				t.Errorf("raw: ReadDirChunk returned %v %v", chunk, chunkCode)
+			}
+		case InvalidNamesFail:
+			if code != fuse.EIO {
+				t.Errorf("fail: OpenDir returned %v %v", entries, code)
+			}
+			if chunkCode != fuse.EIO {
+				t.Errorf("fail: ReadDirChunk returned %v %v", chunk, chunkCode)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
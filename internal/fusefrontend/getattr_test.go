@@ -0,0 +1,88 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestGetAttrSize checks that GetAttr returns the plaintext size of files
+// and symlinks.
+func TestGetAttrSize(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(make([]byte, 10000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	const target = "some/symlink/target"
+	if code = fs.Symlink(target, "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	a, code := fs.GetAttr("foo", ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if !a.IsRegular() || a.Size != 10000 {
+		t.Errorf("foo: wrong attributes: %v", a)
+	}
+	a, code = fs.GetAttr("link", ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if !a.IsSymlink() || a.Size != uint64(len(target)) {
+		t.Errorf("link: wrong attributes: %v", a)
+	}
+}
+
+// TestUtimensNanoseconds sets timestamps with nanosecond precision through
+// a path and through a file handle and checks that GetAttr returns them
+// bit-for-bit.
+func TestUtimensNanoseconds(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if code = fs.Mkdir("dir", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	check := func(path string, a time.Time, m time.Time) {
+		attr, code := fs.GetAttr(path, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if attr.Mtimensec%1000 == 0 {
+			t.Skip("the backing filesystem does not store nanoseconds")
+		}
+		if attr.Atime != uint64(a.Unix()) || attr.Atimensec != uint32(a.Nanosecond()) ||
+			attr.Mtime != uint64(m.Unix()) || attr.Mtimensec != uint32(m.Nanosecond()) {
+			t.Errorf("%s: got atime %d.%09d mtime %d.%09d, want %v %v", path,
+				attr.Atime, attr.Atimensec, attr.Mtime, attr.Mtimensec, a, m)
+		}
+	}
+	a := time.Unix(1234567890, 123456789)
+	m := time.Unix(1234567891, 987654321)
+	for _, path := range []string{"foo", "dir"} {
+		if code = fs.Utimens(path, &a, &m, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+		check(path, a, m)
+	}
+	// Through the file handle, leaving the atime alone
+	m2 := time.Unix(1234567892, 111111111)
+	if code = f.Utimens(nil, &m2); !code.Ok() {
+		t.Fatal(code)
+	}
+	check("foo", a, m2)
+}
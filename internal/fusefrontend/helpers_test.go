@@ -0,0 +1,28 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// newTestFS creates an FS on a fresh temporary CIPHERDIR. The caller should
+// remove the returned directory.
+func newTestFS(t testing.TB, args Args) (*FS, string) {
+	dir, err := ioutil.TempDir("", "gocryptfs-fusefrontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIV(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args.Cipherdir = dir
+	args.CryptoBackend = cryptocore.BackendGoGCM
+	args.LongNames = true
+	args.Raw64 = true
+	args.HKDF = true
+	return NewFS(make([]byte, cryptocore.KeyLen), args), dir
+}
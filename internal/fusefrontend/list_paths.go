@@ -0,0 +1,131 @@
+package fusefrontend
+
+// Enumerate all plaintext paths below a directory, for the ctlsock
+// "ListPaths" request
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// listPathsWorkers is the number of directories the "ListPaths" request
+// reads in parallel
+const listPathsWorkers = 4
+
+// walkChunk is the number of entries WalkPlain reads from a directory at a
+// time
+const walkChunk = 1000
+
+// ErrWalkCanceled is returned by WalkPlain when it has been canceled
+var ErrWalkCanceled = errors.New("walk canceled")
+
+// plainWalker holds the state of one WalkPlain call
+type plainWalker struct {
+	fs     *FS
+	fn     func(path string) error
+	cancel <-chan struct{}
+	// sem limits the number of directories that are read at the same time
+	sem chan struct{}
+	wg  sync.WaitGroup
+	// mu serializes the calls to "fn" and protects "err"
+	mu  sync.Mutex
+	err error
+}
+
+// WalkPlain calls "fn" once for every plaintext path below the directory
+// "prefix" (which is not passed to "fn" itself). Directories are read in
+// chunks with ReadDirChunk, so huge directories do not have to fit into
+// memory, and up to "workers" directories are read in parallel. The calls to "fn" are
+// serialized, but come in no particular order. Symlinks are not followed.
+//
+// The walk stops at the first error, which is returned. This is the error
+// "fn" returned, ErrWalkCanceled if "cancel" has been closed, or the error
+// a directory could not be read with.
+func (fs *FS) WalkPlain(prefix string, workers int, cancel <-chan struct{}, fn func(path string) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	w := plainWalker{
+		fs:     fs,
+		fn:     fn,
+		cancel: cancel,
+		sem:    make(chan struct{}, workers),
+	}
+	w.wg.Add(1)
+	w.dir(prefix)
+	w.wg.Wait()
+	return w.err
+}
+
+// stopped returns true if the walk has to stop
+func (w *plainWalker) stopped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return true
+	}
+	select {
+	case <-w.cancel:
+		w.err = ErrWalkCanceled
+		return true
+	default:
+		return false
+	}
+}
+
+// fail stops the walk with "err", unless it has already been stopped
+func (w *plainWalker) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+// dir reads the plaintext directory "dir", passes its entries to "fn" and
+// starts a goroutine for every subdirectory. The caller must have called
+// w.wg.Add(1).
+func (w *plainWalker) dir(dir string) {
+	defer w.wg.Done()
+	var cookie int64
+	for {
+		if w.stopped() {
+			return
+		}
+		w.sem <- struct{}{}
+		entries, next, status := w.fs.ReadDirChunk(dir, cookie, walkChunk)
+		<-w.sem
+		if !status.Ok() {
+			w.fail(&os.PathError{Op: "ListPaths", Path: dir, Err: syscall.Errno(status)})
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+		cookie = next
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name)
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = w.fn(path)
+			}
+			stop := w.err != nil
+			w.mu.Unlock()
+			if stop {
+				return
+			}
+			if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				w.wg.Add(1)
+				go w.dir(path)
+			}
+		}
+	}
+}
+
+// ListPaths implements ctlsock.ListPathsInterface.
+func (fs *FS) ListPaths(prefix string, fn func(path string) error) error {
+	return fs.WalkPlain(prefix, listPathsWorkers, nil, fn)
+}
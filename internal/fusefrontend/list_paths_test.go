@@ -0,0 +1,87 @@
+package fusefrontend
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestWalkPlain walks a small tree and checks that every plaintext path is
+// returned exactly once.
+func TestWalkPlain(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	long := strings.Repeat("l", 200)
+	dirs := []string{"a", "a/b", "a/b/c", "d", "a/" + long}
+	files := []string{"f1", "a/f2", "a/b/f3", "a/b/c/f4", "d/f5", "a/" + long + "/f6", "a/b/" + long}
+	for _, d := range dirs {
+		if code := fs.Mkdir(d, 0700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	for _, p := range files {
+		f, code := fs.Create(p, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	if code := fs.Symlink("a", "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	want := append(append([]string{"link"}, dirs...), files...)
+	sort.Strings(want)
+	walk := func(prefix string) ([]string, error) {
+		var got []string
+		err := fs.WalkPlain(prefix, 2, nil, func(path string) error {
+			got = append(got, path)
+			return nil
+		})
+		sort.Strings(got)
+		return got, err
+	}
+	got, err := walk("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong paths:\nwant %q\n got %q", want, got)
+	}
+	// Below a prefix
+	got, err = walk("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"a/b/c", "a/b/c/f4", "a/b/f3", "a/b/" + long}
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong paths below a/b:\nwant %q\n got %q", want, got)
+	}
+	if _, err = walk("f1"); err == nil {
+		t.Error("walking a file should fail")
+	}
+	// An error from "fn" stops the walk
+	stop := errors.New("stop")
+	n := 0
+	err = fs.WalkPlain("", 2, nil, func(path string) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("want one call and the error from fn, got %d calls and %v", n, err)
+	}
+	// So does closing "cancel"
+	cancel := make(chan struct{})
+	close(cancel)
+	err = fs.WalkPlain("", 2, cancel, func(path string) error {
+		return nil
+	})
+	if err != ErrWalkCanceled {
+		t.Errorf("want ErrWalkCanceled, got %v", err)
+	}
+}
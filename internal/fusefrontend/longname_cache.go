@@ -0,0 +1,98 @@
+package fusefrontend
+
+// Decrypted long names of recently listed directories
+//
+// Listing a directory means reading the "gocryptfs.longname.*.name" file
+// of every long name and decrypting its content. For directories with
+// many long names, this dominates the time "ls" takes. So we remember the
+// plaintext name of every long name, per directory, and reuse it as long
+// as the directory has the same mtime and DirIV.
+//
+// The hash in the long name is the hash of the encrypted name, so the
+// plaintext name only depends on the hash and the DirIV. Even a stale
+// entry never yields a wrong name. The mtime check makes sure that a
+// ".name" file that has been replaced behind our back is read again.
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/cachebudget"
+)
+
+// lnCacheMaxDirs is the maximum number of directories in the cache. When
+// it is reached, the cache is cleared.
+const lnCacheMaxDirs = 1000
+
+// lnDir holds the decrypted long names of one directory
+type lnDir struct {
+	// mtime of the ciphertext directory when the names were read
+	mtime time.Time
+	// DirIV the names have been decrypted with
+	iv []byte
+	// names maps "gocryptfs.longname.*" names to plaintext names
+	names map[string]string
+}
+
+// lnCache caches lnDir entries by relative ciphertext directory path
+type lnCache struct {
+	sync.Mutex
+	dirs map[string]*lnDir
+	// Memory budget share ("-cache-size") and what we have charged to it
+	account *cachebudget.Account
+	bytes   uint64
+}
+
+// size returns what "d" costs in the memory budget
+func (d *lnDir) size(cDir string) uint64 {
+	n := uint64(len(cDir)+len(d.iv)) + cachebudget.EntryOverhead
+	for k, v := range d.names {
+		n += uint64(len(k)+len(v)) + cachebudget.EntryOverhead
+	}
+	return n
+}
+
+// clear empties the cache.
+func (c *lnCache) clear() {
+	c.Lock()
+	c.dirs = nil
+	c.account.Release(c.bytes)
+	c.bytes = 0
+	c.Unlock()
+}
+
+// lookup returns the cached long names of the ciphertext directory "cDir",
+// or nil if the directory has changed since they have been stored.
+func (c *lnCache) lookup(cDir string, mtime time.Time, iv []byte) map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	d := c.dirs[cDir]
+	if d == nil || !d.mtime.Equal(mtime) || !bytes.Equal(d.iv, iv) {
+		return nil
+	}
+	return d.names
+}
+
+// store replaces the long names of "cDir". The caller must not modify
+// "names" afterwards.
+func (c *lnCache) store(cDir string, mtime time.Time, iv []byte, names map[string]string) {
+	d := &lnDir{mtime: mtime, iv: iv, names: names}
+	c.Lock()
+	if c.dirs == nil || len(c.dirs) >= lnCacheMaxDirs {
+		c.dirs = make(map[string]*lnDir)
+		c.account.Release(c.bytes)
+		c.bytes = 0
+	}
+	if old := c.dirs[cDir]; old != nil {
+		n := old.size(cDir)
+		c.account.Release(n)
+		c.bytes -= n
+	}
+	c.dirs[cDir] = d
+	n := d.size(cDir)
+	c.account.Charge(n)
+	c.bytes += n
+	c.Unlock()
+	c.account.Trim()
+}
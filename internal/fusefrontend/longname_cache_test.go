@@ -0,0 +1,82 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestLongNameCache lists a directory with long names twice. The second
+// listing must not read the ".name" files: we damage them in between and
+// still get the right names. Once the directory mtime changes, they are
+// read again.
+func TestLongNameCache(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	var want []string
+	for _, c := range []string{"a", "b", "c"} {
+		name := "sub/" + strings.Repeat(c, 200)
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+		want = append(want, filepath.Base(name))
+	}
+	list := func() ([]string, fuse.Status) {
+		entries, code := fs.OpenDir("sub", ctx)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		return names, code
+	}
+	if got, code := list(); !code.Ok() || strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("first listing: %v %v", got, code)
+	}
+	cDir, err := fs.getBackingPath("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecars, err := filepath.Glob(filepath.Join(cDir, "*"+nametransform.LongNameSuffix))
+	if err != nil || len(sidecars) != len(want) {
+		t.Fatalf("found %d .name files: %v", len(sidecars), err)
+	}
+	fi, err := os.Stat(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sidecars {
+		// Changing the content of a file does not change the mtime of the
+		// directory
+		if err = ioutil.WriteFile(s, []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi2, _ := os.Stat(cDir); !fi2.ModTime().Equal(fi.ModTime()) {
+		t.Skip("directory mtime has changed, cannot test")
+	}
+	if got, code := list(); !code.Ok() || strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("second listing should come from the cache: %v %v", got, code)
+	}
+	mtime := fi.ModTime().Add(time.Hour)
+	if err = os.Chtimes(cDir, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if got, code := list(); code != fuse.EIO {
+		t.Errorf("after an mtime change, the damaged .name files should be read: %v %v", got, code)
+	}
+}
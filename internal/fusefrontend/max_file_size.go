@@ -0,0 +1,28 @@
+package fusefrontend
+
+// Per-file size limit, "-max-file-size"
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// maxSizeOK returns EFBIG if the file would grow beyond the
+// "-max-file-size" limit by growing to the plaintext size "newSize". Files
+// that are already larger, for example because the limit has been lowered,
+// can still be written to and shrunk. The caller must hold the ContentLock.
+func (f *file) maxSizeOK(newSize uint64) fuse.Status {
+	limit := f.fs.args.MaxFileSize
+	if limit == 0 || newSize <= limit {
+		return fuse.OK
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return fuse.ToStatus(err)
+	}
+	if newSize > f.contentEnc.CipherSizeToPlainSize(uint64(st.Size)) {
+		return fuse.Status(syscall.EFBIG)
+	}
+	return fuse.OK
+}
@@ -0,0 +1,53 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestMaxFileSize writes a file up to the limit and checks that growing it
+// further gets EFBIG, by writing, by truncating and by fallocate.
+func TestMaxFileSize(t *testing.T) {
+	const limit = 10000
+	fs, dir := newTestFS(t, Args{MaxFileSize: limit})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, code = f.Write(make([]byte, limit), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Overwriting is fine
+	if _, code = f.Write([]byte("x"), limit-1); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("x"), limit); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Write: want EFBIG, got %v", code)
+	}
+	if code = f.Truncate(limit + 1); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Truncate: want EFBIG, got %v", code)
+	}
+	if code = fs.Truncate("foo", 2*limit, ctx); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("FS.Truncate: want EFBIG, got %v", code)
+	}
+	if code = f.Allocate(0, limit+1, 0); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Allocate: want EFBIG, got %v", code)
+	}
+	a, code := fs.GetAttr("foo", ctx)
+	if !code.Ok() || a.Size != limit {
+		t.Errorf("size: want %d, got %v %v", limit, a, code)
+	}
+	// Shrinking and growing back up to the limit is fine
+	if code = f.Truncate(100); !code.Ok() {
+		t.Error(code)
+	}
+	if code = f.Truncate(limit); !code.Ok() {
+		t.Error(code)
+	}
+}
@@ -0,0 +1,156 @@
+package fusefrontend
+
+// Volume-wide Merkle root ("-merkle-root")
+//
+// Every node of the plaintext tree gets a SHA-256 hash:
+//
+//   regular file: H(0x00 || backing file: header and all encrypted blocks)
+//   directory:    H(0x01 || DirIV || for each entry, sorted by name:
+//                    uint32 len(name) || name || hash of the entry)
+//   symlink:      H(0x02 || target)
+//   other:        H(0x03 || uint32 file type || uint32 rdev)
+//
+// The encrypted blocks contain the authentication tags, so the root covers
+// all of them and all DirIVs. Everything is authenticated while hashing, so
+// the root is only returned for a volume that decrypts correctly. A volume
+// that has not changed gives the same root again; any change to a file,
+// name, symlink or directory gives a different one, including replacing a
+// file with an older, correctly encrypted copy.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	merkleTypeFile    = 0x00
+	merkleTypeDir     = 0x01
+	merkleTypeSymlink = 0x02
+	merkleTypeOther   = 0x03
+)
+
+// MerkleRoot returns the Merkle root of the tree below the directory "dir"
+// (relative to the mountpoint). Like VerifyTree, it works on the backing
+// files and does not need a mount. It stops at the first entry that cannot
+// be hashed or fails authentication.
+func (fs *FS) MerkleRoot(dir string) ([]byte, error) {
+	return fs.merkleDir(strings.Trim(filepath.Clean("/"+dir), "/"))
+}
+
+// merkleDir returns the hash of the directory "dir".
+func (fs *FS) merkleDir(dir string) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte{merkleTypeDir})
+	if !fs.args.PlaintextNames {
+		cDir, err := fs.encryptPath(dir)
+		if err != nil {
+			return nil, &os.PathError{Op: "merkle", Path: dir, Err: err}
+		}
+		dirfd, err := fs.openBackingDir(cDir)
+		if err != nil {
+			return nil, err
+		}
+		iv, err := fs.nameTransform.ReadDirIVAt(dirfd)
+		dirfd.Close()
+		if err != nil {
+			return nil, &os.PathError{Op: "read diriv", Path: dir, Err: err}
+		}
+		h.Write(iv)
+	}
+	entries, invalid, status := fs.openDir(dir)
+	if !status.Ok() {
+		return nil, &os.PathError{Op: "opendir", Path: dir, Err: syscall.Errno(status)}
+	}
+	if len(invalid) > 0 {
+		return nil, &os.PathError{Op: "opendir", Path: dir, Err: syscall.EBADMSG}
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum, err := fs.merkleEntry(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		writeUint32(h, uint32(len(name)))
+		h.Write([]byte(name))
+		h.Write(sum)
+	}
+	return h.Sum(nil), nil
+}
+
+// merkleEntry returns the hash of the directory entry "path".
+func (fs *FS) merkleEntry(path string) ([]byte, error) {
+	context := &fuse.Context{}
+	a, status := fs.GetAttr(path, context)
+	if !status.Ok() {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: syscall.Errno(status)}
+	}
+	switch {
+	case a.IsDir():
+		return fs.merkleDir(path)
+	case a.IsRegular():
+		return fs.merkleRegular(path, a.Size)
+	case a.IsSymlink():
+		target, status := fs.Readlink(path, context)
+		if !status.Ok() {
+			return nil, &os.PathError{Op: "readlink", Path: path, Err: syscall.Errno(status)}
+		}
+		h := sha256.New()
+		h.Write([]byte{merkleTypeSymlink})
+		h.Write([]byte(target))
+		return h.Sum(nil), nil
+	default:
+		h := sha256.New()
+		h.Write([]byte{merkleTypeOther})
+		writeUint32(h, a.Mode&syscall.S_IFMT)
+		writeUint32(h, a.Rdev)
+		return h.Sum(nil), nil
+	}
+}
+
+// merkleRegular authenticates the regular file "path" of plaintext size
+// "size" and returns the hash of its backing file.
+func (fs *FS) merkleRegular(path string, size uint64) ([]byte, error) {
+	if _, err := fs.checkContent(path, size); err != nil {
+		return nil, &os.PathError{Op: "authenticate", Path: path, Err: err}
+	}
+	ff, status := fs.openFile(path, uint32(os.O_RDONLY))
+	if !status.Ok() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.Errno(status)}
+	}
+	f := ff.(*file)
+	defer f.Release()
+	h := sha256.New()
+	h.Write([]byte{merkleTypeFile})
+	buf := make([]byte, 32*fs.contentEnc.CipherBS())
+	for off := int64(0); ; {
+		n, err := f.readAt(buf, off)
+		h.Write(buf[:n])
+		off += int64(n)
+		if err == io.EOF || err == nil && n == 0 {
+			break
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "read", Path: path, Err: err}
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+func writeUint32(h hash.Hash, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	h.Write(b[:])
+}
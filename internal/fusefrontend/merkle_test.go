@@ -0,0 +1,81 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestMerkleRoot checks that an unchanged tree gives the same root, that
+// modifying one file gives a different root, and that a corrupt block makes
+// MerkleRoot fail.
+func TestMerkleRoot(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, path := range []string{"sub/foo", "bar"} {
+		f, code := fs.Create(path, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write(make([]byte, 10000), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	if code := fs.Symlink("sub/foo", "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	root1, err := fs.MerkleRoot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root2, err := fs.MerkleRoot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root1, root2) {
+		t.Errorf("unchanged tree gave different roots: %x %x", root1, root2)
+	}
+
+	// Same length, different content
+	f, code := fs.Open("sub/foo", uint32(os.O_WRONLY), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte{1}, 5000); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	root3, err := fs.MerkleRoot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(root1, root3) {
+		t.Error("modified file did not change the root")
+	}
+
+	// Corrupt the second block
+	cPath, err := fs.getBackingPath("sub/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cf.WriteAt([]byte{0xaa, 0xbb}, 18+4128+100)
+	cf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.MerkleRoot(""); err == nil {
+		t.Error("corrupt block was not detected")
+	}
+}
@@ -0,0 +1,63 @@
+package fusefrontend
+
+// Restrict the plaintext names that can be created ("-name-policy")
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// NamePolicy lists the rules a new plaintext name has to follow. The zero
+// value allows everything.
+type NamePolicy struct {
+	// Only printable ASCII characters
+	ASCII bool
+	// No whitespace
+	NoSpace bool
+	// Maximum length in characters, 0 means no limit
+	MaxLen int
+	// If non-nil, the whole name has to match
+	Regexp *regexp.Regexp
+}
+
+// Check returns an error that describes the first rule "name" breaks, or
+// nil if it is allowed.
+func (p *NamePolicy) Check(name string) error {
+	if p.ASCII {
+		for _, r := range name {
+			if r < 0x20 || r > 0x7e {
+				return fmt.Errorf("character %q is not printable ASCII", r)
+			}
+		}
+	}
+	if p.NoSpace && strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("contains whitespace")
+	}
+	if p.MaxLen > 0 && utf8.RuneCountInString(name) > p.MaxLen {
+		return fmt.Errorf("longer than %d characters", p.MaxLen)
+	}
+	if p.Regexp != nil && !p.Regexp.MatchString(name) {
+		return fmt.Errorf("does not match %q", p.Regexp.String())
+	}
+	return nil
+}
+
+// namePolicyOK returns false if the name of "path", which is about to be
+// created, breaks the "-name-policy". Existing names stay accessible.
+func (fs *FS) namePolicyOK(path string) bool {
+	if fs.args.NamePolicy == nil {
+		return true
+	}
+	name := filepath.Base(path)
+	if err := fs.args.NamePolicy.Check(name); err != nil {
+		tlog.Info.Printf("The name %q is not allowed by -name-policy: %v", name, err)
+		return false
+	}
+	return true
+}
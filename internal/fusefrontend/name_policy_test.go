@@ -0,0 +1,72 @@
+package fusefrontend
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestNamePolicy creates files, directories and links with allowed and
+// disallowed names under a few policies. Disallowed names must fail with
+// EINVAL.
+func TestNamePolicy(t *testing.T) {
+	testCases := []struct {
+		policy  NamePolicy
+		allowed []string
+		denied  []string
+	}{
+		{
+			NamePolicy{ASCII: true, NoSpace: true},
+			[]string{"report.txt", "a-b_c"},
+			[]string{"with space", "tab\tname", "grüße"},
+		},
+		{
+			NamePolicy{MaxLen: 8},
+			[]string{"12345678", "äöüäöüäö"},
+			[]string{"123456789", strings.Repeat("x", 200)},
+		},
+		{
+			NamePolicy{Regexp: regexp.MustCompile(`^(?:[a-z0-9]+(\.[a-z]+)?)$`)},
+			[]string{"readme", "data.csv"},
+			[]string{"README", "a.b.c", ".hidden"},
+		},
+	}
+	for _, tc := range testCases {
+		policy := tc.policy
+		fs, dir := newTestFS(t, Args{NamePolicy: &policy})
+		ctx := &fuse.Context{}
+		for _, name := range tc.allowed {
+			f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, ctx)
+			if !code.Ok() {
+				t.Errorf("%+v: Create %q: %v", policy, name, code)
+				continue
+			}
+			f.Release()
+		}
+		for i, name := range tc.denied {
+			if _, code := fs.Create(name, uint32(os.O_WRONLY), 0600, ctx); code != fuse.EINVAL {
+				t.Errorf("%+v: Create %q: want EINVAL, got %v", policy, name, code)
+			}
+			if code := fs.Mkdir(name, 0700, ctx); code != fuse.EINVAL {
+				t.Errorf("%+v: Mkdir %q: want EINVAL, got %v", policy, name, code)
+			}
+			if code := fs.Symlink("target", name, ctx); code != fuse.EINVAL {
+				t.Errorf("%+v: Symlink %q: want EINVAL, got %v", policy, name, code)
+			}
+			// Rename and Link check the new name only
+			if code := fs.Rename(tc.allowed[i%len(tc.allowed)], name, ctx); code != fuse.EINVAL {
+				t.Errorf("%+v: Rename to %q: want EINVAL, got %v", policy, name, code)
+			}
+			if code := fs.Link(tc.allowed[0], name, ctx); code != fuse.EINVAL {
+				t.Errorf("%+v: Link %q: want EINVAL, got %v", policy, name, code)
+			}
+			if _, code := fs.GetAttr(name, ctx); code != fuse.ENOENT {
+				t.Errorf("%+v: %q was created: %v", policy, name, code)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
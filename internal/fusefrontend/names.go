@@ -5,8 +5,12 @@ package fusefrontend
 import (
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -23,8 +27,38 @@ func (fs *FS) isFiltered(path string) bool {
 			configfile.ConfDefaultName)
 		return true
 	}
-	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
-	// are exclusive
+	// The trash directory in the root directory is forbidden
+	if fs.isTrashDir(path) {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			TrashDirName)
+		return true
+	}
+	// As is the snapshot directory
+	if fs.isSnapshotDir(path) {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			SnapshotDirName)
+		return true
+	}
+	return false
+}
+
+// isFilteredCreate is like isFiltered, but is used when "path" is about to
+// be created (create, mkdir, rename target, ...). In addition to isFiltered,
+// it forbids creating files that would look like gocryptfs control files
+// (gocryptfs.diriv, gocryptfs.longname.*) in the ciphertext directory when
+// file names are not encrypted. Existing files with these names stay
+// accessible.
+func (fs *FS) isFilteredCreate(path string) bool {
+	if fs.isFiltered(path) {
+		return true
+	}
+	if !fs.args.PlaintextNames {
+		return false
+	}
+	if name := filepath.Base(path); nametransform.IsReservedName(name) {
+		tlog.Info.Printf("The name %q is reserved when -plaintextnames is used\n", name)
+		return true
+	}
 	return false
 }
 
@@ -40,26 +74,81 @@ func (fs *FS) getBackingPath(relPath string) (string, error) {
 	return cAbsPath, nil
 }
 
-// openBackingPath - get the absolute encrypted path of the backing file
-// and open the corresponding directory
-func (fs *FS) openBackingPath(relPath string) (*os.File, string, error) {
+// BackingPaths returns the absolute paths of all backing files that store
+// the relative plaintext path "relPath": the file or directory itself, the
+// ".name" file of long names, and the gocryptfs.diriv of directories.
+// Returns ENOENT if "relPath" does not exist.
+func (fs *FS) BackingPaths(relPath string) ([]string, error) {
+	relPath = strings.Trim(filepath.Clean("/"+relPath), "/")
 	cPath, err := fs.getBackingPath(relPath)
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Stat_t
+	err = syscall.Lstat(cPath, &st)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: relPath, Err: err}
+	}
+	paths := []string{cPath}
+	if fs.args.PlaintextNames {
+		return paths, nil
+	}
+	if nametransform.IsLongContent(filepath.Base(cPath)) {
+		paths = append(paths, cPath+nametransform.LongNameSuffix)
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		paths = append(paths, filepath.Join(cPath, nametransform.DirIVFilename))
+	}
+	return paths, nil
+}
+
+// openBackingPath - open the backing directory that contains "relPath"
+// and return it together with the encrypted name of "relPath" in it.
+// Operating relative to the directory works for trees deeper than
+// PATH_MAX, see openBackingDir.
+func (fs *FS) openBackingPath(relPath string) (*os.File, string, error) {
+	cPath, err := fs.encryptPath(relPath)
 	if err != nil {
 		return nil, "", err
 	}
-	dirfd, err := os.Open(filepath.Dir(cPath))
+	dirfd, err := fs.openBackingDir(nametransform.Dir(cPath))
 	if err != nil {
 		return nil, "", err
 	}
 	return dirfd, filepath.Base(cPath), nil
 }
 
-// encryptPath - encrypt relative plaintext path
+// openBackingDir opens the backing directory "cDir" (relative ciphertext
+// path). If the absolute path is longer than PATH_MAX, the directory is
+// opened one path component at a time.
+func (fs *FS) openBackingDir(cDir string) (*os.File, error) {
+	abs := filepath.Join(fs.args.Cipherdir, cDir)
+	fd, err := syscallcompat.OpenLong(fs.args.Cipherdir, cDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: abs, Err: err}
+	}
+	return os.NewFile(uintptr(fd), abs), nil
+}
+
+// encryptPath - encrypt relative plaintext path. With "-caseinsensitive",
+// the path is first matched against the existing names.
 func (fs *FS) encryptPath(plainPath string) (string, error) {
+	if fs.args.CaseInsensitive {
+		plainPath = fs.foldPath(plainPath)
+	}
+	return fs.encryptPathExact(plainPath)
+}
+
+// encryptPathExact - encrypt relative plaintext path as-is
+func (fs *FS) encryptPathExact(plainPath string) (string, error) {
 	if fs.args.PlaintextNames {
 		return plainPath, nil
 	}
 	fs.dirIVLock.RLock()
+	if cPath, ok := fs.direntCache.lookup(plainPath, &fs.nameTransform.DirIVCache); ok {
+		fs.dirIVLock.RUnlock()
+		return cPath, nil
+	}
 	cPath, err := fs.nameTransform.EncryptPathDirIV(plainPath, fs.args.Cipherdir)
 	tlog.Debug.Printf("encryptPath '%s' -> '%s' (err: %v)", plainPath, cPath, err)
 	fs.dirIVLock.RUnlock()
@@ -0,0 +1,398 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestNetworkBackendDirIVChange simulates another client replacing the
+// gocryptfs.diriv of a directory behind our back and checks that
+// "-network-backend" notices instead of using the cached DirIV.
+func TestNetworkBackendDirIVChange(t *testing.T) {
+	fs, dir := newTestFS(t, Args{NetworkBackend: true})
+	defer os.RemoveAll(dir)
+	if code := fs.Mkdir("a", 0700, &fuse.Context{}); !code.Ok() {
+		t.Fatal(code)
+	}
+	cDir, err := fs.getBackingPath("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Populates the DirIV cache for "a"
+	if _, err = fs.getBackingPath("a/foo"); err != nil {
+		t.Fatal(err)
+	}
+	// Create the new diriv first and rename it over the old one so it gets
+	// a different inode number
+	newIV := cryptocore.RandBytes(nametransform.DirIVLen)
+	tmp := filepath.Join(cDir, "diriv.tmp")
+	if err = ioutil.WriteFile(tmp, newIV, 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(tmp, filepath.Join(cDir, nametransform.DirIVFilename)); err != nil {
+		t.Fatal(err)
+	}
+
+	cPath, err := fs.getBackingPath("a/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(cDir, fs.nameTransform.EncryptName("foo", newIV))
+	if cPath != want {
+		t.Errorf("stale DirIV was used:\nhave %q\nwant %q", cPath, want)
+	}
+
+	// Directory listings must use the new DirIV as well
+	cName := fs.nameTransform.EncryptName("bar", newIV)
+	if err = ioutil.WriteFile(filepath.Join(cDir, cName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, code := fs.OpenDir("a", &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(entries) != 1 || entries[0].Name != "bar" {
+		t.Errorf("wrong directory listing: %v", entries)
+	}
+}
+
+// TestParanoidDirIV corrupts the gocryptfs.diriv of a directory whose DirIV
+// is cached and checks that "-paranoid-diriv" returns EIO instead of using
+// the cached value.
+func TestParanoidDirIV(t *testing.T) {
+	fs, dir := newTestFS(t, Args{ParanoidDirIV: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("a", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Populates the DirIV cache for "a"
+	cPath, err := fs.getBackingPath("a/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The intact DirIV passes the check
+	if _, code := fs.OpenDir("a", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, err = fs.getBackingPath("a/foo"); err != nil {
+		t.Fatal(err)
+	}
+	cDir := filepath.Dir(cPath)
+	tmp := filepath.Join(cDir, "diriv.tmp")
+	if err = ioutil.WriteFile(tmp, cryptocore.RandBytes(nametransform.DirIVLen), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(tmp, filepath.Join(cDir, nametransform.DirIVFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.getBackingPath("a/foo"); err != syscall.EIO {
+		t.Errorf("lookup: want EIO, got %v", err)
+	}
+	if _, code := fs.OpenDir("a", ctx); code != fuse.EIO {
+		t.Errorf("OpenDir: want EIO, got %v", code)
+	}
+}
+
+// TestLongNameRenameRace lists a directory of long-named files while they are
+// renamed concurrently, and checks that every listed name is paired with the
+// right content. The files keep their id in the name across renames and
+// store it as their content.
+func TestLongNameRenameRace(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	const nFiles = 10
+	pad := strings.Repeat("x", 200)
+	name := func(id int, gen int) string {
+		return fmt.Sprintf("%d-%d-%s", id, gen, pad)
+	}
+	for id := 0; id < nFiles; id++ {
+		f, code := fs.Create(name(id, 0), uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		_, code = f.Write([]byte(strconv.Itoa(id)), 0)
+		f.Release()
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		gens := make([]int, nFiles)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := i % nFiles
+			if code := fs.Rename(name(id, gens[id]), name(id, gens[id]+1), ctx); !code.Ok() {
+				t.Errorf("Rename: %v", code)
+				return
+			}
+			gens[id]++
+		}
+	}()
+	buf := make([]byte, 100)
+	for i := 0; i < 200; i++ {
+		entries, code := fs.OpenDir("", ctx)
+		if !code.Ok() {
+			t.Errorf("OpenDir: %v", code)
+			break
+		}
+		for _, e := range entries {
+			f, code := fs.Open(e.Name, uint32(os.O_RDONLY), ctx)
+			if code == fuse.ENOENT {
+				// Renamed in the meantime
+				continue
+			} else if !code.Ok() {
+				t.Errorf("Open: %v", code)
+				continue
+			}
+			res, code := f.Read(buf, 0)
+			if code.Ok() {
+				var data []byte
+				data, code = res.Bytes(buf)
+				if want := strings.SplitN(e.Name, "-", 2)[0]; string(data) != want {
+					t.Errorf("name %q paired with content %q", e.Name[:10], data)
+				}
+			}
+			f.Release()
+			if !code.Ok() {
+				t.Errorf("Read: %v", code)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestNameMax checks that with a low "-max-name-length", names whose
+// encrypted form is longer are stored as long names, or rejected early
+// when long names are disabled.
+func TestNameMax(t *testing.T) {
+	const nameMax = 80
+	fs, dir := newTestFS(t, Args{NameMax: nameMax})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	create := func(fs *FS, name string) fuse.Status {
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, ctx)
+		if code.Ok() {
+			f.Release()
+		}
+		return code
+	}
+	// The encrypted name of 60 bytes is 86 bytes long
+	long1 := strings.Repeat("a", 60)
+	for _, name := range []string{"short1", long1} {
+		if code := create(fs, name); !code.Ok() {
+			t.Fatalf("%s: %v", name, code)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var longNames int
+	for _, e := range entries {
+		if len(e.Name()) > nameMax {
+			t.Errorf("%q is longer than %d bytes", e.Name(), nameMax)
+		}
+		if nametransform.IsLongContent(e.Name()) {
+			longNames++
+		}
+	}
+	if longNames != 1 {
+		t.Errorf("want 1 long name, have %d", longNames)
+	}
+	if _, code := fs.GetAttr(long1, ctx); !code.Ok() {
+		t.Errorf("long name cannot be found: %v", code)
+	}
+	// Without long names, the name is rejected before CIPHERDIR is touched
+	args := fs.args
+	args.LongNames = false
+	fs2 := NewFS(make([]byte, cryptocore.KeyLen), args)
+	if code := create(fs2, strings.Repeat("b", 60)); code != fuse.Status(syscall.ENAMETOOLONG) {
+		t.Errorf("want ENAMETOOLONG, got %v", code)
+	}
+	if code := fs2.Mkdir(strings.Repeat("c", 60), 0700, ctx); code != fuse.Status(syscall.ENAMETOOLONG) {
+		t.Errorf("want ENAMETOOLONG, got %v", code)
+	}
+	if code := fs2.Rename("short1", strings.Repeat("d", 60), ctx); code != fuse.Status(syscall.ENAMETOOLONG) {
+		t.Errorf("want ENAMETOOLONG, got %v", code)
+	}
+	entries2, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries2) != len(entries) {
+		t.Errorf("CIPHERDIR has changed: %d entries before, %d after", len(entries), len(entries2))
+	}
+	if code := create(fs2, "short2"); !code.Ok() {
+		t.Errorf("short name: %v", code)
+	}
+}
+
+// TestRenameAcrossDirs moves files with short and long names between two
+// directories, which have different DirIVs, and checks that they decrypt at
+// the destination and leave nothing behind at the source.
+func TestRenameAcrossDirs(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	for _, d := range []string{"a", "b"} {
+		if code := fs.Mkdir(d, 0700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	short := "short"
+	long := strings.Repeat("l", 200)
+	// list returns the plaintext names in "dir"
+	list := func(dir string) []string {
+		entries, code := fs.OpenDir(dir, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		var n []string
+		for _, e := range entries {
+			n = append(n, e.Name)
+		}
+		return n
+	}
+	// cList returns the ciphertext names in the backing directory of "dir"
+	cList := func(dir string) []string {
+		cDir, err := fs.getBackingPath(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(cDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		n, err := f.Readdirnames(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	read := func(path string) string {
+		f, code := fs.Open(path, uint32(os.O_RDONLY), ctx)
+		if !code.Ok() {
+			t.Fatalf("Open %q: %v", path, code)
+		}
+		defer f.Release()
+		buf := make([]byte, 100)
+		res, code := f.Read(buf, 0)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+	for _, tc := range []struct{ from, to string }{
+		{short, short}, {short, long}, {long, short}, {long, long},
+	} {
+		src := "a/" + tc.from
+		dst := "b/" + tc.to
+		content := fmt.Sprintf("%d->%d", len(tc.from), len(tc.to))
+		f, code := fs.Create(src, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Write([]byte(content), 0)
+		f.Release()
+		if code = fs.Rename(src, dst, ctx); !code.Ok() {
+			t.Fatalf("%s: Rename: %v", content, code)
+		}
+		if got := read(dst); got != content {
+			t.Errorf("%s: wrong content %q", content, got)
+		}
+		if _, code = fs.GetAttr(src, ctx); code != fuse.ENOENT {
+			t.Errorf("%s: source still exists: %v", content, code)
+		}
+		if n := list("a"); len(n) != 0 {
+			t.Errorf("%s: source directory lists %q", content, n)
+		}
+		if n := list("b"); len(n) != 1 || n[0] != tc.to {
+			t.Errorf("%s: destination directory lists %q", content, n)
+		}
+		// Only gocryptfs.diriv is left in the source directory, the
+		// destination has the file and, for long names, its .name file
+		if n := cList("a"); len(n) != 1 {
+			t.Errorf("%s: leftovers in the source directory: %q", content, n)
+		}
+		want := 2
+		if len(tc.to) > 100 {
+			want = 3
+		}
+		if n := cList("b"); len(n) != want {
+			t.Errorf("%s: want %d backing files in the destination, got %q", content, want, n)
+		}
+		// The name has been encrypted with the DirIV of "b"
+		cDst, _ := fs.getBackingPath(dst)
+		cWrong, _ := fs.getBackingPath("a/" + tc.to)
+		if filepath.Base(cDst) == filepath.Base(cWrong) {
+			t.Errorf("%s: same ciphertext name in both directories", content)
+		}
+		if code = fs.Unlink(dst, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	// Renaming a long name onto itself or onto another hard link to it must
+	// not delete its .name file
+	f, code := fs.Create("b/"+long, uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	long2 := long + "2"
+	if code = fs.Link("b/"+long, "b/"+long2, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Rename("b/"+long, "b/"+long, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Rename("b/"+long, "b/"+long2, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if n := list("b"); len(n) != 2 {
+		t.Errorf("want both hard links listed, got %d names", len(n))
+	}
+	// A long-named directory that replaces an empty one
+	if code = fs.Mkdir("a/"+long, 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Mkdir("a/"+long+"/sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Mkdir("b/"+long+"d", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Rename("a/"+long, "b/"+long+"d", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if n := list("b"); len(n) != 3 {
+		t.Errorf("the renamed directory is not listed: got %d names", len(n))
+	}
+	if n := list("b/" + long + "d"); len(n) != 1 || n[0] != "sub" {
+		t.Errorf("wrong content of the renamed directory: %q", n)
+	}
+}
@@ -0,0 +1,38 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestNFCNames checks that the NFC and NFD forms of a name resolve to the
+// same file when NFCNames is enabled.
+func TestNFCNames(t *testing.T) {
+	fs, dir := newTestFS(t, Args{NFCNames: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	nfcName := "caf\u00e9"
+	nfdName := "cafe\u0301"
+	f, code := fs.Create(nfdName, uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if _, code = fs.GetAttr(nfcName, ctx); !code.Ok() {
+		t.Errorf("GetAttr NFC: %v", code)
+	}
+	// Creating the other form fails because it is the same file
+	_, code = fs.Create(nfcName, uint32(os.O_WRONLY), 0600, ctx)
+	if code.Ok() {
+		t.Error("creating the NFC form should fail")
+	}
+	entries, code := fs.OpenDir("", ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(entries) != 1 || entries[0].Name != nfcName {
+		t.Errorf("wrong listing: %v", entries)
+	}
+}
@@ -0,0 +1,124 @@
+package fusefrontend
+
+// List of open file handles for the ctlsock "OpenFiles" request
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// openFileInfo describes an open file handle
+type openFileInfo struct {
+	// Plaintext path, updated on renames
+	path string
+	// Flags that were passed to open(2)
+	flags uint32
+	// When the file was opened
+	since time.Time
+}
+
+// openFiles tracks the open file handles
+type openFiles struct {
+	sync.Mutex
+	m map[*file]*openFileInfo
+}
+
+func (o *openFiles) add(f *file, path string, flags uint32) {
+	o.Lock()
+	defer o.Unlock()
+	if o.m == nil {
+		o.m = make(map[*file]*openFileInfo)
+	}
+	o.m[f] = &openFileInfo{path: path, flags: flags, since: time.Now()}
+}
+
+func (o *openFiles) remove(f *file) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.m, f)
+}
+
+// path returns the current plaintext path of "f"
+func (o *openFiles) path(f *file) (string, bool) {
+	o.Lock()
+	defer o.Unlock()
+	info, ok := o.m[f]
+	if !ok {
+		return "", false
+	}
+	return info.path, true
+}
+
+// rename updates the paths of the open files after "oldPath" has been
+// renamed to "newPath". "oldPath" may also be a directory.
+func (o *openFiles) rename(oldPath string, newPath string) {
+	o.Lock()
+	defer o.Unlock()
+	for _, info := range o.m {
+		if info.path == oldPath {
+			info.path = newPath
+		} else if strings.HasPrefix(info.path, oldPath+"/") {
+			info.path = newPath + info.path[len(oldPath):]
+		}
+	}
+}
+
+// files returns the open file handles and their current plaintext paths
+func (o *openFiles) files() ([]*file, []string) {
+	o.Lock()
+	defer o.Unlock()
+	files := make([]*file, 0, len(o.m))
+	paths := make([]string, 0, len(o.m))
+	for f, info := range o.m {
+		files = append(files, f)
+		paths = append(paths, info.path)
+	}
+	return files, paths
+}
+
+// snapshot returns a copy of the open file infos, sorted by path.
+func (o *openFiles) snapshot() []openFileInfo {
+	o.Lock()
+	list := make([]openFileInfo, 0, len(o.m))
+	for _, info := range o.m {
+		list = append(list, *info)
+	}
+	o.Unlock()
+	sort.Sort(byPath(list))
+	return list
+}
+
+// byPath sorts openFileInfos by path
+type byPath []openFileInfo
+
+func (b byPath) Len() int           { return len(b) }
+func (b byPath) Less(i, j int) bool { return b[i].path < b[j].path }
+func (b byPath) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// accessModeString returns "r", "w" or "rw" for the access mode in "flags".
+func accessModeString(flags uint32) string {
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_WRONLY:
+		return "w"
+	case syscall.O_RDWR:
+		return "rw"
+	}
+	return "r"
+}
+
+// OpenFiles implements ctlsock.OpenFilesInterface. Returns one
+// "MODE<tab>SECONDS<tab>PATH" line per open file handle, where MODE is "r",
+// "w" or "rw" and SECONDS is how long the file has been open.
+func (fs *FS) OpenFiles() (string, error) {
+	now := time.Now()
+	var out []string
+	for _, info := range fs.openFiles.snapshot() {
+		secs := int64(now.Sub(info.since) / time.Second)
+		out = append(out, fmt.Sprintf("%s\t%d\t%s", accessModeString(info.flags), secs, info.path))
+	}
+	return strings.Join(out, "\n"), nil
+}
@@ -0,0 +1,116 @@
+package fusefrontend
+
+// Warm the caches for a list of hot paths after mounting, "-preload"
+
+import (
+	"io"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// preloadChunk is the number of bytes read from a backing file at a time.
+// The preloader checks whether it has been stopped between the chunks.
+const preloadChunk = 128 * 1024
+
+// preloader is the state of the background preload
+type preloader struct {
+	// Closed to stop the preload
+	stop chan struct{}
+	// Closed when the preload goroutine has exited
+	done chan struct{}
+}
+
+// StartPreload warms the caches for the plaintext paths in Args.Preload in
+// the background and returns immediately. For every path, the DirIVs of
+// its parent directories are cached. Directories are listed, which caches
+// their DirIV and the ciphertext names of their entries, and the backing
+// files of regular files are read into the page cache of the host.
+// Paths that do not exist are skipped. The preload is stopped by Wipe().
+func (fs *FS) StartPreload() {
+	p := &fs.preload
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		for i, path := range fs.args.Preload {
+			if !fs.preloadPath(path) {
+				tlog.Debug.Printf("preload: stopped after %d of %d paths", i, len(fs.args.Preload))
+				return
+			}
+		}
+		tlog.Debug.Printf("preload: done, %d paths", len(fs.args.Preload))
+	}()
+}
+
+// stopPreload stops the preload, if it is running, and waits for it to
+// exit.
+func (fs *FS) stopPreload() {
+	p := &fs.preload
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+}
+
+// preloadStopped returns true if stopPreload has been called.
+func (fs *FS) preloadStopped() bool {
+	select {
+	case <-fs.preload.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// preloadPath warms the caches for the plaintext path "path". Returns false
+// if the preload has been stopped.
+func (fs *FS) preloadPath(path string) bool {
+	if fs.preloadStopped() {
+		return false
+	}
+	ctx := &fuse.Context{}
+	a, status := fs.GetAttr(path, ctx)
+	if !status.Ok() {
+		tlog.Debug.Printf("preload: %q: %v", path, status)
+		return true
+	}
+	if a.IsDir() {
+		if _, status = fs.OpenDir(path, ctx); !status.Ok() {
+			tlog.Debug.Printf("preload: %q: OpenDir: %v", path, status)
+		}
+		return true
+	}
+	if !a.IsRegular() {
+		return true
+	}
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		tlog.Debug.Printf("preload: %q: %v", path, err)
+		return true
+	}
+	f, err := os.Open(cPath)
+	if err != nil {
+		tlog.Debug.Printf("preload: %q: %v", path, err)
+		return true
+	}
+	defer f.Close()
+	buf := make([]byte, preloadChunk)
+	for {
+		if fs.preloadStopped() {
+			return false
+		}
+		_, err = f.Read(buf)
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			tlog.Debug.Printf("preload: %q: %v", path, err)
+			return true
+		}
+	}
+}
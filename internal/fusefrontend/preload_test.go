@@ -0,0 +1,52 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestPreload checks that the DirIV and name caches are warm after the
+// preload has finished, and that missing paths are skipped.
+func TestPreload(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	for _, d := range []string{"a", "a/b", "c"} {
+		if code := fs.Mkdir(d, 0700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	f, code := fs.Create("c/file", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("hot data"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	want, err := fs.nameTransform.EncryptPathDirIV("c/file", fs.args.Cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cold start
+	fs.nameTransform.DirIVCache.Clear()
+	fs.direntCache.clear()
+	fs.args.Preload = []string{"a/b", "missing/x", "c/file", "c"}
+	fs.StartPreload()
+	<-fs.preload.done
+	for _, d := range []string{"a", "a/b", "c"} {
+		if iv, _ := fs.nameTransform.DirIVCache.Lookup(d); iv == nil {
+			t.Errorf("DirIV of %q is not cached", d)
+		}
+	}
+	cPath, ok := fs.direntCache.lookup("c/file", fs.nameTransform.DirIVCache)
+	if !ok {
+		t.Error("entries of \"c\" are not cached")
+	} else if cPath != want {
+		t.Errorf("wrong cached path %q", cPath)
+	}
+	// Must not hang when the preload has finished
+	fs.stopPreload()
+}
@@ -0,0 +1,203 @@
+package fusefrontend
+
+// Per-directory byte quotas, "-quota". Usage is counted in plaintext bytes,
+// that is, the apparent file size the user sees, and is recomputed from the
+// backing directory on every mount.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// quota tracks the usage of one plaintext directory tree
+type quota struct {
+	// Relative plaintext path of the directory
+	dir string
+	// Maximum and current usage in plaintext bytes
+	limit uint64
+	used  uint64
+
+	sync.Mutex
+}
+
+// charge adds "n" bytes to the usage, or returns EDQUOT if that would exceed
+// the limit.
+func (q *quota) charge(n uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	if n > q.limit-q.used {
+		return syscall.EDQUOT
+	}
+	q.used += n
+	return nil
+}
+
+// release subtracts "n" bytes from the usage.
+func (q *quota) release(n uint64) {
+	q.Lock()
+	defer q.Unlock()
+	if n > q.used {
+		// Can happen if the backing directory was changed behind our back
+		n = q.used
+	}
+	q.used -= n
+}
+
+// initQuotas sets up the quotas from fs.args.Quotas and computes their
+// current usage.
+func (fs *FS) initQuotas() {
+	for dir, limit := range fs.args.Quotas {
+		q := &quota{dir: dir, limit: limit}
+		q.used = fs.quotaUsage(dir)
+		if q.used > limit {
+			tlog.Warn.Printf("quota %q: usage %d is already above the limit %d", dir, q.used, limit)
+			// Only allow shrinking
+			q.limit = q.used
+		}
+		tlog.Debug.Printf("quota %q: %d of %d bytes used", dir, q.used, limit)
+		fs.quotas = append(fs.quotas, q)
+	}
+}
+
+// quotaUsage sums up the plaintext sizes of the files below "dir".
+// Hard-linked files are counted once.
+func (fs *FS) quotaUsage(dir string) (used uint64) {
+	cDir, err := fs.getBackingPath(dir)
+	if err != nil {
+		return 0
+	}
+	seen := make(map[uint64]bool)
+	filepath.Walk(cDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// The directory does not exist yet, or is not readable
+			return nil
+		}
+		name := fi.Name()
+		if filepath.Dir(path) == fs.args.Cipherdir {
+			if (fs.isTrashDir(name) || fs.isSnapshotDir(name)) && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			if name == configfile.ConfDefaultName {
+				return nil
+			}
+		}
+		if !fi.Mode().IsRegular() || name == nametransform.DirIVFilename ||
+			nametransform.NameType(name) == nametransform.LongNameFilename {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			if seen[uint64(st.Ino)] {
+				return nil
+			}
+			seen[uint64(st.Ino)] = true
+		}
+		used += fs.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
+		return nil
+	})
+	return used
+}
+
+// quotaFor returns the quota that applies to the relative plaintext path
+// "path", or nil. For nested quota directories, the innermost one applies.
+func (fs *FS) quotaFor(path string) *quota {
+	var best *quota
+	for _, q := range fs.quotas {
+		if isBelow(path, q.dir) && (best == nil || len(q.dir) > len(best.dir)) {
+			best = q
+		}
+	}
+	return best
+}
+
+// isBelow returns true if the relative plaintext path "path" is "dir" or
+// inside "dir".
+func isBelow(path string, dir string) bool {
+	return dir == "" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// quotaRenameOK checks if "oldPath" can be renamed or hard-linked to
+// "newPath" without moving data between quotas, and without moving a quota
+// directory itself. Moving data between quotas would require copying it,
+// so we return EXDEV like XFS project quotas do, and "mv" falls back to
+// copy + delete.
+func (fs *FS) quotaRenameOK(oldPath string, newPath string) bool {
+	if len(fs.quotas) == 0 {
+		return true
+	}
+	if fs.quotaFor(oldPath) != fs.quotaFor(newPath) {
+		return false
+	}
+	for _, q := range fs.quotas {
+		if isBelow(q.dir, oldPath) || isBelow(q.dir, newPath) {
+			return false
+		}
+	}
+	return true
+}
+
+// quotaFileSize returns the plaintext size that deleting the backing file
+// "cName" in "dirfd" frees, or 0 if the file has other hard links or is not
+// a regular file.
+func (fs *FS) quotaFileSize(dirfd *os.File, cName string) uint64 {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(int(dirfd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink > 1 {
+		return 0
+	}
+	return fs.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+}
+
+// quotaResize accounts for changing the plaintext size of the file to
+// "newSize". With "growOnly", a smaller "newSize" is ignored, like for
+// writes inside the file. Returns EDQUOT if the file cannot grow, or a
+// function that must be called with the outcome of the operation.
+// The caller must hold the ContentLock.
+func (f *file) quotaResize(newSize uint64, growOnly bool) (done func(ok bool), status fuse.Status) {
+	done = func(bool) {}
+	q := f.quota
+	if q == nil {
+		return done, fuse.OK
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return done, fuse.ToStatus(err)
+	}
+	// The file has been deleted or overwritten by a rename, but is still
+	// open. Its usage was released at that point.
+	if st.Nlink == 0 {
+		return done, fuse.OK
+	}
+	oldSize := f.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	if newSize > oldSize {
+		n := newSize - oldSize
+		if err := q.charge(n); err != nil {
+			return done, fuse.ToStatus(err)
+		}
+		return func(ok bool) {
+			if !ok {
+				q.release(n)
+			}
+		}, fuse.OK
+	}
+	if newSize < oldSize && !growOnly {
+		n := oldSize - newSize
+		return func(ok bool) {
+			if ok {
+				q.release(n)
+			}
+		}, fuse.OK
+	}
+	return done, fuse.OK
+}
@@ -0,0 +1,127 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// TestQuota fills a small quota and checks that further writes get EDQUOT
+// while deletes free up space again.
+func TestQuota(t *testing.T) {
+	const limit = 10000
+	fs, dir := newTestFS(t, Args{Quotas: map[string]uint64{"q": limit}})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("q", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	f1, code := fs.Create("q/f1", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f1.Release()
+	if _, code = f1.Write(make([]byte, 6000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Overwriting does not use more space
+	if _, code = f1.Write(make([]byte, 6000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f2, code := fs.Create("q/f2", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f2.Release()
+	if _, code = f2.Write(make([]byte, 4000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// The quota is full now
+	if _, code = f2.Write([]byte("x"), 4000); code != fuse.Status(syscall.EDQUOT) {
+		t.Errorf("Write: want EDQUOT, got %v", code)
+	}
+	if code = f2.Truncate(5000); code != fuse.Status(syscall.EDQUOT) {
+		t.Errorf("Truncate: want EDQUOT, got %v", code)
+	}
+	// Files outside of the quota directory are not affected
+	f3, code := fs.Create("f3", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f3.Release()
+	if _, code = f3.Write(make([]byte, 20000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Renaming in and out of the quota directory is rejected
+	if code = fs.Rename("f3", "q/f3", ctx); code != fuse.Status(syscall.EXDEV) {
+		t.Errorf("Rename: want EXDEV, got %v", code)
+	}
+	// Shrinking and deleting frees space
+	if code = f2.Truncate(1000); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f2.Write(make([]byte, 3000), 1000); !code.Ok() {
+		t.Errorf("Write after Truncate: %v", code)
+	}
+	if code = fs.Unlink("q/f1", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f2.Write(make([]byte, 6000), 4000); !code.Ok() {
+		t.Errorf("Write after Unlink: %v", code)
+	}
+	if _, code = f2.Write([]byte("x"), 10000); code != fuse.Status(syscall.EDQUOT) {
+		t.Errorf("Write: want EDQUOT, got %v", code)
+	}
+	// The usage is recomputed on mount
+	fs2 := NewFS(make([]byte, cryptocore.KeyLen), fs.args)
+	if len(fs2.quotas) != 1 || fs2.quotas[0].used != limit {
+		t.Errorf("usage was not recomputed: %+v", fs2.quotas)
+	}
+}
+
+// TestQuotaRenameOverOpen checks that writes to a file that has been
+// overwritten by a rename, but is still open, do not use up the quota.
+func TestQuotaRenameOverOpen(t *testing.T) {
+	const limit = 10000
+	fs, dir := newTestFS(t, Args{Quotas: map[string]uint64{"q": limit}})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("q", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	f1, code := fs.Create("q/f1", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f1.Release()
+	if _, code = f1.Write(make([]byte, 6000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f2, code := fs.Create("q/f2", uint32(os.O_RDWR), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f2.Release()
+	if code = fs.Rename("q/f2", "q/f1", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	// The overwritten file is still readable
+	buf := make([]byte, 10)
+	res, code := f1.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if data, _ := res.Bytes(buf); len(data) != len(buf) {
+		t.Errorf("short read: %d bytes", len(data))
+	}
+	if _, code = f1.Write(make([]byte, 6000), 6000); !code.Ok() {
+		t.Fatal(code)
+	}
+	if fs.quotas[0].used != 0 {
+		t.Errorf("wrong usage: %d", fs.quotas[0].used)
+	}
+}
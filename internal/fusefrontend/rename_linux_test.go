@@ -0,0 +1,60 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestRenameEXDEV bind-mounts a directory inside CIPHERDIR onto itself and
+// checks that renaming into it fails with EXDEV, for short and long names,
+// without leaving a .name file behind at the destination.
+func TestRenameEXDEV(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	for _, d := range []string{"a", "b"} {
+		if code := fs.Mkdir(d, 0700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	long := strings.Repeat("l", 200)
+	for _, name := range []string{"short", long} {
+		f, code := fs.Create("a/"+name, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	cB, err := fs.getBackingPath("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Mount(cB, cB, "", syscall.MS_BIND, ""); err != nil {
+		t.Skipf("cannot bind mount: %v", err)
+	}
+	defer syscall.Unmount(cB, 0)
+	for _, name := range []string{"short", long} {
+		if code := fs.Rename("a/"+name, "b/"+name, ctx); code != fuse.Status(syscall.EXDEV) {
+			t.Errorf("%.10s: want EXDEV, got %v", name, code)
+		}
+		if _, code := fs.GetAttr("a/"+name, ctx); !code.Ok() {
+			t.Errorf("%.10s: source is gone: %v", name, code)
+		}
+	}
+	f, err := os.Open(cB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("destination should only contain gocryptfs.diriv: %v", names)
+	}
+}
@@ -0,0 +1,315 @@
+package fusefrontend
+
+// Mirror all changes of CIPHERDIR to a second directory, "-replica"
+//
+// The replica is eventually consistent: operations that change CIPHERDIR
+// queue the affected ciphertext paths, and a background goroutine makes
+// the replica match CIPHERDIR for them. Only CIPHERDIR is ever read.
+// If CIPHERDIR has been changed successfully but the replica cannot be
+// updated, the error is logged and the operation still succeeds; the
+// replica is brought up to date by the full resync at the next mount.
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// replicaTmpSuffix marks the temporary file a backing file is copied to
+// before it is renamed over the old copy in the replica
+const replicaTmpSuffix = ".gocryptfs.replica.tmp"
+
+// replicator is the state of the background replication
+type replicator struct {
+	sync.Mutex
+	// Ciphertext paths relative to CIPHERDIR that have to be mirrored
+	pending map[string]bool
+	// Receives a value when "pending" has been filled
+	wake chan struct{}
+	// Closed to stop the replicator
+	stop chan struct{}
+	// Closed when the replicator goroutine has exited
+	done chan struct{}
+}
+
+// StartReplicator starts mirroring CIPHERDIR to Args.Replica. The whole
+// tree is compared first, so a replica that is empty or out of date
+// catches up. Afterwards, only the paths that are changed through this
+// mount are mirrored. It is stopped by Wipe(), after the pending changes
+// have been written.
+func (fs *FS) StartReplicator() {
+	r := &fs.replica
+	r.pending = make(map[string]bool)
+	r.wake = make(chan struct{}, 1)
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	fs.replicateCipher("")
+	go func() {
+		defer close(r.done)
+		for {
+			select {
+			case <-r.wake:
+				fs.replicatePending()
+			case <-r.stop:
+				fs.replicatePending()
+				return
+			}
+		}
+	}()
+}
+
+// stopReplicator writes the pending changes to the replica and stops the
+// replicator, if it is running.
+func (fs *FS) stopReplicator() {
+	r := &fs.replica
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+// replicate queues the plaintext paths "paths" for mirroring. Call it
+// after an operation has changed them in CIPHERDIR. The long name .name
+// files are mirrored along with their files.
+func (fs *FS) replicate(paths ...string) {
+	if fs.replica.pending == nil {
+		return
+	}
+	for _, path := range paths {
+		cPath, err := fs.encryptPath(path)
+		if err != nil {
+			tlog.Warn.Printf("replica: %q: %v", path, err)
+			continue
+		}
+		fs.replicateCipher(cPath)
+		if !fs.args.PlaintextNames && nametransform.IsLongContent(filepath.Base(cPath)) {
+			fs.replicateCipher(cPath + nametransform.LongNameSuffix)
+		}
+	}
+}
+
+// replicateCipher queues the ciphertext path "cPath", relative to
+// CIPHERDIR, for mirroring.
+func (fs *FS) replicateCipher(cPath string) {
+	r := &fs.replica
+	if r.pending == nil {
+		return
+	}
+	r.Lock()
+	r.pending[cPath] = true
+	r.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replicatePending mirrors the queued paths.
+func (fs *FS) replicatePending() {
+	r := &fs.replica
+	r.Lock()
+	pending := r.pending
+	r.pending = make(map[string]bool)
+	r.Unlock()
+	for cPath := range pending {
+		if err := fs.mirrorParents(cPath); err != nil {
+			tlog.Warn.Printf("replica: %q: %v", cPath, err)
+			continue
+		}
+		fs.mirror(cPath, true)
+	}
+}
+
+// mirrorParents creates the parent directories of "cPath" in the replica
+// if they do not exist yet.
+func (fs *FS) mirrorParents(cPath string) error {
+	if cPath == "" {
+		return nil
+	}
+	dir := filepath.Dir(cPath)
+	if dir == "." {
+		return nil
+	}
+	if _, err := os.Lstat(filepath.Join(fs.args.Replica, dir)); !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.mirrorParents(dir); err != nil {
+		return err
+	}
+	fs.mirror(dir, false)
+	return nil
+}
+
+// mirror makes "cPath" in the replica match "cPath" in CIPHERDIR. Missing
+// entries are deleted, directories are created, regular files are copied
+// if their size or mtime differ, and symlinks are recreated. The content
+// of a directory is only mirrored if "recursive" is true, except for its
+// gocryptfs.diriv, which is needed to decrypt the replica. As "cPath" has
+// been queued because it changed, a regular file is always copied. Errors
+// are logged.
+func (fs *FS) mirror(cPath string, recursive bool) {
+	src := filepath.Join(fs.args.Cipherdir, cPath)
+	dst := filepath.Join(fs.args.Replica, cPath)
+	err := fs.mirrorEntry(src, dst, recursive, true)
+	if err != nil {
+		tlog.Warn.Printf("replica: %q: %v", cPath, err)
+	}
+}
+
+// mirrorEntry mirrors the absolute path "src" to "dst", see mirror. If
+// "changed" is false, regular files with the same size and mtime are
+// assumed to be identical.
+func (fs *FS) mirrorEntry(src string, dst string, recursive bool, changed bool) error {
+	srcFi, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return os.RemoveAll(dst)
+	}
+	if err != nil {
+		return err
+	}
+	dstFi, err := os.Lstat(dst)
+	if err == nil && dstFi.Mode()&os.ModeType != srcFi.Mode()&os.ModeType {
+		if err = os.RemoveAll(dst); err != nil {
+			return err
+		}
+		dstFi = nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	switch {
+	case srcFi.IsDir():
+		return fs.mirrorDir(src, dst, srcFi, dstFi, recursive)
+	case srcFi.Mode().IsRegular():
+		return mirrorFile(src, dst, srcFi, dstFi, changed)
+	case srcFi.Mode()&os.ModeSymlink != 0:
+		return mirrorSymlink(src, dst, dstFi)
+	default:
+		tlog.Debug.Printf("replica: %q: skipping special file", src)
+		return nil
+	}
+}
+
+// mirrorDir creates the directory "dst" if needed and, if "recursive" is
+// set, mirrors its entries and deletes the ones CIPHERDIR does not have.
+func (fs *FS) mirrorDir(src string, dst string, srcFi os.FileInfo, dstFi os.FileInfo, recursive bool) error {
+	if dstFi == nil {
+		// Writable until the entries have been created
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		if !recursive && !fs.args.PlaintextNames {
+			err := fs.mirrorEntry(filepath.Join(src, nametransform.DirIVFilename),
+				filepath.Join(dst, nametransform.DirIVFilename), false, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if recursive {
+		if err := os.Chmod(dst, 0700|srcFi.Mode().Perm()); err != nil {
+			return err
+		}
+		srcNames, err := readDirNames(src)
+		if err != nil {
+			return err
+		}
+		dstNames, err := readDirNames(dst)
+		if err != nil {
+			return err
+		}
+		for name := range srcNames {
+			err = fs.mirrorEntry(filepath.Join(src, name), filepath.Join(dst, name), true, false)
+			if err != nil {
+				tlog.Warn.Printf("replica: %q: %v", filepath.Join(src, name), err)
+			}
+		}
+		for name := range dstNames {
+			if srcNames[name] {
+				continue
+			}
+			if err = os.RemoveAll(filepath.Join(dst, name)); err != nil {
+				tlog.Warn.Printf("replica: %q: %v", filepath.Join(dst, name), err)
+			}
+		}
+	}
+	return os.Chmod(dst, srcFi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+// readDirNames returns the names in directory "dir" as a set
+func readDirNames(dir string) (map[string]bool, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return set, nil
+}
+
+// mirrorFile copies the regular file "src" to "dst", unless "changed" is
+// false and "dst" has the same size and mtime already. The copy is written to a temporary file
+// and renamed over "dst", so the replica never has a half-written file.
+func mirrorFile(src string, dst string, srcFi os.FileInfo, dstFi os.FileInfo, changed bool) error {
+	mode := srcFi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if !changed && dstFi != nil && dstFi.Size() == srcFi.Size() && dstFi.ModTime().Equal(srcFi.ModTime()) {
+		return os.Chmod(dst, mode)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + replicaTmpSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, srcFi.ModTime(), srcFi.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// mirrorSymlink recreates the symlink "src" as "dst" if the targets
+// differ.
+func mirrorSymlink(src string, dst string, dstFi os.FileInfo) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if dstFi != nil {
+		if old, _ := os.Readlink(dst); old == target {
+			return nil
+		}
+		if err = os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, dst)
+}
@@ -0,0 +1,137 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// treeContent returns the relative paths below "dir" with their content:
+// the file content for regular files, the target for symlinks and "dir"
+// for directories.
+func treeContent(t *testing.T, dir string) map[string]string {
+	m := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		switch {
+		case fi.IsDir():
+			m[rel] = "dir"
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			m[rel] = "symlink " + target
+		default:
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			m[rel] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// TestReplica changes the filesystem in various ways and checks that the
+// replica converges to the same state as CIPHERDIR, including the removal
+// of stale entries the replica had before.
+func TestReplica(t *testing.T) {
+	replica, err := ioutil.TempDir("", "gocryptfs-replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(replica)
+	if err = ioutil.WriteFile(filepath.Join(replica, "stale"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs, dir := newTestFS(t, Args{Replica: replica})
+	defer os.RemoveAll(dir)
+	fs.StartReplicator()
+	ctx := &fuse.Context{}
+	for _, d := range []string{"a", "a/b", "gone"} {
+		if code := fs.Mkdir(d, 0700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	write := func(path string, content string) {
+		f, code := fs.Create(path, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write([]byte(content), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	write("a/b/file", "hello")
+	write("moved", "move me")
+	write("deleted", "delete me")
+	long := strings.Repeat("x", 200)
+	write("a/"+long, "long name")
+	if code := fs.Rename("moved", "a/moved", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Unlink("deleted", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Rmdir("gone", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Symlink("a/b/file", "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Rewrite a file through a handle that was opened before a rename
+	f, code := fs.Open("a/b/file", uint32(os.O_RDWR), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Rename("a/b/file", "a/b/renamed", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("HELLO, world"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	// Writes the pending changes
+	fs.stopReplicator()
+
+	want := treeContent(t, dir)
+	have := treeContent(t, replica)
+	for path, content := range want {
+		if have[path] != content {
+			t.Errorf("%q differs in the replica", path)
+		}
+	}
+	for path := range have {
+		if _, ok := want[path]; !ok {
+			t.Errorf("%q only exists in the replica", path)
+		}
+	}
+	// Reads still work and come from CIPHERDIR
+	f, code = fs.Open("a/b/renamed", uint32(os.O_RDONLY), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	res, code := f.Read(make([]byte, 100), 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(nil)
+	if !bytes.Equal(data, []byte("HELLO, world")) {
+		t.Errorf("wrong content %q", data)
+	}
+}
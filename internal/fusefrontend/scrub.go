@@ -0,0 +1,224 @@
+package fusefrontend
+
+// Background integrity scrubber ("-scrub-interval"). While mounted, it
+// periodically authenticates all file contents to detect bit rot, reading
+// at most "-scrub-bwlimit" bytes per second.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// ScrubStats describes what the scrubber has done so far.
+type ScrubStats struct {
+	// Number of completed passes over the whole tree
+	Passes uint64
+	// Number of checked files and content blocks, over all passes
+	Files, Blocks uint64
+	// Number of files that were skipped because they were open for writing
+	Skipped uint64
+	// Failures has one entry for each integrity failure, over all passes
+	Failures []string
+}
+
+// scrubber is the state of the background scrubber
+type scrubber struct {
+	sync.Mutex
+	stats ScrubStats
+	// Closed to stop the scrubber
+	stop chan struct{}
+	// Closed when the scrubber goroutine has exited
+	done chan struct{}
+	// Token bucket for the bandwidth limit: we may read "budget" more
+	// bytes until "last".
+	budget float64
+	last   time.Time
+}
+
+// StartScrubber starts the background scrubber that checks the whole tree
+// every Args.ScrubInterval. It is stopped by Wipe().
+func (fs *FS) StartScrubber() {
+	s := &fs.scrub
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(fs.args.ScrubInterval):
+			}
+			tlog.Debug.Printf("scrub: starting pass")
+			if !fs.scrubDir("") {
+				return
+			}
+			s.Lock()
+			s.stats.Passes++
+			s.Unlock()
+			tlog.Debug.Printf("scrub: pass done")
+		}
+	}()
+}
+
+// stopScrubber stops the scrubber, if it is running, and waits for it to
+// exit.
+func (fs *FS) stopScrubber() {
+	s := &fs.scrub
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+// ScrubStats returns a copy of the scrubber statistics.
+func (fs *FS) ScrubStats() ScrubStats {
+	s := &fs.scrub
+	s.Lock()
+	defer s.Unlock()
+	st := s.stats
+	st.Failures = append([]string(nil), s.stats.Failures...)
+	return st
+}
+
+// scrubFailure logs and records an integrity failure.
+func (fs *FS) scrubFailure(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	tlog.Warn.Printf("scrub: integrity failure: %s", msg)
+	s := &fs.scrub
+	s.Lock()
+	s.stats.Failures = append(s.stats.Failures, msg)
+	s.Unlock()
+}
+
+// scrubDir checks the directory "dir" recursively. Returns false if the
+// scrubber was stopped.
+func (fs *FS) scrubDir(dir string) bool {
+	entries, invalid, status := fs.openDir(dir)
+	if len(invalid) > 0 {
+		fs.scrubFailure("%s/: %d entries with invalid names", dir, len(invalid))
+	}
+	if !status.Ok() {
+		tlog.Warn.Printf("scrub: %s/: opendir: %s", dir, status.String())
+		return true
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name)
+		var ok bool
+		switch {
+		case e.Mode&syscall.S_IFMT == syscall.S_IFDIR:
+			ok = fs.scrubDir(path)
+		case e.Mode&syscall.S_IFMT == syscall.S_IFREG:
+			ok = fs.scrubFile(path)
+		default:
+			ok = true
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// scrubFile authenticates all content blocks of the file "path". Files that
+// are open for writing are skipped, as we may see half-written blocks.
+// Returns false if the scrubber was stopped.
+func (fs *FS) scrubFile(path string) bool {
+	s := &fs.scrub
+	fuseFile, status := fs.openFile(path, uint32(os.O_RDONLY))
+	if !status.Ok() {
+		// The file may have been deleted in the meantime
+		tlog.Debug.Printf("scrub: %s: open: %s", path, status.String())
+		return true
+	}
+	f := fuseFile.(*file)
+	defer f.Release()
+	if openfiletable.IsOpenForWrite(f.qIno) {
+		s.Lock()
+		s.stats.Skipped++
+		s.Unlock()
+		return true
+	}
+	size, err := f.statPlainSize()
+	if err != nil {
+		return true
+	}
+	bs := fs.contentEnc.PlainBS()
+	buf := make([]byte, bs)
+	var blocks uint64
+	for off := uint64(0); off < size; off += bs {
+		if !fs.scrubWait(fs.contentEnc.CipherBS()) {
+			return false
+		}
+		// doRead does not update the atime, unlike Read
+		_, status = f.doRead(buf[:0], off, bs)
+		if !status.Ok() && !openfiletable.IsOpenForWrite(f.qIno) {
+			// Retry once to make sure we did not see a write that has
+			// completed in the meantime
+			_, status = f.doRead(buf[:0], off, bs)
+		}
+		if !status.Ok() && openfiletable.IsOpenForWrite(f.qIno) {
+			s.Lock()
+			s.stats.Skipped++
+			s.Unlock()
+			return true
+		}
+		if !status.Ok() {
+			fs.scrubFailure("%s: %v", path, &CheckBlockError{Block: off / bs, Status: status})
+			break
+		}
+		blocks++
+	}
+	s.Lock()
+	s.stats.Files++
+	s.stats.Blocks += blocks
+	s.Unlock()
+	return true
+}
+
+// scrubWait blocks until we may read "n" more bytes without exceeding
+// Args.ScrubBandwidth (zero means no limit). Returns false if the scrubber
+// was stopped.
+func (fs *FS) scrubWait(n uint64) bool {
+	s := &fs.scrub
+	bw := float64(fs.args.ScrubBandwidth)
+	if bw == 0 {
+		// No limit
+		select {
+		case <-s.stop:
+			return false
+		default:
+			return true
+		}
+	}
+	now := time.Now()
+	if s.last.IsZero() {
+		s.last = now
+	}
+	// Refill the bucket, allowing bursts of up to one second
+	s.budget += now.Sub(s.last).Seconds() * bw
+	if s.budget > bw {
+		s.budget = bw
+	}
+	s.last = now
+	s.budget -= float64(n)
+	var wait time.Duration
+	if s.budget < 0 {
+		wait = time.Duration(-s.budget / bw * float64(time.Second))
+	}
+	select {
+	case <-s.stop:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
@@ -0,0 +1,99 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// waitScrubPasses waits until the scrubber has completed "n" passes.
+func waitScrubPasses(t *testing.T, fs *FS, n uint64) ScrubStats {
+	for i := 0; i < 500; i++ {
+		st := fs.ScrubStats()
+		if st.Passes >= n {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("scrubber did not complete %d passes", n)
+	return ScrubStats{}
+}
+
+// TestScrubber runs the scrubber with a tiny interval, corrupts a file and
+// checks that the failure is reported. Files open for writing are skipped.
+func TestScrubber(t *testing.T) {
+	fs, dir := newTestFS(t, Args{ScrubInterval: 50 * time.Millisecond})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, path := range []string{"sub/foo", "open"} {
+		f, code := fs.Create(path, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write(make([]byte, 10000), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	// Corrupt the second block of both files
+	for _, path := range []string{"sub/foo", "open"} {
+		cPath, err := fs.getBackingPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cf.WriteAt([]byte{0xaa, 0xbb}, 18+4128+100)
+		cf.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, code := fs.Open("open", uint32(os.O_RDWR), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer w.Release()
+
+	fs.StartScrubber()
+	st := waitScrubPasses(t, fs, 1)
+	fs.stopScrubber()
+	if len(st.Failures) != 1 || !strings.Contains(st.Failures[0], "sub/foo: block 1") {
+		t.Errorf("corrupt block not reported correctly: %v", st.Failures)
+	}
+	if st.Files != 1 || st.Blocks != 1 || st.Skipped != 1 {
+		t.Errorf("wrong counts: %+v", st)
+	}
+}
+
+// TestScrubberBandwidth checks that the scrubber keeps to the bandwidth
+// limit.
+func TestScrubberBandwidth(t *testing.T) {
+	// Four ciphertext blocks per second
+	fs, dir := newTestFS(t, Args{ScrubInterval: time.Millisecond, ScrubBandwidth: 4 * 4128})
+	defer os.RemoveAll(dir)
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(make([]byte, 4096*8), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	t0 := time.Now()
+	fs.StartScrubber()
+	waitScrubPasses(t, fs, 1)
+	fs.stopScrubber()
+	// The bucket starts empty, so reading 8 blocks takes 2 seconds
+	if d := time.Since(t0); d < 1500*time.Millisecond {
+		t.Errorf("scrubbing was too fast: %v", d)
+	}
+}
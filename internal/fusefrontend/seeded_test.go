@@ -0,0 +1,127 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// seededVolume creates a filesystem with cryptocore.SeedForTests(seed),
+// fills it and returns the CIPHERDIR.
+func seededVolume(t *testing.T, seed []byte) string {
+	cryptocore.SeedForTests(seed)
+	defer cryptocore.SeedForTests(nil)
+	dir, err := ioutil.TempDir("", "gocryptfs-seeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename:       conf,
+		Password:       "test",
+		LogN:           10,
+		Creator:        "test",
+		EncryptedDirIV: true,
+		CipherDir:      dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS(key, Args{
+		Cipherdir:      dir,
+		CryptoBackend:  cryptocore.BackendGoGCM,
+		LongNames:      true,
+		Raw64:          true,
+		HKDF:           true,
+		EncryptedDirIV: true,
+	})
+	ctx := &fuse.Context{}
+	long := strings.Repeat("l", 200)
+	for _, d := range []string{"a", "a/" + long} {
+		if code := fs.Mkdir(d, 0700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	for i, p := range []string{"f", "a/f", "a/" + long + "/f"} {
+		f, code := fs.Create(p, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		_, code = f.Write(bytes.Repeat([]byte{byte(i)}, 10000), 0)
+		f.Release()
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	if code := fs.Symlink("a/f", "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	return dir
+}
+
+// backingFiles returns the content of every file in "dir", by relative path.
+// Directories map to "dir", symlinks to their target.
+func backingFiles(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		switch {
+		case fi.IsDir():
+			files[rel] = "dir"
+		case fi.Mode()&os.ModeSymlink != 0:
+			files[rel], err = os.Readlink(path)
+		default:
+			var b []byte
+			b, err = ioutil.ReadFile(path)
+			files[rel] = string(b)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// TestSeededVolume creates two volumes with the same seed and checks that
+// their backing directories are byte-for-byte identical, and that a third one
+// with a different seed is not.
+func TestSeededVolume(t *testing.T) {
+	dir1 := seededVolume(t, []byte("seed"))
+	defer os.RemoveAll(dir1)
+	dir2 := seededVolume(t, []byte("seed"))
+	defer os.RemoveAll(dir2)
+	dir3 := seededVolume(t, []byte("other seed"))
+	defer os.RemoveAll(dir3)
+	files1 := backingFiles(t, dir1)
+	files2 := backingFiles(t, dir2)
+	if len(files1) != len(files2) {
+		t.Errorf("different number of backing files: %d vs %d", len(files1), len(files2))
+	}
+	for path, content := range files1 {
+		if c2, ok := files2[path]; !ok {
+			t.Errorf("%q is missing in the second volume", path)
+		} else if c2 != content {
+			t.Errorf("%q differs", path)
+		}
+	}
+	conf := configfile.ConfDefaultName
+	if backingFiles(t, dir3)[conf] == files1[conf] {
+		t.Error("a different seed gave the same config file")
+	}
+}
@@ -0,0 +1,439 @@
+package fusefrontend
+
+// Optional snapshots ("-cow-snapshots"): the ctlsock "Snapshot" request
+// records the current state of CIPHERDIR in
+// CIPHERDIR/.gocryptfs.snapshots/NAME.
+//
+// A snapshot is a copy of the ciphertext tree where the regular files are
+// hard links to the live backing files. Taking it is cheap, and the
+// snapshot directory is a complete CIPHERDIR that can be mounted with "-ro"
+// or archived. To keep it stable, a live file that shares its inode with a
+// snapshot is copied before it is changed ("copy on write"): the copy is
+// renamed over the live name, and the snapshot keeps the original inode.
+//
+// Files that are open for writing while the snapshot is taken are copied
+// right away, as their open file descriptors would otherwise write into
+// the snapshot.
+//
+// Copy on write replaces a single name, so a live file with several names
+// would lose its hard link on the first change. Link fails with EPERM
+// while snapshots are enabled, and Snapshot refuses to run if the live
+// tree already contains hard links.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// SnapshotDirName is the name of the snapshot directory in the root of
+	// CIPHERDIR.
+	SnapshotDirName = ".gocryptfs.snapshots"
+	// snapshotTmpPrefix marks snapshots that are still being taken and
+	// copies that are about to replace a live file
+	snapshotTmpPrefix = ".tmp-"
+)
+
+// snapshotState holds the backing inodes that are part of a snapshot
+type snapshotState struct {
+	// lock is taken for reading by every operation that changes the
+	// filesystem, and for writing while a snapshot is taken.
+	lock sync.RWMutex
+	// mu protects inodes
+	mu     sync.Mutex
+	inodes map[openfiletable.QIno]struct{}
+}
+
+// snapshotRLock blocks while a snapshot is being taken. Operations that
+// change the filesystem call it on entry, like this:
+//
+//	defer fs.snapshotRLock()()
+//
+// Internal helpers must not call it again, as a waiting Snapshot() would
+// deadlock the nested RLock.
+func (fs *FS) snapshotRLock() func() {
+	if !fs.args.Snapshots {
+		return func() {}
+	}
+	fs.snapshots.lock.RLock()
+	return fs.snapshots.lock.RUnlock
+}
+
+// isSnapshotDir returns true if "name" in the root directory is the snapshot
+// directory. Without "-cow-snapshots", it is a normal name.
+func (fs *FS) isSnapshotDir(name string) bool {
+	return fs.args.Snapshots && name == SnapshotDirName
+}
+
+// SnapshotsEnabled implements ctlsock.SnapshotInterface.
+func (fs *FS) SnapshotsEnabled() bool {
+	return fs.args.Snapshots
+}
+
+// snapshotDir returns the absolute path of the snapshot directory
+func (fs *FS) snapshotDir() string {
+	return filepath.Join(fs.args.Cipherdir, SnapshotDirName)
+}
+
+// initSnapshots collects the backing inodes of the existing snapshots.
+func (fs *FS) initSnapshots() {
+	if !fs.args.Snapshots {
+		return
+	}
+	inodes, err := fs.snapshotInodes()
+	if err != nil {
+		tlog.Warn.Printf("initSnapshots: %v", err)
+	}
+	fs.snapshots.mu.Lock()
+	fs.snapshots.inodes = inodes
+	fs.snapshots.mu.Unlock()
+}
+
+// snapshotInodes walks the snapshot directory and returns the inodes of
+// all regular files in it.
+func (fs *FS) snapshotInodes() (map[openfiletable.QIno]struct{}, error) {
+	inodes := make(map[openfiletable.QIno]struct{})
+	err := filepath.Walk(fs.snapshotDir(), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == fs.snapshotDir() {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			inodes[openfiletable.QInoFromStat(fi.Sys().(*syscall.Stat_t))] = struct{}{}
+		}
+		return nil
+	})
+	return inodes, err
+}
+
+// inSnapshot returns true if the backing file "st" shares its inode with a
+// snapshot.
+func (fs *FS) inSnapshot(st *syscall.Stat_t) bool {
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink < 2 {
+		return false
+	}
+	fs.snapshots.mu.Lock()
+	defer fs.snapshots.mu.Unlock()
+	_, ok := fs.snapshots.inodes[openfiletable.QInoFromStat(st)]
+	return ok
+}
+
+// cowBreak makes sure that changing the plaintext file "path" does not
+// change a snapshot. The caller must hold snapshotRLock().
+func (fs *FS) cowBreak(path string) error {
+	if !fs.args.Snapshots {
+		return nil
+	}
+	dirfd, cName, err := fs.openBackingPath(path)
+	if err != nil {
+		// Let the caller report the error
+		return nil
+	}
+	defer dirfd.Close()
+	return fs.cowBreakAt(dirfd, cName)
+}
+
+// cowBreakAt replaces the backing file "cName" in "dirfd" with a copy if
+// it shares its inode with a snapshot.
+func (fs *FS) cowBreakAt(dirfd *os.File, cName string) error {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(int(dirfd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil
+	}
+	st2 := syscallcompat.Unix2syscall(st)
+	if !fs.inSnapshot(&st2) {
+		return nil
+	}
+	tmp := filepath.Join(fs.snapshotDir(), snapshotTmpPrefix+hex.EncodeToString(cryptocore.RandBytes(8)))
+	src := filepath.Join(dirfd.Name(), cName)
+	if err = copyBackingFile(src, tmp, fs.args.DirSync); err != nil {
+		tlog.Warn.Printf("cowBreak %q: %v", src, err)
+		os.Remove(tmp)
+		return err
+	}
+	err = syscallcompat.Renameat(unix.AT_FDCWD, tmp, int(dirfd.Fd()), cName)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	tlog.Debug.Printf("cowBreak: copied %q", src)
+	if fs.args.DirSync {
+		return fs.syncEntry(dirfd, cName)
+	}
+	return nil
+}
+
+// copyBackingFile copies the regular file "src" to the new file "dst",
+// with its permissions, owner, extended attributes and times.
+func copyBackingFile(src string, dst string, sync bool) error {
+	in, err := os.Open(src)
+	if os.IsPermission(err) {
+		// Like openWriteOnlyFile, for files without read permission
+		var fi os.FileInfo
+		if fi, err = os.Lstat(src); err != nil {
+			return err
+		}
+		perms := uint32(fi.Sys().(*syscall.Stat_t).Mode) & 07777
+		if err = syscall.Chmod(src, perms|0400); err != nil {
+			return err
+		}
+		in, err = os.Open(src)
+		syscall.Chmod(src, perms)
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if names, err := llistxattr(src); err == nil {
+		for _, attr := range bytes.Split(names, []byte{0}) {
+			if len(attr) == 0 {
+				continue
+			}
+			val, err := lgetxattr(src, string(attr))
+			if err == nil {
+				err = syscallcompat.Lsetxattr(dst, string(attr), val, 0)
+			}
+			if err != nil {
+				tlog.Debug.Printf("copyBackingFile %q: xattr %q: %v", src, attr, err)
+			}
+		}
+	}
+	// Only root can give the copy away. Otherwise, it is ours anyway.
+	out.Chown(int(st.Uid), int(st.Gid))
+	if err = syscall.Fchmod(int(out.Fd()), uint32(st.Mode)&07777); err != nil {
+		return err
+	}
+	mtime := fi.ModTime()
+	atime := fuse.ToAttr(fi).AccessTime()
+	if err = syscallcompat.Utimensat(unix.AT_FDCWD, dst, &atime, &mtime, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if sync {
+		return out.Sync()
+	}
+	return nil
+}
+
+// checkSnapshotName rejects snapshot names that are not a single, visible
+// path component.
+func checkSnapshotName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\x00") {
+		return &os.PathError{Op: "snapshot", Path: name, Err: syscall.EINVAL}
+	}
+	return nil
+}
+
+// Snapshot implements ctlsock.SnapshotInterface. Records the current state
+// of the filesystem as snapshot "name" and returns the ciphertext directory
+// of the snapshot. Changes to the filesystem wait until it is done.
+func (fs *FS) Snapshot(name string) (string, error) {
+	if !fs.args.Snapshots {
+		// Without copy on write, the next change would end up in the
+		// snapshot
+		return "", &os.PathError{Op: "snapshot", Path: name, Err: syscall.ENOTSUP}
+	}
+	if err := checkSnapshotName(name); err != nil {
+		return "", err
+	}
+	fs.snapshots.lock.Lock()
+	defer fs.snapshots.lock.Unlock()
+	dst := filepath.Join(fs.snapshotDir(), name)
+	if _, err := os.Lstat(dst); err == nil {
+		return "", &os.PathError{Op: "snapshot", Path: name, Err: syscall.EEXIST}
+	}
+	if err := os.Mkdir(fs.snapshotDir(), 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	// The files that are open for writing are copied instead of linked
+	writable := make(map[openfiletable.QIno]bool)
+	files, _ := fs.openFiles.files()
+	for _, f := range files {
+		if f.writable {
+			writable[f.qIno] = true
+		}
+	}
+	tmp := filepath.Join(fs.snapshotDir(), snapshotTmpPrefix+name)
+	os.RemoveAll(tmp)
+	inodes := make(map[openfiletable.QIno]struct{})
+	err := fs.snapshotTree(fs.args.Cipherdir, tmp, true, writable, inodes)
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if fs.args.DirSync {
+		if d, err := os.Open(fs.snapshotDir()); err == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+	fs.snapshots.mu.Lock()
+	for qi := range inodes {
+		fs.snapshots.inodes[qi] = struct{}{}
+	}
+	fs.snapshots.mu.Unlock()
+	tlog.Info.Printf("Snapshot %q taken", name)
+	return dst, nil
+}
+
+// snapshotTree recreates the ciphertext directory "src" as "dst". Regular
+// files are hard-linked and their inodes added to "inodes", unless they are
+// in "writable". "root" is set for the top-level directory, where the trash
+// and the snapshots themselves are left out.
+func (fs *FS) snapshotTree(src string, dst string, root bool, writable map[openfiletable.QIno]bool, inodes map[openfiletable.QIno]struct{}) error {
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		if root && (fs.isSnapshotDir(name) || fs.isTrashDir(name)) {
+			continue
+		}
+		s, d := filepath.Join(src, name), filepath.Join(dst, name)
+		st := fi.Sys().(*syscall.Stat_t)
+		qi := openfiletable.QInoFromStat(st)
+		switch {
+		case fi.IsDir():
+			err = fs.snapshotTree(s, d, false, writable, inodes)
+		case fi.Mode()&os.ModeSymlink != 0:
+			var target string
+			if target, err = os.Readlink(s); err == nil {
+				err = os.Symlink(target, d)
+			}
+		case fi.Mode().IsRegular() && (writable[qi] || name == nametransform.DirIVFilename || root && name == configfile.ConfDefaultName):
+			// gocryptfs.diriv and gocryptfs.conf are small, and Chown and
+			// "-passwd" change them in place
+			err = copyBackingFile(s, d, false)
+		case fi.Mode().IsRegular() && hasLink(inodes, qi):
+			// A second live name of the same file. See the comment on
+			// top of the file.
+			err = &os.PathError{Op: "snapshot", Path: s, Err: syscall.EMLINK}
+		default:
+			err = os.Link(s, d)
+			if err == nil && fi.Mode().IsRegular() {
+				inodes[qi] = struct{}{}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Directory permissions and times last, after all entries are in
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	os.Lchown(dst, int(st.Uid), int(st.Gid))
+	if err = syscall.Chmod(dst, uint32(st.Mode)&07777); err != nil {
+		return err
+	}
+	mtime := fi.ModTime()
+	atime := fuse.ToAttr(fi).AccessTime()
+	return syscallcompat.Utimensat(unix.AT_FDCWD, dst, &atime, &mtime, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// hasLink returns true if the inode "qi" has already been linked into the
+// snapshot under another name.
+func hasLink(inodes map[openfiletable.QIno]struct{}, qi openfiletable.QIno) bool {
+	_, ok := inodes[qi]
+	return ok
+}
+
+// SnapshotList implements ctlsock.SnapshotInterface. Returns one line per
+// snapshot: "NAME<tab>TIME", sorted by name.
+func (fs *FS) SnapshotList() (string, error) {
+	entries, err := ioutil.ReadDir(fs.snapshotDir())
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var out []string
+	for _, fi := range entries {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		t := fi.ModTime().UTC().Format(time.RFC3339)
+		out = append(out, fmt.Sprintf("%s\t%s", fi.Name(), t))
+	}
+	sort.Strings(out)
+	return strings.Join(out, "\n"), nil
+}
+
+// SnapshotDelete implements ctlsock.SnapshotInterface. Deletes snapshot
+// "name".
+func (fs *FS) SnapshotDelete(name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	fs.snapshots.lock.Lock()
+	defer fs.snapshots.lock.Unlock()
+	dir := filepath.Join(fs.snapshotDir(), name)
+	if _, err := os.Lstat(dir); err != nil {
+		return err
+	}
+	// The snapshot keeps its own permissions, which may not let us delete
+	// the entries
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	inodes, err := fs.snapshotInodes()
+	if err != nil {
+		return err
+	}
+	fs.snapshots.mu.Lock()
+	fs.snapshots.inodes = inodes
+	fs.snapshots.mu.Unlock()
+	return nil
+}
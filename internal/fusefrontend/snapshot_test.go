@@ -0,0 +1,162 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// readFile returns the plaintext content of "path", or "" if it cannot be
+// read.
+func readFile(t *testing.T, fs *FS, path string) string {
+	f, code := fs.Open(path, uint32(os.O_RDONLY), &fuse.Context{})
+	if !code.Ok() {
+		t.Errorf("Open %q: %v", path, code)
+		return ""
+	}
+	defer f.Release()
+	buf := make([]byte, 1000)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Errorf("Read %q: %v", path, code)
+		return ""
+	}
+	data, _ := res.Bytes(buf)
+	return string(data)
+}
+
+// TestSnapshot takes a snapshot, changes the files in several ways and
+// checks that the snapshot can be opened as a CIPHERDIR of its own that
+// still has the old content.
+func TestSnapshot(t *testing.T) {
+	fs, dir := newTestFS(t, Args{Snapshots: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	long := strings.Repeat("x", 200)
+	var open nodefs.File
+	for _, path := range []string{"foo", "sub/bar", long, "open"} {
+		f, code := fs.Create(path, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write([]byte("old"), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		if path == "open" {
+			open = f
+			continue
+		}
+		f.Release()
+	}
+	defer open.Release()
+
+	snapDir, err := fs.Snapshot("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Snapshot("s1"); err == nil {
+		t.Error("taking a snapshot with the same name twice should fail")
+	}
+	if _, err = fs.Snapshot("../x"); err == nil {
+		t.Error("invalid snapshot name was accepted")
+	}
+
+	f, code := fs.Open("foo", uint32(os.O_WRONLY), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Write([]byte("new"), 0)
+	f.Release()
+	if code = fs.Truncate("sub/bar", 0, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Chmod(long, 0644, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = open.Write([]byte("new"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	if got := readFile(t, fs, "foo"); got != "new" {
+		t.Errorf("foo: want %q, got %q", "new", got)
+	}
+	snapFS := NewFS(make([]byte, cryptocore.KeyLen), Args{
+		Cipherdir:     snapDir,
+		CryptoBackend: cryptocore.BackendGoGCM,
+		LongNames:     true,
+		Raw64:         true,
+		HKDF:          true,
+	})
+	for _, path := range []string{"foo", "sub/bar", long, "open"} {
+		if got := readFile(t, snapFS, path); got != "old" {
+			t.Errorf("snapshot %q: want %q, got %q", path, "old", got)
+		}
+	}
+	a, code := snapFS.GetAttr(long, ctx)
+	if !code.Ok() || a.Mode&07777 != 0600 {
+		t.Errorf("snapshot: chmod went through: %v %o", code, a.Mode)
+	}
+
+	entries, code := fs.OpenDir("", ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, e := range entries {
+		if e.Name == SnapshotDirName {
+			t.Error("the snapshot directory is visible")
+		}
+	}
+	list, err := fs.SnapshotList()
+	if err != nil || !strings.HasPrefix(list, "s1\t") {
+		t.Errorf("SnapshotList: %q %v", list, err)
+	}
+	if err = fs.SnapshotDelete("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(snapDir); !os.IsNotExist(err) {
+		t.Errorf("snapshot still exists: %v", err)
+	}
+	if len(fs.snapshots.inodes) != 0 {
+		t.Errorf("stale snapshot inodes: %v", fs.snapshots.inodes)
+	}
+}
+
+// TestSnapshotHardLinks checks that hard links, which copy on write would
+// split, are refused.
+func TestSnapshotHardLinks(t *testing.T) {
+	fs, dir := newTestFS(t, Args{Snapshots: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if code = fs.Link("foo", "bar", ctx); code != fuse.EPERM {
+		t.Errorf("Link: want EPERM, got %v", code)
+	}
+	// A hard link that was created without "-cow-snapshots"
+	cFoo, err := fs.getBackingPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(cFoo, cFoo+".link"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Snapshot("s1")
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EMLINK {
+		t.Errorf("Snapshot: want EMLINK, got %v", err)
+	}
+	if list, _ := fs.SnapshotList(); list != "" {
+		t.Errorf("a snapshot was left behind: %q", list)
+	}
+}
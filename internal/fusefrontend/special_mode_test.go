@@ -0,0 +1,105 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// checkMode checks that "path" has the permission and special bits "want".
+func checkMode(t *testing.T, fs *FS, path string, want uint32) {
+	a, code := fs.GetAttr(path, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatalf("%s: %v", path, code)
+	}
+	if a.Mode&07777 != want {
+		t.Errorf("%s: mode %#o, want %#o", path, a.Mode&07777, want)
+	}
+}
+
+// TestSpecialModeBits checks that the setuid, setgid and sticky bits
+// survive Create, Mkdir and Chmod and are reported by GetAttr.
+func TestSpecialModeBits(t *testing.T) {
+	for _, plaintextNames := range []bool{false, true} {
+		fs, dir := newTestFS(t, Args{PlaintextNames: plaintextNames})
+		defer os.RemoveAll(dir)
+		ctx := &fuse.Context{}
+		long := strings.Repeat("l", 255)
+		for _, name := range []string{"suid", long} {
+			f, code := fs.Create(name, uint32(os.O_WRONLY), 04755, ctx)
+			if !code.Ok() {
+				t.Fatal(code)
+			}
+			f.Release()
+			checkMode(t, fs, name, 04755)
+		}
+		if code := fs.Chmod("suid", 06750, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+		checkMode(t, fs, "suid", 06750)
+
+		dirs := map[string]uint32{
+			"sticky":    01777,
+			"sgid":      02755,
+			"suid-dir":  04700,
+			"sticky-ro": 01500,
+		}
+		for name, mode := range dirs {
+			if code := fs.Mkdir(name, mode, ctx); !code.Ok() {
+				t.Fatal(code)
+			}
+			checkMode(t, fs, name, mode)
+		}
+		// A new directory inherits setgid from its parent, also when the
+		// permissions are fixed up after creating gocryptfs.diriv
+		for name, mode := range map[string]uint32{"sgid/a": 0755, "sgid/b": 0600} {
+			if code := fs.Mkdir(name, mode, ctx); !code.Ok() {
+				t.Fatal(code)
+			}
+			checkMode(t, fs, name, mode|syscall.S_ISGID)
+			fs.Chmod(name, 0700, ctx)
+		}
+		fs.Chmod("sticky-ro", 0700, ctx)
+		if code := fs.Chmod("sticky", 01700, ctx); !code.Ok() {
+			t.Fatal(code)
+		}
+		checkMode(t, fs, "sticky", 01700)
+	}
+}
+
+// TestSpecialModeBitsWrite checks that a write clears the setuid and setgid
+// bits unless the writer has CAP_FSETID (we assume root has it), like on a
+// local filesystem. Opening a write-only file must not lose them either.
+func TestSpecialModeBitsWrite(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 06755, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	checkMode(t, fs, "foo", 06755)
+	if _, code = f.Write([]byte("foo"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if os.Getuid() == 0 {
+		checkMode(t, fs, "foo", 06755)
+	} else {
+		checkMode(t, fs, "foo", 0755)
+	}
+
+	if code = fs.Chmod("foo", 04200, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Goes through openWriteOnlyFile() unless we are root
+	wo, code := fs.Open("foo", uint32(os.O_WRONLY), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	wo.Release()
+	checkMode(t, fs, "foo", 04200)
+}
@@ -0,0 +1,115 @@
+package fusefrontend
+
+// Batch stat for the ctlsock "Stat" request
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// StatPaths implements ctlsock.StatInterface. The paths are grouped by
+// their parent directory, which is opened once, and the entries are
+// stat'ed relative to it.
+func (fs *FS) StatPaths(paths []string) ([]ctlsock.StatAttr, []error) {
+	attrs := make([]ctlsock.StatAttr, len(paths))
+	errs := make([]error, len(paths))
+	// Indexes into "paths", by parent directory
+	byDir := make(map[string][]int)
+	var dirs []string
+	for i, p := range paths {
+		d := nametransform.Dir(p)
+		if byDir[d] == nil {
+			dirs = append(dirs, d)
+		}
+		byDir[d] = append(byDir[d], i)
+	}
+	for _, d := range dirs {
+		fs.statDir(d, byDir[d], paths, attrs, errs)
+	}
+	return attrs, errs
+}
+
+// statDir stats paths[i] for all "i" in "idx". All of them are in the
+// plaintext directory "dir".
+func (fs *FS) statDir(dir string, idx []int, paths []string, attrs []ctlsock.StatAttr, errs []error) {
+	setErr := func(i int, err error) {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		errs[i] = &os.PathError{Op: "stat", Path: paths[i], Err: err}
+	}
+	cDir, err := fs.encryptPath(dir)
+	var dirfd int
+	if err == nil {
+		dirfd, err = syscall.Open(filepath.Join(fs.args.Cipherdir, cDir),
+			syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	}
+	if err != nil {
+		for _, i := range idx {
+			setErr(i, err)
+		}
+		return
+	}
+	defer syscall.Close(dirfd)
+	for _, i := range idx {
+		a, err := fs.statAt(dirfd, cDir, paths[i])
+		if err != nil {
+			setErr(i, err)
+			continue
+		}
+		attrs[i] = a
+	}
+}
+
+// statAt returns the attributes of the plaintext path "path". Its parent
+// directory has the ciphertext path "cDir" and is open as "dirfd".
+func (fs *FS) statAt(dirfd int, cDir string, path string) (ctlsock.StatAttr, error) {
+	if fs.isFiltered(path) {
+		return ctlsock.StatAttr{}, syscall.EPERM
+	}
+	cName := "."
+	if path != "" {
+		cPath, err := fs.encryptPath(path)
+		if err != nil {
+			return ctlsock.StatAttr{}, err
+		}
+		cName = filepath.Base(cPath)
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return ctlsock.StatAttr{}, err
+	}
+	st2 := syscallcompat.Unix2syscall(st)
+	var a fuse.Attr
+	a.FromStat(&st2)
+	// Same as GetAttr
+	if a.IsRegular() && fs.isSymlinkFile(filepath.Join(cDir, cName), a.Size) {
+		a.Mode = syscall.S_IFLNK | 0777
+	}
+	if a.IsRegular() {
+		a.Size = fs.contentEnc.CipherSizeToPlainSize(a.Size)
+	} else if a.IsSymlink() {
+		target, status := fs.Readlink(path, &fuse.Context{})
+		if !status.Ok() {
+			return ctlsock.StatAttr{}, syscall.Errno(status)
+		}
+		a.Size = uint64(len(target))
+	}
+	fs.forceTime(&a)
+	return ctlsock.StatAttr{
+		Size:      a.Size,
+		Mode:      a.Mode,
+		Mtime:     a.Mtime,
+		Mtimensec: a.Mtimensec,
+	}, nil
+}
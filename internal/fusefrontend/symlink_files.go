@@ -0,0 +1,162 @@
+package fusefrontend
+
+// Symlinks stored as regular files (SymlinkFiles feature flag)
+//
+// Some backing stores and backup tools mangle symlinks: they limit the
+// length of the target, restrict the characters in it, or do not support
+// symlinks at all. With the SymlinkFiles feature flag, a symlink is stored
+// as a small regular file instead. It has the usual file header, but with
+// contentenc.SymlinkVersion as the version, followed by the target
+// encrypted like file content, but starting at block number
+// symlinkFirstBlockNo.
+//
+// The version is not authenticated. The block number is, as it goes into the
+// GCM additional data, so a file whose version has been changed fails to
+// decrypt instead of being read as the other file type.
+//
+// Telling such a file apart from a regular file means reading its header.
+// Only files that are small enough to hold a target have to be checked.
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// maxSymlinkTarget is the maximum length of a symlink target plus one,
+	// like PATH_MAX
+	maxSymlinkTarget = 4096
+	// symlinkFileMode is the mode of the backing file. The mode the user
+	// sees is always 0777, like for real symlinks.
+	symlinkFileMode = 0600
+	// symlinkFirstBlockNo is the block number of the first block of the
+	// target. Regular files never get anywhere near it.
+	symlinkFirstBlockNo = 1 << 63
+)
+
+// createSymlink creates the backing symlink "cName" in "dirfd" that points
+// to the plaintext "target".
+func (fs *FS) createSymlink(dirfd int, cName string, target string) error {
+	if fs.args.SymlinkFiles {
+		return fs.writeSymlinkFile(dirfd, cName, target)
+	}
+	cTarget := target
+	if !fs.args.PlaintextNames {
+		// Symlinks are encrypted like file contents (GCM) and base64-encoded
+		cBinTarget := fs.contentEnc.EncryptBlock([]byte(target), 0, nil)
+		cTarget = fs.nameTransform.B64.EncodeToString(cBinTarget)
+	}
+	return syscallcompat.Symlinkat(cTarget, dirfd, cName)
+}
+
+// writeSymlinkFile creates the regular file "cName" in "dirfd" that stores
+// the encrypted "target".
+func (fs *FS) writeSymlinkFile(dirfd int, cName string, target string) error {
+	if len(target) >= maxSymlinkTarget {
+		return syscall.ENAMETOOLONG
+	}
+	h := contentenc.RandomSymlinkHeader()
+	var blocks [][]byte
+	bs := int(fs.contentEnc.PlainBS())
+	t := []byte(target)
+	for len(t) > 0 {
+		n := len(t)
+		if n > bs {
+			n = bs
+		}
+		blocks = append(blocks, t[:n])
+		t = t[n:]
+	}
+	ciphertext := fs.contentEnc.EncryptBlocks(blocks, symlinkFirstBlockNo, h.ID)
+	buf := append(h.Pack(), ciphertext...)
+	fs.contentEnc.CReqPool.Put(ciphertext)
+
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, symlinkFileMode)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.Write(fd, buf)
+	if err == nil && n != len(buf) {
+		err = syscall.EIO
+	}
+	if err == nil && fs.args.DirSync {
+		err = syncFd(fd)
+	}
+	syscall.Close(fd)
+	if err != nil {
+		tlog.Warn.Printf("writeSymlinkFile %q: %v", cName, err)
+		syscallcompat.Unlinkat(dirfd, cName, 0)
+	}
+	return err
+}
+
+// isSymlinkFile returns true if the regular backing file "cPath" (relative
+// to the cipherdir), that is "size" bytes big, stores a symlink target.
+func (fs *FS) isSymlinkFile(cPath string, size uint64) bool {
+	if !fs.args.SymlinkFiles || size <= contentenc.HeaderLen ||
+		size > fs.contentEnc.PlainSizeToCipherSize(maxSymlinkTarget-1) {
+		return false
+	}
+	fd, err := syscall.Open(filepath.Join(fs.args.Cipherdir, cPath), syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 2)
+	n, _ := syscall.Pread(fd, buf, 0)
+	return contentenc.IsSymlinkHeader(buf[:n])
+}
+
+// direntMode returns S_IFLNK if the regular backing file "cPath" (relative
+// to the cipherdir) stores a symlink target, and S_IFREG otherwise.
+func (fs *FS) direntMode(cPath string) uint32 {
+	var st syscall.Stat_t
+	err := syscall.Lstat(filepath.Join(fs.args.Cipherdir, cPath), &st)
+	if err == nil && fs.isSymlinkFile(cPath, uint64(st.Size)) {
+		return syscall.S_IFLNK
+	}
+	return syscall.S_IFREG
+}
+
+// readSymlinkFile reads and decrypts the target stored in the regular file
+// "cName" in "dirfd". Returns EINVAL if the file is not a symlink file.
+func (fs *FS) readSymlinkFile(dirfd *os.File, cName string) (string, error) {
+	fd, err := syscallcompat.Openat(int(dirfd.Fd()), cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	cPath := filepath.Join(dirfd.Name(), cName)
+	f := os.NewFile(uintptr(fd), cPath)
+	defer f.Close()
+	max := fs.contentEnc.PlainSizeToCipherSize(maxSymlinkTarget - 1)
+	buf := make([]byte, max+1)
+	n, err := io.ReadFull(f, buf)
+	if err == nil {
+		// Too big to be a symlink file
+		return "", syscall.EINVAL
+	} else if err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	buf = buf[:n]
+	if n <= contentenc.HeaderLen || !contentenc.IsSymlinkHeader(buf) {
+		return "", syscall.EINVAL
+	}
+	h, err := contentenc.ParseSymlinkHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		return "", syscall.EIO
+	}
+	plaintext, err := fs.contentEnc.DecryptBlocks(buf[contentenc.HeaderLen:], symlinkFirstBlockNo, h.ID)
+	if err != nil {
+		tlog.Warn.Printf("readSymlinkFile %q: %v", cPath, err)
+		return "", syscall.EIO
+	}
+	target := string(plaintext)
+	fs.contentEnc.PReqPool.Put(plaintext)
+	return target, nil
+}
@@ -0,0 +1,173 @@
+package fusefrontend
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// TestSymlinkFiles creates symlinks with long targets and reads them back,
+// with symlinks stored as backing symlinks and as regular files.
+func TestSymlinkFiles(t *testing.T) {
+	for _, symlinkFiles := range []bool{false, true} {
+		fs, dir := newTestFS(t, Args{SymlinkFiles: symlinkFiles})
+		defer os.RemoveAll(dir)
+		ctx := &fuse.Context{}
+		// A small regular file must stay a regular file
+		f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write([]byte("foo"), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+		targets := map[string]string{
+			"short":                  "../foo",
+			"long":                   strings.Repeat("x/", 1000),
+			strings.Repeat("n", 255): strings.Repeat("y", 200),
+		}
+		if symlinkFiles {
+			// Too long for a backing symlink once it is encrypted and
+			// base64-encoded
+			targets["verylong"] = strings.Repeat("z", 4000)
+		}
+		for name, target := range targets {
+			if code = fs.Symlink(target, name, ctx); !code.Ok() {
+				t.Fatalf("symlinkFiles=%v: Symlink %q: %v", symlinkFiles, name, code)
+			}
+			out, code := fs.Readlink(name, ctx)
+			if !code.Ok() || out != target {
+				t.Errorf("symlinkFiles=%v: Readlink %q: %v, got %d bytes", symlinkFiles, name, code, len(out))
+			}
+			a, code := fs.GetAttr(name, ctx)
+			if !code.Ok() {
+				t.Fatal(code)
+			}
+			if !a.IsSymlink() || a.Size != uint64(len(target)) {
+				t.Errorf("symlinkFiles=%v: %q: wrong attributes: %v", symlinkFiles, name, a)
+			}
+			cPath, err := fs.getBackingPath(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Lstat(cPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().IsRegular() != symlinkFiles {
+				t.Errorf("symlinkFiles=%v: %q: wrong backing file type: %v", symlinkFiles, name, fi.Mode())
+			}
+		}
+		if a, code := fs.GetAttr("foo", ctx); !code.Ok() || !a.IsRegular() || a.Size != 3 {
+			t.Errorf("symlinkFiles=%v: foo: wrong attributes: %v %v", symlinkFiles, a, code)
+		}
+		entries, code := fs.OpenDir("", ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		for _, e := range entries {
+			want := uint32(syscall.S_IFLNK)
+			if e.Name == "foo" {
+				want = syscall.S_IFREG
+			}
+			if e.Mode != want {
+				t.Errorf("symlinkFiles=%v: %q: wrong dirent mode %#o", symlinkFiles, e.Name, e.Mode)
+			}
+		}
+	}
+}
+
+// TestSymlinkFilesCorrupt checks that a damaged symlink file is reported as
+// EIO.
+func TestSymlinkFilesCorrupt(t *testing.T) {
+	fs, dir := newTestFS(t, Args{SymlinkFiles: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Symlink("some/target", "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	cPath, err := fs.getBackingPath("link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xaa}, 30)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code := fs.Readlink("link", ctx); code != fuse.EIO {
+		t.Errorf("want EIO, got %v", code)
+	}
+	// Removing the link removes the backing file
+	if code := fs.Unlink("link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, err = os.Lstat(filepath.Join(dir, filepath.Base(cPath))); !os.IsNotExist(err) {
+		t.Errorf("backing file still exists: %v", err)
+	}
+}
+
+// setVersion overwrites the header version of the backing file of "path".
+func setVersion(t *testing.T, fs *FS, path string, version uint16) {
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, version)
+	if _, err = f.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSymlinkFilesSwapped checks that changing the unauthenticated header
+// version does not turn a regular file into a symlink, or the other way
+// round.
+func TestSymlinkFilesSwapped(t *testing.T) {
+	fs, dir := newTestFS(t, Args{SymlinkFiles: true})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	f, code := fs.Create("file", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("some/target"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	setVersion(t, fs, "file", contentenc.SymlinkVersion)
+	if _, code = fs.Readlink("file", ctx); code != fuse.EIO {
+		t.Errorf("regular file as symlink: want EIO, got %v", code)
+	}
+
+	if code = fs.Symlink("some/target", "link", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	setVersion(t, fs, "link", contentenc.CurrentVersion)
+	f, code = fs.Open("link", uint32(os.O_RDONLY), ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	buf := make([]byte, 100)
+	if _, code = f.Read(buf, 0); code != fuse.EIO {
+		t.Errorf("symlink as regular file: want EIO, got %v", code)
+	}
+}
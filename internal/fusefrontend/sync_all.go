@@ -0,0 +1,101 @@
+package fusefrontend
+
+// Make everything durable at once, for the ctlsock "SyncAll" request
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// syncFS is used for the syncfs(2) call of SyncAll. The tests replace it.
+var syncFS = syscallcompat.Syncfs
+
+// SyncAll implements ctlsock.SyncInterface. It returns once everything that
+// has been written through the mount is durable, for example before taking
+// a snapshot of the backing storage:
+//
+//  1. Every file that is open for writing is fsync'ed, like an fsync(2) by
+//     the application would. With "-write-intent", this records the durable
+//     size.
+//  2. The backing directories of these files, and the ".name" files of long
+//     names, are fsync'ed, so that newly created files cannot get lost.
+//  3. The backing filesystem is synced with syncfs(2). This covers files
+//     that have already been closed, and all other directory changes.
+//
+// gocryptfs has no write-back buffers of its own. Writes the kernel has not
+// yet passed to us are not covered; call fsync(2) or syncfs(2) on the
+// mountpoint first to flush them.
+func (fs *FS) SyncAll() error {
+	files, paths := fs.openFiles.files()
+	dirs := make(map[string][]string)
+	for i, f := range files {
+		if !f.writable {
+			continue
+		}
+		code := f.Fsync(0)
+		if code == fuse.EBADF {
+			// Released in the meantime, step 3 covers it
+			continue
+		}
+		if !code.Ok() {
+			return &os.PathError{Op: "fsync", Path: paths[i], Err: syscall.Errno(code)}
+		}
+		cPath, err := fs.getBackingPath(paths[i])
+		if err != nil {
+			return err
+		}
+		cDir := filepath.Dir(cPath)
+		dirs[cDir] = append(dirs[cDir], filepath.Base(cPath))
+	}
+	cDirs := make([]string, 0, len(dirs))
+	for cDir := range dirs {
+		cDirs = append(cDirs, cDir)
+	}
+	sort.Strings(cDirs)
+	for _, cDir := range cDirs {
+		if err := fs.syncDirEntries(cDir, dirs[cDir]); err != nil {
+			return err
+		}
+	}
+	root, err := os.Open(fs.args.Cipherdir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if err = syncFS(int(root.Fd())); err != nil {
+		return &os.PathError{Op: "syncfs", Path: fs.args.Cipherdir, Err: err}
+	}
+	return nil
+}
+
+// syncDirEntries fsyncs the ".name" files of the long names among "cNames"
+// and then the backing directory "cDir".
+func (fs *FS) syncDirEntries(cDir string, cNames []string) error {
+	dirfd, err := os.Open(cDir)
+	if err != nil {
+		return err
+	}
+	defer dirfd.Close()
+	if !fs.args.PlaintextNames {
+		for _, cName := range cNames {
+			if !nametransform.IsLongContent(cName) {
+				continue
+			}
+			err = syncFileAt(dirfd, cName+nametransform.LongNameSuffix)
+			if err != nil && err != syscall.ENOENT {
+				return &os.PathError{Op: "fsync", Path: filepath.Join(cDir, cName+nametransform.LongNameSuffix), Err: err}
+			}
+		}
+	}
+	if err = syncFd(int(dirfd.Fd())); err != nil {
+		return &os.PathError{Op: "fsync", Path: cDir, Err: err}
+	}
+	return nil
+}
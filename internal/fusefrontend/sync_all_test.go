@@ -0,0 +1,71 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestSyncAll writes to files in two directories, one with a long name, and
+// checks that SyncAll fsyncs the files, their directories and the ".name"
+// file, and syncs the backing filesystem. Files open for reading are not
+// fsync'ed.
+func TestSyncAll(t *testing.T) {
+	fs, dir := newTestFS(t, Args{})
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	if code := fs.Mkdir("sub", 0700, ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	long := strings.Repeat("x", 200)
+	for _, path := range []string{"sub/foo", long, "ro"} {
+		f, code := fs.Create(path, uint32(os.O_WRONLY), 0600, ctx)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if path == "ro" {
+			f.Release()
+			f, code = fs.Open(path, uint32(os.O_RDONLY), ctx)
+			if !code.Ok() {
+				t.Fatal(code)
+			}
+		} else if _, code = f.Write([]byte("hello"), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		defer f.Release()
+	}
+	var synced []string
+	defer spySyncFd(&synced)()
+	var syncedFS []string
+	origSyncFS := syncFS
+	syncFS = func(fd int) error {
+		path, _ := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		syncedFS = append(syncedFS, path)
+		return origSyncFS(fd)
+	}
+	defer func() { syncFS = origSyncFS }()
+
+	if err := fs.SyncAll(); err != nil {
+		t.Fatal(err)
+	}
+	cFoo, _ := fs.getBackingPath("sub/foo")
+	cLong, _ := fs.getBackingPath(long)
+	cSub, _ := fs.getBackingPath("sub")
+	cRo, _ := fs.getBackingPath("ro")
+	for _, want := range []string{cFoo, cLong, cLong + nametransform.LongNameSuffix, cSub, dir} {
+		if !contains(synced, want) {
+			t.Errorf("%s was not synced: %v", want, synced)
+		}
+	}
+	if contains(synced, cRo) {
+		t.Errorf("read-only file was synced: %v", synced)
+	}
+	if len(syncedFS) != 1 || syncedFS[0] != dir {
+		t.Errorf("syncfs: want %s, got %v", dir, syncedFS)
+	}
+}
@@ -0,0 +1,272 @@
+package fusefrontend
+
+// Optional trash ("-trash"): Unlink and Rmdir move the ciphertext into
+// CIPHERDIR/.gocryptfs.trash instead of deleting it.
+//
+// Each trashed object is renamed to a random ID. Next to it, "ID.meta"
+// stores the original plaintext path and the deletion time. The meta file
+// uses the normal gocryptfs file format (header + encrypted blocks), so
+// the plaintext path does not leak.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// TrashDirName is the name of the trash directory in the root of
+	// CIPHERDIR.
+	TrashDirName = ".gocryptfs.trash"
+	// trashMetaSuffix is appended to the ID to get the name of the meta file
+	trashMetaSuffix = ".meta"
+	// trashIDLen is the length of the random trash ID, in bytes
+	trashIDLen = 16
+)
+
+// trashMeta is stored, encrypted, in the "ID.meta" file
+type trashMeta struct {
+	// Path is the original plaintext path, relative to the mountpoint
+	Path string
+	// Time is the deletion time in seconds since the epoch
+	Time int64
+}
+
+// isTrashDir returns true if "name" in the root directory is the trash
+// directory. Without "-trash", it is a normal name.
+func (fs *FS) isTrashDir(name string) bool {
+	return fs.args.Trash && name == TrashDirName
+}
+
+// TrashEnabled implements ctlsock.TrashInterface.
+func (fs *FS) TrashEnabled() bool {
+	return fs.args.Trash
+}
+
+// openTrashDir opens the trash directory, creating it if necessary.
+func (fs *FS) openTrashDir() (*os.File, error) {
+	dir := filepath.Join(fs.args.Cipherdir, TrashDirName)
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	return os.Open(dir)
+}
+
+// writeTrashMeta encrypts "m" and writes it to "name" in the trash dir.
+func (fs *FS) writeTrashMeta(trashFd *os.File, name string, m trashMeta) error {
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	bs := int(fs.contentEnc.PlainBS())
+	var blocks [][]byte
+	for len(js) > 0 {
+		n := bs
+		if n > len(js) {
+			n = len(js)
+		}
+		blocks = append(blocks, js[:n])
+		js = js[n:]
+	}
+	h := contentenc.RandomHeader()
+	ciphertext := fs.contentEnc.EncryptBlocks(blocks, 0, h.ID)
+	buf := append(h.Pack(), ciphertext...)
+	fs.contentEnc.CReqPool.Put(ciphertext)
+	fd, err := syscallcompat.Openat(int(trashFd.Fd()), name,
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	_, err = f.Write(buf)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// readTrashMeta reads and decrypts the meta file of trash item "id".
+func (fs *FS) readTrashMeta(id string) (m trashMeta, err error) {
+	path := filepath.Join(fs.args.Cipherdir, TrashDirName, id+trashMetaSuffix)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	if len(buf) < contentenc.HeaderLen {
+		return m, fmt.Errorf("%s: file too short", path)
+	}
+	h, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		return m, err
+	}
+	js, err := fs.contentEnc.DecryptBlocks(buf[contentenc.HeaderLen:], 0, h.ID)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(js, &m)
+	fs.contentEnc.PReqPool.Put(js)
+	return m, err
+}
+
+// moveToTrash moves the ciphertext object "cName" in "dirfd", which is
+// called "plainPath" in the plaintext view, into the trash directory.
+// The ".name" file of long names is left for the caller to delete.
+func (fs *FS) moveToTrash(dirfd *os.File, cName string, plainPath string) error {
+	trashFd, err := fs.openTrashDir()
+	if err != nil {
+		return err
+	}
+	defer trashFd.Close()
+	id := hex.EncodeToString(cryptocore.RandBytes(trashIDLen))
+	m := trashMeta{
+		Path: plainPath,
+		Time: time.Now().Unix(),
+	}
+	err = fs.writeTrashMeta(trashFd, id+trashMetaSuffix, m)
+	if err != nil {
+		tlog.Warn.Printf("moveToTrash: writing meta file failed: %v", err)
+		return err
+	}
+	err = syscallcompat.Renameat(int(dirfd.Fd()), cName, int(trashFd.Fd()), id)
+	if err != nil {
+		syscallcompat.Unlinkat(int(trashFd.Fd()), id+trashMetaSuffix, 0)
+		return err
+	}
+	if fs.args.DirSync {
+		err = syncFileAt(trashFd, id+trashMetaSuffix)
+		if err == nil {
+			err = fs.syncEntry(trashFd, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	tlog.Debug.Printf("moveToTrash: %q -> %s", plainPath, id)
+	return nil
+}
+
+// trashIDs returns the IDs of all objects in the trash, sorted.
+func (fs *FS) trashIDs() ([]string, error) {
+	names, err := ioutil.ReadDir(filepath.Join(fs.args.Cipherdir, TrashDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, fi := range names {
+		if strings.HasSuffix(fi.Name(), trashMetaSuffix) {
+			ids = append(ids, strings.TrimSuffix(fi.Name(), trashMetaSuffix))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// TrashList implements ctlsock.TrashInterface. Returns one line per trashed
+// object: "ID<tab>DELETION TIME<tab>PATH".
+func (fs *FS) TrashList() (string, error) {
+	ids, err := fs.trashIDs()
+	if err != nil {
+		return "", err
+	}
+	var out []string
+	for _, id := range ids {
+		m, err := fs.readTrashMeta(id)
+		if err != nil {
+			tlog.Warn.Printf("TrashList: %s: %v", id, err)
+			continue
+		}
+		t := time.Unix(m.Time, 0).UTC().Format(time.RFC3339)
+		out = append(out, fmt.Sprintf("%s\t%s\t%s", id, t, m.Path))
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// TrashRestore implements ctlsock.TrashInterface. Moves the trashed object
+// "id" back to its original location and returns the plaintext path.
+// The parent directory must exist and the path must be free.
+func (fs *FS) TrashRestore(id string) (string, error) {
+	if strings.Contains(id, "/") || strings.HasSuffix(id, trashMetaSuffix) {
+		return "", &os.PathError{Op: "restore", Path: id, Err: syscall.EINVAL}
+	}
+	m, err := fs.readTrashMeta(id)
+	if err != nil {
+		return "", err
+	}
+	if fs.isFilteredCreate(m.Path) {
+		return "", &os.PathError{Op: "restore", Path: m.Path, Err: syscall.EPERM}
+	}
+	dirfd, cName, err := fs.openBackingPath(m.Path)
+	if err != nil {
+		return "", err
+	}
+	defer dirfd.Close()
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(int(dirfd.Fd()), cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		return "", &os.PathError{Op: "restore", Path: m.Path, Err: syscall.EEXIST}
+	}
+	trashFd, err := fs.openTrashDir()
+	if err != nil {
+		return "", err
+	}
+	defer trashFd.Close()
+	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		err = fs.nameTransform.WriteLongName(dirfd, cName, filepath.Base(m.Path))
+		if err != nil {
+			return "", err
+		}
+	}
+	err = syscallcompat.Renameat(int(trashFd.Fd()), id, int(dirfd.Fd()), cName)
+	if err != nil {
+		if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+			nametransform.DeleteLongName(dirfd, cName)
+		}
+		return "", err
+	}
+	err = syscallcompat.Unlinkat(int(trashFd.Fd()), id+trashMetaSuffix, 0)
+	if err != nil {
+		tlog.Warn.Printf("TrashRestore: could not delete meta file: %v", err)
+	}
+	// A restored directory may shadow a cached one that was deleted.
+	fs.nameTransform.DirIVCache.Clear()
+	return m.Path, nil
+}
+
+// TrashEmpty implements ctlsock.TrashInterface. Permanently deletes
+// everything in the trash.
+func (fs *FS) TrashEmpty() error {
+	dir := filepath.Join(fs.args.Cipherdir, TrashDirName)
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range names {
+		err = os.RemoveAll(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package fusefrontend
+
+// Write-intent records ("-write-intent")
+//
+// Every file has a record that says up to which plaintext offset its
+// content is durable, i.e. has been written and fsync'ed. After a crash,
+// an application can query the record (ctlsock "DurableSize" request),
+// truncate the file to that size and resume writing from there.
+//
+// Fsync moves the mark up to the file size, after the data has been synced.
+// Before anything modifies a block below the mark, the mark is lowered to
+// the start of that block and synced: a crash in the middle of the write
+// may leave the block torn. So the mark is lowered and synced once per
+// commit interval for sequential writes, and never claims too much.
+//
+// The record is stored as an xattr of the backing file, so it follows
+// renames and hard links and goes away with the file.
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// intentXattr is the name of the xattr holding the record. The value is the
+// durable plaintext size as a decimal number.
+const intentXattr = "user.gocryptfs.durable"
+
+// CheckWriteIntent checks that the backing directory supports the xattrs
+// that "-write-intent" needs.
+func CheckWriteIntent(cipherdir string) error {
+	f, err := os.Open(cipherdir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	const probe = "user.gocryptfs.probe"
+	err = syscallcompat.Fsetxattr(int(f.Fd()), probe, []byte("1"), 0)
+	if err != nil {
+		return err
+	}
+	return syscallcompat.Fremovexattr(int(f.Fd()), probe)
+}
+
+// readIntent reads the durable size from the xattr of "fd". Returns 0 if
+// the file has no record.
+func readIntent(fd int) (uint64, error) {
+	buf := make([]byte, 20)
+	n, err := syscallcompat.Fgetxattr(fd, intentXattr, buf)
+	if err == syscall.ENODATA {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(buf[:n]), 10, 64)
+}
+
+// loadIntent loads the record into the open file table entry, if that has
+// not happened yet. The caller must hold the ContentLock.
+func (f *file) loadIntent() error {
+	e := f.fileTableEntry
+	if e.IntentLoaded {
+		return nil
+	}
+	durable, err := readIntent(f.intFd())
+	if err != nil {
+		return err
+	}
+	e.Durable = durable
+	e.IntentLoaded = true
+	return nil
+}
+
+// storeIntent writes "durable" to the record and syncs it to disk. The
+// caller must hold the ContentLock.
+func (f *file) storeIntent(durable uint64) error {
+	err := syscallcompat.Fsetxattr(f.intFd(), intentXattr, []byte(strconv.FormatUint(durable, 10)), 0)
+	if err != nil {
+		return err
+	}
+	// Unlike fdatasync, fsync also syncs the xattr
+	err = syscall.Fsync(f.intFd())
+	if err != nil {
+		return err
+	}
+	f.fileTableEntry.Durable = durable
+	return nil
+}
+
+// intentBeforeWrite must be called before modifying the file at plaintext
+// offset "off" or above. It lowers the durable mark to the start of the
+// block containing "off". Writes past the mark may pad the block at the
+// old end of file, so "off" is capped at the mark. The caller must hold
+// the ContentLock.
+func (f *file) intentBeforeWrite(off uint64) fuse.Status {
+	if !f.fs.args.WriteIntent {
+		return fuse.OK
+	}
+	if err := f.loadIntent(); err != nil {
+		tlog.Warn.Printf("ino%d: write intent: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	if off > f.fileTableEntry.Durable {
+		off = f.fileTableEntry.Durable
+	}
+	blockStart := f.contentEnc.BlockNoToPlainOff(f.contentEnc.PlainOffToBlockNo(off))
+	if blockStart >= f.fileTableEntry.Durable {
+		return fuse.OK
+	}
+	if err := f.storeIntent(blockStart); err != nil {
+		tlog.Warn.Printf("ino%d: write intent: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
+
+// intentCommit must be called after the file has been fsync'ed. It moves
+// the durable mark up to the file size. The caller must hold the
+// ContentLock.
+func (f *file) intentCommit() fuse.Status {
+	if err := f.loadIntent(); err != nil {
+		tlog.Warn.Printf("ino%d: write intent: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	size, err := f.statPlainSize()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if size == f.fileTableEntry.Durable {
+		return fuse.OK
+	}
+	if err = f.storeIntent(size); err != nil {
+		tlog.Warn.Printf("ino%d: write intent: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
+
+// DurableSize returns the size of the durable prefix of the plaintext file
+// "path", as recorded by "-write-intent".
+func (fs *FS) DurableSize(path string) (uint64, error) {
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := syscall.Open(cPath, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+	durable, err := readIntent(fd)
+	if err != nil {
+		return 0, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return 0, err
+	}
+	// The record can be stale if the file was truncated behind our back
+	if size := fs.contentEnc.CipherSizeToPlainSize(uint64(st.Size)); size < durable {
+		durable = size
+	}
+	return durable, nil
+}
@@ -0,0 +1,134 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// TestWriteIntent writes half of a file, syncs it, writes the rest without
+// syncing and simulates a crash by damaging the unsynced part. After a
+// remount, the durable prefix must be readable and the record must point
+// to its end.
+func TestWriteIntent(t *testing.T) {
+	fs, dir := newTestFS(t, Args{WriteIntent: true})
+	defer os.RemoveAll(dir)
+	if err := CheckWriteIntent(dir); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	const half = 256 * 1024
+	content := make([]byte, 2*half)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	f, code := fs.Create("foo", uint32(os.O_RDWR), 0600, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(content[:half], 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if durable, err := fs.DurableSize("foo"); err != nil || durable != 0 {
+		t.Errorf("before fsync: durable=%d err=%v", durable, err)
+	}
+	if code = f.Fsync(0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if durable, err := fs.DurableSize("foo"); err != nil || durable != half {
+		t.Errorf("after fsync: durable=%d err=%v", durable, err)
+	}
+	// Appending does not touch the durable prefix
+	if _, code = f.Write(content[half:], half); !code.Ok() {
+		t.Fatal(code)
+	}
+	if durable, _ := fs.DurableSize("foo"); durable != half {
+		t.Errorf("after append: durable=%d", durable)
+	}
+	f.Release()
+	// Crash: the tail of the file never made it to disk
+	cPath, err := fs.getBackingPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cf.WriteAt(make([]byte, 100), int64(fs.contentEnc.PlainSizeToCipherSize(half))+50)
+	cf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remount
+	fs2 := NewFS(make([]byte, cryptocore.KeyLen), fs.args)
+	durable, err := fs2.DurableSize("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if durable != half {
+		t.Fatalf("after remount: durable=%d, want %d", durable, half)
+	}
+	f, code = fs2.Open("foo", uint32(os.O_RDWR), &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	buf := make([]byte, durable)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if data, _ := res.Bytes(buf); !bytes.Equal(data, content[:half]) {
+		t.Error("durable prefix has been corrupted")
+	}
+	// Resume: cut off the damaged tail and rewrite it
+	if code = f.Truncate(durable); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(content[half:], half); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = f.Fsync(0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if durable, _ = fs2.DurableSize("foo"); durable != 2*half {
+		t.Errorf("after resume: durable=%d", durable)
+	}
+}
+
+// TestWriteIntentOverwrite checks that overwriting data below the durable
+// mark lowers the mark to the start of the modified block.
+func TestWriteIntentOverwrite(t *testing.T) {
+	fs, dir := newTestFS(t, Args{WriteIntent: true})
+	defer os.RemoveAll(dir)
+	if err := CheckWriteIntent(dir); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	f, code := fs.Create("foo", uint32(os.O_RDWR), 0600, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, code = f.Write(make([]byte, 10*4096), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = f.Fsync(0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("x"), 3*4096+100); !code.Ok() {
+		t.Fatal(code)
+	}
+	if durable, _ := fs.DurableSize("foo"); durable != 3*4096 {
+		t.Errorf("after overwrite: durable=%d, want %d", durable, 3*4096)
+	}
+	if code = f.Truncate(1000); !code.Ok() {
+		t.Fatal(code)
+	}
+	if durable, _ := fs.DurableSize("foo"); durable != 0 {
+		t.Errorf("after truncate: durable=%d, want 0", durable)
+	}
+}
@@ -0,0 +1,253 @@
+package fusefrontend
+
+// Extended attributes ("-xattr-passthrough")
+//
+// With "-xattr-passthrough", the "user." xattrs set through the mount are
+// stored on the backing file. Names that start with one of the configured
+// prefixes are stored as they are, so that tools working on CIPHERDIR (for
+// example backup or sync software) can read them. All other names and values
+// are encrypted: the name becomes
+//
+//   user.gocryptfs.x.<base64 of the EME-encrypted name>
+//
+// and the value is encrypted like a content block, with the plaintext name
+// as associated data. Other namespaces are not supported.
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// xattrUserPrefix is the only namespace that is supported
+	xattrUserPrefix = "user."
+	// xattrInternalPrefix is reserved for the xattrs gocryptfs uses itself
+	xattrInternalPrefix = "user.gocryptfs."
+	// xattrEncPrefix is prepended to the encrypted names
+	xattrEncPrefix = "user.gocryptfs.x."
+	// xattrBlockNo is the block number used as associated data when
+	// encrypting a value. It is different from checksumBlockNo and no
+	// content block gets that far.
+	xattrBlockNo = ^uint64(0) - 1
+)
+
+// xattrNameIV is the fixed IV for encrypting xattr names. Like the names of
+// a directory, the same name always encrypts to the same ciphertext, so it
+// can be looked up.
+var xattrNameIV = []byte("gocryptfs.xattr.")
+
+// xattrEnabled returns true if "-xattr-passthrough" is in use.
+func (fs *FS) xattrEnabled() bool {
+	return len(fs.args.XattrPassthrough) > 0
+}
+
+// xattrPassthrough returns true if "attr" is stored unencrypted.
+func (fs *FS) xattrPassthrough(attr string) bool {
+	for _, prefix := range fs.args.XattrPassthrough {
+		if strings.HasPrefix(attr, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptXattrName returns the name "attr" is stored under on the backing
+// file.
+func (fs *FS) encryptXattrName(attr string) string {
+	if fs.xattrPassthrough(attr) {
+		return attr
+	}
+	return xattrEncPrefix + fs.nameTransform.EncryptName(attr, xattrNameIV)
+}
+
+// decryptXattrName returns the plaintext name of the backing xattr "cAttr",
+// or false if it is not one that is presented in the mount.
+func (fs *FS) decryptXattrName(cAttr string) (string, bool) {
+	if strings.HasPrefix(cAttr, xattrEncPrefix) {
+		attr, err := fs.nameTransform.DecryptName(cAttr[len(xattrEncPrefix):], xattrNameIV)
+		if err != nil {
+			tlog.Warn.Printf("xattr: cannot decrypt name %q: %v", cAttr, err)
+			return "", false
+		}
+		return attr, true
+	}
+	if fs.xattrPassthrough(cAttr) && !strings.HasPrefix(cAttr, xattrInternalPrefix) {
+		return cAttr, true
+	}
+	return "", false
+}
+
+// GetXAttr implements pathfs.Filesystem.
+func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if fs.args.Checksum && attr == checksumXattr {
+		return fs.getChecksumXAttr(name, context)
+	}
+	if !fs.xattrEnabled() {
+		if fs.args.Checksum {
+			return nil, fuse.ENODATA
+		}
+		return nil, fuse.ENOSYS
+	}
+	if fs.isFiltered(name) {
+		return nil, fuse.EPERM
+	}
+	if !strings.HasPrefix(attr, xattrUserPrefix) || strings.HasPrefix(attr, xattrInternalPrefix) {
+		return nil, fuse.ENODATA
+	}
+	cPath, err := fs.getBackingPath(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	value, err := lgetxattr(cPath, fs.encryptXattrName(attr))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if fs.xattrPassthrough(attr) {
+		return value, fuse.OK
+	}
+	plain, err := fs.contentEnc.DecryptBlock(value, xattrBlockNo, []byte(attr))
+	if err != nil {
+		tlog.Warn.Printf("xattr: %q of %q: cannot decrypt value: %v", attr, name, err)
+		return nil, fuse.EIO
+	}
+	return plain, fuse.OK
+}
+
+// SetXAttr implements pathfs.Filesystem.
+func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.args.Checksum && attr == checksumXattr {
+		return fuse.EPERM
+	}
+	if !fs.xattrEnabled() {
+		return fuse.ENOSYS
+	}
+	if fs.isFiltered(name) {
+		return fuse.EPERM
+	}
+	if !strings.HasPrefix(attr, xattrUserPrefix) || strings.HasPrefix(attr, xattrInternalPrefix) {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	defer fs.snapshotRLock()()
+	cPath, err := fs.getBackingPath(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if err = fs.cowBreak(name); err != nil {
+		return fuse.ToStatus(err)
+	}
+	if !fs.xattrPassthrough(attr) {
+		if uint64(len(data)) > fs.contentEnc.PlainBS() {
+			return fuse.Status(syscall.E2BIG)
+		}
+		data = fs.contentEnc.EncryptBlock(data, xattrBlockNo, []byte(attr))
+	}
+	return fuse.ToStatus(syscallcompat.Lsetxattr(cPath, fs.encryptXattrName(attr), data, flags))
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if fs.args.Checksum && attr == checksumXattr {
+		return fuse.EPERM
+	}
+	if !fs.xattrEnabled() {
+		return fuse.ENOSYS
+	}
+	if fs.isFiltered(name) {
+		return fuse.EPERM
+	}
+	if !strings.HasPrefix(attr, xattrUserPrefix) || strings.HasPrefix(attr, xattrInternalPrefix) {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	defer fs.snapshotRLock()()
+	cPath, err := fs.getBackingPath(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if err = fs.cowBreak(name); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fuse.ToStatus(syscallcompat.Lremovexattr(cPath, fs.encryptXattrName(attr)))
+}
+
+// ListXAttr implements pathfs.Filesystem.
+func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if !fs.args.Checksum && !fs.xattrEnabled() {
+		return nil, fuse.ENOSYS
+	}
+	var attrs []string
+	if fs.args.Checksum {
+		has, status := fs.hasChecksumXAttr(name, context)
+		if !status.Ok() {
+			return nil, status
+		}
+		if has {
+			attrs = append(attrs, checksumXattr)
+		}
+	}
+	if !fs.xattrEnabled() {
+		return attrs, fuse.OK
+	}
+	if fs.isFiltered(name) {
+		return nil, fuse.EPERM
+	}
+	cPath, err := fs.getBackingPath(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	list, err := llistxattr(cPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	for _, cAttr := range bytes.Split(list, []byte{0}) {
+		if len(cAttr) == 0 {
+			continue
+		}
+		if attr, ok := fs.decryptXattrName(string(cAttr)); ok {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs, fuse.OK
+}
+
+// lgetxattr returns the value of the xattr "attr" of "path". The value may
+// change size between the two calls, so ERANGE is retried.
+func lgetxattr(path string, attr string) ([]byte, error) {
+	for {
+		sz, err := syscallcompat.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = syscallcompat.Lgetxattr(path, attr, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+// llistxattr returns the NUL-separated xattr names of "path", see lgetxattr.
+func llistxattr(path string) ([]byte, error) {
+	for {
+		sz, err := syscallcompat.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = syscallcompat.Llistxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
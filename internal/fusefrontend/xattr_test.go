@@ -0,0 +1,86 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestXattrPassthrough sets an xattr that is on the passthrough list and one
+// that is not, and checks that only the first one is stored in cleartext on
+// the backing file, and that both can be read and listed through the mount.
+func TestXattrPassthrough(t *testing.T) {
+	fs, dir := newTestFS(t, Args{XattrPassthrough: []string{"user.app."}})
+	defer os.RemoveAll(dir)
+	if err := CheckWriteIntent(dir); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	ctx := &fuse.Context{}
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, ctx)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	want := map[string]string{
+		"user.app.tag": "public-value",
+		"user.secret":  "secret-value",
+	}
+	for attr, value := range want {
+		if code = fs.SetXAttr("foo", attr, []byte(value), 0, ctx); !code.Ok() {
+			t.Fatalf("SetXAttr %q: %v", attr, code)
+		}
+	}
+	cPath, err := fs.getBackingPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := llistxattr(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backing []string
+	for _, cAttr := range strings.Split(string(list), "\x00") {
+		if cAttr == "" {
+			continue
+		}
+		backing = append(backing, cAttr)
+		value, err := lgetxattr(cPath, cAttr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cAttr == "user.app.tag" {
+			if string(value) != want[cAttr] {
+				t.Errorf("passthrough xattr has value %q", value)
+			}
+		} else if bytes.Contains(value, []byte("secret")) || strings.Contains(cAttr, "secret") {
+			t.Errorf("backing xattr %q=%q is not encrypted", cAttr, value)
+		}
+	}
+	if len(backing) != 2 {
+		t.Errorf("backing file has xattrs %q", backing)
+	}
+	for attr, value := range want {
+		got, code := fs.GetXAttr("foo", attr, ctx)
+		if !code.Ok() || string(got) != value {
+			t.Errorf("GetXAttr %q: %q %v", attr, got, code)
+		}
+	}
+	names, code := fs.ListXAttr("foo", ctx)
+	sort.Strings(names)
+	if !code.Ok() || len(names) != 2 || names[0] != "user.app.tag" || names[1] != "user.secret" {
+		t.Errorf("ListXAttr: %q %v", names, code)
+	}
+	if code = fs.RemoveXAttr("foo", "user.secret", ctx); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = fs.GetXAttr("foo", "user.secret", ctx); code != fuse.ENODATA {
+		t.Errorf("removed xattr: want ENODATA, got %v", code)
+	}
+	if code = fs.SetXAttr("foo", "user.gocryptfs.durable", []byte("1"), 0, ctx); code.Ok() {
+		t.Error("could set a reserved xattr")
+	}
+}
@@ -0,0 +1,323 @@
+// Package fusefrontend_archive provides a read-only decrypted view of a
+// ciphertext directory that has been packed into a tar or zip archive.
+package fusefrontend_archive
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/archive"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// node is a plaintext file, directory or symlink
+type node struct {
+	// Ciphertext entry in the archive
+	entry *archive.Entry
+	// Plaintext names of the directory entries
+	children []string
+	// Set if the directory could not be decrypted, for example because its
+	// gocryptfs.diriv is missing
+	err error
+}
+
+// ArchiveFS implements the pathfs.FileSystem interface and provides a
+// read-only decrypted view of an archive. All names are decrypted when the
+// archive is opened.
+type ArchiveFS struct {
+	// Embed pathfs.defaultFileSystem for a ENOSYS implementation of all methods
+	pathfs.FileSystem
+	// Stores configuration arguments
+	args fusefrontend.Args
+	// The opened archive
+	archive *archive.Archive
+	// Filename encryption helper
+	nameTransform *nametransform.NameTransform
+	// Content encryption helper
+	contentEnc *contentenc.ContentEnc
+	// Crypto backend of nameTransform and contentEnc, kept for Wipe()
+	cryptoCore *cryptocore.CryptoCore
+	// Plaintext path -> node
+	nodes map[string]*node
+	// Ciphertext path -> plaintext path, for DecryptPath
+	plainPaths map[string]string
+}
+
+var _ pathfs.FileSystem = &ArchiveFS{}
+
+// NewFS returns a read-only FUSE filesystem that decrypts the contents of
+// "a", which contains the ciphertext directory.
+func NewFS(masterkey []byte, args fusefrontend.Args, a *archive.Archive) *ArchiveFS {
+	ivBits := contentenc.DefaultIVBits
+	if args.IVBits != 0 {
+		ivBits = args.IVBits
+	}
+	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, ivBits, args.HKDF, args.ForceDecode)
+	plainBS := uint64(contentenc.DefaultBS)
+	if args.Compress {
+		plainBS = contentenc.CompressedBS
+	}
+	contentEnc := contentenc.New(cryptoCore, plainBS, args.ForceDecode, args.Compress)
+	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64, args.NFCNames)
+	if args.EncryptedDirIV {
+		nameTransform.SetDirIVCipher(cryptocore.NewDirIVAEAD(masterkey))
+	}
+	if args.NamePadding > 0 {
+		nameTransform.SetNamePadding(args.NamePadding)
+	}
+	afs := &ArchiveFS{
+		// pathfs.defaultFileSystem returns ENOSYS for all operations
+		FileSystem:    pathfs.NewDefaultFileSystem(),
+		args:          args,
+		archive:       a,
+		nameTransform: nameTransform,
+		contentEnc:    contentEnc,
+		cryptoCore:    cryptoCore,
+		nodes:         make(map[string]*node),
+		plainPaths:    make(map[string]string),
+	}
+	root, _ := a.Lookup("")
+	afs.index("", root)
+	return afs
+}
+
+// Wipe tries to wipe the encryption keys from memory. It is called after the
+// filesystem has been unmounted, the ArchiveFS must not be used afterwards.
+func (afs *ArchiveFS) Wipe() {
+	afs.cryptoCore.Wipe()
+	afs.archive.Close()
+}
+
+// index adds the plaintext path "plainPath", stored in "e", and everything
+// below it.
+func (afs *ArchiveFS) index(plainPath string, e *archive.Entry) {
+	n := &node{entry: e}
+	afs.nodes[plainPath] = n
+	afs.plainPaths[e.Path] = plainPath
+	if !e.Mode.IsDir() {
+		return
+	}
+	entries, err := afs.archive.ReadDir(e.Path)
+	if err != nil {
+		n.err = err
+		return
+	}
+	var iv []byte
+	if !afs.args.PlaintextNames {
+		data, err := afs.archive.ReadFile(filepath.Join(e.Path, nametransform.DirIVFilename))
+		if err == nil {
+			iv, err = afs.nameTransform.ReadDirIVFrom(bytes.NewReader(data))
+		}
+		if err != nil {
+			tlog.Warn.Printf("archive: directory %q: cannot read %s: %v", e.Path, nametransform.DirIVFilename, err)
+			n.err = syscall.EIO
+			return
+		}
+	}
+	for _, child := range entries {
+		name, skip, err := afs.decryptDirEntry(e.Path, child.Name(), iv)
+		if skip {
+			continue
+		}
+		if err != nil {
+			tlog.Warn.Printf("archive: directory %q: invalid entry %q: %v", e.Path, child.Name(), err)
+			continue
+		}
+		n.children = append(n.children, name)
+		afs.index(filepath.Join(plainPath, name), child)
+	}
+}
+
+// decryptDirEntry decrypts the name "cName" in the ciphertext directory
+// "cDir", like fusefrontend does. "skip" is set for the gocryptfs control
+// files.
+func (afs *ArchiveFS) decryptDirEntry(cDir string, cName string, iv []byte) (name string, skip bool, err error) {
+	if cDir == "" && (cName == configfile.ConfDefaultName || cName == fusefrontend.TrashDirName || cName == fusefrontend.SnapshotDirName) {
+		return "", true, nil
+	}
+	if afs.args.PlaintextNames {
+		return cName, false, nil
+	}
+	if cName == nametransform.DirIVFilename {
+		return "", true, nil
+	}
+	if afs.args.LongNames {
+		switch nametransform.NameType(cName) {
+		case nametransform.LongNameFilename:
+			return "", true, nil
+		case nametransform.LongNameContent:
+			hashName := cName
+			data, err := afs.archive.ReadFile(filepath.Join(cDir, hashName+nametransform.LongNameSuffix))
+			if err != nil {
+				return "", false, fmt.Errorf("Could not read .name: %v", err)
+			}
+			cName = string(data)
+			if afs.nameTransform.HashLongName(cName) != hashName {
+				return "", false, fmt.Errorf(".name does not match the hash")
+			}
+		}
+	}
+	name, err = afs.nameTransform.DecryptName(cName, iv)
+	return name, false, err
+}
+
+// lookup returns the node of the plaintext path "relPath"
+func (afs *ArchiveFS) lookup(relPath string) (*node, fuse.Status) {
+	n, ok := afs.nodes[relPath]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return n, fuse.OK
+}
+
+// GetAttr implements pathfs.Filesystem.
+func (afs *ArchiveFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	n, status := afs.lookup(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	e := n.entry
+	a := &fuse.Attr{
+		Mode:  uint32(e.Mode.Perm()),
+		Nlink: 1,
+		Owner: fuse.Owner{Uid: uint32(e.Uid), Gid: uint32(e.Gid)},
+	}
+	switch {
+	case e.Mode.IsDir():
+		a.Mode |= syscall.S_IFDIR
+	case e.Mode&os.ModeSymlink != 0:
+		a.Mode |= syscall.S_IFLNK
+		target, status := afs.Readlink(relPath, context)
+		if !status.Ok() {
+			return nil, status
+		}
+		a.Size = uint64(len(target))
+	default:
+		a.Mode |= syscall.S_IFREG
+		a.Size = afs.contentEnc.CipherSizeToPlainSize(uint64(e.Size))
+	}
+	a.SetTimes(&e.ModTime, &e.ModTime, &e.ModTime)
+	if afs.args.ForceOwner != nil {
+		a.Owner = *afs.args.ForceOwner
+	}
+	return a, fuse.OK
+}
+
+// Access implements pathfs.Filesystem. Nothing can be written.
+func (afs *ArchiveFS) Access(relPath string, mode uint32, context *fuse.Context) fuse.Status {
+	if _, status := afs.lookup(relPath); !status.Ok() {
+		return status
+	}
+	if mode&2 != 0 {
+		return fuse.ToStatus(syscall.EROFS)
+	}
+	return fuse.OK
+}
+
+// OpenDir implements pathfs.FileSystem.
+func (afs *ArchiveFS) OpenDir(relPath string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n, status := afs.lookup(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	if !n.entry.Mode.IsDir() {
+		return nil, fuse.ENOTDIR
+	}
+	if n.err != nil {
+		return nil, fuse.ToStatus(n.err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(n.children))
+	for _, name := range n.children {
+		a, status := afs.GetAttr(filepath.Join(relPath, name), context)
+		if !status.Ok() {
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: a.Mode})
+	}
+	return entries, fuse.OK
+}
+
+// Readlink implements pathfs.FileSystem.
+func (afs *ArchiveFS) Readlink(relPath string, context *fuse.Context) (string, fuse.Status) {
+	n, status := afs.lookup(relPath)
+	if !status.Ok() {
+		return "", status
+	}
+	if n.entry.Mode&os.ModeSymlink == 0 {
+		return "", fuse.EINVAL
+	}
+	cTarget := n.entry.Linkname
+	if afs.args.PlaintextNames {
+		return cTarget, fuse.OK
+	}
+	// Symlinks are encrypted like file contents (GCM) and base64-encoded
+	cBinTarget, err := afs.nameTransform.B64.DecodeString(cTarget)
+	if err != nil {
+		tlog.Warn.Printf("Readlink: %v", err)
+		return "", fuse.EIO
+	}
+	target, err := afs.contentEnc.DecryptBlock(cBinTarget, 0, nil)
+	if err != nil {
+		tlog.Warn.Printf("Readlink: %v", err)
+		return "", fuse.EIO
+	}
+	return string(target), fuse.OK
+}
+
+// Open implements pathfs.FileSystem.
+func (afs *ArchiveFS) Open(relPath string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_APPEND|syscall.O_TRUNC) != 0 {
+		return nil, fuse.ToStatus(syscall.EROFS)
+	}
+	n, status := afs.lookup(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	if n.entry.Mode.IsDir() {
+		return nil, fuse.ToStatus(syscall.EISDIR)
+	}
+	r, err := afs.archive.Open(n.entry)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return &file{
+		File:       nodefs.NewDefaultFile(),
+		r:          r,
+		path:       relPath,
+		contentEnc: afs.contentEnc,
+	}, fuse.OK
+}
+
+// StatFs implements pathfs.FileSystem. It reports the filesystem the
+// archive is on.
+func (afs *ArchiveFS) StatFs(relPath string) *fuse.StatfsOut {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(afs.args.Cipherdir, &st); err != nil {
+		return nil
+	}
+	var out fuse.StatfsOut
+	out.FromStatfsT(&st)
+	return &out
+}
+
+// decryptPath returns the plaintext path of the ciphertext path "cPath".
+func (afs *ArchiveFS) decryptPath(cPath string) (string, error) {
+	plainPath, ok := afs.plainPaths[strings.Trim(filepath.Clean("/"+cPath), "/")]
+	if !ok {
+		return "", syscall.ENOENT
+	}
+	return plainPath, nil
+}
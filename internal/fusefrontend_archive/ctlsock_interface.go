@@ -0,0 +1,33 @@
+package fusefrontend_archive
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+)
+
+var _ ctlsock.Interface = &ArchiveFS{} // Verify that interface is implemented.
+var _ ctlsock.CapabilitiesInterface = &ArchiveFS{}
+
+// EncryptPath implements ctlsock.Backend. Only paths that exist in the
+// archive can be encrypted, as the names depend on the stored DirIVs.
+func (afs *ArchiveFS) EncryptPath(plainPath string) (string, error) {
+	n, ok := afs.nodes[strings.Trim(filepath.Clean("/"+plainPath), "/")]
+	if !ok {
+		return "", syscall.ENOENT
+	}
+	return n.entry.Path, nil
+}
+
+// DecryptPath implements ctlsock.Backend
+func (afs *ArchiveFS) DecryptPath(cipherPath string) (string, error) {
+	return afs.decryptPath(cipherPath)
+}
+
+// Capabilities implements ctlsock.CapabilitiesInterface. Archives are
+// always looked up case-sensitively.
+func (afs *ArchiveFS) Capabilities() ctlsock.Capabilities {
+	return ctlsock.Capabilities{CaseSensitive: true}
+}
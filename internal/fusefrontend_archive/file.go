@@ -0,0 +1,122 @@
+package fusefrontend_archive
+
+import (
+	"io"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// file is an opened regular file in the archive
+type file struct {
+	// Embed nodefs.defaultFile for a ENOSYS implementation of all methods
+	nodefs.File
+	// Ciphertext content
+	r io.ReaderAt
+	// Plaintext path, for log messages
+	path string
+	// Content encryption helper
+	contentEnc *contentenc.ContentEnc
+	// idLock protects id and empty
+	idLock sync.Mutex
+	// File ID from the header, read on the first Read()
+	id []byte
+	// Set if the file has no content besides the header
+	empty bool
+}
+
+var _ nodefs.File = &file{} // Verify that interface is implemented.
+
+// readFileID returns the file ID from the header. "nil, nil" means that the
+// file is empty.
+func (f *file) readFileID() ([]byte, error) {
+	f.idLock.Lock()
+	defer f.idLock.Unlock()
+	if f.id != nil || f.empty {
+		return f.id, nil
+	}
+	// We read +1 byte to determine if the file has actual content
+	// and not only the header. A header-only file is considered empty.
+	buf := make([]byte, contentenc.HeaderLen+1)
+	n, err := f.r.ReadAt(buf, 0)
+	if err == io.EOF && n <= contentenc.HeaderLen {
+		if n != 0 && n < contentenc.HeaderLen {
+			tlog.Warn.Printf("%q: incomplete header, got %d instead of %d bytes", f.path, n, contentenc.HeaderLen)
+		}
+		f.empty = true
+		return nil, nil
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	h, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		return nil, err
+	}
+	f.id = h.ID
+	return f.id, nil
+}
+
+// Read implements nodefs.File.
+func (f *file) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	length := uint64(len(buf))
+	if f.contentEnc.CheckPlainRange(uint64(off), length) != nil {
+		max := f.contentEnc.MaxPlainSize()
+		if uint64(off) >= max {
+			return fuse.ReadResultData(nil), fuse.OK
+		}
+		length = max - uint64(off)
+	}
+	fileID, err := f.readFileID()
+	if err != nil {
+		tlog.Warn.Printf("%q: readFileID: %v", f.path, err)
+		return nil, fuse.EIO
+	}
+	if fileID == nil {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	// Read the backing ciphertext in one go
+	blocks := f.contentEnc.ExplodePlainRange(uint64(off), length)
+	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
+	skip := blocks[0].Skip
+	ciphertext := make([]byte, alignedLength)
+	n, err := f.r.ReadAt(ciphertext, int64(alignedOffset))
+	if err != nil && err != io.EOF {
+		tlog.Warn.Printf("%q: ReadAt: %v", f.path, err)
+		return nil, fuse.EIO
+	}
+	if n == 0 {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext[:n], blocks[0].BlockNo, fileID)
+	if err != nil {
+		curruptBlockNo := blocks[0].BlockNo + f.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
+		tlog.Warn.Printf("%q: corrupt block #%d: %v", f.path, curruptBlockNo, err)
+		return nil, fuse.EIO
+	}
+	// Crop down to the relevant part
+	var out []byte
+	lenHave := len(plaintext)
+	lenWant := int(skip + length)
+	if lenHave > lenWant {
+		out = plaintext[skip:lenWant]
+	} else if lenHave > int(skip) {
+		out = plaintext[skip:lenHave]
+	}
+	return fuse.ReadResultData(out), fuse.OK
+}
+
+// GetAttr implements nodefs.File. Returning ENOSYS makes go-fuse ask
+// ArchiveFS.GetAttr() instead.
+func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
+	return fuse.ENOSYS
+}
+
+// String implements nodefs.File.
+func (f *file) String() string {
+	return "archive file " + f.path
+}
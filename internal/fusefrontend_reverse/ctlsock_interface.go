@@ -10,6 +10,7 @@ import (
 )
 
 var _ ctlsock.Interface = &ReverseFS{} // Verify that interface is implemented.
+var _ ctlsock.CapabilitiesInterface = &ReverseFS{}
 
 // EncryptPath implements ctlsock.Backend.
 // This is actually not used inside reverse mode, but we implement it because
@@ -36,3 +37,9 @@ func (rfs *ReverseFS) DecryptPath(cipherPath string) (string, error) {
 	p, err := rfs.decryptPath(cipherPath)
 	return p, err
 }
+
+// Capabilities implements ctlsock.CapabilitiesInterface. Reverse mode
+// always looks up names case-sensitively.
+func (rfs *ReverseFS) Capabilities() ctlsock.Capabilities {
+	return ctlsock.Capabilities{CaseSensitive: true}
+}
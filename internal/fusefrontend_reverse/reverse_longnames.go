@@ -106,6 +106,9 @@ func (rfs *ReverseFS) newNameFile(relPath string) (nodefs.File, fuse.Status) {
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if !rfs.isVisible(filepath.Join(pDir, pName)) {
+		return nil, fuse.ENOENT
+	}
 	content := []byte(rfs.nameTransform.EncryptName(pName, dirIV))
 	parentFile := filepath.Join(rfs.args.Cipherdir, pDir, pName)
 	return rfs.newVirtualFile(content, parentFile, inoBaseNameFile)
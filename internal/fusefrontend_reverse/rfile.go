@@ -123,6 +123,9 @@ func (rf *reverseFile) encryptBlocks(plaintext []byte, firstBlockNo uint64, file
 // "off" ... ciphertext offset (must be >= HEADER_LEN)
 // "length" ... ciphertext length
 func (rf *reverseFile) readBackingFile(off uint64, length uint64) (out []byte, err error) {
+	if err = rf.contentEnc.CheckCipherRange(off, length); err != nil {
+		return nil, err
+	}
 	blocks := rf.contentEnc.ExplodeCipherRange(off, length)
 
 	// Read the backing plaintext in one go
@@ -35,6 +35,8 @@ type ReverseFS struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Crypto backend of nameTransform and contentEnc, kept for Wipe()
+	cryptoCore *cryptocore.CryptoCore
 }
 
 var _ pathfs.FileSystem = &ReverseFS{}
@@ -48,8 +50,8 @@ func NewFS(masterkey []byte, args fusefrontend.Args) *ReverseFS {
 	}
 	initLongnameCache()
 	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, contentenc.DefaultIVBits, args.HKDF, false)
-	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS, false)
-	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64)
+	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS, false, false)
+	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64, false)
 
 	return &ReverseFS{
 		// pathfs.defaultFileSystem returns ENOSYS for all operations
@@ -58,9 +60,16 @@ func NewFS(masterkey []byte, args fusefrontend.Args) *ReverseFS {
 		args:          args,
 		nameTransform: nameTransform,
 		contentEnc:    contentEnc,
+		cryptoCore:    cryptoCore,
 	}
 }
 
+// Wipe tries to wipe the encryption keys from memory. It is called after the
+// filesystem has been unmounted, the ReverseFS must not be used afterwards.
+func (rfs *ReverseFS) Wipe() {
+	rfs.cryptoCore.Wipe()
+}
+
 // relDir is identical to filepath.Dir excepts that it returns "" when
 // filepath.Dir would return ".".
 // In the FUSE API, the root directory is called "", and we actually want that.
@@ -264,6 +273,16 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if rfs.args.SingleFile != "" {
+		// Only the root directory is visible, see decryptPath()
+		var visible []fuse.DirEntry
+		for _, e := range entries {
+			if e.Name == rfs.args.SingleFile || e.Name == configfile.ConfReverseName {
+				visible = append(visible, e)
+			}
+		}
+		entries = visible
+	}
 	if rfs.args.PlaintextNames {
 		return rfs.openDirPlaintextnames(cipherPath, entries)
 	}
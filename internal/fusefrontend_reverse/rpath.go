@@ -58,7 +58,23 @@ func (rfs *ReverseFS) rDecryptName(cName string, dirIV []byte, pDir string) (pNa
 	return pName, nil
 }
 
+// decryptPath decrypts the relative ciphertext path "relPath". Paths that
+// are hidden because we serve a single file return ENOENT.
 func (rfs *ReverseFS) decryptPath(relPath string) (string, error) {
+	pRelPath, err := rfs.decryptPathAll(relPath)
+	if err == nil && !rfs.isVisible(pRelPath) {
+		return "", syscall.ENOENT
+	}
+	return pRelPath, err
+}
+
+// isVisible returns false if the relative plaintext path "pRelPath" is
+// hidden because we serve a single file.
+func (rfs *ReverseFS) isVisible(pRelPath string) bool {
+	return rfs.args.SingleFile == "" || pRelPath == "" || pRelPath == rfs.args.SingleFile
+}
+
+func (rfs *ReverseFS) decryptPathAll(relPath string) (string, error) {
 	if rfs.args.PlaintextNames || relPath == "" {
 		return relPath, nil
 	}
@@ -2,14 +2,19 @@ package nametransform
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
+	"golang.org/x/sync/singleflight"
+
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform/dirivcache"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -20,53 +25,146 @@ const (
 	// DirIVFilename is the filename used to store directory IV.
 	// Exported because we have to ignore this name in directory listing.
 	DirIVFilename = "gocryptfs.diriv"
+	// dirIVNonceLen is the GCM nonce length for encrypted DirIVs
+	dirIVNonceLen = 16
+	// encryptedDirIVLen is the size of an encrypted gocryptfs.diriv file
+	// (EncryptedDirIV feature flag): nonce, encrypted DirIV, GCM tag.
+	encryptedDirIVLen = dirIVNonceLen + DirIVLen + cryptocore.AuthTagLen
 )
 
 // ReadDirIV - read the "gocryptfs.diriv" file from "dir" (absolute ciphertext path)
 // This function is exported because it allows for an efficient readdir implementation.
-func ReadDirIV(dir string) (iv []byte, err error) {
+func (be *NameTransform) ReadDirIV(dir string) (iv []byte, err error) {
 	fd, err := os.Open(filepath.Join(dir, DirIVFilename))
 	if err != nil {
 		// Note: getting errors here is normal because of concurrent deletes.
 		return nil, err
 	}
 	defer fd.Close()
-	return fdReadDirIV(fd)
+	return be.fdReadDirIV(fd)
+}
+
+// readDirIVStamped is like ReadDirIV, but also returns the stamp of the
+// gocryptfs.diriv file for the DirIV cache. The directory is "cDir"
+// (relative ciphertext path) below "rootDir", and may be deeper than
+// PATH_MAX.
+func (be *NameTransform) readDirIVStamped(rootDir string, cDir string) (iv []byte, stamp dirivcache.Stamp, err error) {
+	fdRaw, err := syscallcompat.OpenLong(rootDir, filepath.Join(cDir, DirIVFilename),
+		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, stamp, err
+	}
+	fd := os.NewFile(uintptr(fdRaw), filepath.Join(rootDir, cDir, DirIVFilename))
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, stamp, err
+	}
+	iv, err = be.fdReadDirIV(fd)
+	return iv, dirIVStamp(fi), err
+}
+
+// statDirIV returns the stamp of the gocryptfs.diriv file in "dir"
+// (absolute ciphertext path).
+func statDirIV(dir string) (dirivcache.Stamp, error) {
+	fi, err := os.Lstat(filepath.Join(dir, DirIVFilename))
+	if err != nil {
+		return dirivcache.Stamp{}, err
+	}
+	return dirIVStamp(fi), nil
+}
+
+func dirIVStamp(fi os.FileInfo) dirivcache.Stamp {
+	stamp := dirivcache.Stamp{
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		stamp.Ino = uint64(st.Ino)
+	}
+	return stamp
 }
 
 // ReadDirIVAt reads "gocryptfs.diriv" from the directory that is opened as "dirfd".
 // Using the dirfd makes it immune to concurrent renames of the directory.
-func ReadDirIVAt(dirfd *os.File) (iv []byte, err error) {
+func (be *NameTransform) ReadDirIVAt(dirfd *os.File) (iv []byte, err error) {
 	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), DirIVFilename,
 		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
-		tlog.Warn.Printf("ReadDirIVAt: opening %q in dir %q failed: %v",
-			DirIVFilename, dirfd.Name(), err)
+		// ENOENT is normal when the directory has been deleted concurrently
+		if err != syscall.ENOENT {
+			tlog.Warn.Printf("ReadDirIVAt: opening %q in dir %q failed: %v",
+				DirIVFilename, dirfd.Name(), err)
+		}
 		return nil, err
 	}
 	fd := os.NewFile(uintptr(fdRaw), DirIVFilename)
 	defer fd.Close()
-	return fdReadDirIV(fd)
+	return be.fdReadDirIV(fd)
+}
+
+// CheckDirIVAt reads gocryptfs.diriv in "dirfd" and returns EIO if it does
+// not match the cached DirIV "iv". The DirIV of a directory never changes,
+// so a mismatch means that the file has been corrupted or tampered with.
+// Does nothing unless SetParanoidDirIV has been called.
+func (be *NameTransform) CheckDirIVAt(dirfd *os.File, iv []byte) error {
+	if !be.paranoid {
+		return nil
+	}
+	diskIV, err := be.ReadDirIVAt(dirfd)
+	if err != nil {
+		return err
+	}
+	return checkDirIV(dirfd.Name(), iv, diskIV)
+}
+
+// checkDirIV returns EIO if "diskIV", which has just been read from the
+// directory "dir", differs from the cached "iv".
+func checkDirIV(dir string, iv []byte, diskIV []byte) error {
+	if !bytes.Equal(iv, diskIV) {
+		tlog.Warn.Printf("gocryptfs.diriv in %q does not match the cached DirIV, "+
+			"it has been modified behind our back. Returning EIO.", dir)
+		return syscall.EIO
+	}
+	return nil
 }
 
 // allZeroDirIV is preallocated to quickly check if the data read from disk is all zero
 var allZeroDirIV = make([]byte, DirIVLen)
 
+// ReadDirIVFrom reads and verifies the DirIV from "r", which has the
+// content of a gocryptfs.diriv file. Used when the ciphertext directory is
+// not on a filesystem, like in an archive.
+func (be *NameTransform) ReadDirIVFrom(r io.Reader) (iv []byte, err error) {
+	return be.fdReadDirIV(r)
+}
+
 // fdReadDirIV reads and verifies the DirIV from an opened gocryptfs.diriv file.
-func fdReadDirIV(fd *os.File) (iv []byte, err error) {
-	// We want to detect if the file is bigger than DirIVLen, so
+func (be *NameTransform) fdReadDirIV(fd io.Reader) (iv []byte, err error) {
+	wantLen := DirIVLen
+	if be.dirIVAEAD != nil {
+		wantLen = encryptedDirIVLen
+	}
+	// We want to detect if the file is bigger than wantLen, so
 	// make the buffer 1 byte bigger than necessary.
-	iv = make([]byte, DirIVLen+1)
+	iv = make([]byte, wantLen+1)
 	n, err := fd.Read(iv)
 	if err != nil && err != io.EOF {
 		tlog.Warn.Printf("ReadDirIVAt: Read failed: %v", err)
 		return nil, err
 	}
 	iv = iv[0:n]
-	if len(iv) != DirIVLen {
-		tlog.Warn.Printf("ReadDirIVAt: wanted %d bytes, got %d. Returning EINVAL.", DirIVLen, len(iv))
+	if len(iv) != wantLen {
+		tlog.Warn.Printf("ReadDirIVAt: wanted %d bytes, got %d. Returning EINVAL.", wantLen, len(iv))
 		return nil, syscall.EINVAL
 	}
+	if be.dirIVAEAD != nil {
+		iv, err = be.dirIVAEAD.Open(nil, iv[:dirIVNonceLen], iv[dirIVNonceLen:], nil)
+		if err != nil {
+			tlog.Warn.Printf("ReadDirIVAt: diriv failed authentication. Returning EBADMSG.")
+			return nil, syscall.EBADMSG
+		}
+	}
 	if bytes.Equal(iv, allZeroDirIV) {
 		tlog.Warn.Printf("ReadDirIVAt: diriv is all-zero. Returning EINVAL.")
 		return nil, syscall.EINVAL
@@ -79,12 +177,31 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 // "dir" should be a path (without slashes) relative to the directory
 // described by "dirfd". This function is exported because it is used from
 // pathfs_frontend, main, and also the automated tests.
+//
+// The DirIV is stored in plaintext. Use the NameTransform method for
+// filesystems that have the EncryptedDirIV feature flag set.
 func WriteDirIV(dirfd *os.File, dir string) error {
+	return writeDirIV(dirfd, dir, nil)
+}
+
+// WriteDirIV is like the package-level WriteDirIV, but encrypts the DirIV
+// if the NameTransform uses encrypted DirIVs.
+func (be *NameTransform) WriteDirIV(dirfd *os.File, dir string) error {
+	return writeDirIV(dirfd, dir, be.dirIVAEAD)
+}
+
+// writeDirIV implements WriteDirIV. If "aead" is not nil, the DirIV is
+// encrypted with it.
+func writeDirIV(dirfd *os.File, dir string, aead cipher.AEAD) error {
 	// For relative paths we do not expect that "dir" contains slashes
 	if dirfd != nil && strings.Contains(dir, "/") {
 		log.Panicf("WriteDirIV: Relative path should not contain slashes: %v", dir)
 	}
 	iv := cryptocore.RandBytes(DirIVLen)
+	if aead != nil {
+		nonce := cryptocore.RandBytes(dirIVNonceLen)
+		iv = aead.Seal(nonce, nonce, iv, nil)
+	}
 	file := filepath.Join(dir, DirIVFilename)
 	// 0400 permissions: gocryptfs.diriv should never be modified after creation.
 	// Don't use "ioutil.WriteFile", it causes trouble on NFS: https://github.com/rfjakob/gocryptfs/issues/105
@@ -107,14 +224,51 @@ func WriteDirIV(dirfd *os.File, dir string) error {
 	return nil
 }
 
+// Only explain once why names are rejected
+var nameMaxInfoOnce sync.Once
+
 // encryptAndHashName encrypts "name" and hashes it to a longname if it is
-// too long.
-func (be *NameTransform) encryptAndHashName(name string, iv []byte) string {
+// too long. Without long names, a name that is too long for the backing
+// filesystem is rejected with ENAMETOOLONG.
+func (be *NameTransform) encryptAndHashName(name string, iv []byte) (string, error) {
 	cName := be.EncryptName(name, iv)
-	if be.longNames && len(cName) > syscall.NAME_MAX {
-		return be.HashLongName(cName)
+	if len(cName) <= be.nameMax {
+		return cName, nil
+	}
+	if be.longNames {
+		return be.HashLongName(cName), nil
+	}
+	nameMaxInfoOnce.Do(func() {
+		tlog.Info.Printf("The encrypted name of %q is %d bytes, but CIPHERDIR only allows %d. "+
+			"Names like this need \"-longnames\", returning ENAMETOOLONG", name, len(cName), be.nameMax)
+	})
+	return "", syscall.ENAMETOOLONG
+}
+
+// readDirIVHook, if set, is called before readAndCacheDirIV reads a DirIV
+// from disk. Used by the tests.
+var readDirIVHook func()
+
+// readAndCacheDirIV reads the DirIV of the directory "cipherWD" (relative to
+// "rootDir") and stores it in the cache as "plainWD". Concurrent calls for
+// the same directory share a single read, so that many lookups in a
+// directory that is not cached yet do not all hit the disk.
+func (be *NameTransform) readAndCacheDirIV(rootDir string, cipherWD string, plainWD string) ([]byte, error) {
+	v, err, _ := be.dirIVReads.Do(cipherWD, func() (interface{}, error) {
+		if readDirIVHook != nil {
+			readDirIVHook()
+		}
+		iv, stamp, err := be.readDirIVStamped(rootDir, cipherWD)
+		if err != nil {
+			return nil, err
+		}
+		be.DirIVCache.StoreStamped(plainWD, iv, cipherWD, stamp)
+		return iv, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return cName
+	return v.([]byte), nil
 }
 
 // EncryptPathDirIV - encrypt relative plaintext path "plainPath" using EME with
@@ -131,32 +285,49 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 	if len(baseName) > syscall.NAME_MAX {
 		return "", syscall.ENAMETOOLONG
 	}
-	// If we have the iv and the encrypted directory name in the cache, we
-	// can skip the directory walk. This optimization yields a 10% improvement
-	// in the tar extract benchmark.
-	parentDir := Dir(plainPath)
-	if iv, cParentDir := be.DirIVCache.Lookup(parentDir); iv != nil {
-		cBaseName := be.encryptAndHashName(baseName, iv)
-		return filepath.Join(cParentDir, cBaseName), nil
-	}
-	// We have to walk the directory tree, starting at the root directory.
-	// ciphertext working directory (relative path)
-	cipherWD := ""
-	// plaintext working directory (relative path)
-	plainWD := ""
+	// Resume the directory walk at the deepest ancestor of the parent
+	// directory we have in the cache. If that is the parent directory
+	// itself, we skip the walk completely. This optimization yields a 10%
+	// improvement in the tar extract benchmark.
 	plainNames := strings.Split(plainPath, "/")
-	for _, plainName := range plainNames {
-		iv, _ := be.DirIVCache.Lookup(plainWD)
+	iv, cipherWD, depth := be.DirIVCache.LookupLongest(Dir(plainPath))
+	// plaintext working directory (relative path)
+	plainWD := strings.Join(plainNames[:depth], "/")
+	if be.revalidate && depth > 0 {
+		// Another client may have replaced the directory. Its descendants
+		// are walked below and need no check, but if the match is stale,
+		// everything cached below the root is suspect.
+		stamp, err := statDirIV(filepath.Join(rootDir, cipherWD))
+		if err != nil || !be.DirIVCache.Revalidate(plainWD, stamp) {
+			be.DirIVCache.Clear()
+			iv, _ = be.DirIVCache.Lookup("")
+			cipherWD, plainWD, depth = "", "", 0
+		}
+	}
+	if be.paranoid && iv != nil {
+		diskIV, _, err := be.readDirIVStamped(rootDir, cipherWD)
+		if err != nil {
+			return "", err
+		}
+		if err = checkDirIV(filepath.Join(rootDir, cipherWD), iv, diskIV); err != nil {
+			return "", err
+		}
+	}
+	for _, plainName := range plainNames[depth:] {
 		if iv == nil {
-			iv, err = ReadDirIV(filepath.Join(rootDir, cipherWD))
+			iv, err = be.readAndCacheDirIV(rootDir, cipherWD, plainWD)
 			if err != nil {
 				return "", err
 			}
-			be.DirIVCache.Store(plainWD, iv, cipherWD)
 		}
-		cipherName := be.encryptAndHashName(plainName, iv)
+		cipherName, err := be.encryptAndHashName(plainName, iv)
+		if err != nil {
+			return "", err
+		}
 		cipherWD = filepath.Join(cipherWD, cipherName)
 		plainWD = filepath.Join(plainWD, plainName)
+		// Deeper directories are not in the cache
+		iv = nil
 	}
 	return cipherWD, nil
 }
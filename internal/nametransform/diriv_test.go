@@ -0,0 +1,160 @@
+package nametransform
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/eme"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func newEncryptedDirIVTransform(key []byte) *NameTransform {
+	n := New(nil, true, true, false)
+	n.SetDirIVCipher(cryptocore.NewDirIVAEAD(key))
+	return n
+}
+
+// TestEncryptedDirIVRoundTrip writes encrypted DirIVs and reads them back
+func TestEncryptedDirIVRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEncryptedDirIV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := newEncryptedDirIVTransform(make([]byte, cryptocore.KeyLen))
+	var ivs [][]byte
+	for _, d := range []string{"a", "b"} {
+		d = filepath.Join(dir, d)
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = n.WriteDirIV(nil, d); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(d, DirIVFilename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) != encryptedDirIVLen {
+			t.Fatalf("wrong file size %d", len(raw))
+		}
+		iv, err := n.ReadDirIV(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(iv) != DirIVLen || bytes.Contains(raw, iv) {
+			t.Errorf("DirIV %x is not encrypted in %x", iv, raw)
+		}
+		ivs = append(ivs, iv)
+	}
+	if bytes.Equal(ivs[0], ivs[1]) {
+		t.Error("DirIVs are identical")
+	}
+	// A plaintext NameTransform must not accept encrypted DirIVs and vice
+	// versa
+	if _, err = New(nil, true, true, false).ReadDirIV(filepath.Join(dir, "a")); err != syscall.EINVAL {
+		t.Errorf("want EINVAL, got %v", err)
+	}
+	if err = WriteDirIV(nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.ReadDirIV(dir); err != syscall.EINVAL {
+		t.Errorf("want EINVAL, got %v", err)
+	}
+}
+
+// TestEncryptedDirIVTampered checks that modified or forged encrypted DirIVs
+// are rejected
+func TestEncryptedDirIVTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEncryptedDirIV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := newEncryptedDirIVTransform(make([]byte, cryptocore.KeyLen))
+	if err = n.WriteDirIV(nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, DirIVFilename)
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written with a different key
+	otherKey := bytes.Repeat([]byte{1}, cryptocore.KeyLen)
+	if _, err = newEncryptedDirIVTransform(otherKey).ReadDirIV(dir); err != syscall.EBADMSG {
+		t.Errorf("wrong key: want EBADMSG, got %v", err)
+	}
+	// Flip one bit in the nonce, the ciphertext and the tag
+	for _, i := range []int{0, dirIVNonceLen, encryptedDirIVLen - 1} {
+		tampered := append([]byte{}, orig...)
+		tampered[i] ^= 1
+		os.Chmod(path, 0600)
+		if err = ioutil.WriteFile(path, tampered, 0400); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = n.ReadDirIV(dir); err != syscall.EBADMSG {
+			t.Errorf("byte %d: want EBADMSG, got %v", i, err)
+		}
+	}
+}
+
+// TestDirIVReadCoalescing checks that concurrent lookups in a directory
+// that is not cached read its gocryptfs.diriv only once.
+func TestDirIVReadCoalescing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDirIVReadCoalescing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = WriteDirIV(nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := New(eme.New(bc), true, true, false)
+	var reads int32
+	readDirIVHook = func() {
+		atomic.AddInt32(&reads, 1)
+		// Make sure that all goroutines arrive while the read is running
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer func() { readDirIVHook = nil }()
+	const N = 20
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	results := make([]string, N)
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			cPath, err := n.EncryptPathDirIV("foo", dir)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = cPath
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	if reads != 1 {
+		t.Errorf("want 1 read, got %d", reads)
+	}
+	for i := range results {
+		if results[i] == "" || results[i] != results[0] {
+			t.Errorf("result %d: %q != %q", i, results[i], results[0])
+		}
+	}
+}
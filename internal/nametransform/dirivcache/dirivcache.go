@@ -1,15 +1,24 @@
 package dirivcache
 
 import (
+	"bytes"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/cachebudget"
 )
 
 const (
+	// maxEntries is the default capacity of each shard, see SetMaxEntries()
 	maxEntries = 100
+	// expireTime is the default for how long a shard stays valid, see
+	// SetExpireTime()
 	expireTime = 1 * time.Second
+	// numShards is the number of independently-locked shards
+	numShards = 16
 )
 
 type cacheEntry struct {
@@ -17,86 +26,394 @@ type cacheEntry struct {
 	iv []byte
 	// Relative ciphertext path of the directory.
 	cDir string
+	// Version of the gocryptfs.diriv file the IV was read from.
+	stamp Stamp
 }
 
-// DirIVCache stores up to "maxEntries" directory IVs.
-type DirIVCache struct {
-	// data in the cache, indexed by relative plaintext path
+// entrySize is what an entry costs in the memory budget
+func entrySize(dir string, e cacheEntry) uint64 {
+	return uint64(len(dir)+len(e.iv)+len(e.cDir)) + cachebudget.EntryOverhead
+}
+
+// Stamp identifies a version of a gocryptfs.diriv file on disk. If a
+// directory is deleted and re-created, or its gocryptfs.diriv is replaced,
+// the stamp changes.
+type Stamp struct {
+	Ino   uint64
+	Size  int64
+	Mtime int64
+}
+
+// shard stores the entries for the directories whose first path segment
+// hashes to it.
+type shard struct {
+	// data in the shard, indexed by relative plaintext path
 	// of the directory.
 	data map[string]cacheEntry
 
-	// The DirIV of the root directory gets special treatment because it
-	// cannot change (the root directory cannot be renamed or deleted).
-	// It is unaffected by the expiry timer and cache clears.
-	rootDirIV []byte
-
-	// expiry is the time when the whole cache expires.
+	// expiry is the time when the whole shard expires.
 	// The cached entry my become out-of-date if the ciphertext directory is
 	// modifed behind the back of gocryptfs. Having an expiry time limits the
-	// inconstency to one second, like attr_timeout does for the kernel
-	// getattr cache.
+	// inconstency to one second (or what was set with SetExpireTime()), like
+	// attr_timeout does for the kernel getattr cache.
 	expiry time.Time
 
+	// bytes is the sum of entrySize() over all entries in data
+	bytes uint64
+
+	// pins counts the Pin() calls for each directory and its ancestors.
+	// Unlike data, it survives expiry and Clear().
+	pins map[string]int
+
 	sync.RWMutex
 }
 
+// DirIVCache stores up to "maxEntries" directory IVs per shard. The cache
+// is split into "numShards" shards by the first path segment, so that
+// operations on unrelated top-level directories do not contend for the
+// same lock.
+type DirIVCache struct {
+	// Counters for Stats(). They are accessed without holding any locks so
+	// atomic operations must be used. They must be the first elements of
+	// the struct to guarantee 64-bit alignment.
+	hits, misses, evictions uint64
+
+	shards [numShards]shard
+
+	// The DirIV of the root directory gets special treatment because it
+	// cannot change (the root directory cannot be renamed or deleted).
+	// It is unaffected by the expiry timer and cache clears. Storing a
+	// different root DirIV clears the subdirectory entries, as they were
+	// derived from the old one.
+	rootDirIV     []byte
+	rootDirIVLock sync.RWMutex
+
+	// ttl overrides expireTime if non-zero
+	ttl time.Duration
+
+	// capacity overrides maxEntries if non-zero
+	capacity int
+
+	// Memory budget share, see SetBudget()
+	account *cachebudget.Account
+}
+
+// SetExpireTime sets how long stored entries stay valid. Must be called
+// before the cache is used.
+func (c *DirIVCache) SetExpireTime(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// SetMaxEntries sets the capacity of each shard. Must be called before the
+// cache is used, or be followed by Clear().
+func (c *DirIVCache) SetMaxEntries(n int) {
+	c.capacity = n
+}
+
+// maxEntries returns the capacity of each shard
+func (c *DirIVCache) maxEntries() int {
+	if c.capacity > 0 {
+		return c.capacity
+	}
+	return maxEntries
+}
+
+// Stats are the counters of a DirIVCache
+type Stats struct {
+	// LookupLongest calls that found the directory itself
+	Hits uint64
+	// LookupLongest calls that found only an ancestor or nothing, so that
+	// the caller has to read DirIVs from disk
+	Misses uint64
+	// Entries dropped to make room for others, because the shard was full
+	// or the memory budget was exceeded
+	Evictions uint64
+	// Number of cached directories, not counting the root directory
+	Entries int
+}
+
+// Stats returns the counters since the cache was created or since the last
+// ResetStats() call.
+func (c *DirIVCache) Stats() Stats {
+	st := Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		if s.data != nil && time.Since(s.expiry) <= 0 {
+			st.Entries += len(s.data)
+		}
+		s.RUnlock()
+	}
+	return st
+}
+
+// ResetStats sets the counters of Stats() to zero.
+func (c *DirIVCache) ResetStats() {
+	atomic.StoreUint64(&c.hits, 0)
+	atomic.StoreUint64(&c.misses, 0)
+	atomic.StoreUint64(&c.evictions, 0)
+}
+
+// SetBudget makes the cache draw from the memory budget "b". Must be called
+// before the cache is used.
+func (c *DirIVCache) SetBudget(b *cachebudget.Budget) {
+	c.account = b.Register("diriv", c.trim)
+}
+
+// shardFor returns the shard responsible for the relative plaintext path
+// "dir".
+func (c *DirIVCache) shardFor(dir string) *shard {
+	top := dir
+	if i := strings.IndexByte(dir, '/'); i >= 0 {
+		top = dir[:i]
+	}
+	// Inlined 32-bit FNV-1a, hash/fnv would allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(top); i++ {
+		h ^= uint32(top[i])
+		h *= 16777619
+	}
+	return &c.shards[h%numShards]
+}
+
 // Lookup - fetch entry for "dir" (relative plaintext path) from the cache.
 // Returns the directory IV and the relative encrypted path, or (nil, "")
 // if the entry was not found.
 func (c *DirIVCache) Lookup(dir string) (iv []byte, cDir string) {
-	c.RLock()
-	defer c.RUnlock()
 	if dir == "" {
+		c.rootDirIVLock.RLock()
+		defer c.rootDirIVLock.RUnlock()
 		return c.rootDirIV, ""
 	}
-	if c.data == nil {
-		return nil, ""
-	}
-	if time.Since(c.expiry) > 0 {
-		c.data = nil
+	s := c.shardFor(dir)
+	s.RLock()
+	defer s.RUnlock()
+	// An expired shard is re-initialized in the next Store()
+	if s.data == nil || time.Since(s.expiry) > 0 {
 		return nil, ""
 	}
-	v := c.data[dir]
+	v := s.data[dir]
 	return v.iv, v.cDir
 }
 
+// LookupLongest - fetch the entry for the deepest cached ancestor of "dir"
+// (relative plaintext path), including "dir" itself.
+// Returns the directory IV, the relative encrypted path and the number of
+// path segments of the match, so the caller can resume a directory walk
+// there. If nothing but the root directory matches, matchedDepth is 0 and
+// iv is the root DirIV, which may be nil.
+func (c *DirIVCache) LookupLongest(dir string) (iv []byte, cDir string, matchedDepth int) {
+	if dir != "" {
+		// All ancestors share the first path segment and thus the shard
+		s := c.shardFor(dir)
+		s.RLock()
+		if s.data != nil && time.Since(s.expiry) <= 0 {
+			depth := strings.Count(dir, "/") + 1
+			for d := dir; ; depth-- {
+				if v, ok := s.data[d]; ok {
+					s.RUnlock()
+					if d == dir {
+						atomic.AddUint64(&c.hits, 1)
+					} else {
+						atomic.AddUint64(&c.misses, 1)
+					}
+					return v.iv, v.cDir, depth
+				}
+				i := strings.LastIndexByte(d, '/')
+				if i < 0 {
+					break
+				}
+				d = d[:i]
+			}
+		}
+		s.RUnlock()
+	}
+	iv, _ = c.Lookup("")
+	if dir == "" && iv != nil {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return iv, "", 0
+}
+
 // Store - write an entry for directory "dir" into the cache.
 // Arguments:
 // dir ... relative plaintext path
 // iv .... directory IV
 // cDir .. relative ciphertext path
 func (c *DirIVCache) Store(dir string, iv []byte, cDir string) {
-	c.Lock()
-	defer c.Unlock()
+	c.StoreStamped(dir, iv, cDir, Stamp{})
+}
+
+// StoreStamped is like Store, but also remembers the version of the
+// gocryptfs.diriv file for Revalidate().
+func (c *DirIVCache) StoreStamped(dir string, iv []byte, cDir string, stamp Stamp) {
 	if dir == "" {
+		c.rootDirIVLock.Lock()
+		changed := c.rootDirIV != nil && !bytes.Equal(c.rootDirIV, iv)
 		c.rootDirIV = iv
+		c.rootDirIVLock.Unlock()
+		// Re-storing the same IV, for example after a revalidation, keeps
+		// the cached subdirectories
+		if changed {
+			c.Clear()
+		}
+		return
 	}
 	// Sanity check: plaintext and chiphertext paths must have the same number
 	// of segments
 	if strings.Count(dir, "/") != strings.Count(cDir, "/") {
 		log.Panicf("inconsistent number of path segments: dir=%q cDir=%q", dir, cDir)
 	}
-	// Clear() may have cleared c.data: re-initialize
-	if c.data == nil {
-		c.data = make(map[string]cacheEntry, maxEntries)
-		// Set expiry time one second into the future
-		c.expiry = time.Now().Add(expireTime)
+	s := c.shardFor(dir)
+	s.Lock()
+	// Clear() may have cleared s.data, or it may have expired: re-initialize
+	if s.data == nil || time.Since(s.expiry) > 0 {
+		s.reset(c.account)
+		s.data = make(map[string]cacheEntry, c.maxEntries())
+		ttl := c.ttl
+		if ttl == 0 {
+			ttl = expireTime
+		}
+		s.expiry = time.Now().Add(ttl)
+	}
+	if old, ok := s.data[dir]; ok {
+		s.remove(c.account, dir, old)
+	} else if len(s.data) >= c.maxEntries() {
+		// Delete a random unpinned entry from the map if reached maxEntries.
+		// If all entries are pinned, the shard grows beyond maxEntries.
+		for k, v := range s.data {
+			if s.pins[k] > 0 {
+				continue
+			}
+			s.remove(c.account, k, v)
+			atomic.AddUint64(&c.evictions, 1)
+			break
+		}
+	}
+	e := cacheEntry{iv, cDir, stamp}
+	s.data[dir] = e
+	n := entrySize(dir, e)
+	s.bytes += n
+	c.account.Charge(n)
+	s.Unlock()
+	c.account.Trim()
+}
+
+// remove deletes the entry "dir" from the shard. The caller must hold the
+// shard lock.
+func (s *shard) remove(account *cachebudget.Account, dir string, e cacheEntry) {
+	delete(s.data, dir)
+	n := entrySize(dir, e)
+	s.bytes -= n
+	account.Release(n)
+}
+
+// reset drops all entries of the shard. The caller must hold the shard lock.
+func (s *shard) reset(account *cachebudget.Account) {
+	// Will be re-initialized in the next Store()
+	s.data = nil
+	account.Release(s.bytes)
+	s.bytes = 0
+}
+
+// Revalidate checks that the entry for "dir" was stored with "stamp", the
+// current version of its gocryptfs.diriv file. If it was not, the entry is
+// deleted and false is returned.
+func (c *DirIVCache) Revalidate(dir string, stamp Stamp) bool {
+	if dir == "" {
+		// The root DirIV cannot change
+		return true
+	}
+	s := c.shardFor(dir)
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.data[dir]
+	if ok && v.stamp == stamp {
+		return true
+	}
+	if ok {
+		s.remove(c.account, dir, v)
 	}
-	// Delete a random entry from the map if reached maxEntries
-	if len(c.data) >= maxEntries {
-		for k := range c.data {
-			delete(c.data, k)
+	return false
+}
+
+// Pin exempts the entries for "dir" (relative plaintext path) and all its
+// ancestors from eviction, both when a shard is full and when the memory
+// budget is exceeded. Pins are counted, every Pin() needs an Unpin().
+//
+// Pinned entries are still replaced by Store, and they are still dropped
+// when they expire and by Clear(), because a stale DirIV must never be
+// used. They are just never evicted to make room for other entries.
+func (c *DirIVCache) Pin(dir string) {
+	c.addPins(dir, 1)
+}
+
+// Unpin undoes one Pin() call for "dir".
+func (c *DirIVCache) Unpin(dir string) {
+	c.addPins(dir, -1)
+}
+
+// addPins adds "delta" to the pin count of "dir" and its ancestors. The
+// root DirIV is never evicted and needs no pin.
+func (c *DirIVCache) addPins(dir string, delta int) {
+	if dir == "" {
+		return
+	}
+	// All ancestors share the first path segment and thus the shard
+	s := c.shardFor(dir)
+	s.Lock()
+	defer s.Unlock()
+	if s.pins == nil {
+		s.pins = make(map[string]int)
+	}
+	for d := dir; ; {
+		if n := s.pins[d] + delta; n > 0 {
+			s.pins[d] = n
+		} else {
+			delete(s.pins, d)
+		}
+		i := strings.LastIndexByte(d, '/')
+		if i < 0 {
 			break
 		}
+		d = d[:i]
+	}
+}
+
+// trim is called when the memory budget is exceeded. Unlike Clear(), it
+// keeps the pinned entries.
+func (c *DirIVCache) trim() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		if len(s.pins) == 0 {
+			atomic.AddUint64(&c.evictions, uint64(len(s.data)))
+			s.reset(c.account)
+		} else {
+			for k, v := range s.data {
+				if s.pins[k] == 0 {
+					s.remove(c.account, k, v)
+					atomic.AddUint64(&c.evictions, 1)
+				}
+			}
+		}
+		s.Unlock()
 	}
-	c.data[dir] = cacheEntry{iv, cDir}
 }
 
 // Clear ... clear the cache.
 // Called from fusefrontend when directories are renamed or deleted.
 func (c *DirIVCache) Clear() {
-	c.Lock()
-	defer c.Unlock()
-	// Will be re-initialized in the next Store()
-	c.data = nil
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		s.reset(c.account)
+		s.Unlock()
+	}
 }
@@ -0,0 +1,194 @@
+package dirivcache
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreLookup(t *testing.T) {
+	var c DirIVCache
+	iv := []byte("0123456789abcdef")
+	c.Store("", iv, "")
+	c.Store("a/b", iv, "A/B")
+	if v, cDir := c.Lookup("a/b"); v == nil || cDir != "A/B" {
+		t.Errorf("Lookup a/b: got %v %q", v, cDir)
+	}
+	if v, _ := c.Lookup("x/b"); v != nil {
+		t.Errorf("Lookup x/b should have failed")
+	}
+	c.Clear()
+	if v, _ := c.Lookup("a/b"); v != nil {
+		t.Errorf("Lookup after Clear should have failed")
+	}
+	// The root DirIV survives Clear
+	if v, _ := c.Lookup(""); v == nil {
+		t.Errorf("root DirIV was cleared")
+	}
+}
+
+func TestLookupLongest(t *testing.T) {
+	var c DirIVCache
+	rootIV := []byte("rootrootrootroot")
+	abIV := []byte("abababababababab")
+	c.Store("", rootIV, "")
+	c.Store("a/b", abIV, "A/B")
+	iv, cDir, depth := c.LookupLongest("a/b/c/d")
+	if !bytes.Equal(iv, abIV) || cDir != "A/B" || depth != 2 {
+		t.Errorf("a/b/c/d: got %q %q %d", iv, cDir, depth)
+	}
+	// Exact match
+	if _, _, depth = c.LookupLongest("a/b"); depth != 2 {
+		t.Errorf("a/b: got depth %d", depth)
+	}
+	// "a/bb" is not below "a/b"
+	iv, cDir, depth = c.LookupLongest("a/bb/c")
+	if !bytes.Equal(iv, rootIV) || cDir != "" || depth != 0 {
+		t.Errorf("a/bb/c: got %q %q %d", iv, cDir, depth)
+	}
+	c.Clear()
+	if iv, _, depth = c.LookupLongest("a/b/c/d"); !bytes.Equal(iv, rootIV) || depth != 0 {
+		t.Errorf("after Clear: got %q %d", iv, depth)
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	var c DirIVCache
+	iv := []byte("1234567890123456")
+	stamp := Stamp{Ino: 1, Size: 16, Mtime: 1000}
+	c.StoreStamped("a", iv, "A", stamp)
+	if !c.Revalidate("a", stamp) {
+		t.Fatal("unchanged stamp was rejected")
+	}
+	changed := stamp
+	changed.Mtime++
+	if c.Revalidate("a", changed) {
+		t.Fatal("changed stamp was accepted")
+	}
+	// The stale entry must be gone
+	if iv2, _ := c.Lookup("a"); iv2 != nil {
+		t.Errorf("stale entry still cached: %q", iv2)
+	}
+	if c.Revalidate("b", stamp) {
+		t.Error("missing entry was accepted")
+	}
+}
+
+func TestSetExpireTime(t *testing.T) {
+	var c DirIVCache
+	c.SetExpireTime(10 * time.Millisecond)
+	iv := []byte("1234567890123456")
+	c.Store("a", iv, "A")
+	if iv2, _ := c.Lookup("a"); iv2 == nil {
+		t.Fatal("entry not found")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if iv2, _ := c.Lookup("a"); iv2 != nil {
+		t.Error("entry did not expire")
+	}
+}
+
+// benchStoreLookup runs Store+Lookup from many goroutines. Goroutine number
+// i works below the top-level directory topDir(i).
+func benchStoreLookup(b *testing.B, topDir func(i int64) string) {
+	var c DirIVCache
+	iv := make([]byte, 16)
+	var n int64
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		top := topDir(atomic.AddInt64(&n, 1))
+		var dirs []string
+		for i := 0; i < 50; i++ {
+			dirs = append(dirs, fmt.Sprintf("%s/%d", top, i))
+		}
+		var i int
+		for pb.Next() {
+			dir := dirs[i%len(dirs)]
+			c.Store(dir, iv, dir)
+			c.Lookup(dir)
+			i++
+		}
+	})
+}
+
+// BenchmarkSameTopDir has all goroutines contend for the same shard.
+// Run with "go test -race -bench ." and compare to BenchmarkDifferentTopDirs.
+func BenchmarkSameTopDir(b *testing.B) {
+	benchStoreLookup(b, func(i int64) string { return "top" })
+}
+
+// BenchmarkDifferentTopDirs spreads the goroutines across the shards.
+func BenchmarkDifferentTopDirs(b *testing.B) {
+	benchStoreLookup(b, func(i int64) string { return fmt.Sprintf("top%d", i) })
+}
+
+// TestStoreRoot checks that re-storing the root DirIV keeps the cached
+// subdirectories, while storing a different one clears them.
+func TestStoreRoot(t *testing.T) {
+	var c DirIVCache
+	rootIV := []byte("rootrootrootroot")
+	abIV := []byte("abababababababab")
+	c.Store("", rootIV, "")
+	c.Store("a", abIV, "A")
+	c.Store("a/b", abIV, "A/B")
+	c.Store("", append([]byte(nil), rootIV...), "")
+	for _, dir := range []string{"a", "a/b"} {
+		if v, _ := c.Lookup(dir); v == nil {
+			t.Errorf("%s: dropped after re-storing the root DirIV", dir)
+		}
+	}
+	otherIV := []byte("otherotherotherx")
+	c.Store("", otherIV, "")
+	for _, dir := range []string{"a", "a/b"} {
+		if v, _ := c.Lookup(dir); v != nil {
+			t.Errorf("%s: survived a root DirIV change", dir)
+		}
+	}
+	if v, _ := c.Lookup(""); !bytes.Equal(v, otherIV) {
+		t.Errorf("root DirIV: got %q", v)
+	}
+}
+
+// TestPin fills the shard of a pinned directory past its capacity and
+// checks that the pinned entry and its ancestor survive, both the eviction
+// in Store and the memory budget trim, while unpinned entries are evicted.
+func TestPin(t *testing.T) {
+	var c DirIVCache
+	iv := []byte("1234567890123456")
+	c.Pin("hot/dir")
+	c.Store("hot", iv, "HOT")
+	c.Store("hot/dir", iv, "HOT/DIR")
+	// All "hot/..." directories end up in the same shard
+	for i := 0; i < 3*maxEntries; i++ {
+		c.Store(fmt.Sprintf("hot/x%d", i), iv, fmt.Sprintf("HOT/X%d", i))
+	}
+	for _, dir := range []string{"hot", "hot/dir"} {
+		if v, _ := c.Lookup(dir); v == nil {
+			t.Errorf("%s: pinned entry has been evicted", dir)
+		}
+	}
+	evicted := 0
+	for i := 0; i < 3*maxEntries; i++ {
+		if v, _ := c.Lookup(fmt.Sprintf("hot/x%d", i)); v == nil {
+			evicted++
+		}
+	}
+	if evicted < 2*maxEntries {
+		t.Errorf("only %d unpinned entries have been evicted", evicted)
+	}
+	c.trim()
+	if v, _ := c.Lookup("hot/dir"); v == nil {
+		t.Error("trim evicted the pinned entry")
+	}
+	if v, _ := c.Lookup(fmt.Sprintf("hot/x%d", 3*maxEntries-1)); v != nil {
+		t.Error("trim kept an unpinned entry")
+	}
+	// Unpinned, the entry is evicted like any other
+	c.Unpin("hot/dir")
+	c.trim()
+	if v, _ := c.Lookup("hot/dir"); v != nil {
+		t.Error("trim kept the unpinned entry")
+	}
+}
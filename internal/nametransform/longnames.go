@@ -22,6 +22,11 @@ const (
 	longNamePrefix = "gocryptfs.longname."
 )
 
+// MinNameMax is the shortest name limit that long names work with: the
+// ".name" file of a hashed name must fit. The SHA256 hash takes 44 bytes
+// base64-encoded, 43 without padding.
+const MinNameMax = len(longNamePrefix) + 44 + len(LongNameSuffix)
+
 // HashLongName - take the hash of a long string "name" and return
 // "gocryptfs.longname.[sha256]"
 func (n *NameTransform) HashLongName(name string) string {
@@ -57,6 +62,17 @@ func NameType(cName string) int {
 	return LongNameContent
 }
 
+// IsReservedName returns true if the plain file name "name" would collide
+// with a gocryptfs control file if it was stored unencrypted, which is the
+// case with "-plaintextnames". Encrypted names never collide: they only
+// contain base64 characters, which do not include ".".
+//
+// gocryptfs.conf is not covered here because it is only reserved in the
+// root directory.
+func IsReservedName(name string) bool {
+	return name == DirIVFilename || strings.HasPrefix(name, longNamePrefix)
+}
+
 // IsLongContent returns true if "cName" is the content store of a long name
 // file (looks like "gocryptfs.longname.[sha256]").
 func IsLongContent(cName string) bool {
@@ -71,6 +87,34 @@ func ReadLongName(path string) (string, error) {
 		return "", err
 	}
 	defer fd.Close()
+	return readLongNameFd(fd)
+}
+
+// ReadLongNameAt reads the encrypted name of the long name file "hashName"
+// from "hashName.name" in the directory opened as "dirfd", and checks that
+// the name actually hashes to "hashName". Together, this makes sure that we
+// never pair a name with the content of another file, even when the
+// directory or the files in it are renamed concurrently.
+func (n *NameTransform) ReadLongNameAt(dirfd *os.File, hashName string) (string, error) {
+	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), hashName+LongNameSuffix,
+		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	fd := os.NewFile(uintptr(fdRaw), hashName+LongNameSuffix)
+	defer fd.Close()
+	cName, err := readLongNameFd(fd)
+	if err != nil {
+		return "", err
+	}
+	if n.HashLongName(cName) != hashName {
+		return "", fmt.Errorf("ReadLongNameAt: content of %s does not match the hash", fd.Name())
+	}
+	return cName, nil
+}
+
+// readLongNameFd reads the encrypted name from an opened ".name" file.
+func readLongNameFd(fd *os.File) (string, error) {
 	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA=="
 	lim := 344
 	// Allocate a bigger buffer so we see whether the file is too big
@@ -104,7 +148,7 @@ func (n *NameTransform) WriteLongName(dirfd *os.File, hashName string, plainName
 	plainName = filepath.Base(plainName)
 
 	// Encrypt the basename
-	dirIV, err := ReadDirIVAt(dirfd)
+	dirIV, err := n.ReadDirIVAt(dirfd)
 	if err != nil {
 		return err
 	}
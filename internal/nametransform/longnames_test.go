@@ -1,7 +1,14 @@
 package nametransform
 
 import (
+	"crypto/aes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/rfjakob/eme"
 )
 
 func TestIsLongName(t *testing.T) {
@@ -20,3 +27,71 @@ func TestIsLongName(t *testing.T) {
 		t.Errorf("False positive")
 	}
 }
+
+func TestIsReservedName(t *testing.T) {
+	reserved := []string{DirIVFilename, "gocryptfs.longname.foo", "gocryptfs.longname.foo.name"}
+	for _, n := range reserved {
+		if !IsReservedName(n) {
+			t.Errorf("%q should be reserved", n)
+		}
+	}
+	allowed := []string{"gocryptfs.conf", "gocryptfs.diriv2", "xgocryptfs.longname.foo", "foo"}
+	for _, n := range allowed {
+		if IsReservedName(n) {
+			t.Errorf("%q should not be reserved", n)
+		}
+	}
+}
+
+// Encrypting a reserved name must never produce a reserved name
+func TestEncryptReservedName(t *testing.T) {
+	key := make([]byte, 32)
+	c, _ := aes.NewCipher(key)
+	for _, raw64 := range []bool{false, true} {
+		n := New(eme.New(c), true, raw64, false)
+		iv := make([]byte, DirIVLen)
+		for _, name := range []string{DirIVFilename, "gocryptfs.conf", "gocryptfs.longname.foo"} {
+			cName := n.EncryptName(name, iv)
+			if IsReservedName(cName) || strings.Contains(cName, ".") {
+				t.Errorf("raw64=%v: %q encrypts to %q", raw64, name, cName)
+			}
+		}
+	}
+}
+
+// TestReadLongNameAt checks that ReadLongNameAt rejects a ".name" file that
+// belongs to another file
+func TestReadLongNameAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReadLongNameAt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirfd, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dirfd.Close()
+	n := New(nil, true, true, false)
+	cName := strings.Repeat("a", 300)
+	hashName := n.HashLongName(cName)
+	err = ioutil.WriteFile(filepath.Join(dir, hashName+LongNameSuffix), []byte(cName), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := n.ReadLongNameAt(dirfd, hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != cName {
+		t.Errorf("want %q, got %q", cName, got)
+	}
+	// The ".name" file of "hashName" now contains the name of another file
+	err = ioutil.WriteFile(filepath.Join(dir, hashName+LongNameSuffix), []byte(strings.Repeat("b", 300)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.ReadLongNameAt(dirfd, hashName); err == nil {
+		t.Error("mismatched .name file was accepted")
+	}
+}
@@ -4,10 +4,16 @@ package nametransform
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
 	"encoding/base64"
+	"fmt"
+	"log"
 	"syscall"
+	"time"
 
 	"github.com/rfjakob/eme"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/rfjakob/gocryptfs/internal/nametransform/dirivcache"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -15,16 +21,40 @@ import (
 
 // NameTransform is used to transform filenames.
 type NameTransform struct {
+	// First element, keeps the atomic counters of DirIVCache 64-bit
+	// aligned.
+	DirIVCache dirivcache.DirIVCache
 	emeCipher  *eme.EMECipher
 	longNames  bool
-	DirIVCache dirivcache.DirIVCache
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depeding
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// nfc = convert names to Unicode Normalization Form C before encrypting
+	// them. Corresponds to the NFCNames feature flag.
+	nfc bool
+	// revalidate = check that cached DirIVs are still current before
+	// using them. Set by SetNetworkBackend().
+	revalidate bool
+	// dirIVAEAD encrypts and authenticates the gocryptfs.diriv files if
+	// the EncryptedDirIV feature flag is set, nil otherwise.
+	dirIVAEAD cipher.AEAD
+	// padTo = pad names to a multiple of this many bytes before encrypting
+	// them, 0 if disabled. Set by SetNamePadding().
+	padTo int
+	// nameMax = longest ciphertext name the backing filesystem can store.
+	// Longer names are hashed if longNames is set, and rejected otherwise.
+	// Set by SetNameMax().
+	nameMax int
+	// paranoid = re-read gocryptfs.diriv and compare it with the cached
+	// DirIV on every lookup. Set by SetParanoidDirIV().
+	paranoid bool
+	// dirIVReads coalesces concurrent reads of the same gocryptfs.diriv
+	// file in EncryptPathDirIV
+	dirIVReads singleflight.Group
 }
 
 // New returns a new NameTransform instance.
-func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
+func New(e *eme.EMECipher, longNames bool, raw64 bool, nfc bool) *NameTransform {
 	b64 := base64.URLEncoding
 	if raw64 {
 		b64 = base64.RawURLEncoding
@@ -33,7 +63,107 @@ func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
 		emeCipher: e,
 		longNames: longNames,
 		B64:       b64,
+		nfc:       nfc,
+		nameMax:   syscall.NAME_MAX,
+	}
+}
+
+// networkExpireTime is the DirIV cache expiry time for "-network-backend"
+const networkExpireTime = 100 * time.Millisecond
+
+// SetNetworkBackend prepares the NameTransform for a CIPHERDIR on a network
+// filesystem that other clients may modify: DirIVs expire from the cache
+// faster, and cached DirIVs are revalidated against the mtime, size and inode
+// number of their gocryptfs.diriv file before they are used.
+// Must be called before the NameTransform is used.
+func (n *NameTransform) SetNetworkBackend() {
+	n.revalidate = true
+	n.DirIVCache.SetExpireTime(networkExpireTime)
+}
+
+// SetParanoidDirIV makes the NameTransform check cached DirIVs against the
+// gocryptfs.diriv file on disk before every use, see CheckDirIVAt. This
+// catches corruption and tampering at the price of one read per lookup.
+// Must be called before the NameTransform is used.
+func (n *NameTransform) SetParanoidDirIV() {
+	n.paranoid = true
+}
+
+// SetDirIVCipher makes the NameTransform store gocryptfs.diriv files
+// encrypted and authenticated with "aead", see cryptocore.NewDirIVAEAD.
+// Corresponds to the EncryptedDirIV feature flag.
+// Must be called before the NameTransform is used.
+func (n *NameTransform) SetDirIVCipher(aead cipher.AEAD) {
+	n.dirIVAEAD = aead
+}
+
+// SetNameMax sets the longest ciphertext name the backing filesystem can
+// store. Names are hashed or rejected at this length instead of 255 bytes.
+// With long names, it must be at least MinNameMax.
+// Must be called before the NameTransform is used.
+//
+// This changes the ciphertext names of existing files whose encrypted name
+// is longer than "nameMax", so it must stay the same for a CIPHERDIR. Such
+// names cannot exist on the backing filesystem anyway.
+func (n *NameTransform) SetNameMax(nameMax int) {
+	if nameMax < 1 || nameMax > syscall.NAME_MAX || n.longNames && nameMax < MinNameMax {
+		log.Panicf("invalid nameMax %d", nameMax)
+	}
+	n.nameMax = nameMax
+}
+
+// maxPaddedNameLen is the padded length of the longest possible name
+// (255 bytes, padded to 16).
+const maxPaddedNameLen = 256
+
+// CheckNamePadding returns an error if "padTo" is not a valid name padding:
+// a multiple of 16 between 32 and 256.
+func CheckNamePadding(padTo int) error {
+	if padTo < 32 || padTo > maxPaddedNameLen || padTo%aes.BlockSize != 0 {
+		return fmt.Errorf("name padding %d is not a multiple of 16 between 32 and %d", padTo, maxPaddedNameLen)
+	}
+	return nil
+}
+
+// SetNamePadding makes the NameTransform pad names to a multiple of "padTo"
+// bytes before encrypting them, so that the ciphertext length only reveals
+// the length class of the name. See CheckNamePadding for valid values.
+// Corresponds to the NamePadding feature flag.
+// Must be called before the NameTransform is used.
+func (n *NameTransform) SetNamePadding(padTo int) {
+	if err := CheckNamePadding(padTo); err != nil {
+		log.Panic(err)
+	}
+	n.padTo = padTo
+}
+
+// padName fills "bin" up with null bytes so that, after pad16 has added the
+// final byte, its length is a multiple of n.padTo. Names never contain null
+// bytes, so unPadName can strip them again.
+//
+// The length is capped at maxPaddedNameLen. Otherwise, a padTo that is not
+// a power of two could take long names beyond what readLongNameFd accepts
+// in the ".name" files. All names that are padded to maxPaddedNameLen
+// become long names anyway.
+func (n *NameTransform) padName(bin []byte) []byte {
+	l := (len(bin)/n.padTo + 1) * n.padTo
+	if l > maxPaddedNameLen {
+		l = maxPaddedNameLen
 	}
+	return append(bin, make([]byte, l-1-len(bin))...)
+}
+
+// unPadName strips the null bytes added by padName. "bin" has already been
+// unPad16'ed, so its length must be one less than a padded length.
+func (n *NameTransform) unPadName(bin []byte) ([]byte, error) {
+	if (len(bin)+1)%n.padTo != 0 && len(bin)+1 != maxPaddedNameLen {
+		return nil, syscall.EBADMSG
+	}
+	bin = bytes.TrimRight(bin, "\x00")
+	if len(bin) == 0 {
+		return nil, syscall.EBADMSG
+	}
+	return bin, nil
 }
 
 // DecryptName decrypts a base64-encoded encrypted filename "cipherName" using the
@@ -60,6 +190,13 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 		// a generic error.
 		return "", syscall.EBADMSG
 	}
+	if n.padTo > 0 {
+		bin, err = n.unPadName(bin)
+		if err != nil {
+			tlog.Debug.Printf("DecryptName: invalid name padding")
+			return "", err
+		}
+	}
 	// A name can never contain a null byte or "/". Make sure we never return those
 	// to the kernel, even when we read a corrupted (or fuzzed) filesystem.
 	if bytes.Contains(bin, []byte{0}) || bytes.Contains(bin, []byte("/")) {
@@ -76,11 +213,19 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 // EncryptName encrypts "plainName", returns a base64-encoded "cipherName64".
 // Used internally by EncryptPathDirIV().
 // The encryption is either CBC or EME, depending on "useEME".
+// With the NFCNames feature flag, "plainName" is normalized to NFC first, so
+// that NFC and NFD forms of the same name map to the same ciphertext.
 //
 // This function is exported because fusefrontend needs access to the full (not hashed)
 // name if longname is used. Otherwise you should use EncryptPathDirIV()
 func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 string) {
+	if n.nfc {
+		plainName = norm.NFC.String(plainName)
+	}
 	bin := []byte(plainName)
+	if n.padTo > 0 {
+		bin = n.padName(bin)
+	}
 	bin = pad16(bin)
 	bin = n.emeCipher.Encrypt(iv, bin)
 	cipherName64 = n.B64.EncodeToString(bin)
@@ -2,7 +2,10 @@ package nametransform
 
 import (
 	"bytes"
+	"crypto/aes"
 	"testing"
+
+	"github.com/rfjakob/eme"
 )
 
 func TestPad16(t *testing.T) {
@@ -49,3 +52,81 @@ func TestUnpad16Garbage(t *testing.T) {
 		}
 	}
 }
+
+// TestEncryptNameNFC checks that the NFC and NFD forms of a name encrypt to
+// the same ciphertext with nfc enabled, and to different ones without.
+func TestEncryptNameNFC(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, DirIVLen)
+	nfcName := "caf\u00e9"  // "e" with acute accent as one code point
+	nfdName := "cafe\u0301" // "e" followed by a combining acute accent
+	n := New(eme.New(bc), true, true, true)
+	if n.EncryptName(nfcName, iv) != n.EncryptName(nfdName, iv) {
+		t.Error("NFC and NFD forms should encrypt identically")
+	}
+	plain, err := n.DecryptName(n.EncryptName(nfdName, iv), iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != nfcName {
+		t.Errorf("decrypted name should be in NFC form, got %q", plain)
+	}
+	n = New(eme.New(bc), true, true, false)
+	if n.EncryptName(nfcName, iv) == n.EncryptName(nfdName, iv) {
+		t.Error("names should not be normalized without nfc")
+	}
+}
+
+// TestNamePadding checks that names of different lengths encrypt to the same
+// ciphertext length with name padding, and that they still decrypt.
+func TestNamePadding(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, DirIVLen)
+	n := New(eme.New(bc), true, true, false)
+	n.SetNamePadding(64)
+	// Padded length => plaintext name lengths
+	classes := map[int][]int{
+		64:  {1, 2, 15, 16, 17, 40, 63},
+		128: {64, 65, 100, 127},
+		192: {128, 191},
+		256: {192, 200, 254, 255},
+	}
+	for padded, lengths := range classes {
+		want := n.B64.EncodedLen(padded)
+		for _, l := range lengths {
+			name := string(bytes.Repeat([]byte("x"), l))
+			cName := n.EncryptName(name, iv)
+			if len(cName) != want {
+				t.Errorf("name length %d: want ciphertext length %d, got %d", l, want, len(cName))
+			}
+			plain, err := n.DecryptName(cName, iv)
+			if err != nil || plain != name {
+				t.Errorf("name length %d: round-trip failed: %q, %v", l, plain, err)
+			}
+		}
+	}
+	// With a padding that does not divide 256, the longest names are
+	// capped at 256 bytes
+	n.SetNamePadding(48)
+	for _, l := range []int{240, 250, 255} {
+		name := string(bytes.Repeat([]byte("x"), l))
+		cName := n.EncryptName(name, iv)
+		if len(cName) != n.B64.EncodedLen(256) {
+			t.Errorf("name length %d: wrong ciphertext length %d", l, len(cName))
+		}
+		if plain, err := n.DecryptName(cName, iv); err != nil || plain != name {
+			t.Errorf("name length %d: round-trip failed: %q, %v", l, plain, err)
+		}
+	}
+	// Names without the padding are rejected
+	n2 := New(eme.New(bc), true, true, false)
+	if _, err := n.DecryptName(n2.EncryptName("foo", iv), iv); err == nil {
+		t.Error("unpadded name should have been rejected")
+	}
+}
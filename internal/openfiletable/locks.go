@@ -0,0 +1,143 @@
+package openfiletable
+
+import (
+	"sync"
+	"syscall"
+)
+
+// Lock is a byte range lock held by "Owner" on the bytes Start...End
+// (inclusive).
+type Lock struct {
+	Owner uint64
+	Start uint64
+	End   uint64
+	// Typ is syscall.F_RDLCK or syscall.F_WRLCK
+	Typ uint32
+	Pid uint32
+}
+
+// overlaps returns true if "l" and the range start...end share at least
+// one byte.
+func (l *Lock) overlaps(start uint64, end uint64) bool {
+	return l.Start <= end && start <= l.End
+}
+
+// conflicts returns true if "l" prevents "owner" from taking a lock of type
+// "typ" on start...end.
+func (l *Lock) conflicts(owner uint64, start uint64, end uint64, typ uint32) bool {
+	if l.Owner == owner || !l.overlaps(start, end) {
+		return false
+	}
+	return l.Typ == syscall.F_WRLCK || typ == syscall.F_WRLCK
+}
+
+// LockTable coordinates byte range locks between all open handles of one
+// file, following POSIX record lock semantics: a new lock replaces the
+// owner's own locks in the same range, and unlocking part of a range splits
+// the lock. Whole-file locks are locks on 0...math.MaxUint64.
+// The zero value is ready to use.
+type LockTable struct {
+	mu sync.Mutex
+	// changed is lazily initialized and closed (and cleared) whenever the
+	// locks change, waking up blocked Wait() callers.
+	changed chan struct{}
+	locks   []Lock
+}
+
+// Conflict returns the first lock that prevents "owner" from taking a lock
+// of type "typ" on start...end, or nil if there is none.
+func (lt *LockTable) Conflict(owner uint64, start uint64, end uint64, typ uint32) *Lock {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.conflict(owner, start, end, typ)
+}
+
+func (lt *LockTable) conflict(owner uint64, start uint64, end uint64, typ uint32) *Lock {
+	for i := range lt.locks {
+		if lt.locks[i].conflicts(owner, start, end, typ) {
+			l := lt.locks[i]
+			return &l
+		}
+	}
+	return nil
+}
+
+// TryLock takes (or, if l.Typ is syscall.F_UNLCK, releases) the lock "l".
+// It returns false without changing anything if a conflicting lock is held
+// by another owner.
+func (lt *LockTable) TryLock(l Lock) bool {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if l.Typ != syscall.F_UNLCK && lt.conflict(l.Owner, l.Start, l.End, l.Typ) != nil {
+		return false
+	}
+	lt.set(l)
+	return true
+}
+
+// Wait is like TryLock but blocks until the lock can be taken. It returns
+// false without taking the lock if "cancel" is closed first.
+func (lt *LockTable) Wait(l Lock, cancel <-chan struct{}) bool {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for {
+		select {
+		case <-cancel:
+			return false
+		default:
+		}
+		if l.Typ == syscall.F_UNLCK || lt.conflict(l.Owner, l.Start, l.End, l.Typ) == nil {
+			break
+		}
+		if lt.changed == nil {
+			lt.changed = make(chan struct{})
+		}
+		changed := lt.changed
+		lt.mu.Unlock()
+		select {
+		case <-changed:
+		case <-cancel:
+		}
+		lt.mu.Lock()
+	}
+	lt.set(l)
+	return true
+}
+
+// UnlockAll releases all locks held by "owner".
+func (lt *LockTable) UnlockAll(owner uint64) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.set(Lock{Owner: owner, Start: 0, End: ^uint64(0), Typ: syscall.F_UNLCK})
+}
+
+// set removes the owner's locks in l.Start...l.End, splitting locks that
+// extend beyond the range, and adds "l" unless it is an unlock.
+// Caller must hold lt.mu.
+func (lt *LockTable) set(l Lock) {
+	var out []Lock
+	for _, o := range lt.locks {
+		if o.Owner != l.Owner || !o.overlaps(l.Start, l.End) {
+			out = append(out, o)
+			continue
+		}
+		if o.Start < l.Start {
+			head := o
+			head.End = l.Start - 1
+			out = append(out, head)
+		}
+		if o.End > l.End {
+			tail := o
+			tail.Start = l.End + 1
+			out = append(out, tail)
+		}
+	}
+	if l.Typ != syscall.F_UNLCK {
+		out = append(out, l)
+	}
+	lt.locks = out
+	if lt.changed != nil {
+		close(lt.changed)
+		lt.changed = nil
+	}
+}
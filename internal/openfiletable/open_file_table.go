@@ -69,6 +69,24 @@ type Entry struct {
 	HeaderLock sync.RWMutex
 	// ID is the file ID in the file header.
 	ID []byte
+	// PosixLocks holds the fcntl() record locks on the file.
+	PosixLocks LockTable
+	// Flocks holds the flock() locks on the file. These are independent of
+	// the fcntl() locks, like on Linux.
+	Flocks LockTable
+	// Number of file handles that may write to the file. Protected by the
+	// table lock.
+	writers int
+	// IntentLoaded says if Durable has been loaded from the "-write-intent"
+	// record of the file. Both are protected by ContentLock.
+	IntentLoaded bool
+	// Durable is the plaintext size up to which the file content is known
+	// to be on disk, see fusefrontend/write_intent.go.
+	Durable uint64
+	// ChecksumStale says that the "-checksum" xattr has been removed
+	// because the content has changed, see fusefrontend/checksum.go.
+	// Protected by ContentLock.
+	ChecksumStale bool
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
@@ -99,6 +117,45 @@ func Unregister(qi QIno) {
 	}
 }
 
+// RegisterWriter marks one of the file handles of "qi" as writable. Call
+// UnregisterWriter before Unregister.
+func RegisterWriter(qi QIno) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.entries[qi].writers++
+}
+
+// UnregisterWriter undoes RegisterWriter.
+func UnregisterWriter(qi QIno) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.entries[qi].writers--
+}
+
+// Writers returns the number of writable file handles of "qi".
+func Writers(qi QIno) int {
+	t.Lock()
+	defer t.Unlock()
+
+	e := t.entries[qi]
+	if e == nil {
+		return 0
+	}
+	return e.writers
+}
+
+// IsOpenForWrite returns true if the file "qi" is currently open through a
+// writable file handle.
+func IsOpenForWrite(qi QIno) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	e := t.entries[qi]
+	return e != nil && e.writers > 0
+}
+
 // countingMutex incrementes t.writeLockCount on each Lock() call.
 type countingMutex struct {
 	sync.Mutex
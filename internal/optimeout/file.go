@@ -0,0 +1,133 @@
+package optimeout
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// file wraps the files opened through FS. The byte range locks are not
+// wrapped, as waiting for a lock is not a hung backend.
+type file struct {
+	nodefs.File
+	fs *FS
+	// Plaintext path at the time the file was opened
+	path string
+}
+
+// Read implements nodefs.File. The backend reads into its own buffer, as
+// "buf" is reused once we have returned.
+func (f *file) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	var res fuse.ReadResult
+	var code fuse.Status
+	if !f.fs.run("Read", f.path, func() {
+		res, code = f.File.Read(make([]byte, len(buf)), off)
+		if code.Ok() {
+			// The result may point to a file descriptor that is only
+			// read from later. Get the bytes while we are still waited for.
+			var data []byte
+			data, code = res.Bytes(make([]byte, len(buf)))
+			res.Done()
+			res = fuse.ReadResultData(data)
+		}
+	}) {
+		return nil, fuse.EIO
+	}
+	return res, code
+}
+
+// Write implements nodefs.File. The backend gets a copy of "data", as it
+// is reused once we have returned.
+func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	dataCopy := append([]byte(nil), data...)
+	var n uint32
+	var code fuse.Status
+	if !f.fs.run("Write", f.path, func() { n, code = f.File.Write(dataCopy, off) }) {
+		return 0, fuse.EIO
+	}
+	return n, code
+}
+
+// Flush implements nodefs.File.
+func (f *file) Flush() fuse.Status {
+	var code fuse.Status
+	if !f.fs.run("Flush", f.path, func() { code = f.File.Flush() }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Release implements nodefs.File. There is no error to return, but the
+// kernel still waits for the answer.
+func (f *file) Release() {
+	f.fs.run("Release", f.path, f.File.Release)
+}
+
+// Fsync implements nodefs.File.
+func (f *file) Fsync(flags int) fuse.Status {
+	var code fuse.Status
+	if !f.fs.run("Fsync", f.path, func() { code = f.File.Fsync(flags) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Truncate implements nodefs.File.
+func (f *file) Truncate(size uint64) fuse.Status {
+	var code fuse.Status
+	if !f.fs.run("Truncate", f.path, func() { code = f.File.Truncate(size) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// GetAttr implements nodefs.File. The backend fills in its own fuse.Attr.
+func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
+	var attr fuse.Attr
+	var code fuse.Status
+	if !f.fs.run("GetAttr", f.path, func() { code = f.File.GetAttr(&attr) }) {
+		return fuse.EIO
+	}
+	if code.Ok() {
+		*a = attr
+	}
+	return code
+}
+
+// Chown implements nodefs.File.
+func (f *file) Chown(uid uint32, gid uint32) fuse.Status {
+	var code fuse.Status
+	if !f.fs.run("Chown", f.path, func() { code = f.File.Chown(uid, gid) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Chmod implements nodefs.File.
+func (f *file) Chmod(mode uint32) fuse.Status {
+	var code fuse.Status
+	if !f.fs.run("Chmod", f.path, func() { code = f.File.Chmod(mode) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Utimens implements nodefs.File.
+func (f *file) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	a, m = copyTime(a), copyTime(m)
+	var code fuse.Status
+	if !f.fs.run("Utimens", f.path, func() { code = f.File.Utimens(a, m) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Allocate implements nodefs.File.
+func (f *file) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	var code fuse.Status
+	if !f.fs.run("Allocate", f.path, func() { code = f.File.Allocate(off, size, mode) }) {
+		return fuse.EIO
+	}
+	return code
+}
@@ -0,0 +1,345 @@
+// Package optimeout wraps a pathfs.FileSystem and gives up on operations
+// that take longer than a timeout ("-op-timeout"). They fail with EIO, so
+// that a hung backing call, for example on a network filesystem that has
+// gone away, does not block the FUSE request forever and the filesystem
+// can still be unmounted.
+//
+// A backing syscall cannot be interrupted from Go, so the abandoned call
+// keeps running in its goroutine and its result is discarded, except that a
+// file opened too late is released again. It gets its own copies of the
+// buffers and the request context, as go-fuse reuses them once the request
+// has been answered.
+package optimeout
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// logf reports the abandoned operations. This is not a warning, as
+// "-wpanic" must not turn a hung backend into a crash.
+var logf = tlog.Info.Printf
+
+// FS fails the operations on the wrapped pathfs.FileSystem, and on the files
+// opened through it, with EIO when they take longer than the timeout.
+type FS struct {
+	pathfs.FileSystem
+	timeout time.Duration
+}
+
+var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
+
+// NewFS wraps "fs". Operations that take longer than "timeout" fail with EIO.
+func NewFS(fs pathfs.FileSystem, timeout time.Duration) *FS {
+	return &FS{
+		FileSystem: fs,
+		timeout:    timeout,
+	}
+}
+
+// run calls "op" in a new goroutine and waits at most fs.timeout for it to
+// return. Returns false if it did not, after logging the operation "opName"
+// on the plaintext path "path". "op" must only write to variables that the
+// caller does not look at after a timeout.
+func (fs *FS) run(opName string, path string, op func()) bool {
+	done := make(chan struct{})
+	go func() {
+		op()
+		close(done)
+	}()
+	timer := time.NewTimer(fs.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		logf("operation timed out: %s %q did not return within %v, failing it with EIO", opName, path, fs.timeout)
+		return false
+	}
+}
+
+// runOpen is run for Open and Create. If the backend opens the file after
+// the timeout, the kernel never learns about it and never releases it. So
+// the goroutine keeps waiting and releases the file itself.
+func (fs *FS) runOpen(opName string, path string, op func() (nodefs.File, fuse.Status)) (nodefs.File, fuse.Status) {
+	type result struct {
+		f    nodefs.File
+		code fuse.Status
+	}
+	results := make(chan result)
+	abandoned := make(chan struct{})
+	go func() {
+		f, code := op()
+		select {
+		case results <- result{f, code}:
+		case <-abandoned:
+			if code.Ok() && f != nil {
+				logf("operation timed out: %s %q succeeded late, releasing the file", opName, path)
+				f.Release()
+			}
+		}
+	}()
+	timer := time.NewTimer(fs.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.f, r.code
+	case <-timer.C:
+		close(abandoned)
+		logf("operation timed out: %s %q did not return within %v, failing it with EIO", opName, path, fs.timeout)
+		return nil, fuse.EIO
+	}
+}
+
+// copyContext returns a copy of "context" that stays valid after the
+// request has been answered.
+func copyContext(context *fuse.Context) *fuse.Context {
+	if context == nil {
+		return nil
+	}
+	c := *context
+	return &c
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// GetAttr implements pathfs.Filesystem.
+func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	ctx := copyContext(context)
+	var out *fuse.Attr
+	var code fuse.Status
+	if !fs.run("GetAttr", name, func() { out, code = fs.FileSystem.GetAttr(name, ctx) }) {
+		return nil, fuse.EIO
+	}
+	return out, code
+}
+
+// Chmod implements pathfs.Filesystem.
+func (fs *FS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Chmod", name, func() { code = fs.FileSystem.Chmod(name, mode, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Chown implements pathfs.Filesystem.
+func (fs *FS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Chown", name, func() { code = fs.FileSystem.Chown(name, uid, gid, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Utimens implements pathfs.Filesystem.
+func (fs *FS) Utimens(name string, a *time.Time, m *time.Time, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	a, m = copyTime(a), copyTime(m)
+	var code fuse.Status
+	if !fs.run("Utimens", name, func() { code = fs.FileSystem.Utimens(name, a, m, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Truncate implements pathfs.Filesystem.
+func (fs *FS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Truncate", name, func() { code = fs.FileSystem.Truncate(name, size, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Access implements pathfs.Filesystem.
+func (fs *FS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Access", name, func() { code = fs.FileSystem.Access(name, mode, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Link implements pathfs.Filesystem.
+func (fs *FS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Link", newName, func() { code = fs.FileSystem.Link(oldName, newName, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Mkdir implements pathfs.Filesystem.
+func (fs *FS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Mkdir", name, func() { code = fs.FileSystem.Mkdir(name, mode, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Mknod implements pathfs.Filesystem.
+func (fs *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Mknod", name, func() { code = fs.FileSystem.Mknod(name, mode, dev, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Rename implements pathfs.Filesystem.
+func (fs *FS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Rename", oldName, func() { code = fs.FileSystem.Rename(oldName, newName, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Rmdir implements pathfs.Filesystem.
+func (fs *FS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Rmdir", name, func() { code = fs.FileSystem.Rmdir(name, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Unlink implements pathfs.Filesystem.
+func (fs *FS) Unlink(name string, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Unlink", name, func() { code = fs.FileSystem.Unlink(name, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// GetXAttr implements pathfs.Filesystem.
+func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	ctx := copyContext(context)
+	var out []byte
+	var code fuse.Status
+	if !fs.run("GetXAttr", name, func() { out, code = fs.FileSystem.GetXAttr(name, attr, ctx) }) {
+		return nil, fuse.EIO
+	}
+	return out, code
+}
+
+// ListXAttr implements pathfs.Filesystem.
+func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	ctx := copyContext(context)
+	var out []string
+	var code fuse.Status
+	if !fs.run("ListXAttr", name, func() { out, code = fs.FileSystem.ListXAttr(name, ctx) }) {
+		return nil, fuse.EIO
+	}
+	return out, code
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("RemoveXAttr", name, func() { code = fs.FileSystem.RemoveXAttr(name, attr, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// SetXAttr implements pathfs.Filesystem.
+func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	dataCopy := append([]byte(nil), data...)
+	var code fuse.Status
+	if !fs.run("SetXAttr", name, func() { code = fs.FileSystem.SetXAttr(name, attr, dataCopy, flags, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// OpenDir implements pathfs.Filesystem.
+func (fs *FS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	ctx := copyContext(context)
+	var out []fuse.DirEntry
+	var code fuse.Status
+	if !fs.run("OpenDir", name, func() { out, code = fs.FileSystem.OpenDir(name, ctx) }) {
+		return nil, fuse.EIO
+	}
+	return out, code
+}
+
+// Symlink implements pathfs.Filesystem.
+func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	ctx := copyContext(context)
+	var code fuse.Status
+	if !fs.run("Symlink", linkName, func() { code = fs.FileSystem.Symlink(target, linkName, ctx) }) {
+		return fuse.EIO
+	}
+	return code
+}
+
+// Readlink implements pathfs.Filesystem.
+func (fs *FS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	ctx := copyContext(context)
+	var out string
+	var code fuse.Status
+	if !fs.run("Readlink", name, func() { out, code = fs.FileSystem.Readlink(name, ctx) }) {
+		return "", fuse.EIO
+	}
+	return out, code
+}
+
+// Open implements pathfs.Filesystem.
+func (fs *FS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	ctx := copyContext(context)
+	f, code := fs.runOpen("Open", name, func() (nodefs.File, fuse.Status) {
+		return fs.FileSystem.Open(name, flags, ctx)
+	})
+	if !code.Ok() {
+		return nil, code
+	}
+	return &file{File: f, fs: fs, path: name}, fuse.OK
+}
+
+// Create implements pathfs.Filesystem.
+func (fs *FS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	ctx := copyContext(context)
+	f, code := fs.runOpen("Create", name, func() (nodefs.File, fuse.Status) {
+		return fs.FileSystem.Create(name, flags, mode, ctx)
+	})
+	if !code.Ok() {
+		return nil, code
+	}
+	return &file{File: f, fs: fs, path: name}, fuse.OK
+}
+
+// StatFs implements pathfs.Filesystem.
+func (fs *FS) StatFs(name string) *fuse.StatfsOut {
+	var out *fuse.StatfsOut
+	if !fs.run("StatFs", name, func() { out = fs.FileSystem.StatFs(name) }) {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,166 @@
+package optimeout
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const timeout = 50 * time.Millisecond
+
+// hangFS is a backing filesystem where everything below "hang" blocks until
+// "release" is closed.
+type hangFS struct {
+	pathfs.FileSystem
+	release chan struct{}
+}
+
+func (fs *hangFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	switch name {
+	case "":
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}, fuse.OK
+	case "hang":
+		<-fs.release
+	}
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0644}, fuse.OK
+}
+
+func (fs *hangFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return &hangFile{nodefs.NewDefaultFile(), fs.release}, fuse.OK
+}
+
+type hangFile struct {
+	nodefs.File
+	release chan struct{}
+}
+
+func (f *hangFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	<-f.release
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+// captureLog replaces logf and returns the logged lines. Call the returned
+// function to restore logf.
+func captureLog(lines chan<- string) func() {
+	orig := logf
+	logf = func(format string, v ...interface{}) {
+		lines <- fmt.Sprintf(format, v...)
+	}
+	return func() { logf = orig }
+}
+
+// TestTimeout checks that hung operations fail with EIO after the timeout,
+// and that the others are passed through.
+func TestTimeout(t *testing.T) {
+	lines := make(chan string, 10)
+	defer captureLog(lines)()
+	backing := &hangFS{pathfs.NewDefaultFileSystem(), make(chan struct{})}
+	defer close(backing.release)
+	fs := NewFS(backing, timeout)
+
+	if _, code := fs.GetAttr("foo", &fuse.Context{}); !code.Ok() {
+		t.Errorf("GetAttr: %v", code)
+	}
+	if code := fs.Access("foo", 0, &fuse.Context{}); code != fuse.ENOSYS {
+		t.Errorf("Access: want ENOSYS, got %v", code)
+	}
+	start := time.Now()
+	if a, code := fs.GetAttr("hang", &fuse.Context{}); code != fuse.EIO || a != nil {
+		t.Errorf("GetAttr: want EIO, got %v", code)
+	}
+	f, code := fs.Open("foo", 0, &fuse.Context{})
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Read(make([]byte, 10), 0); code != fuse.EIO {
+		t.Errorf("Read: want EIO, got %v", code)
+	}
+	if d := time.Since(start); d > 20*timeout {
+		t.Errorf("took %v", d)
+	}
+	if len(lines) != 2 {
+		t.Errorf("want 2 log lines, got %d", len(lines))
+	}
+}
+
+// lateFS is a backing filesystem where Open blocks until "release" is
+// closed. The file it returns closes "released" when it is released.
+type lateFS struct {
+	pathfs.FileSystem
+	release  chan struct{}
+	released chan struct{}
+}
+
+func (fs *lateFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	<-fs.release
+	return &lateFile{nodefs.NewDefaultFile(), fs.released}, fuse.OK
+}
+
+type lateFile struct {
+	nodefs.File
+	released chan struct{}
+}
+
+func (f *lateFile) Release() {
+	close(f.released)
+}
+
+// TestLateOpen checks that a file the backend opens after the timeout is
+// released again.
+func TestLateOpen(t *testing.T) {
+	lines := make(chan string, 10)
+	defer captureLog(lines)()
+	backing := &lateFS{pathfs.NewDefaultFileSystem(), make(chan struct{}), make(chan struct{})}
+	fs := NewFS(backing, timeout)
+
+	if f, code := fs.Open("foo", 0, &fuse.Context{}); code != fuse.EIO || f != nil {
+		t.Fatalf("Open: want EIO, got %v", code)
+	}
+	close(backing.release)
+	select {
+	case <-backing.released:
+	case <-time.After(20 * timeout):
+		t.Error("the late file was not released")
+	}
+}
+
+// TestUnmount checks that a mount whose backend hangs can still be
+// unmounted.
+func TestUnmount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip(err)
+	}
+	lines := make(chan string, 10)
+	defer captureLog(lines)()
+	backing := &hangFS{pathfs.NewDefaultFileSystem(), make(chan struct{})}
+	defer close(backing.release)
+	mnt, err := ioutil.TempDir("", "gocryptfs-optimeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mnt)
+	pathFs := pathfs.NewPathNodeFs(NewFS(backing, timeout), nil)
+	conn := nodefs.NewFileSystemConnector(pathFs.Root(), &nodefs.Options{})
+	srv, err := fuse.NewServer(conn.RawFS(), mnt, &fuse.MountOptions{})
+	if err != nil {
+		t.Skipf("cannot mount: %v", err)
+	}
+	go srv.Serve()
+	if err = srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(mnt + "/hang")
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+		t.Errorf("stat: want EIO, got %v", err)
+	}
+	if err = srv.Unmount(); err != nil {
+		t.Errorf("unmount failed: %v", err)
+	}
+}
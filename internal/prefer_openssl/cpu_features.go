@@ -0,0 +1,42 @@
+package prefer_openssl
+
+import (
+	"io/ioutil"
+	"regexp"
+)
+
+// CPUFeatures says which crypto instructions the CPU has, according to
+// /proc/cpuinfo.
+type CPUFeatures struct {
+	// x86 AES instructions ("aes")
+	AESNI bool
+	// x86 carry-less multiplication, used by GCM ("pclmulqdq")
+	CLMUL bool
+	// ARMv8 AES instructions ("aes")
+	ARMAES bool
+	// ARMv8 polynomial multiplication, used by GCM ("pmull")
+	ARMPMULL bool
+}
+
+// GetCPUFeatures returns the crypto features of the CPU we are running on.
+// All features are false if /proc/cpuinfo cannot be read, like on MacOS.
+func GetCPUFeatures() CPUFeatures {
+	return fileCPUFeatures("/proc/cpuinfo")
+}
+
+// fileCPUFeatures parses the cpuinfo file "file". x86 lists the features
+// in the "flags" lines, ARM in the "Features" lines.
+func fileCPUFeatures(file string) (f CPUFeatures) {
+	ci, err := ioutil.ReadFile(file)
+	if err != nil {
+		return f
+	}
+	has := func(line string, feature string) bool {
+		return regexp.MustCompile(`(?m)^` + line + `\s*:.*\b` + feature + `\b`).Match(ci)
+	}
+	f.AESNI = has("flags", "aes")
+	f.CLMUL = has("flags", "pclmulqdq")
+	f.ARMAES = has("Features", "aes")
+	f.ARMPMULL = has("Features", "pmull")
+	return f
+}
@@ -21,3 +21,20 @@ func TestPentiumG630(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCPUFeatures(t *testing.T) {
+	testCases := []struct {
+		file string
+		want CPUFeatures
+	}{
+		{"cpuinfo.xeon_e312xx.txt", CPUFeatures{AESNI: true, CLMUL: true}},
+		{"cpuinfo.pentium_g630.txt", CPUFeatures{CLMUL: true}},
+		{"cpuinfo.cortex_a53.txt", CPUFeatures{ARMAES: true, ARMPMULL: true}},
+		{"nonexistent.txt", CPUFeatures{}},
+	}
+	for _, tc := range testCases {
+		if have := fileCPUFeatures(tc.file); have != tc.want {
+			t.Errorf("%s: want %+v, have %+v", tc.file, tc.want, have)
+		}
+	}
+}
@@ -16,7 +16,7 @@ func TestMain(m *testing.M) {
 
 func TestExtpass(t *testing.T) {
 	p1 := "ads2q4tw41reg52"
-	p2 := readPasswordExtpass("echo " + p1)
+	p2 := readPasswordExtpass("echo "+p1, false)
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -24,7 +24,7 @@ func TestExtpass(t *testing.T) {
 
 func TestOnceExtpass(t *testing.T) {
 	p1 := "lkadsf0923rdfi48rqwhdsf"
-	p2 := Once("echo " + p1)
+	p2 := Once("echo "+p1, "")
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -32,7 +32,7 @@ func TestOnceExtpass(t *testing.T) {
 
 func TestTwiceExtpass(t *testing.T) {
 	p1 := "w5w44t3wfe45srz434"
-	p2 := Once("echo " + p1)
+	p2 := Once("echo "+p1, "")
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -42,7 +42,7 @@ func TestTwiceExtpass(t *testing.T) {
 // https://talks.golang.org/2014/testing.slide#23
 func TestExtpassEmpty(t *testing.T) {
 	if os.Getenv("TEST_SLAVE") == "1" {
-		readPasswordExtpass("echo")
+		readPasswordExtpass("echo", false)
 		return
 	}
 	cmd := exec.Command(os.Args[0], "-test.run=TestExtpassEmpty$")
@@ -53,3 +53,29 @@ func TestExtpassEmpty(t *testing.T) {
 	}
 	t.Fatal("empty password should have failed")
 }
+
+// An empty password is accepted when unlocking, and when choosing a new
+// password with "-allow-empty-password".
+func TestExtpassEmptyAllowed(t *testing.T) {
+	if p := Once("echo", ""); p != "" {
+		t.Errorf("Once: want empty password, got %q", p)
+	}
+	if p := Twice("echo", "", true); p != "" {
+		t.Errorf("Twice: want empty password, got %q", p)
+	}
+}
+
+// Twice must reject an empty password by default.
+func TestTwiceEmpty(t *testing.T) {
+	if os.Getenv("TEST_SLAVE") == "1" {
+		Twice("echo", "", false)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestTwiceEmpty$")
+	cmd.Env = append(os.Environ(), "TEST_SLAVE=1")
+	err := cmd.Run()
+	if err != nil {
+		return
+	}
+	t.Fatal("empty password should have failed")
+}
@@ -0,0 +1,46 @@
+package readpassword
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestOncePassenv(t *testing.T) {
+	p1 := "9ahv0ahsheiD7chahf"
+	os.Setenv("GOCRYPTFS_TEST_PW", p1)
+	p2 := Once("", "GOCRYPTFS_TEST_PW")
+	if p1 != p2 {
+		t.Errorf("p1=%q != p2=%q", p1, p2)
+	}
+	// The variable must be gone after reading it
+	if _, ok := os.LookupEnv("GOCRYPTFS_TEST_PW"); ok {
+		t.Error("GOCRYPTFS_TEST_PW is still set")
+	}
+}
+
+// -passenv takes precedence over extpass
+func TestTwicePassenv(t *testing.T) {
+	p1 := "ooJ4aec3aeK1Ieth"
+	os.Setenv("GOCRYPTFS_TEST_PW", p1)
+	p2 := Twice("echo wrong", "GOCRYPTFS_TEST_PW", false)
+	if p1 != p2 {
+		t.Errorf("p1=%q != p2=%q", p1, p2)
+	}
+}
+
+// When the variable is not set, we should crash.
+func TestPassenvUnset(t *testing.T) {
+	if os.Getenv("TEST_SLAVE") == "1" {
+		os.Unsetenv("GOCRYPTFS_TEST_PW")
+		Once("", "GOCRYPTFS_TEST_PW")
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestPassenvUnset$")
+	cmd.Env = append(os.Environ(), "TEST_SLAVE=1")
+	err := cmd.Run()
+	if err != nil {
+		return
+	}
+	t.Fatal("unset variable should have failed")
+}
@@ -21,39 +21,54 @@ const (
 	maxPasswordLen = 2048
 )
 
-// Once tries to get a password from the user, either from the terminal, extpass
-// or stdin.
-func Once(extpass string) string {
+// Once tries to get a password from the user, either from the terminal, extpass,
+// the environment variable "passenv" or stdin.
+// Once may return an empty password, because the filesystem may have been
+// created with one (see Twice). The caller must handle a failed unlock with an
+// empty password.
+func Once(extpass string, passenv string) string {
+	if passenv != "" {
+		return readPasswordEnv(passenv, true)
+	}
 	if extpass != "" {
-		return readPasswordExtpass(extpass)
+		return readPasswordExtpass(extpass, true)
 	}
 	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
-		return readPasswordStdin()
+		return readPasswordStdin(true)
 	}
-	return readPasswordTerminal("Password: ")
+	return readPasswordTerminal("Password: ", true)
 }
 
 // Twice is the same as Once but will prompt twice if we get the password from
-// the terminal.
-func Twice(extpass string) string {
-	if extpass != "" {
-		return readPasswordExtpass(extpass)
-	}
-	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
-		return readPasswordStdin()
+// the terminal. It is used for choosing a new password, and exits on an empty
+// password unless "allowEmpty" is set ("-allow-empty-password").
+func Twice(extpass string, passenv string, allowEmpty bool) string {
+	var p string
+	if passenv != "" {
+		p = readPasswordEnv(passenv, allowEmpty)
+	} else if extpass != "" {
+		p = readPasswordExtpass(extpass, allowEmpty)
+	} else if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		p = readPasswordStdin(allowEmpty)
+	} else {
+		p1 := readPasswordTerminal("Password: ", allowEmpty)
+		p2 := readPasswordTerminal("Repeat: ", allowEmpty)
+		if p1 != p2 {
+			tlog.Fatal.Println("Passwords do not match")
+			os.Exit(exitcodes.ReadPassword)
+		}
+		p = p1
 	}
-	p1 := readPasswordTerminal("Password: ")
-	p2 := readPasswordTerminal("Repeat: ")
-	if p1 != p2 {
-		tlog.Fatal.Println("Passwords do not match")
-		os.Exit(exitcodes.ReadPassword)
+	if p == "" {
+		tlog.Warn.Println(tlog.ColorYellow + "WARNING: The password is empty. Anybody who can read " +
+			"CIPHERDIR can decrypt your files." + tlog.ColorReset)
 	}
-	return p1
+	return p
 }
 
 // readPasswordTerminal reads a line from the terminal.
-// Exits on read error or empty result.
-func readPasswordTerminal(prompt string) string {
+// Exits on read error, or on empty result unless "allowEmpty" is set.
+func readPasswordTerminal(prompt string, allowEmpty bool) string {
 	fd := int(os.Stdin.Fd())
 	fmt.Fprintf(os.Stderr, prompt)
 	// terminal.ReadPassword removes the trailing newline
@@ -63,7 +78,7 @@ func readPasswordTerminal(prompt string) string {
 		os.Exit(exitcodes.ReadPassword)
 	}
 	fmt.Fprintf(os.Stderr, "\n")
-	if len(p) == 0 {
+	if len(p) == 0 && !allowEmpty {
 		tlog.Fatal.Println("Password is empty")
 		os.Exit(exitcodes.PasswordEmpty)
 	}
@@ -71,11 +86,12 @@ func readPasswordTerminal(prompt string) string {
 }
 
 // readPasswordStdin reads a line from stdin.
-// It exits with a fatal error on read error or empty result.
-func readPasswordStdin() string {
+// It exits with a fatal error on read error, or on empty result unless
+// "allowEmpty" is set.
+func readPasswordStdin(allowEmpty bool) string {
 	tlog.Info.Println("Reading password from stdin")
 	p := readLineUnbuffered(os.Stdin)
-	if len(p) == 0 {
+	if len(p) == 0 && !allowEmpty {
 		tlog.Fatal.Println("Got empty password from stdin")
 		os.Exit(exitcodes.ReadPassword)
 	}
@@ -84,8 +100,8 @@ func readPasswordStdin() string {
 
 // readPasswordExtpass executes the "extpass" program and returns the first line
 // of the output.
-// Exits on read error or empty result.
-func readPasswordExtpass(extpass string) string {
+// Exits on read error, or on empty result unless "allowEmpty" is set.
+func readPasswordExtpass(extpass string, allowEmpty bool) string {
 	tlog.Info.Println("Reading password from extpass program")
 	var parts []string
 	// The option "-passfile=FILE" gets transformed to
@@ -116,13 +132,44 @@ func readPasswordExtpass(extpass string) string {
 		tlog.Fatal.Printf("extpass program returned an error: %v", err)
 		os.Exit(exitcodes.ReadPassword)
 	}
-	if len(p) == 0 {
+	if len(p) == 0 && !allowEmpty {
 		tlog.Fatal.Println("extpass: password is empty")
 		os.Exit(exitcodes.ReadPassword)
 	}
 	return p
 }
 
+// readPasswordEnv reads the password from the environment variable "name" and
+// removes the variable from the environment, so that programs we start later
+// do not inherit it.
+// Exits if the variable is not set, or on empty result unless "allowEmpty" is
+// set.
+func readPasswordEnv(name string, allowEmpty bool) string {
+	tlog.Info.Printf("Reading password from environment variable %s", name)
+	// Only an advisory, so it must not trip "-wpanic"
+	tlog.Info.Println(tlog.ColorYellow + "WARNING: Passing the password in an environment variable " +
+		"may expose it to other processes of the same user, to process listings and to core dumps. " +
+		"Prefer -extpass or -passfile." + tlog.ColorReset)
+	p, ok := os.LookupEnv(name)
+	if !ok {
+		tlog.Fatal.Printf("passenv: environment variable %s is not set", name)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	if err := os.Unsetenv(name); err != nil {
+		tlog.Fatal.Printf("passenv: could not unset %s: %v", name, err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	if len(p) > maxPasswordLen {
+		tlog.Fatal.Printf("fatal: maximum password length of %d bytes exceeded", maxPasswordLen)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	if len(p) == 0 && !allowEmpty {
+		tlog.Fatal.Println("passenv: password is empty")
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return p
+}
+
 // readLineUnbuffered reads single bytes from "r" util it gets "\n" or EOF.
 // The returned string does NOT contain the trailing "\n".
 func readLineUnbuffered(r io.Reader) (l string) {
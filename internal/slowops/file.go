@@ -0,0 +1,83 @@
+package slowops
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// file wraps the files opened through FS. The byte range locks are not
+// wrapped, as waiting for a lock is not slow storage.
+type file struct {
+	nodefs.File
+	fs *FS
+	// Plaintext path at the time the file was opened
+	path string
+}
+
+// Read implements nodefs.File.
+func (f *file) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	defer f.fs.done(time.Now(), "Read", f.path)
+	return f.File.Read(buf, off)
+}
+
+// Write implements nodefs.File.
+func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	defer f.fs.done(time.Now(), "Write", f.path)
+	return f.File.Write(data, off)
+}
+
+// Flush implements nodefs.File.
+func (f *file) Flush() fuse.Status {
+	defer f.fs.done(time.Now(), "Flush", f.path)
+	return f.File.Flush()
+}
+
+// Release implements nodefs.File.
+func (f *file) Release() {
+	defer f.fs.done(time.Now(), "Release", f.path)
+	f.File.Release()
+}
+
+// Fsync implements nodefs.File.
+func (f *file) Fsync(flags int) fuse.Status {
+	defer f.fs.done(time.Now(), "Fsync", f.path)
+	return f.File.Fsync(flags)
+}
+
+// Truncate implements nodefs.File.
+func (f *file) Truncate(size uint64) fuse.Status {
+	defer f.fs.done(time.Now(), "Truncate", f.path)
+	return f.File.Truncate(size)
+}
+
+// GetAttr implements nodefs.File.
+func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
+	defer f.fs.done(time.Now(), "GetAttr", f.path)
+	return f.File.GetAttr(a)
+}
+
+// Chown implements nodefs.File.
+func (f *file) Chown(uid uint32, gid uint32) fuse.Status {
+	defer f.fs.done(time.Now(), "Chown", f.path)
+	return f.File.Chown(uid, gid)
+}
+
+// Chmod implements nodefs.File.
+func (f *file) Chmod(mode uint32) fuse.Status {
+	defer f.fs.done(time.Now(), "Chmod", f.path)
+	return f.File.Chmod(mode)
+}
+
+// Utimens implements nodefs.File.
+func (f *file) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	defer f.fs.done(time.Now(), "Utimens", f.path)
+	return f.File.Utimens(a, m)
+}
+
+// Allocate implements nodefs.File.
+func (f *file) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	defer f.fs.done(time.Now(), "Allocate", f.path)
+	return f.File.Allocate(off, size, mode)
+}
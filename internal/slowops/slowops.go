@@ -0,0 +1,192 @@
+// Package slowops wraps a pathfs.FileSystem and logs every operation that
+// takes longer than a threshold ("-trace-slow-ops"). This helps to find
+// out which files and operations are affected when the backing storage
+// stalls, for example on a network filesystem.
+package slowops
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// logf prints the slow operations. This is not a warning, as "-wpanic"
+// must not turn a slow operation into a crash.
+var logf = tlog.Info.Printf
+
+// FS logs the operations on the wrapped pathfs.FileSystem, and on the files
+// opened through it, that take longer than the threshold.
+type FS struct {
+	pathfs.FileSystem
+	threshold time.Duration
+}
+
+var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
+
+// NewFS wraps "fs". Operations that take longer than "threshold" are logged.
+func NewFS(fs pathfs.FileSystem, threshold time.Duration) *FS {
+	return &FS{
+		FileSystem: fs,
+		threshold:  threshold,
+	}
+}
+
+// done logs the operation "op" on the plaintext "paths" if it has started
+// more than fs.threshold ago. Use as "defer fs.done(time.Now(), ...)".
+func (fs *FS) done(start time.Time, op string, paths ...string) {
+	d := time.Since(start)
+	if d <= fs.threshold {
+		return
+	}
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = fmt.Sprintf("%q", p)
+	}
+	logf("slow operation: %s %s took %v", op, strings.Join(quoted, " -> "), d)
+}
+
+// GetAttr implements pathfs.Filesystem.
+func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	defer fs.done(time.Now(), "GetAttr", name)
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+// Chmod implements pathfs.Filesystem.
+func (fs *FS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Chmod", name)
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+// Chown implements pathfs.Filesystem.
+func (fs *FS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Chown", name)
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+// Utimens implements pathfs.Filesystem.
+func (fs *FS) Utimens(name string, a *time.Time, m *time.Time, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Utimens", name)
+	return fs.FileSystem.Utimens(name, a, m, context)
+}
+
+// Truncate implements pathfs.Filesystem.
+func (fs *FS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Truncate", name)
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+// Access implements pathfs.Filesystem.
+func (fs *FS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Access", name)
+	return fs.FileSystem.Access(name, mode, context)
+}
+
+// Link implements pathfs.Filesystem.
+func (fs *FS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Link", oldName, newName)
+	return fs.FileSystem.Link(oldName, newName, context)
+}
+
+// Mkdir implements pathfs.Filesystem.
+func (fs *FS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Mkdir", name)
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+// Mknod implements pathfs.Filesystem.
+func (fs *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Mknod", name)
+	return fs.FileSystem.Mknod(name, mode, dev, context)
+}
+
+// Rename implements pathfs.Filesystem.
+func (fs *FS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Rename", oldName, newName)
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+// Rmdir implements pathfs.Filesystem.
+func (fs *FS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Rmdir", name)
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+// Unlink implements pathfs.Filesystem.
+func (fs *FS) Unlink(name string, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Unlink", name)
+	return fs.FileSystem.Unlink(name, context)
+}
+
+// GetXAttr implements pathfs.Filesystem.
+func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	defer fs.done(time.Now(), "GetXAttr", name)
+	return fs.FileSystem.GetXAttr(name, attr, context)
+}
+
+// ListXAttr implements pathfs.Filesystem.
+func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	defer fs.done(time.Now(), "ListXAttr", name)
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "RemoveXAttr", name)
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+// SetXAttr implements pathfs.Filesystem.
+func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "SetXAttr", name)
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+// Open implements pathfs.Filesystem.
+func (fs *FS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	defer fs.done(time.Now(), "Open", name)
+	f, code := fs.FileSystem.Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &file{File: f, fs: fs, path: name}, fuse.OK
+}
+
+// Create implements pathfs.Filesystem.
+func (fs *FS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	defer fs.done(time.Now(), "Create", name)
+	f, code := fs.FileSystem.Create(name, flags, mode, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &file{File: f, fs: fs, path: name}, fuse.OK
+}
+
+// OpenDir implements pathfs.Filesystem.
+func (fs *FS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	defer fs.done(time.Now(), "OpenDir", name)
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+// Symlink implements pathfs.Filesystem.
+func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	defer fs.done(time.Now(), "Symlink", linkName)
+	return fs.FileSystem.Symlink(target, linkName, context)
+}
+
+// Readlink implements pathfs.Filesystem.
+func (fs *FS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	defer fs.done(time.Now(), "Readlink", name)
+	return fs.FileSystem.Readlink(name, context)
+}
+
+// StatFs implements pathfs.Filesystem.
+func (fs *FS) StatFs(name string) *fuse.StatfsOut {
+	defer fs.done(time.Now(), "StatFs", name)
+	return fs.FileSystem.StatFs(name)
+}
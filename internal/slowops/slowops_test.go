@@ -0,0 +1,79 @@
+package slowops
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const delay = 50 * time.Millisecond
+
+// slowFS is a backing filesystem that takes "delay" for GetAttr and for
+// reading a file.
+type slowFS struct {
+	pathfs.FileSystem
+}
+
+func (fs *slowFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	time.Sleep(delay)
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0644}, fuse.OK
+}
+
+func (fs *slowFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return &slowFile{nodefs.NewDefaultFile()}, fuse.OK
+}
+
+type slowFile struct {
+	nodefs.File
+}
+
+func (f *slowFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	time.Sleep(delay)
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+// captureLog replaces logf and returns the logged lines. Call the returned
+// function to restore logf.
+func captureLog(lines *[]string) func() {
+	orig := logf
+	logf = func(format string, v ...interface{}) {
+		*lines = append(*lines, fmt.Sprintf(format, v...))
+	}
+	return func() { logf = orig }
+}
+
+// TestSlowOps checks that operations are logged if they take longer than
+// the threshold, and only then.
+func TestSlowOps(t *testing.T) {
+	var lines []string
+	defer captureLog(&lines)()
+	backing := &slowFS{pathfs.NewDefaultFileSystem()}
+
+	fs := NewFS(backing, delay/5)
+	fs.GetAttr("dir/foo", &fuse.Context{})
+	f, _ := fs.Open("dir/bar", 0, &fuse.Context{})
+	f.Read(make([]byte, 10), 0)
+	// Fast operations must not show up
+	fs.Access("dir/baz", 0, &fuse.Context{})
+	f.Flush()
+	if len(lines) != 2 {
+		t.Fatalf("want 2 log lines, got %d: %v", len(lines), lines)
+	}
+	if !strings.Contains(lines[0], `GetAttr "dir/foo"`) || !strings.Contains(lines[1], `Read "dir/bar"`) {
+		t.Errorf("wrong log lines: %v", lines)
+	}
+
+	lines = nil
+	fs = NewFS(backing, 10*delay)
+	fs.GetAttr("dir/foo", &fuse.Context{})
+	f, _ = fs.Open("dir/bar", 0, &fuse.Context{})
+	f.Read(make([]byte, 10), 0)
+	if len(lines) != 0 {
+		t.Errorf("below the threshold, nothing should be logged: %v", lines)
+	}
+}
@@ -39,6 +39,14 @@ func New(key []byte, forceDecode bool) cipher.AEAD {
 	return stupidGCM{key: key, forceDecode: forceDecode}
 }
 
+// Wipe overwrites the key with zeros. The object must not be used
+// afterwards.
+func (g stupidGCM) Wipe() {
+	for i := range g.key {
+		g.key[i] = 0
+	}
+}
+
 func (g stupidGCM) NonceSize() int {
 	return ivLen
 }
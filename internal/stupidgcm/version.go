@@ -0,0 +1,22 @@
+// +build !without_openssl
+
+package stupidgcm
+
+// #include <openssl/crypto.h>
+// #include <openssl/opensslv.h>
+// #cgo pkg-config: libcrypto
+//
+// static const char *openssl_version(void) {
+// #if OPENSSL_VERSION_NUMBER >= 0x10100000L
+// 	return OpenSSL_version(OPENSSL_VERSION);
+// #else
+// 	return SSLeay_version(SSLEAY_VERSION);
+// #endif
+// }
+import "C"
+
+// OpenSSLVersion returns the version string of the OpenSSL library we are
+// running with, like "OpenSSL 1.1.0g  2 Nov 2017".
+func OpenSSLVersion() string {
+	return C.GoString(C.openssl_version())
+}
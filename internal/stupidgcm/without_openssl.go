@@ -21,6 +21,11 @@ func errExit() {
 	os.Exit(exitcodes.OpenSSL)
 }
 
+// OpenSSLVersion returns an empty string as we have no OpenSSL
+func OpenSSLVersion() string {
+	return ""
+}
+
 func New(_ []byte, _ bool) stupidGCM {
 	errExit()
 	// Never reached
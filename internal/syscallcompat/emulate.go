@@ -151,6 +151,26 @@ func emulateFchmodat(dirfd int, path string, mode uint32, flags int) (err error)
 	return syscall.Chmod(path, mode)
 }
 
+// emulateFaccessat emulates the syscall for platforms that don't have it
+// in the kernel (darwin). Like access(2), it follows symlinks.
+func emulateFaccessat(dirfd int, path string, mode uint32) (err error) {
+	if !filepath.IsAbs(path) {
+		chdirMutex.Lock()
+		defer chdirMutex.Unlock()
+		cwd, err := syscall.Open(".", syscall.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(cwd)
+		err = syscall.Fchdir(dirfd)
+		if err != nil {
+			return err
+		}
+		defer syscall.Fchdir(cwd)
+	}
+	return syscall.Access(path, mode)
+}
+
 // emulateFchownat emulates the syscall for platforms that don't have it
 // in the kernel (darwin).
 func emulateFchownat(dirfd int, path string, uid int, gid int, flags int) (err error) {
@@ -1,6 +1,7 @@
 package syscallcompat
 
 import (
+	"io/ioutil"
 	"os"
 	"syscall"
 	"testing"
@@ -200,6 +201,24 @@ func TestEmulateFchmodat(t *testing.T) {
 	}
 }
 
+func TestEmulateFaccessat(t *testing.T) {
+	err := ioutil.WriteFile(tmpDir+"/access", nil, 0400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = emulateFaccessat(tmpDirFd, "access", unix.R_OK); err != nil {
+		t.Error(err)
+	}
+	if os.Getuid() != 0 {
+		if err = emulateFaccessat(tmpDirFd, "access", unix.W_OK); err != syscall.EACCES {
+			t.Errorf("want EACCES, got %v", err)
+		}
+	}
+	if err = emulateFaccessat(tmpDirFd, "access-missing", unix.F_OK); err != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+}
+
 func TestEmulateFchownat(t *testing.T) {
 	t.Skipf("TODO")
 }
@@ -90,6 +90,110 @@ func getdents(fd int) ([]fuse.DirEntry, error) {
 	return entries, nil
 }
 
+// getdentsChunk reads up to "max" entries of the directory "fd", starting at
+// "cookie". The cookie is 0 for the beginning of the directory, or the
+// "next" value of the previous call. An empty result means that the end has
+// been reached.
+//
+// The cookies are the d_off values of the backing filesystem, which keep
+// pointing to the same place when entries are added or removed elsewhere
+// (ext4 and xfs derive them from the name hash). Only one chunk of the
+// directory is in memory at a time.
+func getdentsChunk(fd int, cookie int64, max int) (entries []fuse.DirEntry, next int64, err error) {
+	if _, err = syscall.Seek(fd, cookie, 0); err != nil {
+		return nil, cookie, err
+	}
+	next = cookie
+	// Leave room for Sizeof(Dirent) zeros after the last entry, as in
+	// getdents()
+	buf := make([]byte, 8192+sizeofDirent)
+	for len(entries) < max {
+		n, err := syscall.Getdents(fd, buf[:8192])
+		if err != nil {
+			return nil, cookie, err
+		}
+		if n == 0 {
+			break
+		}
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		for offset := 0; offset < n && len(entries) < max; {
+			s := *(*syscall.Dirent)(unsafe.Pointer(&buf[offset]))
+			if s.Reclen == 0 || int(s.Reclen) > sizeofDirent {
+				tlog.Warn.Printf("getdentsChunk: corrupt entry: Reclen=%d at offset=%d. Returning EBADR",
+					s.Reclen, offset)
+				return nil, cookie, syscall.EBADR
+			}
+			offset += int(s.Reclen)
+			// Entries after this one have been read, but will be read
+			// again by the next call
+			next = s.Off
+			name, err := getdentsName(s)
+			if err != nil {
+				return nil, cookie, err
+			}
+			if name == "." || name == ".." {
+				continue
+			}
+			mode, err := convertDType(fd, name, s.Type)
+			if err != nil {
+				// Deleted in the meantime
+				continue
+			}
+			entries = append(entries, fuse.DirEntry{
+				Ino:  s.Ino,
+				Mode: mode,
+				Name: name,
+			})
+		}
+	}
+	return entries, next, nil
+}
+
+// firstDirEntry returns the name of the first entry of the directory "fd"
+// besides ".", ".." and the names in "ignore", or "" if there is none. It
+// stops reading at the first match, so it does not matter how large the
+// directory is.
+func firstDirEntry(fd int, ignore []string) (string, error) {
+	// Start from the beginning in case the fd has been read before
+	if _, err := syscall.Seek(fd, 0, 0); err != nil {
+		return "", err
+	}
+	// Leave room for Sizeof(Dirent) zeros after the last entry, as in
+	// getdents()
+	buf := make([]byte, 4096+sizeofDirent)
+	for {
+		n, err := syscall.Getdents(fd, buf[:4096])
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return "", nil
+		}
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		for offset := 0; offset < n; {
+			s := *(*syscall.Dirent)(unsafe.Pointer(&buf[offset]))
+			if s.Reclen == 0 || int(s.Reclen) > sizeofDirent {
+				tlog.Warn.Printf("firstDirEntry: corrupt entry: Reclen=%d at offset=%d. Returning EBADR",
+					s.Reclen, offset)
+				return "", syscall.EBADR
+			}
+			offset += int(s.Reclen)
+			name, err := getdentsName(s)
+			if err != nil {
+				return "", err
+			}
+			if name == "." || name == ".." || isIgnored(name, ignore) {
+				continue
+			}
+			return name, nil
+		}
+	}
+}
+
 // getdentsName extracts the filename from a Dirent struct and returns it as
 // a Go string.
 func getdentsName(s syscall.Dirent) (string, error) {
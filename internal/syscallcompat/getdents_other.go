@@ -1,6 +1,7 @@
 package syscallcompat
 
 import (
+	"io"
 	"os"
 	"syscall"
 
@@ -9,6 +10,65 @@ import (
 	"github.com/hanwen/go-fuse/fuse"
 )
 
+// emulateFirstDirEntry is the slow variant of firstDirEntry that goes
+// through os.File.Readdirnames().
+func emulateFirstDirEntry(fd int, ignore []string) (string, error) {
+	if _, err := syscall.Seek(fd, 0, 0); err != nil {
+		return "", err
+	}
+	newFd, err := syscall.Dup(fd)
+	if err != nil {
+		return "", err
+	}
+	f := os.NewFile(uintptr(newFd), "")
+	defer f.Close()
+	for {
+		names, err := f.Readdirnames(10)
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, name := range names {
+			if !isIgnored(name, ignore) {
+				return name, nil
+			}
+		}
+	}
+}
+
+// isIgnored returns true if "name" is in "ignore".
+func isIgnored(name string, ignore []string) bool {
+	for _, i := range ignore {
+		if name == i {
+			return true
+		}
+	}
+	return false
+}
+
+// emulateGetdentsChunk is the slow variant of getdentsChunk. It reads the
+// whole directory every time, and the cookie is just the index of the next
+// entry, which is not stable when the directory changes.
+func emulateGetdentsChunk(fd int, cookie int64, max int) ([]fuse.DirEntry, int64, error) {
+	if _, err := syscall.Seek(fd, 0, 0); err != nil {
+		return nil, cookie, err
+	}
+	all, err := emulateGetdents(fd)
+	if err != nil {
+		return nil, cookie, err
+	}
+	if cookie >= int64(len(all)) {
+		return nil, cookie, nil
+	}
+	all = all[cookie:]
+	if len(all) > max {
+		all = all[:max]
+	}
+	return all, cookie + int64(len(all)), nil
+}
+
 // emulateGetdents reads all directory entries from the open directory "fd"
 // and returns them in a fuse.DirEntry slice.
 func emulateGetdents(fd int) (out []fuse.DirEntry, err error) {
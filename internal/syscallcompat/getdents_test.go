@@ -3,6 +3,7 @@
 package syscallcompat
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -90,3 +91,103 @@ func testGetdents(t *testing.T) {
 		}
 	}
 }
+
+// TestFirstDirEntry checks that a directory that only contains
+// gocryptfs.diriv is considered empty, and one with another file is not.
+func TestFirstDirEntry(t *testing.T) {
+	for _, f := range []func(int, []string) (string, error){firstDirEntry, emulateFirstDirEntry} {
+		testDir, err := ioutil.TempDir(tmpDir, "TestFirstDirEntry")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(testDir+"/gocryptfs.diriv", nil, 0400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Open(testDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(fd)
+		name, err := f(fd, []string{"gocryptfs.diriv"})
+		if err != nil || name != "" {
+			t.Errorf("only gocryptfs.diriv: name=%q err=%v", name, err)
+		}
+		name, err = f(fd, nil)
+		if err != nil || name != "gocryptfs.diriv" {
+			t.Errorf("nothing ignored: name=%q err=%v", name, err)
+		}
+		err = ioutil.WriteFile(testDir+"/foo", nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The fd has already been read, firstDirEntry must rewind it
+		name, err = f(fd, []string{"gocryptfs.diriv"})
+		if err != nil || name != "foo" {
+			t.Errorf("with a file: name=%q err=%v", name, err)
+		}
+	}
+}
+
+// TestGetdentsChunk reads a large directory in small chunks while files are
+// created and deleted in between, and checks that every file that exists
+// all the time is returned exactly once.
+func TestGetdentsChunk(t *testing.T) {
+	testDir, err := ioutil.TempDir(tmpDir, "TestGetdentsChunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	const nFiles = 2000
+	for i := 0; i < nFiles; i++ {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/keep%d", testDir, i), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// tmpfs only has stable offsets since Linux 6.6
+	onTmpfs, _ := IsMemoryFS(testDir)
+	mutate := !onTmpfs
+	for _, f := range []func(int, int64, int) ([]fuse.DirEntry, int64, error){getdentsChunk, emulateGetdentsChunk} {
+		fd, err := syscall.Open(testDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]int)
+		var cookie int64
+		for i := 0; ; i++ {
+			var entries []fuse.DirEntry
+			entries, cookie, err = f(fd, cookie, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) == 0 {
+				break
+			}
+			if len(entries) > 7 {
+				t.Fatalf("chunk of %d entries", len(entries))
+			}
+			for _, e := range entries {
+				seen[e.Name]++
+			}
+			if mutate && i%10 == 0 {
+				name := fmt.Sprintf("%s/tmp%d", testDir, i)
+				ioutil.WriteFile(name, nil, 0600)
+				os.Remove(fmt.Sprintf("%s/tmp%d", testDir, i-10))
+			}
+		}
+		syscall.Close(fd)
+		for i := 0; i < nFiles; i++ {
+			if n := seen[fmt.Sprintf("keep%d", i)]; n != 1 {
+				t.Errorf("keep%d returned %d times", i, n)
+			}
+		}
+		for name, n := range seen {
+			if n != 1 {
+				t.Errorf("%s returned %d times", name, n)
+			}
+		}
+		// The cookies of the emulation are not stable
+		mutate = false
+	}
+}
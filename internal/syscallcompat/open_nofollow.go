@@ -5,6 +5,8 @@ import (
 	"strings"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -51,3 +53,41 @@ func OpenNofollow(baseDir string, relPath string, flags int, mode uint32) (fd in
 	// the user plus forced NOFOLLOW.
 	return Openat(dirfd, final, flags|syscall.O_NOFOLLOW, mode)
 }
+
+// OpenLong opens "relPath" below "baseDir" with open(2). If the combined
+// path is longer than PATH_MAX, open(2) fails with ENAMETOOLONG, and
+// OpenLong falls back to walking the directory tree like OpenNofollow,
+// which passes one path component at a time to the kernel. Short paths
+// cost no extra syscalls.
+func OpenLong(baseDir string, relPath string, flags int, mode uint32) (fd int, err error) {
+	fd, err = syscall.Open(filepath.Join(baseDir, relPath), flags, mode)
+	if err != syscall.ENAMETOOLONG {
+		return fd, err
+	}
+	return OpenNofollow(baseDir, relPath, flags, mode)
+}
+
+// LstatLong is lstat(2) on "relPath" below "baseDir", with the same
+// fallback for paths longer than PATH_MAX as OpenLong.
+func LstatLong(baseDir string, relPath string, st *syscall.Stat_t) error {
+	err := syscall.Lstat(filepath.Join(baseDir, relPath), st)
+	if err != syscall.ENAMETOOLONG {
+		return err
+	}
+	parent := filepath.Dir(relPath)
+	if parent == "." {
+		parent = ""
+	}
+	dirfd, err := OpenNofollow(baseDir, parent, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	var ust unix.Stat_t
+	err = Fstatat(dirfd, filepath.Base(relPath), &ust, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+	*st = Unix2syscall(ust)
+	return nil
+}
@@ -2,6 +2,8 @@ package syscallcompat
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 )
@@ -42,3 +44,47 @@ func TestOpenNofollow(t *testing.T) {
 		syscall.Close(fd)
 	}
 }
+
+// TestOpenLong creates a directory tree deeper than PATH_MAX and checks
+// that OpenLong and LstatLong reach the bottom.
+func TestOpenLong(t *testing.T) {
+	name := strings.Repeat("x", 200)
+	var parts []string
+	dirfd, err := syscall.Open(tmpDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if err = Mkdirat(dirfd, name, 0700); err != nil && err != syscall.EEXIST {
+			t.Fatal(err)
+		}
+		fd, err := Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirfd = fd
+		parts = append(parts, name)
+	}
+	syscall.Close(dirfd)
+	rel := filepath.Join(filepath.Join(parts...), "f")
+	if len(tmpDir)+len(rel) < 4096 {
+		t.Fatalf("path is only %d bytes long", len(tmpDir)+len(rel))
+	}
+	fd, err := OpenLong(tmpDir, rel, syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = LstatLong(tmpDir, rel, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("wrong mode %#o", st.Mode)
+	}
+	// Short paths work as well
+	if err = LstatLong(tmpDir, name, &st); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,53 @@
+package syscallcompat
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// RetryPolicy says how often backing I/O is retried after a transient error.
+// The zero value does not retry.
+type RetryPolicy struct {
+	// Number of retries after the first attempt
+	Max int
+	// Wait this long before the first retry. The delay doubles with every
+	// further retry.
+	Delay time.Duration
+}
+
+// IsTransient returns true if "err" may go away when the operation is
+// repeated, like the I/O errors and timeouts of a network filesystem that
+// has lost its connection for a moment. Errors like ENOENT or EACCES are
+// final and return false.
+func IsTransient(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case syscall.EIO, syscall.ETIMEDOUT, syscall.EHOSTDOWN, syscall.EHOSTUNREACH,
+		syscall.ENETDOWN, syscall.ENETUNREACH, syscall.ECONNRESET:
+		return true
+	}
+	return false
+}
+
+// Do calls "fn" until it succeeds, fails with an error that is not
+// transient, or the retries are used up. It returns the last error.
+// "fn" must be safe to repeat, like a pread or pwrite at a fixed offset.
+func (p RetryPolicy) Do(fn func() error) error {
+	err := fn()
+	delay := p.Delay
+	for i := 0; i < p.Max && IsTransient(err); i++ {
+		tlog.Debug.Printf("Retry %d/%d in %v after: %v", i+1, p.Max, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		err = fn()
+	}
+	return err
+}
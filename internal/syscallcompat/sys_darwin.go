@@ -3,12 +3,16 @@ package syscallcompat
 import (
 	"log"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
 
+// O_NOATIME does not exist on OSX. Passing zero makes it a no-op.
+const O_NOATIME = 0
+
 // Sorry, fallocate is not available on OSX at all and
 // fcntl F_PREALLOCATE is not accessible from Go.
 // See https://github.com/rfjakob/gocryptfs/issues/18 if you want to help.
@@ -16,11 +20,69 @@ func EnospcPrealloc(fd int, off int64, len int64) error {
 	return nil
 }
 
+// PunchHole is not supported on OSX. This is a no-op, the data stays
+// allocated.
+func PunchHole(fd int, off int64, len int64) error {
+	return nil
+}
+
+// IsMemoryFS returns false, we do not detect RAM disks on macOS.
+func IsMemoryFS(path string) (bool, error) {
+	return false, nil
+}
+
+// NameMax returns 255. macOS has pathconf(2), but we do not have a wrapper
+// for it, and all filesystems we are likely to run on allow 255 bytes.
+func NameMax(path string) (int, error) {
+	return syscall.NAME_MAX, nil
+}
+
+// Syncfs calls sync(2), macOS has no syncfs(2). This writes out all
+// filesystems, not just the one "fd" is on.
+func Syncfs(fd int) error {
+	return syscall.Sync()
+}
+
 // See above.
 func Fallocate(fd int, mode uint32, off int64, len int64) error {
 	return syscall.EOPNOTSUPP
 }
 
+// Fgetxattr is not implemented on Darwin.
+func Fgetxattr(fd int, attr string, dest []byte) (sz int, err error) {
+	return 0, syscall.ENOTSUP
+}
+
+// Lgetxattr is not implemented on Darwin.
+func Lgetxattr(path string, attr string, dest []byte) (sz int, err error) {
+	return 0, syscall.ENOTSUP
+}
+
+// Lsetxattr is not implemented on Darwin.
+func Lsetxattr(path string, attr string, data []byte, flags int) (err error) {
+	return syscall.ENOTSUP
+}
+
+// Lremovexattr is not implemented on Darwin.
+func Lremovexattr(path string, attr string) (err error) {
+	return syscall.ENOTSUP
+}
+
+// Llistxattr is not implemented on Darwin.
+func Llistxattr(path string, dest []byte) (sz int, err error) {
+	return 0, syscall.ENOTSUP
+}
+
+// Fsetxattr is not implemented on Darwin.
+func Fsetxattr(fd int, attr string, data []byte, flags int) (err error) {
+	return syscall.ENOTSUP
+}
+
+// Fremovexattr is not implemented on Darwin.
+func Fremovexattr(fd int, attr string) (err error) {
+	return syscall.ENOTSUP
+}
+
 // Dup3 is not available on Darwin, so we use Dup2 instead.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	if flags != 0 {
@@ -53,6 +115,10 @@ func Fchmodat(dirfd int, path string, mode uint32, flags int) (err error) {
 	return emulateFchmodat(dirfd, path, mode, flags)
 }
 
+func Faccessat(dirfd int, path string, mode uint32) (err error) {
+	return emulateFaccessat(dirfd, path, mode)
+}
+
 func Fchownat(dirfd int, path string, uid int, gid int, flags int) (err error) {
 	return emulateFchownat(dirfd, path, uid, gid, flags)
 }
@@ -69,6 +135,63 @@ func Fstatat(dirfd int, path string, stat *unix.Stat_t, flags int) (err error) {
 	return emulateFstatat(dirfd, path, stat, flags)
 }
 
+// timesToTimeval fills in the nil times from "st". Darwin only has utimes(2),
+// so the precision is microseconds.
+func timesToTimeval(a *time.Time, m *time.Time, st *syscall.Stat_t) []syscall.Timeval {
+	tv := []syscall.Timeval{
+		syscall.NsecToTimeval(syscall.TimespecToNsec(st.Atimespec)),
+		syscall.NsecToTimeval(syscall.TimespecToNsec(st.Mtimespec)),
+	}
+	if a != nil {
+		tv[0] = syscall.NsecToTimeval(a.UnixNano())
+	}
+	if m != nil {
+		tv[1] = syscall.NsecToTimeval(m.UnixNano())
+	}
+	return tv
+}
+
+// Utimensat is emulated using utimes(2). Symlinks are skipped, like in
+// Fchmodat.
+func Utimensat(dirfd int, path string, a *time.Time, m *time.Time, flags int) (err error) {
+	chdirMutex.Lock()
+	defer chdirMutex.Unlock()
+	cwd, err := syscall.Open(".", syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(cwd)
+	if err = syscall.Fchdir(dirfd); err != nil {
+		return err
+	}
+	defer syscall.Fchdir(cwd)
+	var st syscall.Stat_t
+	if err = syscall.Lstat(path, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return nil
+	}
+	return syscall.Utimes(path, timesToTimeval(a, m, &st))
+}
+
+// Futimens is emulated using futimes(2).
+func Futimens(fd int, a *time.Time, m *time.Time) (err error) {
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	return syscall.Futimes(fd, timesToTimeval(a, m, &st))
+}
+
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return emulateGetdents(fd)
 }
+
+func GetdentsChunk(fd int, cookie int64, max int) ([]fuse.DirEntry, int64, error) {
+	return emulateGetdentsChunk(fd, cookie, max)
+}
+
+func FirstDirEntry(fd int, ignore ...string) (string, error) {
+	return emulateFirstDirEntry(fd, ignore)
+}
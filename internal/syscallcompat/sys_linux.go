@@ -4,6 +4,8 @@ package syscallcompat
 import (
 	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
@@ -12,10 +14,19 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
-const _FALLOC_FL_KEEP_SIZE = 0x01
+const (
+	_FALLOC_FL_KEEP_SIZE  = 0x01
+	_FALLOC_FL_PUNCH_HOLE = 0x02
+)
+
+// O_NOATIME prevents reads from updating the atime of the file. Only the
+// owner of the file (or root) may use it.
+const O_NOATIME = syscall.O_NOATIME
 
 var preallocWarn sync.Once
 
+var punchHoleWarn sync.Once
+
 // EnospcPrealloc preallocates ciphertext space without changing the file
 // size. This guarantees that we don't run out of space while writing a
 // ciphertext block (that would corrupt the block).
@@ -42,11 +53,155 @@ func EnospcPrealloc(fd int, off int64, len int64) (err error) {
 	}
 }
 
+// PunchHole deallocates the byte range off...off+len, which then reads as
+// zeros. The file size is not changed. Filesystems that do not support hole
+// punching are tolerated with a warning, the data stays allocated there.
+func PunchHole(fd int, off int64, len int64) (err error) {
+	for {
+		err = syscall.Fallocate(fd, _FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_KEEP_SIZE, off, len)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EOPNOTSUPP {
+			punchHoleWarn.Do(func() {
+				tlog.Warn.Printf("Warning: The underlying filesystem " +
+					"does not support punching holes. Compressed blocks will " +
+					"not save any space.\n")
+			})
+			return nil
+		}
+		return err
+	}
+}
+
+// IsMemoryFS returns true if "path" is on tmpfs or ramfs, so files stored
+// there never reach a disk (unless the machine swaps).
+func IsMemoryFS(path string) (bool, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		return false, err
+	}
+	// The type of "Type" depends on the architecture, and the magic
+	// numbers are 32 bits
+	t := uint32(st.Type)
+	return t == unix.TMPFS_MAGIC || t == unix.RAMFS_MAGIC, nil
+}
+
+// NameMax returns the longest name the filesystem "path" is on can store,
+// like pathconf(path, _PC_NAME_MAX).
+func NameMax(path string) (int, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Namelen), nil
+}
+
+// Syncfs writes all dirty data and metadata of the filesystem "fd" is on to
+// disk, like syncfs(2).
+func Syncfs(fd int) error {
+	return unix.Syncfs(fd)
+}
+
 // Fallocate wraps the Fallocate syscall.
 func Fallocate(fd int, mode uint32, off int64, len int64) (err error) {
 	return syscall.Fallocate(fd, mode, off, len)
 }
 
+// Fgetxattr reads the extended attribute "attr" of "fd" into "dest" and
+// returns its size.
+func Fgetxattr(fd int, attr string, dest []byte) (sz int, err error) {
+	attrPtr, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return 0, err
+	}
+	var destPtr unsafe.Pointer
+	if len(dest) > 0 {
+		destPtr = unsafe.Pointer(&dest[0])
+	}
+	r, _, errno := syscall.Syscall6(syscall.SYS_FGETXATTR, uintptr(fd),
+		uintptr(unsafe.Pointer(attrPtr)), uintptr(destPtr), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// Lgetxattr is like Fgetxattr, but takes a path and does not follow
+// symlinks.
+func Lgetxattr(path string, attr string, dest []byte) (sz int, err error) {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	attrPtr, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return 0, err
+	}
+	var destPtr unsafe.Pointer
+	if len(dest) > 0 {
+		destPtr = unsafe.Pointer(&dest[0])
+	}
+	r, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(attrPtr)), uintptr(destPtr), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// Lsetxattr sets the extended attribute "attr" of "path", without following
+// symlinks.
+func Lsetxattr(path string, attr string, data []byte, flags int) (err error) {
+	return unix.Lsetxattr(path, attr, data, flags)
+}
+
+// Lremovexattr removes the extended attribute "attr" of "path", without
+// following symlinks.
+func Lremovexattr(path string, attr string) (err error) {
+	return unix.Lremovexattr(path, attr)
+}
+
+// Llistxattr reads the NUL-separated list of extended attribute names of
+// "path" into "dest", without following symlinks, and returns its size.
+func Llistxattr(path string, dest []byte) (sz int, err error) {
+	return unix.Llistxattr(path, dest)
+}
+
+// Fsetxattr sets the extended attribute "attr" of "fd" to "data".
+func Fsetxattr(fd int, attr string, data []byte, flags int) (err error) {
+	attrPtr, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var dataPtr unsafe.Pointer
+	if len(data) > 0 {
+		dataPtr = unsafe.Pointer(&data[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR, uintptr(fd),
+		uintptr(unsafe.Pointer(attrPtr)), uintptr(dataPtr), uintptr(len(data)), uintptr(flags), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Fremovexattr removes the extended attribute "attr" of "fd".
+func Fremovexattr(fd int, attr string) (err error) {
+	attrPtr, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_FREMOVEXATTR, uintptr(fd),
+		uintptr(unsafe.Pointer(attrPtr)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 // Openat wraps the Openat syscall.
 func Openat(dirfd int, path string, flags int, mode uint32) (fd int, err error) {
 	// Why would we ever want to call this without O_NOFOLLOW and O_EXCL?
@@ -88,6 +243,12 @@ func Fchmodat(dirfd int, path string, mode uint32, flags int) (err error) {
 	return syscall.Fchmodat(dirfd, path, mode, flags)
 }
 
+// Faccessat syscall. Like access(2), it checks with the real uid and gid
+// and follows symlinks.
+func Faccessat(dirfd int, path string, mode uint32) (err error) {
+	return unix.Faccessat(dirfd, path, mode, 0)
+}
+
 // Fchownat syscall.
 func Fchownat(dirfd int, path string, uid int, gid int, flags int) (err error) {
 	// Why would we ever want to call this without AT_SYMLINK_NOFOLLOW?
@@ -98,6 +259,55 @@ func Fchownat(dirfd int, path string, uid int, gid int, flags int) (err error) {
 	return syscall.Fchownat(dirfd, path, uid, gid, flags)
 }
 
+// timeToTimespec converts "t" for utimensat(2). nil becomes UTIME_OMIT,
+// which leaves the timestamp unchanged.
+func timeToTimespec(t *time.Time) unix.Timespec {
+	if t == nil {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
+
+// utimensat wraps the syscall. An empty "path" is passed as NULL, which
+// makes the kernel operate on "dirfd" itself.
+func utimensat(dirfd int, path string, a *time.Time, m *time.Time, flags int) error {
+	ts := [2]unix.Timespec{timeToTimespec(a), timeToTimespec(m)}
+	var pathPtr *byte
+	if path != "" {
+		var err error
+		pathPtr, err = syscall.BytePtrFromString(path)
+		if err != nil {
+			return err
+		}
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd),
+		uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&ts[0])), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Utimensat sets the access time "a" and the modification time "m" of
+// "path" relative to "dirfd", with nanosecond precision. A nil time is left
+// unchanged.
+func Utimensat(dirfd int, path string, a *time.Time, m *time.Time, flags int) (err error) {
+	// Why would we ever want to call this without AT_SYMLINK_NOFOLLOW?
+	if flags&unix.AT_SYMLINK_NOFOLLOW == 0 {
+		tlog.Warn.Printf("Utimensat: adding missing AT_SYMLINK_NOFOLLOW flag")
+		flags |= unix.AT_SYMLINK_NOFOLLOW
+	}
+	if path == "" {
+		return syscall.ENOENT
+	}
+	return utimensat(dirfd, path, a, m, flags)
+}
+
+// Futimens is like Utimensat, but for the open file "fd".
+func Futimens(fd int, a *time.Time, m *time.Time) (err error) {
+	return utimensat(fd, "", a, m, 0)
+}
+
 // Symlinkat syscall.
 func Symlinkat(oldpath string, newdirfd int, newpath string) (err error) {
 	return unix.Symlinkat(oldpath, newdirfd, newpath)
@@ -122,3 +332,16 @@ func Fstatat(dirfd int, path string, stat *unix.Stat_t, flags int) (err error) {
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return getdents(fd)
 }
+
+// GetdentsChunk reads the directory "fd" in chunks of "max" entries, see
+// getdentsChunk.
+func GetdentsChunk(fd int, cookie int64, max int) ([]fuse.DirEntry, int64, error) {
+	return getdentsChunk(fd, cookie, max)
+}
+
+// FirstDirEntry returns the name of the first entry of the directory "fd"
+// that is not in "ignore", or "" if there is none. Unlike Getdents, it
+// returns as soon as it has found one.
+func FirstDirEntry(fd int, ignore ...string) (string, error) {
+	return firstDirEntry(fd, ignore)
+}
@@ -0,0 +1,51 @@
+package syscallcompat
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestUtimensat sets timestamps with nanosecond precision, through a path
+// and through a file descriptor, and checks that they read back exactly.
+// A nil time must stay unchanged.
+func TestUtimensat(t *testing.T) {
+	path := tmpDir + "/utimensat"
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	a := time.Unix(1234567890, 123456789)
+	m := time.Unix(1234567891, 987654321)
+	if err = Utimensat(tmpDirFd, "utimensat", &a, &m, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mtim.Nsec%1000 == 0 {
+		t.Skip("the filesystem does not store nanoseconds")
+	}
+	if st.Atim.Sec != a.Unix() || st.Atim.Nsec != int64(a.Nanosecond()) ||
+		st.Mtim.Sec != m.Unix() || st.Mtim.Nsec != int64(m.Nanosecond()) {
+		t.Errorf("Utimensat: wrong times %v %v", st.Atim, st.Mtim)
+	}
+	m2 := time.Unix(1234567892, 111111111)
+	if err = Futimens(int(f.Fd()), nil, &m2); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Atim.Sec != a.Unix() || st.Atim.Nsec != int64(a.Nanosecond()) {
+		t.Errorf("Futimens: atime changed to %v", st.Atim)
+	}
+	if st.Mtim.Sec != m2.Unix() || st.Mtim.Nsec != int64(m2.Nanosecond()) {
+		t.Errorf("Futimens: wrong mtime %v", st.Mtim)
+	}
+}
@@ -0,0 +1,45 @@
+package tlog
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// quotedRe matches a double-quoted, possibly escaped, Go string literal as
+// printed by "%q".
+var quotedRe = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// RedactFuseDebug removes everything from a go-fuse debug line that may
+// contain plaintext. go-fuse prints file content only as a byte count, but
+// file names, symlink targets and xattr values are printed as quoted strings.
+// These are replaced by their length. Opcodes, node ids, offsets, sizes and
+// status codes are kept.
+func RedactFuseDebug(line string) string {
+	return quotedRe.ReplaceAllStringFunc(line, func(q string) string {
+		return fmt.Sprintf("<%d bytes>", len(q)-2)
+	})
+}
+
+// fuseDebugWriter forwards go-fuse debug output to the output of the Debug
+// logger. It does not go through Debug.Printf, as our own debug messages
+// contain plaintext and stay disabled.
+type fuseDebugWriter struct{}
+
+func (fuseDebugWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		Debug.Logger.Printf("go-fuse: %s", RedactFuseDebug(line))
+	}
+	return len(p), nil
+}
+
+// SwitchLoggerToDebug redirects the default log.Logger that the go-fuse lib
+// uses to the output of the Debug logger, with plaintext redacted. Debug does
+// not have to be enabled.
+func SwitchLoggerToDebug() {
+	log.SetPrefix("")
+	// The Debug logger adds timestamps if it wants them
+	log.SetFlags(0)
+	log.SetOutput(fuseDebugWriter{})
+}
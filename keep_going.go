@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fileErrors implements "-keep-going" for the commands that walk the whole
+// tree: errors of single files and directories are logged and counted, and
+// the walk goes on.
+type fileErrors struct {
+	keepGoing bool
+	// Number of files and directories that have been skipped
+	n int
+}
+
+// skip returns "err" unless "-keep-going" is active. Then it logs "err",
+// counts it, and returns nil, so that the caller continues with the next
+// file.
+func (fe *fileErrors) skip(err error) error {
+	if err == nil || !fe.keepGoing {
+		return err
+	}
+	fe.n++
+	tlog.Warn.Printf("Skipping: %v", err)
+	return nil
+}
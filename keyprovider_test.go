@@ -0,0 +1,103 @@
+// +build go1.7
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/mount"
+)
+
+// testKMS "wraps" keys by reversing them
+type testKMS struct{}
+
+func (testKMS) reverse(in []byte) []byte {
+	out := make([]byte, len(in))
+	for i := range in {
+		out[len(in)-1-i] = in[i]
+	}
+	return out
+}
+
+func (k testKMS) Wrap(uri string, key []byte) ([]byte, error) {
+	return k.reverse(key), nil
+}
+
+func (k testKMS) Unwrap(uri string, wrapped []byte) ([]byte, error) {
+	return k.reverse(wrapped), nil
+}
+
+func init() {
+	configfile.RegisterKeyProvider("testkms", testKMS{})
+}
+
+// TestKeyProviderMount creates a filesystem whose master key is wrapped by
+// a key provider and mounts it twice via loadConfig(), which must not ask
+// for a password.
+func TestKeyProviderMount(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gocryptfs-TestKeyProviderMount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	args := &argContainer{
+		cipherdir:  tmp + "/cipher",
+		mountpoint: tmp + "/mnt",
+	}
+	args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
+	for _, d := range []string{args.cipherdir, args.mountpoint} {
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename:    args.config,
+		LogN:        10,
+		Creator:     "test",
+		KeyProvider: "testkms://key1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteDirIV(nil, args.cipherdir); err != nil {
+		t.Fatal(err)
+	}
+	mountFS := func() (context.CancelFunc, *mount.Handle) {
+		masterkey, confFile, err := loadConfig(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		h := initFuseFrontend(masterkey, args, confFile)
+		if err = h.Start(ctx); err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		return cancel, h
+	}
+
+	cancel, h := mountFS()
+	err = ioutil.WriteFile(args.mountpoint+"/foo", []byte("bar"), 0600)
+	cancel()
+	h.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel, h = mountFS()
+	content, err := ioutil.ReadFile(args.mountpoint + "/foo")
+	cancel()
+	h.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "bar" {
+		t.Errorf("wrong content: %q", content)
+	}
+}
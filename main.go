@@ -10,8 +10,10 @@ import (
 
 	"github.com/hanwen/go-fuse/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/archive"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/speed"
@@ -34,21 +36,36 @@ var raceDetector bool
 // loadConfig loads the config file "args.config", prompting the user for the password
 func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.ConfFile, err error) {
 	// Check if the file can be opened at all before prompting for a password
-	fd, err := os.Open(args.config)
-	if err != nil {
-		tlog.Fatal.Printf("Cannot open config file: %v", err)
-		return nil, nil, exitcodes.NewErr(err.Error(), exitcodes.OpenConf)
+	if args._archive != nil && !args._configCustom {
+		if _, ok := args._archive.Lookup(configfile.ConfDefaultName); !ok {
+			tlog.Fatal.Printf("Cannot open config file: %s not found in the archive", configfile.ConfDefaultName)
+			return nil, nil, exitcodes.NewErr("config file not found", exitcodes.OpenConf)
+		}
+	} else {
+		fd, err := os.Open(args.config)
+		if err != nil {
+			tlog.Fatal.Printf("Cannot open config file: %v", err)
+			return nil, nil, exitcodes.NewErr(err.Error(), exitcodes.OpenConf)
+		}
+		fd.Close()
 	}
-	fd.Close()
 	// The user has passed the master key (probably because he forgot the
 	// password).
 	if args.masterkey != "" {
 		masterkey = parseMasterKey(args.masterkey)
-		_, confFile, err = configfile.LoadConfFile(args.config, "")
-	} else {
-		pw := readpassword.Once(args.extpass)
+		confFile, err = loadConfFile(args)
+	} else if confFile, err = loadConfFile(args); err == nil &&
+		confFile.IsFeatureFlagSet(configfile.FlagKeyFile) {
+		// The master key is stored in a key file, there is no password.
+		masterkey, err = confFile.LoadKeyFile(args.keyfile)
+	} else if err == nil && confFile.IsFeatureFlagSet(configfile.FlagKeyProvider) {
+		// The master key is wrapped by a key provider, there is no password.
+		tlog.Info.Printf("Unwrapping master key via %s", confFile.KeyProvider)
+		masterkey, err = confFile.UnwrapKey()
+	} else if err == nil {
+		pw := readpassword.Once(args.extpass, args.passenv)
 		tlog.Info.Println("Decrypting master key")
-		masterkey, confFile, err = configfile.LoadConfFile(args.config, pw)
+		masterkey, err = confFile.DecryptMasterKey(pw)
 	}
 	if err != nil {
 		tlog.Fatal.Println(err)
@@ -57,16 +74,36 @@ func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.Conf
 	return masterkey, confFile, nil
 }
 
+// loadConfFile parses the config file without decrypting the master key.
+// When mounting an archive without "-config", the config file is read from
+// the archive.
+func loadConfFile(args *argContainer) (*configfile.ConfFile, error) {
+	if args._archive != nil && !args._configCustom {
+		js, err := args._archive.ReadFile(configfile.ConfDefaultName)
+		if err != nil {
+			return nil, err
+		}
+		_, confFile, err := configfile.ParseConfFile(js, args.config, "")
+		return confFile, err
+	}
+	_, confFile, err := configfile.LoadConfFile(args.config, "")
+	return confFile, err
+}
+
 // changePassword - change the password of config file "filename"
 func changePassword(args *argContainer) {
 	masterkey, confFile, err := loadConfig(args)
 	if err != nil {
 		exitcodes.Exit(err)
 	}
+	if !confFile.UsesPassword() {
+		tlog.Fatal.Printf("This filesystem uses a key file or key provider and has no password")
+		os.Exit(exitcodes.Usage)
+	}
 	tlog.Info.Println("Please enter your new password.")
-	newPw := readpassword.Twice(args.extpass)
+	newPw := readpassword.Twice(args.extpass, args.passenv, args.allowemptypassword)
 	readpassword.CheckTrailingGarbage()
-	confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
+	confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.Params())
 	if args.masterkey != "" {
 		bak := args.config + ".bak"
 		err = os.Link(args.config, bak)
@@ -88,6 +125,95 @@ func changePassword(args *argContainer) {
 	os.Exit(0)
 }
 
+// changeKDF - re-encrypt the master key with new scrypt parameters and the
+// same password. Parameters that are not given on the command line keep
+// their current value.
+func changeKDF(args *argContainer) {
+	if args.masterkey != "" {
+		tlog.Fatal.Printf("-change-kdf needs the password and cannot be used with -masterkey")
+		os.Exit(exitcodes.Usage)
+	}
+	_, confFile, err := configfile.LoadConfFile(args.config, "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if !confFile.UsesPassword() {
+		tlog.Fatal.Printf("This filesystem uses a key file or key provider and has no password")
+		os.Exit(exitcodes.Usage)
+	}
+	old := confFile.ScryptObject.Params()
+	p := old
+	if isFlagPassed("scryptn") || args.scryptpreset != "" {
+		p.LogN = args.scryptn
+	}
+	if args.scryptr != 0 {
+		p.R = args.scryptr
+	}
+	if args.scryptp != 0 {
+		p.P = args.scryptp
+	}
+	if p == old {
+		tlog.Fatal.Printf("The scrypt parameters are %s already. Pass -scryptn, -scryptr, -scryptp or -scrypt-preset.", old)
+		os.Exit(exitcodes.Usage)
+	}
+	if err = p.Validate(); err != nil {
+		tlog.Fatal.Printf("Invalid scrypt parameters: %v", err)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	pw := readpassword.Once(args.extpass, args.passenv)
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := confFile.DecryptMasterKey(pw)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Printf("Encrypting master key with scrypt %s", p)
+	confFile.EncryptKey(masterkey, pw, p)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"scrypt parameters changed from %s to %s."+tlog.ColorReset, old, p)
+	os.Exit(0)
+}
+
+// setLabel - change the label stored in the config file. The label is not
+// encrypted, so we do not need the password.
+func setLabel(args *argContainer) {
+	_, confFile, err := configfile.LoadConfFile(args.config, "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	confFile.Label = args.setlabel
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "Label changed." + tlog.ColorReset)
+	os.Exit(0)
+}
+
+// printFingerprint - print the fingerprint of the master key, so the user
+// can check if two filesystems share the same key without revealing it.
+func printFingerprint(args *argContainer) {
+	masterkey, _, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	fmt.Println(cryptocore.KeyFingerprint(masterkey))
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	os.Exit(0)
+}
+
 // printVersion prints a version string like this:
 // gocryptfs v0.12-36-ge021b9d-dirty; go-fuse a4c968c; 2016-07-03 go1.6.2
 func printVersion() {
@@ -115,7 +241,11 @@ func main() {
 	args := parseCliOpts()
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
-	if !args.fg && flagSet.NArg() == 2 {
+	mountArgs := 2
+	if args.ephemeral {
+		mountArgs = 1
+	}
+	if !args.fg && flagSet.NArg() == mountArgs && !args.check && !args.reencrypt && !args.findpath && !args.diff && len(args._command) == 0 {
 		ret := forkChild()
 		os.Exit(ret)
 	}
@@ -126,7 +256,11 @@ func main() {
 	if args.version {
 		tlog.Debug.Printf("openssl=%v\n", args.openssl)
 		tlog.Debug.Printf("on-disk format %d\n", contentenc.CurrentVersion)
-		printVersion()
+		if args.json {
+			printVersionJSON()
+		} else {
+			printVersion()
+		}
 		os.Exit(0)
 	}
 	// "-hh"
@@ -143,6 +277,19 @@ func main() {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicing on warnings")
 	}
+	// "-q"
+	if args.quiet {
+		tlog.Info.Enabled = false
+	}
+	// "-healthcheck" works on the MOUNTPOINT. Stat'ing it like CIPHERDIR
+	// below could hang.
+	if args.healthcheck {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -healthcheck [-healthcheck-timeout DURATION] MOUNTPOINT", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		healthCheck(flagSet.Arg(0), args.healthchecktimeout) // does not return
+	}
 	// Every operation below requires CIPHERDIR. Exit if we don't have it.
 	if flagSet.NArg() == 0 {
 		if flagSet.NFlag() == 0 {
@@ -158,13 +305,32 @@ func main() {
 	// Check that CIPHERDIR exists
 	args.cipherdir, _ = filepath.Abs(flagSet.Arg(0))
 	err = checkDir(args.cipherdir)
+	if err != nil && args.reverse && !args.init && isRegularFile(args.cipherdir) {
+		// Reverse mode for a single file: serve its directory, but hide
+		// everything else
+		args._singleFile = filepath.Base(args.cipherdir)
+		args.cipherdir = filepath.Dir(args.cipherdir)
+		err = nil
+	} else if err != nil && !args.reverse && !args.init && isRegularFile(args.cipherdir) {
+		// A tar or zip archive of a ciphertext directory: mount it read-only
+		args._archive, err = archive.Open(args.cipherdir)
+		args.ro = true
+	}
 	if err != nil {
 		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 		os.Exit(exitcodes.CipherDir)
 	}
-	// "-q"
-	if args.quiet {
-		tlog.Info.Enabled = false
+	// "-replica"
+	if args.replica != "" {
+		args.replica, _ = filepath.Abs(args.replica)
+		err = checkDir(args.replica)
+		if err == nil && (args.replica == args.cipherdir || strings.HasPrefix(args.replica, args.cipherdir+"/")) {
+			err = fmt.Errorf("%s is inside of CIPHERDIR", args.replica)
+		}
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-replica\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
 	}
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
@@ -184,6 +350,14 @@ func main() {
 	} else {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
 	}
+	// "-keyfile"
+	if args.keyfile != "" {
+		args.keyfile, err = filepath.Abs(args.keyfile)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-keyfile\" setting: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+	}
 	// "-force_owner"
 	if args.force_owner != "" {
 		var uidNum, gidNum int64
@@ -206,21 +380,20 @@ func main() {
 	}
 	// "-cpuprofile"
 	if args.cpuprofile != "" {
-		onExitFunc := setupCpuprofile(args.cpuprofile)
-		defer onExitFunc()
+		addProfileStop(setupCpuprofile(args.cpuprofile))
 	}
 	// "-memprofile"
 	if args.memprofile != "" {
-		onExitFunc := setupMemprofile(args.memprofile)
-		defer onExitFunc()
+		addProfileStop(setupMemprofile(args.memprofile))
 	}
 	// "-trace"
 	if args.trace != "" {
-		onExitFunc := setupTrace(args.trace)
-		defer onExitFunc()
+		addProfileStop(setupTrace(args.trace))
 	}
 	if args.cpuprofile != "" || args.memprofile != "" || args.trace != "" {
-		tlog.Info.Printf("Note: You must unmount gracefully, otherwise the profile file(s) will stay empty!\n")
+		defer stopProfiles()
+		tlog.Info.Printf("Note: The profile file(s) are written on unmount, SIGINT or SIGTERM. " +
+			"They stay empty if gocryptfs is killed otherwise!\n")
 	}
 	// "-openssl"
 	if !args.openssl {
@@ -229,8 +402,19 @@ func main() {
 		tlog.Debug.Printf("OpenSSL enabled")
 	}
 	// Operation flags
-	if args.info && args.init || args.info && args.passwd || args.passwd && args.init {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd is allowed")
+	nOps := 0
+	setlabel := isFlagPassed("set-label")
+	for _, op := range []bool{args.info, args.init, args.passwd, args.changekdf, args.check, args.reencrypt, args.verify, args.merkleroot, args.findpath, args.finddup, args.benchmarkcache, args.diff, setlabel, args.fingerprint, args.ephemeral} {
+		if op {
+			nOps++
+		}
+	}
+	if nOps > 1 {
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -change-kdf, -check, -reencrypt, -verify, -merkle-root, -findpath, -finddup, -benchmark-cache, -diff, -set-label, -fingerprint, -ephemeral is allowed")
+		os.Exit(exitcodes.Usage)
+	}
+	if args._archive != nil && nOps > 0 {
+		tlog.Fatal.Printf("Archives can only be mounted")
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
@@ -257,6 +441,106 @@ func main() {
 		}
 		changePassword(&args) // does not return
 	}
+	// "-change-kdf"
+	if args.changekdf {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -change-kdf [-scryptn N] [-scryptr R] [-scryptp P] [-scrypt-preset NAME] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		changeKDF(&args) // does not return
+	}
+	// "-set-label"
+	if setlabel {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -set-label LABEL CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		setLabel(&args) // does not return
+	}
+	// "-fingerprint"
+	if args.fingerprint {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -fingerprint [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		printFingerprint(&args) // does not return
+	}
+	// "-check"
+	if args.check {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -check [OPTIONS] CIPHERDIR PLAINTEXTPATH", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		checkFile(&args, flagSet.Arg(1)) // does not return
+	}
+	// "-findpath"
+	if args.findpath {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -findpath [OPTIONS] CIPHERDIR PLAINTEXTPATH", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		findPath(&args, flagSet.Arg(1)) // does not return
+	}
+	// "-verify"
+	if args.verify {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -verify [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		verifyTree(&args) // does not return
+	}
+	// "-merkle-root"
+	if args.merkleroot {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -merkle-root [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		merkleRoot(&args) // does not return
+	}
+	// "-finddup"
+	if args.finddup {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -finddup [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		findDups(&args) // does not return
+	}
+	// "-benchmark-cache"
+	if args.benchmarkcache {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -benchmark-cache [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		benchmarkCache(&args) // does not return
+	}
+	// "-reencrypt"
+	if args.reencrypt {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -reencrypt [OPTIONS] CIPHERDIR NEWCIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		reencrypt(&args, flagSet.Arg(1)) // does not return
+	}
+	// "-diff"
+	if args.diff {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -diff [OPTIONS] CIPHERDIR_A CIPHERDIR_B", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		diffDirs(&args, flagSet.Arg(1)) // does not return
+	}
+	// "-ephemeral"
+	if args.ephemeral {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -ephemeral [OPTIONS] MOUNTPOINT", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		ret := mountEphemeral(&args)
+		if ret != 0 {
+			os.Exit(ret)
+		}
+		return
+	}
 	// Default operation: mount.
 	if flagSet.NArg() != 2 {
 		prettyArgs := prettyArgs()
@@ -6,7 +6,6 @@ import (
 	"log/syslog"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
@@ -20,22 +19,31 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 
+	"github.com/rfjakob/gocryptfs/internal/backendguard"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_archive"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/optimeout"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/slowops"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/mount"
 )
 
 // doMount mounts an encrypted directory.
 // Called from main.
 func doMount(args *argContainer) int {
-	// Check mountpoint
+	// Check mountpoint. It is the last argument, "-ephemeral" only has
+	// MOUNTPOINT.
 	var err error
-	args.mountpoint, err = filepath.Abs(flagSet.Arg(1))
+	args.mountpoint, err = filepath.Abs(flagSet.Arg(flagSet.NArg() - 1))
 	if err != nil {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
@@ -48,14 +56,18 @@ func doMount(args *argContainer) int {
 		os.Exit(exitcodes.MountPoint)
 	}
 	// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
-	// encrypting ourselves.
-	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") {
+	// encrypting ourselves. Not a problem if we only serve a single file.
+	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") && args._singleFile == "" {
 		tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported",
 			args.mountpoint, args.cipherdir)
 		os.Exit(exitcodes.MountPoint)
 	}
 	if args.nonempty {
 		err = checkDir(args.mountpoint)
+		if err == nil && checkDirEmpty(args.mountpoint) != nil {
+			tlog.Info.Printf(tlog.ColorYellow+"The mountpoint %q is not empty. Its contents will be hidden "+
+				"while the filesystem is mounted."+tlog.ColorReset, args.mountpoint)
+		}
 	} else {
 		err = checkDirEmpty(args.mountpoint)
 	}
@@ -84,6 +96,34 @@ func doMount(args *argContainer) int {
 			}
 		}()
 	}
+	// An archive is read-only and has no backing directory to write state to
+	if args._archive != nil {
+		for _, f := range []string{"acl", "checksum", "cow-snapshots", "notify-changes", "preload", "replica", "scrub-interval", "write-intent", "xattr-passthrough"} {
+			if isFlagPassed(f) {
+				tlog.Fatal.Printf("The -%s flag cannot be used when mounting an archive", f)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+	}
+	// Check for xattr support before asking for the password as well
+	if args.writeintent {
+		if err = fusefrontend.CheckWriteIntent(args.cipherdir); err != nil {
+			tlog.Fatal.Printf("-write-intent needs xattr support in CIPHERDIR: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+	}
+	if args.checksum {
+		if err = fusefrontend.CheckWriteIntent(args.cipherdir); err != nil {
+			tlog.Fatal.Printf("-checksum needs xattr support in CIPHERDIR: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+	}
+	if args.xattrpassthrough != "" {
+		if err = fusefrontend.CheckWriteIntent(args.cipherdir); err != nil {
+			tlog.Fatal.Printf("-xattr-passthrough needs xattr support in CIPHERDIR: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+	}
 	// Get master key (may prompt for the password)
 	var masterkey []byte
 	var confFile *configfile.ConfFile
@@ -97,6 +137,9 @@ func doMount(args *argContainer) int {
 			"ZEROKEY MODE PROVIDES NO SECURITY AT ALL AND SHOULD ONLY BE USED FOR TESTING." +
 			tlog.ColorReset)
 		masterkey = make([]byte, cryptocore.KeyLen)
+	} else if args.ephemeral {
+		// "-ephemeral": the key only lives in our memory
+		masterkey = cryptocore.RandBytes(cryptocore.KeyLen)
 	} else {
 		// Load master key from config file
 		// Prompts the user for the password
@@ -108,13 +151,20 @@ func doMount(args *argContainer) int {
 			}
 			exitcodes.Exit(err)
 		}
-		readpassword.CheckTrailingGarbage()
-		printMasterKey(masterkey)
+		// With a key file or key provider, there is no password, and the key
+		// file or the KMS is the backup of the master key.
+		if confFile.UsesPassword() {
+			readpassword.CheckTrailingGarbage()
+			printMasterKey(masterkey)
+		}
 	}
 	// We cannot use JSON for pretty-printing as the fields are unexported
 	tlog.Debug.Printf("cli args: %#v", args)
 	// Initialize FUSE server
-	srv := initFuseFrontend(masterkey, args, confFile)
+	h := initFuseFrontend(masterkey, args, confFile)
+	if confFile != nil && confFile.Label != "" {
+		tlog.Info.Printf("Volume label: %s", confFile.Label)
+	}
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
 	// We have been forked into the background, as evidenced by the set
 	// "notifypid".
@@ -127,7 +177,9 @@ func doMount(args *argContainer) int {
 			tlog.Info.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_INFO)
 			tlog.Debug.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_DEBUG)
 			tlog.Warn.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
-			tlog.SwitchLoggerToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
+			if !args.debugfuse {
+				tlog.SwitchLoggerToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
+			}
 			// Daemons should redirect stdin, stdout and stderr
 			redirectStdFds()
 		}
@@ -144,15 +196,20 @@ func doMount(args *argContainer) int {
 	// Increase the open file limit to 4096. This is not essential, so do it after
 	// we have switched to syslog and don't bother the user with warnings.
 	setOpenFileLimit()
+	// "CIPHERDIR MOUNTPOINT -- CMD ARGS..."
+	if len(args._command) > 0 {
+		debug.FreeOSMemory()
+		return runCommand(h, args._command)
+	}
 	// Wait for SIGINT in the background and unmount ourselves if we get it.
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
-	handleSigint(srv, args.mountpoint)
+	handleSigint(h)
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
 	// Jump into server loop. Returns when it gets an umount request from the kernel.
-	srv.Serve()
+	h.Serve()
 	return 0
 }
 
@@ -176,64 +233,160 @@ func setOpenFileLimit() {
 	}
 }
 
-// initFuseFrontend - initialize gocryptfs/fusefrontend
+// makeFrontendArgs reconciliates CLI and config file arguments into a
+// fusefrontend.Args struct that is passed to the filesystem implementation.
 // Calls os.Exit on errors
-func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile.ConfFile) *fuse.Server {
-	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
-	// that is passed to the filesystem implementation
-	cryptoBackend := cryptocore.BackendGoGCM
-	if args.openssl {
-		cryptoBackend = cryptocore.BackendOpenSSL
-	}
-	if args.aessiv {
-		cryptoBackend = cryptocore.BackendAESSIV
-	}
+func makeFrontendArgs(args *argContainer, confFile *configfile.ConfFile) fusefrontend.Args {
+	cryptoBackend := args.cryptoBackend()
 	// forceOwner implies allow_other, as documented.
 	// Set this early, so args.allow_other can be relied on below this point.
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:      args.cipherdir,
-		PlaintextNames: args.plaintextnames,
-		LongNames:      args.longnames,
-		CryptoBackend:  cryptoBackend,
-		ConfigCustom:   args._configCustom,
-		Raw64:          args.raw64,
-		NoPrealloc:     args.noprealloc,
-		HKDF:           args.hkdf,
-		SerializeReads: args.serialize_reads,
-		ForceDecode:    args.forcedecode,
-		ForceOwner:     args._forceOwner,
-	}
-	// confFile is nil when "-zerokey" or "-masterkey" was used
+		Cipherdir:        args.cipherdir,
+		PlaintextNames:   args.plaintextnames,
+		LongNames:        args.longnames,
+		CryptoBackend:    cryptoBackend,
+		ConfigCustom:     args._configCustom,
+		Raw64:            args.raw64,
+		NoPrealloc:       args.noprealloc,
+		HKDF:             args.hkdf,
+		SerializeReads:   args.serialize_reads,
+		ForceDecode:      args.forcedecode,
+		ForceOwner:       args._forceOwner,
+		Compress:         args.compress,
+		Trash:            args.trash,
+		Snapshots:        args.snapshots,
+		DirSync:          args.dirsync,
+		CaseInsensitive:  args.caseinsensitive,
+		NFCNames:         args.nfcnames,
+		NetworkBackend:   args.networkbackend,
+		ParanoidDirIV:    args.paranoiddiriv,
+		Quotas:           args._quotas,
+		DirectIO:         args._directIO,
+		Preload:          args._preload,
+		Replica:          args.replica,
+		ScrubInterval:    args.scrubinterval,
+		ScrubBandwidth:   args._scrubBandwidth,
+		WriteIntent:      args.writeintent,
+		Checksum:         args.checksum,
+		NamePolicy:       args._namePolicy,
+		XattrPassthrough: args._xattrPassthrough,
+		CreateUmask:      args._createUmask,
+		ForceMode:        args._forceMode,
+		MaxFileSize:      args._maxFileSize,
+		CacheSize:        args._cacheSize,
+		ForceTime:        args._forceTime,
+		SingleFile:       args._singleFile,
+		Retry: syscallcompat.RetryPolicy{
+			Max:   args.retry,
+			Delay: args.retrydelay,
+		},
+	}
+	if args.atime {
+		frontendArgs.Atime = fusefrontend.AtimeStrict
+	} else if args.relatime {
+		frontendArgs.Atime = fusefrontend.AtimeRelative
+	} else if args.noatime {
+		frontendArgs.Atime = fusefrontend.AtimeNone
+	}
+	switch args.invalidnames {
+	case "raw":
+		frontendArgs.InvalidNames = fusefrontend.InvalidNamesRaw
+	case "fail":
+		frontendArgs.InvalidNames = fusefrontend.InvalidNamesFail
+	}
+	// confFile is nil when "-zerokey", "-masterkey" or "-ephemeral" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
-		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
-		frontendArgs.Raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
-		frontendArgs.HKDF = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
-		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
-			frontendArgs.CryptoBackend = cryptocore.BackendAESSIV
-		} else if args.reverse {
+		frontendArgs.SetFeatureFlags(confFile)
+		if frontendArgs.Compress && args.reverse {
+			tlog.Fatal.Printf("Reverse mode does not support compressed filesystems")
+			os.Exit(exitcodes.Usage)
+		}
+		if frontendArgs.EncryptedDirIV && args.reverse {
+			tlog.Fatal.Printf("Reverse mode does not support encrypted DirIVs")
+			os.Exit(exitcodes.Usage)
+		}
+		if frontendArgs.NamePadding > 0 && args.reverse {
+			tlog.Fatal.Printf("Reverse mode does not support name padding")
+			os.Exit(exitcodes.Usage)
+		}
+		if frontendArgs.SymlinkFiles && args.reverse {
+			tlog.Fatal.Printf("Reverse mode does not support symlink files")
+			os.Exit(exitcodes.Usage)
+		}
+		if frontendArgs.SymlinkFiles && args._archive != nil {
+			tlog.Fatal.Printf("Mounting an archive does not support symlink files")
+			os.Exit(exitcodes.Usage)
+		}
+		if frontendArgs.IVBits != contentenc.DefaultIVBits && frontendArgs.CryptoBackend == cryptocore.BackendOpenSSL {
+			// stupidgcm only supports 128-bit IVs
+			if args.forcedecode {
+				tlog.Fatal.Printf("-forcedecode needs OpenSSL, which does not support %d-bit GCM IVs", frontendArgs.IVBits)
+				os.Exit(exitcodes.Usage)
+			}
+			tlog.Debug.Printf("%d-bit GCM IVs, using Go GCM instead of OpenSSL", frontendArgs.IVBits)
+			frontendArgs.CryptoBackend = cryptocore.BackendGoGCM
+		}
+		if !confFile.IsFeatureFlagSet(configfile.FlagAESSIV) && args.reverse {
 			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if !frontendArgs.PlaintextNames {
+		frontendArgs.NameMax = nameMax(args)
+	}
+	if args.forcetime == "init" {
+		// The gocryptfs.diriv in the top directory is written once by "-init"
+		var t time.Time
+		if args._archive != nil {
+			e, ok := args._archive.Lookup(nametransform.DirIVFilename)
+			if !ok {
+				tlog.Fatal.Printf("-force-time init: cannot get the creation time: %s not found in the archive", nametransform.DirIVFilename)
+				os.Exit(exitcodes.Usage)
+			}
+			t = e.ModTime
+		} else {
+			fi, err := os.Stat(filepath.Join(args.cipherdir, nametransform.DirIVFilename))
+			if err != nil {
+				tlog.Fatal.Printf("-force-time init: cannot get the creation time: %v", err)
+				os.Exit(exitcodes.Usage)
+			}
+			t = fi.ModTime()
+		}
+		frontendArgs.ForceTime = &t
+	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
 	if args.allow_other && os.Getuid() == 0 {
 		frontendArgs.PreserveOwner = true
 	}
+	return frontendArgs
+}
+
+// initFuseFrontend - initialize gocryptfs/fusefrontend and mount it
+// Calls os.Exit on errors
+func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile.ConfFile) *mount.Handle {
+	frontendArgs := makeFrontendArgs(args, confFile)
 	jsonBytes, _ := json.MarshalIndent(frontendArgs, "", "\t")
 	tlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
 	var finalFs pathfs.FileSystem
 	var ctlSockBackend ctlsock.Interface
+	var wipeKeys func()
 	// pathFsOpts are passed into go-fuse/pathfs
 	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: true}
-	if args.sharedstorage {
+	if args.sharedstorage || args.networkbackend {
 		// shared storage mode disables hard link tracking as the backing inode
 		// numbers may change behind our back:
 		// https://github.com/rfjakob/gocryptfs/issues/156
+		// Network filesystems like SSHFS may not have stable inode numbers
+		// to begin with.
+		pathFsOpts.ClientInodes = false
+	}
+	if args.snapshots {
+		// Copy on write gives a file a new backing inode number
 		pathFsOpts.ClientInodes = false
 	}
 	if args.reverse {
@@ -243,14 +396,50 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		fs := fusefrontend_reverse.NewFS(masterkey, frontendArgs)
 		finalFs = fs
 		ctlSockBackend = fs
+		wipeKeys = fs.Wipe
 		// Reverse mode is read-only, so we don't need a working link().
 		// Disable hard link tracking to avoid strange breakage on duplicate
 		// inode numbers ( https://github.com/rfjakob/gocryptfs/issues/149 ).
 		pathFsOpts.ClientInodes = false
+	} else if args._archive != nil {
+		fs := fusefrontend_archive.NewFS(masterkey, frontendArgs, args._archive)
+		finalFs = fs
+		ctlSockBackend = fs
+		wipeKeys = fs.Wipe
+		// Hard links in the archive do not have inode numbers we could use
+		pathFsOpts.ClientInodes = false
 	} else {
 		fs := fusefrontend.NewFS(masterkey, frontendArgs)
 		finalFs = fs
+		if args.acl {
+			finalFs = fusefrontend.NewACLFS(fs)
+		}
 		ctlSockBackend = fs
+		wipeKeys = fs.Wipe
+		if frontendArgs.ScrubInterval > 0 {
+			fs.StartScrubber()
+		}
+		if len(frontendArgs.Preload) > 0 {
+			fs.StartPreload()
+		}
+		if frontendArgs.Replica != "" {
+			fs.StartReplicator()
+		}
+	}
+	// The archive file stays open, so it cannot disappear
+	if args._archive == nil {
+		guardFs, err := backendguard.NewFS(finalFs, args.cipherdir)
+		if err != nil {
+			tlog.Fatal.Printf("Cannot access CIPHERDIR: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		finalFs = guardFs
+	}
+	if args.optimeout > 0 {
+		finalFs = optimeout.NewFS(finalFs, args.optimeout)
+	}
+	if args.traceslowops > 0 {
+		finalFs = slowops.NewFS(finalFs, args.traceslowops)
 	}
 	// fusefrontend / fusefrontend_reverse have initialized their crypto with
 	// derived keys (HKDF), we can purge the master key from memory.
@@ -268,6 +457,14 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		// sharedstorage mode sets all cache timeouts to zero so changes to the
 		// backing shared storage show up immediately.
 		fuseOpts = &nodefs.Options{}
+	} else if args.networkbackend {
+		// Keep stat() results for a short time only, and do not cache
+		// negative lookups at all, so files created by other clients show
+		// up immediately.
+		fuseOpts = &nodefs.Options{
+			AttrTimeout:  100 * time.Millisecond,
+			EntryTimeout: 100 * time.Millisecond,
+		}
 	} else {
 		fuseOpts = &nodefs.Options{
 			// These options are to be compatible with libfuse defaults,
@@ -278,6 +475,40 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		}
 	}
 	conn := nodefs.NewFileSystemConnector(pathFs.Root(), fuseOpts)
+	mOpts := makeMountOptions(args)
+	srv, err := fuse.NewServer(conn.RawFS(), args.mountpoint, &mOpts)
+	if err != nil {
+		tlog.Fatal.Printf("fuse.NewServer failed: %v", err)
+		if runtime.GOOS == "darwin" {
+			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
+		}
+		os.Exit(exitcodes.FuseNewServer)
+	}
+	if args.debugfuse {
+		// go-fuse logs through the default logger, which now ends up in
+		// the output of tlog.Debug (and follows it to syslog).
+		tlog.SwitchLoggerToDebug()
+	}
+	srv.SetDebug(args.fusedebug || args.debugfuse)
+	// The notifications need the server, so we can only start watching now
+	if args.notifychanges {
+		_, err = watchBacking(args, pathFs, ctlSockBackend)
+		if err != nil {
+			tlog.Warn.Printf("-notify-changes: cannot watch %s, continuing without: %v", args.cipherdir, err)
+		}
+	}
+
+	// All FUSE file and directory create calls carry explicit permission
+	// information. We need an unrestricted umask to create the files and
+	// directories with the requested permissions.
+	syscall.Umask(0000)
+
+	return mount.NewHandle(srv, args.mountpoint, wipeKeys)
+}
+
+// makeMountOptions returns the options for mounting the filesystem, as
+// passed to fusermount.
+func makeMountOptions(args *argContainer) fuse.MountOptions {
 	mOpts := fuse.MountOptions{
 		// Writes and reads are usually capped at 128kiB on Linux through
 		// the FUSE_MAX_PAGES_PER_REQ kernel constant in fuse_i.h. Our
@@ -292,8 +523,19 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		tlog.Info.Printf(tlog.ColorYellow + "The option \"-allow_other\" is set. Make sure the file " +
 			"permissions protect your data from unwanted access." + tlog.ColorReset)
 		mOpts.AllowOther = true
-		// Make the kernel check the file permissions for us
-		mOpts.Options = append(mOpts.Options, "default_permissions")
+		if args.acl {
+			// fusefrontend.ACLFS checks the file permissions itself. The
+			// kernel would only look at the mode bits.
+			tlog.Info.Printf("Checking permissions in gocryptfs, honoring POSIX ACLs")
+		} else {
+			// Make the kernel check the file permissions for us
+			mOpts.Options = append(mOpts.Options, "default_permissions")
+		}
+	} else if args.allow_root {
+		tlog.Info.Printf(tlog.ColorYellow + "The option \"-allow_root\" is set. Make sure the file " +
+			"permissions protect your data from unwanted access." + tlog.ColorReset)
+		// go-fuse has no field for allow_root, fusermount takes it as an option
+		mOpts.Options = append(mOpts.Options, "allow_root", "default_permissions")
 	}
 	if args.forcedecode {
 		tlog.Info.Printf(tlog.ColorYellow + "THE OPTION \"-forcedecode\" IS ACTIVE. GOCRYPTFS WILL RETURN CORRUPT DATA!" +
@@ -302,6 +544,11 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 	if args.nonempty {
 		mOpts.Options = append(mOpts.Options, "nonempty")
 	}
+	// Have the kernel forward fcntl() and flock() locks to us so they are
+	// coordinated through the open file table.
+	if !args.reverse && args._archive == nil {
+		mOpts.EnableLocks = true
+	}
 	// Set values shown in "df -T" and friends
 	// First column, "Filesystem"
 	fsname := args.cipherdir
@@ -333,42 +580,39 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fuse.NewServer(conn.RawFS(), args.mountpoint, &mOpts)
-	if err != nil {
-		tlog.Fatal.Printf("fuse.NewServer failed: %v", err)
-		if runtime.GOOS == "darwin" {
-			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
-		}
-		os.Exit(exitcodes.FuseNewServer)
-	}
-	srv.SetDebug(args.fusedebug)
-
-	// All FUSE file and directory create calls carry explicit permission
-	// information. We need an unrestricted umask to create the files and
-	// directories with the requested permissions.
-	syscall.Umask(0000)
-
-	return srv
+	return mOpts
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
+// handleSigint unmounts the filesystem, writes out the profiles and exits
+// when we get SIGINT or SIGTERM.
+func handleSigint(h *mount.Handle) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
 		<-ch
-		err := srv.Unmount()
-		if err != nil {
-			tlog.Warn.Print(err)
-			if runtime.GOOS == "linux" {
-				// MacOSX does not support lazy unmount
-				tlog.Info.Printf("Trying lazy unmount")
-				cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				cmd.Run()
-			}
-		}
+		h.Unmount()
+		// os.Exit skips the deferred stopProfiles() in main
+		stopProfiles()
 		os.Exit(exitcodes.SigInt)
 	}()
 }
+
+// nameMax returns the "-max-name-length" setting, or the name length limit
+// of CIPHERDIR if it is shorter than 255 bytes, or 0 for 255 bytes.
+func nameMax(args *argContainer) int {
+	if args.maxnamelength > 0 || args.reverse || args._archive != nil {
+		return args.maxnamelength
+	}
+	n, err := syscallcompat.NameMax(args.cipherdir)
+	if err != nil || n <= 0 || n >= syscall.NAME_MAX {
+		return 0
+	}
+	if args.longnames && n < nametransform.MinNameMax {
+		tlog.Info.Printf("CIPHERDIR only allows names of %d bytes, too short for long names. "+
+			"Long file names will fail.", n)
+		return 0
+	}
+	tlog.Debug.Printf("CIPHERDIR allows names of %d bytes", n)
+	return n
+}
@@ -0,0 +1,105 @@
+//go:build go1.7
+// +build go1.7
+
+package mount
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+)
+
+// Options describe the filesystem to mount.
+type Options struct {
+	// Cipherdir is the ciphertext directory (absolute path).
+	Cipherdir string
+	// Mountpoint is the directory the plaintext view is mounted on.
+	Mountpoint string
+	// ConfigFile is the gocryptfs.conf of the filesystem. Empty means
+	// CIPHERDIR/gocryptfs.conf. The feature flags in it decide how the
+	// filesystem is read and written.
+	ConfigFile string
+}
+
+// Mount mounts the filesystem described by "opts" and returns once it is
+// mounted. "masterkey" is the decrypted master key of the filesystem.
+// Cancelling "ctx" unmounts the filesystem. Use Wait on the returned Handle
+// to block until it has been unmounted and torn down.
+//
+// Like the gocryptfs command, Mount sets the umask of the process to zero,
+// because FUSE create calls carry explicit permissions.
+func Mount(ctx context.Context, masterkey []byte, opts Options) (*Handle, error) {
+	confPath := opts.ConfigFile
+	if confPath == "" {
+		confPath = filepath.Join(opts.Cipherdir, configfile.ConfDefaultName)
+	}
+	// An empty password reads the config file without decrypting the key
+	_, cf, err := configfile.LoadConfFile(confPath, "")
+	if err != nil {
+		return nil, err
+	}
+	args := fusefrontend.Args{
+		Cipherdir:     opts.Cipherdir,
+		CryptoBackend: cryptocore.BackendGoGCM,
+		// On by default in the gocryptfs command as well
+		LongNames: true,
+	}
+	args.SetFeatureFlags(cf)
+	fs := fusefrontend.NewFS(masterkey, args)
+	pathFs := pathfs.NewPathNodeFs(fs, &pathfs.PathNodeFsOptions{ClientInodes: true})
+	conn := nodefs.NewFileSystemConnector(pathFs.Root(), &nodefs.Options{
+		NegativeTimeout: time.Second,
+		AttrTimeout:     time.Second,
+		EntryTimeout:    time.Second,
+	})
+	mOpts := fuse.MountOptions{
+		// Same limits as the gocryptfs command, see makeMountOptions
+		MaxWrite:    fuse.MAX_KERNEL_WRITE,
+		Options:     []string{fmt.Sprintf("max_read=%d", fuse.MAX_KERNEL_WRITE), "fsname=" + opts.Cipherdir},
+		Name:        "gocryptfs",
+		EnableLocks: true,
+	}
+	srv, err := fuse.NewServer(conn.RawFS(), opts.Mountpoint, &mOpts)
+	if err != nil {
+		fs.Wipe()
+		return nil, err
+	}
+	syscall.Umask(0000)
+	h := NewHandle(srv, opts.Mountpoint, fs.Wipe)
+	if err = h.Start(ctx); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Start runs the FUSE server in the background and returns once the
+// filesystem is mounted. Cancelling "ctx" unmounts the filesystem. If
+// mounting fails, Start unmounts, waits for the teardown and returns the
+// error.
+func (h *Handle) Start(ctx context.Context) error {
+	go h.Serve()
+	if err := h.WaitMount(); err != nil {
+		h.Unmount()
+		h.Wait()
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.Unmount()
+		case <-h.done:
+			// Unmounted by someone else
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,81 @@
+// Package mount mounts a gocryptfs filesystem from inside a Go program and
+// controls its lifecycle. Unlike the gocryptfs command, it does not fork,
+// prompt for a password or install signal handlers: the caller supplies the
+// master key, and unmounts by calling Unmount or by cancelling a context.
+package mount
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Handle controls the lifecycle of a mounted filesystem.
+type Handle struct {
+	srv        *fuse.Server
+	mountpoint string
+	// wipeKeys is called after the filesystem has been unmounted
+	wipeKeys func()
+	// done is closed when the filesystem has been unmounted and torn down
+	done        chan struct{}
+	unmountOnce sync.Once
+	unmountErr  error
+}
+
+// NewHandle returns a Handle for "srv", which serves the filesystem mounted
+// on "mountpoint". "wipeKeys" is called once the filesystem has been
+// unmounted. The server is not started yet, see Serve.
+func NewHandle(srv *fuse.Server, mountpoint string, wipeKeys func()) *Handle {
+	return &Handle{
+		srv:        srv,
+		mountpoint: mountpoint,
+		wipeKeys:   wipeKeys,
+		done:       make(chan struct{}),
+	}
+}
+
+// Serve runs the FUSE server loop. It returns when the filesystem has been
+// unmounted (for whatever reason) and the encryption keys have been wiped.
+// Must be called exactly once.
+func (h *Handle) Serve() {
+	h.srv.Serve()
+	h.wipeKeys()
+	close(h.done)
+}
+
+// WaitMount blocks until the kernel has accepted the mount. Serve must be
+// running in another goroutine.
+func (h *Handle) WaitMount() error {
+	return h.srv.WaitMount()
+}
+
+// Unmount unmounts the filesystem. If that fails, we try a lazy unmount on
+// Linux so we don't leave a dangling "Transport endpoint is not connected"
+// mountpoint behind. Safe to call several times.
+func (h *Handle) Unmount() error {
+	h.unmountOnce.Do(func() {
+		h.unmountErr = h.srv.Unmount()
+		if h.unmountErr != nil {
+			tlog.Warn.Print(h.unmountErr)
+			if runtime.GOOS == "linux" {
+				// MacOSX does not support lazy unmount
+				tlog.Info.Printf("Trying lazy unmount")
+				cmd := exec.Command("fusermount", "-u", "-z", h.mountpoint)
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				h.unmountErr = cmd.Run()
+			}
+		}
+	})
+	return h.unmountErr
+}
+
+// Wait blocks until the filesystem has been unmounted and torn down.
+func (h *Handle) Wait() {
+	<-h.done
+}
@@ -0,0 +1,128 @@
+// +build go1.7
+
+package mount
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// leakedGoroutines returns the stacks of the goroutines that run code of
+// go-fuse or gocryptfs, except the one that calls it.
+func leakedGoroutines() []string {
+	buf := make([]byte, 1024*1024)
+	buf = buf[:runtime.Stack(buf, true)]
+	var out []string
+	// The first stack is our own
+	for _, g := range strings.Split(string(buf), "\n\n")[1:] {
+		if strings.Contains(g, "github.com/hanwen/go-fuse") || strings.Contains(g, "github.com/rfjakob/gocryptfs") {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// TestMountCancel mounts a filesystem, cancels the context and checks
+// that the mountpoint is released and that no goroutines are left behind.
+func TestMountCancel(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gocryptfs-TestMountCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	opts := Options{
+		Cipherdir:  tmp + "/cipher",
+		Mountpoint: tmp + "/mnt",
+	}
+	for _, d := range []string{opts.Cipherdir, opts.Mountpoint} {
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compression changes the on-disk format, so the file is only readable
+	// if Mount honors the feature flags of the config file
+	confPath := opts.Cipherdir + "/" + configfile.ConfDefaultName
+	err = configfile.CreateConfFile(&configfile.CreateArgs{
+		Filename: confPath,
+		Password: "test",
+		LogN:     10,
+		Creator:  "test",
+		Compress: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteDirIV(nil, opts.Cipherdir); err != nil {
+		t.Fatal(err)
+	}
+	masterkey, _, err := configfile.LoadConfFile(confPath, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := leakedGoroutines(); len(g) > 0 {
+		t.Fatalf("goroutines left over from earlier tests:\n%s", strings.Join(g, "\n\n"))
+	}
+	mountCancel := func(f func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		h, err := Mount(ctx, masterkey, opts)
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		f()
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			h.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for unmount")
+		}
+	}
+
+	content := strings.Repeat("compressible ", 1000)
+	mountCancel(func() {
+		err = ioutil.WriteFile(opts.Mountpoint+"/foo", []byte(content), 0600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mountpoint is an empty directory again
+	entries, err := ioutil.ReadDir(opts.Mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("mountpoint is not empty: %d entries", len(entries))
+	}
+	var got []byte
+	mountCancel(func() {
+		got, err = ioutil.ReadFile(opts.Mountpoint + "/foo")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("wrong content after remount: %d bytes", len(got))
+	}
+	// Goroutines may take a moment to exit
+	var g []string
+	for i := 0; i < 100; i++ {
+		if g = leakedGoroutines(); len(g) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%d goroutines leaked:\n%s", len(g), strings.Join(g, "\n\n"))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func hasOption(opts []string, o string) bool {
+	for _, v := range opts {
+		if v == o {
+			return true
+		}
+	}
+	return false
+}
+
+// TestMountOptionsAllowRoot checks the mount options for "-allow_root" and
+// "-allow_other"
+func TestMountOptionsAllowRoot(t *testing.T) {
+	mOpts := makeMountOptions(&argContainer{allow_root: true})
+	if mOpts.AllowOther {
+		t.Error("-allow_root must not set allow_other")
+	}
+	for _, o := range []string{"allow_root", "default_permissions"} {
+		if !hasOption(mOpts.Options, o) {
+			t.Errorf("option %q missing: %v", o, mOpts.Options)
+		}
+	}
+	mOpts = makeMountOptions(&argContainer{allow_other: true})
+	if !mOpts.AllowOther {
+		t.Error("-allow_other must set allow_other")
+	}
+	if hasOption(mOpts.Options, "allow_root") || !hasOption(mOpts.Options, "default_permissions") {
+		t.Errorf("wrong options for -allow_other: %v", mOpts.Options)
+	}
+	mOpts = makeMountOptions(&argContainer{})
+	if mOpts.AllowOther || hasOption(mOpts.Options, "allow_root") || hasOption(mOpts.Options, "default_permissions") {
+		t.Errorf("wrong default options: %v", mOpts.Options)
+	}
+}
+
+// TestMountOptionsNonempty checks that "-nonempty" is passed on to fusermount
+func TestMountOptionsNonempty(t *testing.T) {
+	mOpts := makeMountOptions(&argContainer{nonempty: true})
+	if !hasOption(mOpts.Options, "nonempty") {
+		t.Errorf("option \"nonempty\" missing: %v", mOpts.Options)
+	}
+	mOpts = makeMountOptions(&argContainer{})
+	if hasOption(mOpts.Options, "nonempty") {
+		t.Errorf("option \"nonempty\" should not be set: %v", mOpts.Options)
+	}
+}
@@ -0,0 +1,64 @@
+package names_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/names"
+)
+
+// Fixed key and DirIV so that the examples are reproducible. Real ones come
+// from the config file and from Cipher.ReadDirIV.
+var (
+	masterkey = bytes.Repeat([]byte{0x42}, 32)
+	dirIV     = bytes.Repeat([]byte{0x17}, names.DirIVLen)
+)
+
+func ExampleCipher_EncryptName() {
+	c, err := names.New(masterkey, names.Options{HKDF: true, Raw64: true, LongNames: true})
+	if err != nil {
+		panic(err)
+	}
+	enc, err := c.EncryptName("hello.txt", dirIV)
+	if err != nil {
+		panic(err)
+	}
+	// 9 bytes are padded to one 16-byte block, which is 22 bytes in
+	// unpadded base64
+	fmt.Println(len(enc.Stored), enc.LongName == "")
+	plain, err := c.DecryptName(enc.Stored, "", dirIV)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(plain)
+	// Output:
+	// 22 true
+	// hello.txt
+}
+
+func ExampleCipher_EncryptName_longName() {
+	c, err := names.New(masterkey, names.Options{HKDF: true, Raw64: true, LongNames: true})
+	if err != nil {
+		panic(err)
+	}
+	long := strings.Repeat("x", 200)
+	enc, err := c.EncryptName(long, dirIV)
+	if err != nil {
+		panic(err)
+	}
+	// Store the file as enc.Stored and write enc.LongName to the sidecar
+	fmt.Println(names.IsLongName(enc.Stored), names.IsSidecar(enc.Stored+names.LongNameSuffix))
+	plain, err := c.DecryptName(enc.Stored, enc.LongName, dirIV)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(plain == long)
+	// A sidecar that does not belong to the name is rejected
+	_, err = c.DecryptName(enc.Stored, enc.LongName+"x", dirIV)
+	fmt.Println(err != nil)
+	// Output:
+	// true true
+	// true
+	// true
+}
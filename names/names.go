@@ -0,0 +1,175 @@
+// Package names encrypts and decrypts single gocryptfs file names without
+// mounting the filesystem. It is meant for tools that work on the
+// ciphertext directory directly, like a sync client that wants to know
+// which plaintext file an encrypted name belongs to.
+//
+// The names in a directory are encrypted with the master key and the
+// DirIV of the directory, which is stored in its "gocryptfs.diriv" file.
+// Use Cipher.ReadDirIV to get it, as the file is encrypted on filesystems
+// with the EncryptedDirIV feature flag.
+// Encrypted names that are too long for the backing filesystem are stored
+// as "gocryptfs.longname.[sha256]", and the full encrypted name is stored
+// in a sidecar file next to it, with ".name" appended.
+package names
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+const (
+	// DirIVLen is the length of a DirIV in bytes.
+	DirIVLen = nametransform.DirIVLen
+	// DirIVFilename is the file in each ciphertext directory that stores
+	// the DirIV.
+	DirIVFilename = nametransform.DirIVFilename
+	// LongNameSuffix is appended to a long name to get its sidecar file.
+	LongNameSuffix = nametransform.LongNameSuffix
+)
+
+// Options are the feature flags from gocryptfs.conf that affect file names.
+// "gocryptfs -info" shows them.
+type Options struct {
+	// HKDF feature flag. Set for filesystems created by gocryptfs v1.3
+	// and later.
+	HKDF bool
+	// Raw64 feature flag: base64 without padding.
+	Raw64 bool
+	// LongNames feature flag: encrypted names longer than 255 bytes are
+	// hashed. Without it, they are rejected.
+	LongNames bool
+	// NFCNames feature flag: names are normalized to Unicode NFC before
+	// they are encrypted.
+	NFCNames bool
+	// NamePadding from gocryptfs.conf if the NamePadding feature flag is
+	// set, 0 otherwise.
+	NamePadding int
+	// EncryptedDirIV feature flag: the gocryptfs.diriv files are encrypted.
+	EncryptedDirIV bool
+}
+
+// Cipher encrypts and decrypts file names. It does not change after New()
+// and is safe for concurrent use by multiple goroutines.
+type Cipher struct {
+	nameTransform *nametransform.NameTransform
+	longNames     bool
+}
+
+// EncryptedName is a file name as it is stored in the ciphertext directory.
+type EncryptedName struct {
+	// Name of the file in the ciphertext directory
+	Stored string
+	// For long names, the content of the sidecar file Stored+LongNameSuffix.
+	// Empty otherwise.
+	LongName string
+}
+
+// New returns a Cipher for the filesystem with the 32-byte master key
+// "masterkey" and the feature flags "opts". The Cipher keeps a copy of the
+// derived name key, "masterkey" may be overwritten afterwards.
+func New(masterkey []byte, opts Options) (*Cipher, error) {
+	if len(masterkey) != cryptocore.KeyLen {
+		return nil, fmt.Errorf("master key has %d bytes, want %d", len(masterkey), cryptocore.KeyLen)
+	}
+	if opts.NamePadding != 0 {
+		if err := nametransform.CheckNamePadding(opts.NamePadding); err != nil {
+			return nil, err
+		}
+	}
+	// Only the EME cipher is used, the content backend does not matter.
+	// The copy keeps the Go GCM instance valid if "masterkey" is wiped.
+	key := append([]byte(nil), masterkey...)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, 128, opts.HKDF, false)
+	nt := nametransform.New(cc.EMECipher, opts.LongNames, opts.Raw64, opts.NFCNames)
+	if opts.NamePadding != 0 {
+		nt.SetNamePadding(opts.NamePadding)
+	}
+	if opts.EncryptedDirIV {
+		nt.SetDirIVCipher(cryptocore.NewDirIVAEAD(key))
+	}
+	return &Cipher{nameTransform: nt, longNames: opts.LongNames}, nil
+}
+
+// ReadDirIV returns the DirIV of the ciphertext directory "dir", read from
+// its gocryptfs.diriv file and decrypted if the filesystem has the
+// EncryptedDirIV feature flag.
+func (c *Cipher) ReadDirIV(dir string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(dir, DirIVFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c.ReadDirIVFrom(f)
+}
+
+// ReadDirIVFrom is like ReadDirIV, but reads the content of the
+// gocryptfs.diriv file from "r".
+func (c *Cipher) ReadDirIVFrom(r io.Reader) ([]byte, error) {
+	return c.nameTransform.ReadDirIVFrom(r)
+}
+
+// EncryptName encrypts "plainName" in the directory with the DirIV "dirIV".
+// If the encrypted name is too long, it is hashed, and the returned
+// LongName has to be written to the sidecar file.
+func (c *Cipher) EncryptName(plainName string, dirIV []byte) (EncryptedName, error) {
+	if err := checkDirIV(dirIV); err != nil {
+		return EncryptedName{}, err
+	}
+	if plainName == "" || plainName == "." || plainName == ".." || strings.ContainsAny(plainName, "/\x00") {
+		return EncryptedName{}, fmt.Errorf("invalid file name %q", plainName)
+	}
+	cName := c.nameTransform.EncryptName(plainName, dirIV)
+	if len(cName) <= syscall.NAME_MAX {
+		return EncryptedName{Stored: cName}, nil
+	}
+	if !c.longNames {
+		return EncryptedName{}, syscall.ENAMETOOLONG
+	}
+	return EncryptedName{Stored: c.nameTransform.HashLongName(cName), LongName: cName}, nil
+}
+
+// DecryptName decrypts the name "stored" in the directory with the DirIV
+// "dirIV". If IsLongName(stored) is true, "longName" must be the content of
+// its sidecar file, and it is checked against the hash in "stored".
+// Otherwise, "longName" is ignored.
+func (c *Cipher) DecryptName(stored string, longName string, dirIV []byte) (string, error) {
+	if err := checkDirIV(dirIV); err != nil {
+		return "", err
+	}
+	cName := stored
+	switch nametransform.NameType(stored) {
+	case nametransform.LongNameFilename:
+		return "", fmt.Errorf("%q is a long name sidecar file", stored)
+	case nametransform.LongNameContent:
+		if c.nameTransform.HashLongName(longName) != stored {
+			return "", fmt.Errorf("long name does not match the hash in %q", stored)
+		}
+		cName = longName
+	}
+	return c.nameTransform.DecryptName(cName, dirIV)
+}
+
+// IsLongName returns true if "stored" is a hashed long name. Its encrypted
+// name is in the sidecar file stored+LongNameSuffix.
+func IsLongName(stored string) bool {
+	return nametransform.NameType(stored) == nametransform.LongNameContent
+}
+
+// IsSidecar returns true if "stored" is the sidecar file of a long name.
+func IsSidecar(stored string) bool {
+	return nametransform.NameType(stored) == nametransform.LongNameFilename
+}
+
+func checkDirIV(dirIV []byte) error {
+	if len(dirIV) != DirIVLen {
+		return fmt.Errorf("DirIV has %d bytes, want %d", len(dirIV), DirIVLen)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package names
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestReadDirIVEncrypted checks that ReadDirIV decrypts the DirIV with the
+// EncryptedDirIV feature flag, and that it cannot be read without it.
+func TestReadDirIVEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReadDirIVEncrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := bytes.Repeat([]byte{0x42}, 32)
+	opts := Options{HKDF: true, Raw64: true, LongNames: true, EncryptedDirIV: true}
+	c, err := New(key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.nameTransform.WriteDirIV(nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	iv, err := c.ReadDirIV(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iv) != DirIVLen {
+		t.Errorf("DirIV has %d bytes", len(iv))
+	}
+	raw, err := ioutil.ReadFile(dir + "/" + DirIVFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, iv) {
+		t.Error("the DirIV is stored in plaintext")
+	}
+	enc, err := c.EncryptName("foo", iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := c.DecryptName(enc.Stored, "", iv); err != nil || plain != "foo" {
+		t.Errorf("DecryptName: %q, %v", plain, err)
+	}
+	opts.EncryptedDirIV = false
+	c2, err := New(key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c2.ReadDirIV(dir); err == nil {
+		t.Error("reading an encrypted DirIV without EncryptedDirIV should fail")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/changewatch"
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// changeNotifier translates changes in the backing directory into FUSE
+// invalidation notifications for the mounted view
+type changeNotifier struct {
+	pathFs  *pathfs.PathNodeFs
+	backend ctlsock.Interface
+	reverse bool
+}
+
+// watchBacking watches the backing directory (CIPHERDIR, or the plaintext
+// directory in reverse mode) and makes the kernel drop its cached entries,
+// attributes and pages of every path that changes there, so that changes
+// made behind our back show up at once instead of after the cache timeout.
+//
+// This is called when you pass the "-notify-changes" option.
+func watchBacking(args *argContainer, pathFs *pathfs.PathNodeFs, backend ctlsock.Interface) (*changewatch.Watcher, error) {
+	n := changeNotifier{
+		pathFs:  pathFs,
+		backend: backend,
+		reverse: args.reverse,
+	}
+	return changewatch.New(args.cipherdir, n.event)
+}
+
+// translate returns the mounted path of the backing path "path".
+func (n *changeNotifier) translate(path string) (string, error) {
+	if n.reverse {
+		return n.backend.EncryptPath(path)
+	}
+	return n.backend.DecryptPath(path)
+}
+
+// event handles one change in the backing directory.
+func (n *changeNotifier) event(ev changewatch.Event) {
+	name := filepath.Base(ev.Path)
+	if !n.reverse && (name == nametransform.DirIVFilename || ev.Path == configfile.ConfDefaultName ||
+		nametransform.NameType(name) == nametransform.LongNameFilename) {
+		// Not visible in the mount
+		return
+	}
+	p, err := n.translate(ev.Path)
+	switch ev.Op {
+	case changewatch.Entry:
+		// A deleted long name cannot be decrypted any more. Its parent
+		// directory can.
+		dir, dirErr := n.translate(nametransform.Dir(ev.Path))
+		if dirErr != nil {
+			return
+		}
+		if err == nil {
+			n.pathFs.EntryNotify(dir, filepath.Base(p))
+			if n.reverse && nametransform.IsLongContent(filepath.Base(p)) {
+				n.pathFs.EntryNotify(dir, filepath.Base(p)+nametransform.LongNameSuffix)
+			}
+		}
+		// Size, mtime and listing of the directory
+		n.pathFs.Notify(dir)
+	case changewatch.Attr:
+		if err == nil {
+			n.pathFs.FileNotify(p, -1, 0)
+		}
+	case changewatch.Content:
+		if err == nil {
+			n.pathFs.FileNotify(p, 0, 0)
+		}
+	}
+}
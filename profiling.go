@@ -2,14 +2,42 @@ package main
 
 import (
 	"os"
+	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
+	"sync"
 	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// profileStop holds the functions that finish the profiles and traces. They
+// run when main returns, and in handleSigint, where os.Exit would skip
+// deferred calls.
+var profileStop struct {
+	sync.Mutex
+	funcs []func()
+}
+
+// addProfileStop registers "f" to be called by stopProfiles.
+func addProfileStop(f func()) {
+	profileStop.Lock()
+	profileStop.funcs = append(profileStop.funcs, f)
+	profileStop.Unlock()
+}
+
+// stopProfiles finishes and writes out all profiles and traces. Safe to call
+// several times, only the first call does something.
+func stopProfiles() {
+	profileStop.Lock()
+	defer profileStop.Unlock()
+	for _, f := range profileStop.funcs {
+		f()
+	}
+	profileStop.funcs = nil
+}
+
 // setupCpuprofile is called to handle a non-empty "-cpuprofile" cli argument
 func setupCpuprofile(cpuprofileArg string) func() {
 	tlog.Info.Printf("Writing CPU profile to %s", cpuprofileArg)
@@ -25,10 +53,27 @@ func setupCpuprofile(cpuprofileArg string) func() {
 	}
 	return func() {
 		pprof.StopCPUProfile()
+		if err := f.Close(); err != nil {
+			tlog.Warn.Printf("cpuprofile: %v", err)
+		}
+	}
+}
+
+// writeHeapProfile replaces the contents of "f" with a current heap profile.
+func writeHeapProfile(f *os.File) error {
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
 	}
+	// Get up-to-date statistics, the profile shows the state as of the
+	// last garbage collection
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
 }
 
-// setupTrace is called to handle a non-empty "-memprofile" cli argument
+// setupMemprofile is called to handle a non-empty "-memprofile" cli argument
 func setupMemprofile(memprofileArg string) func() {
 	tlog.Info.Printf("Will write memory profile to %q", memprofileArg)
 	f, err := os.Create(memprofileArg)
@@ -36,41 +81,36 @@ func setupMemprofile(memprofileArg string) func() {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.Profiler)
 	}
+	// Serializes the periodic and the final write
+	var lock sync.Mutex
 	exiting := false
 	// Write the memory profile to disk every 60 seconds to get the in-use
 	// memory stats.
 	go func() {
 		for {
 			time.Sleep(60 * time.Second)
+			lock.Lock()
 			if exiting {
+				lock.Unlock()
 				return
 			}
-			_, err = f.Seek(0, 0)
+			err := writeHeapProfile(f)
+			lock.Unlock()
 			if err != nil {
-				tlog.Warn.Printf("memprofile: Seek failed: %v", err)
-				return
-			}
-			err = f.Truncate(0)
-			if err != nil {
-				tlog.Warn.Printf("memprofile: Truncate failed: %v", err)
-				return
-			}
-			err = pprof.WriteHeapProfile(f)
-			if err == nil {
-				tlog.Info.Printf("memprofile: periodic write to %q succeeded",
-					memprofileArg)
-			} else {
-				tlog.Warn.Printf("memprofile: periodic WriteHeapProfile failed: %v", err)
+				tlog.Warn.Printf("memprofile: periodic write failed: %v", err)
 				return
 			}
+			tlog.Info.Printf("memprofile: periodic write to %q succeeded",
+				memprofileArg)
 		}
 	}()
 	// Final write on exit.
 	return func() {
+		lock.Lock()
+		defer lock.Unlock()
 		exiting = true
-		err = pprof.WriteHeapProfile(f)
-		if err != nil {
-			tlog.Warn.Printf("memprofile: on-exit WriteHeapProfile failed: %v", err)
+		if err := writeHeapProfile(f); err != nil {
+			tlog.Warn.Printf("memprofile: on-exit write failed: %v", err)
 		}
 		f.Close()
 	}
@@ -91,5 +131,8 @@ func setupTrace(traceArg string) func() {
 	}
 	return func() {
 		trace.Stop()
+		if err := f.Close(); err != nil {
+			tlog.Warn.Printf("trace: %v", err)
+		}
 	}
 }
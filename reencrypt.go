@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// reencryptor copies the plaintext view of one filesystem into another
+type reencryptor struct {
+	src     *fusefrontend.FS
+	dst     *fusefrontend.FS
+	context *fuse.Context
+	// Progress counters
+	files      uint64
+	skipped    uint64
+	bytes      uint64
+	lastReport time.Time
+	// Errors skipped because of "-keep-going"
+	errs fileErrors
+}
+
+// reencrypt copies CIPHERDIR into "newDir", re-encrypting file names,
+// gocryptfs.diriv files and content under a new master key. The new config
+// file uses the same password and settings as the old one.
+//
+// If "newDir" already contains a config file, we assume that an earlier run
+// was interrupted and resume: files that have already been copied completely
+// are skipped.
+//
+// This is called when you pass the "-reencrypt" option.
+func reencrypt(args *argContainer, newDir string) {
+	if args.reverse || args.masterkey != "" || args.zerokey {
+		tlog.Fatal.Printf("-reencrypt cannot be used with -reverse, -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	newDir, _ = filepath.Abs(newDir)
+	if newDir == args.cipherdir {
+		tlog.Fatal.Printf("In-place re-encryption is not supported, please pass an empty NEWCIPHERDIR")
+		os.Exit(exitcodes.Usage)
+	}
+	err := checkDir(newDir)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid NEWCIPHERDIR: %v", err)
+		os.Exit(exitcodes.Init)
+	}
+	// Unlock the old filesystem
+	_, oldConf, err := configfile.LoadConfFile(args.config, "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if !oldConf.UsesPassword() {
+		tlog.Fatal.Printf("-reencrypt does not support filesystems that use a key file or key provider")
+		os.Exit(exitcodes.Usage)
+	}
+	pw := readpassword.Once(args.extpass, args.passenv)
+	tlog.Info.Println("Decrypting master key")
+	oldKey, err := oldConf.DecryptMasterKey(pw)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	// Create the new config file, or load it if we are resuming
+	newConfPath := filepath.Join(newDir, configfile.ConfDefaultName)
+	if _, err = os.Stat(newConfPath); os.IsNotExist(err) {
+		err = checkDirEmpty(newDir)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid NEWCIPHERDIR: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+		plaintextNames := oldConf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		err = configfile.CreateConfFile(&configfile.CreateArgs{
+			Filename:       newConfPath,
+			Password:       pw,
+			PlaintextNames: plaintextNames,
+			LogN:           oldConf.ScryptObject.LogN(),
+			ScryptR:        oldConf.ScryptObject.R,
+			ScryptP:        oldConf.ScryptObject.P,
+			Creator:        tlog.ProgramName + " " + GitVersion,
+			AESSIV:         oldConf.IsFeatureFlagSet(configfile.FlagAESSIV),
+			Compress:       oldConf.IsFeatureFlagSet(configfile.FlagCompression),
+			NFCNames:       oldConf.IsFeatureFlagSet(configfile.FlagNFCNames),
+			EncryptedDirIV: oldConf.IsFeatureFlagSet(configfile.FlagEncryptedDirIV),
+			CipherDir:      newDir,
+			NamePadding:    oldConf.NamePadding,
+			Label:          oldConf.Label,
+			SymlinkFiles:   oldConf.IsFeatureFlagSet(configfile.FlagSymlinkFiles),
+			GCMIVBits:      oldConf.GCMIVBits,
+		})
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.WriteConf)
+		}
+		if !plaintextNames && !oldConf.IsFeatureFlagSet(configfile.FlagEncryptedDirIV) {
+			err = nametransform.WriteDirIV(nil, newDir)
+			if err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.Init)
+			}
+		}
+		tlog.Info.Printf("Created new filesystem in %s", newDir)
+	} else {
+		tlog.Info.Printf("Resuming re-encryption into %s", newDir)
+	}
+	_, newConf, err := configfile.LoadConfFile(newConfPath, "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	newKey, err := newConf.DecryptMasterKey(pw)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if bytes.Equal(oldKey, newKey) {
+		tlog.Fatal.Printf("The new filesystem uses the old master key")
+		os.Exit(exitcodes.Init)
+	}
+	srcArgs := *args
+	dstArgs := *args
+	dstArgs.cipherdir = newDir
+	dstArgs.config = newConfPath
+	r := reencryptor{
+		src:     fusefrontend.NewFS(oldKey, makeFrontendArgs(&srcArgs, oldConf)),
+		dst:     fusefrontend.NewFS(newKey, makeFrontendArgs(&dstArgs, newConf)),
+		context: &fuse.Context{},
+		errs:    fileErrors{keepGoing: args.keepgoing},
+	}
+	for i := range oldKey {
+		oldKey[i] = 0
+		newKey[i] = 0
+	}
+	// Like in initFuseFrontend, we want to create files with exactly the
+	// permissions we ask for.
+	syscall.Umask(0000)
+	err = r.copyDir("")
+	if err != nil {
+		tlog.Fatal.Printf("Re-encryption failed: %v", err)
+		tlog.Info.Printf("Run the same command again to resume.")
+		os.Exit(exitcodes.Other)
+	}
+	if r.errs.n > 0 {
+		tlog.Fatal.Printf("Re-encryption incomplete: %d files could not be copied", r.errs.n)
+		tlog.Info.Printf("Run the same command again to retry them.")
+		os.Exit(exitcodes.FilesFailed)
+	}
+	tlog.Info.Printf("Re-encryption complete: %d files copied, %d already done, %d bytes.",
+		r.files, r.skipped, r.bytes)
+	tlog.Info.Printf("After checking that %s mounts and contains your files, delete %s.",
+		newDir, args.cipherdir)
+	os.Exit(0)
+}
+
+// progress prints the progress counters every few seconds
+func (r *reencryptor) progress() {
+	if time.Since(r.lastReport) < 2*time.Second {
+		return
+	}
+	r.lastReport = time.Now()
+	tlog.Info.Printf("%d files, %d bytes copied", r.files, r.bytes)
+}
+
+// exists returns true if "path" exists in the destination filesystem
+func (r *reencryptor) exists(path string) bool {
+	_, status := r.dst.GetAttr(path, r.context)
+	return status.Ok()
+}
+
+// copyDir recursively copies the contents of the plaintext directory "dir"
+func (r *reencryptor) copyDir(dir string) error {
+	entries, status := r.src.OpenDir(dir, r.context)
+	if !status.Ok() {
+		return fmt.Errorf("OpenDir %q: %v", dir, status)
+	}
+	for _, e := range entries {
+		err := r.errs.skip(r.copyEntry(filepath.Join(dir, e.Name)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEntry copies the plaintext file, directory, symlink or device "path"
+func (r *reencryptor) copyEntry(path string) error {
+	a, status := r.src.GetAttr(path, r.context)
+	if !status.Ok() {
+		return fmt.Errorf("GetAttr %q: %v", path, status)
+	}
+	perm := a.Mode & 07777
+	switch {
+	case a.IsDir():
+		if !r.exists(path) {
+			status = r.dst.Mkdir(path, perm|0700, r.context)
+			if !status.Ok() {
+				return fmt.Errorf("Mkdir %q: %v", path, status)
+			}
+		}
+		err := r.copyDir(path)
+		if err != nil {
+			return err
+		}
+		status = r.dst.Chmod(path, perm, r.context)
+	case a.IsRegular():
+		err := r.copyFile(path, a)
+		if err != nil {
+			return err
+		}
+	case a.IsSymlink():
+		if !r.exists(path) {
+			var target string
+			target, status = r.src.Readlink(path, r.context)
+			if status.Ok() {
+				status = r.dst.Symlink(target, path, r.context)
+			}
+		}
+		// Timestamps cannot be set on symlinks
+		if !status.Ok() {
+			return fmt.Errorf("Symlink %q: %v", path, status)
+		}
+		return nil
+	default:
+		if !r.exists(path) {
+			status = r.dst.Mknod(path, a.Mode, uint32(a.Rdev), r.context)
+		}
+	}
+	if !status.Ok() {
+		return fmt.Errorf("%q: %v", path, status)
+	}
+	// Set the timestamps last, after the content (or, for directories,
+	// all children) have been copied.
+	atime := time.Unix(int64(a.Atime), int64(a.Atimensec))
+	mtime := time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+	status = r.dst.Utimens(path, &atime, &mtime, r.context)
+	if !status.Ok() {
+		return fmt.Errorf("Utimens %q: %v", path, status)
+	}
+	return nil
+}
+
+// copyFile copies the regular file "path" with attributes "a". A file with
+// the same size and mtime in the destination has been copied by an earlier
+// run and is skipped. A copy that fails half-way is deleted again.
+func (r *reencryptor) copyFile(path string, a *fuse.Attr) (err error) {
+	if d, status := r.dst.GetAttr(path, r.context); status.Ok() {
+		if d.Size == a.Size && d.Mtime == a.Mtime && d.Mtimensec == a.Mtimensec {
+			r.skipped++
+			return nil
+		}
+		// Partial copy from an earlier run
+		status = r.dst.Unlink(path, r.context)
+		if !status.Ok() {
+			return fmt.Errorf("Unlink %q: %v", path, status)
+		}
+	}
+	src, status := r.src.Open(path, uint32(os.O_RDONLY), r.context)
+	if !status.Ok() {
+		return fmt.Errorf("Open %q: %v", path, status)
+	}
+	defer src.Release()
+	dst, status := r.dst.Create(path, uint32(os.O_WRONLY), a.Mode&07777, r.context)
+	if !status.Ok() {
+		return fmt.Errorf("Create %q: %v", path, status)
+	}
+	defer dst.Release()
+	defer func() {
+		if err != nil {
+			r.dst.Unlink(path, r.context)
+		}
+	}()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off := uint64(0); off < a.Size; {
+		res, status := src.Read(buf, int64(off))
+		if !status.Ok() {
+			return fmt.Errorf("Read %q at %d: %v", path, off, status)
+		}
+		data, status := res.Bytes(buf)
+		if !status.Ok() {
+			return fmt.Errorf("Read %q at %d: %v", path, off, status)
+		}
+		if len(data) == 0 {
+			break
+		}
+		_, status = dst.Write(data, int64(off))
+		if !status.Ok() {
+			return fmt.Errorf("Write %q at %d: %v", path, off, status)
+		}
+		off += uint64(len(data))
+		r.bytes += uint64(len(data))
+	}
+	r.files++
+	r.progress()
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/mount"
+)
+
+// runCommand runs "command" while the filesystem is mounted
+// ("gocryptfs CIPHERDIR MOUNTPOINT -- CMD ARGS..."). When the command exits,
+// for whatever reason, the filesystem is unmounted and the keys are wiped.
+// Returns the exit code of the command, or 128+n if it was killed by signal
+// n, like a shell does.
+func runCommand(h *mount.Handle, command []string) int {
+	go h.Serve()
+	if err := h.WaitMount(); err != nil {
+		tlog.Fatal.Printf("WaitMount: %v", err)
+		h.Unmount()
+		h.Wait()
+		return exitcodes.FuseNewServer
+	}
+	// SIGINT and SIGTERM are passed on to the command. We unmount once it
+	// has exited.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	ret := 0
+	if err := cmd.Start(); err != nil {
+		tlog.Fatal.Printf("Could not run command: %v", err)
+		ret = exitcodes.RunCommand
+	} else {
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- cmd.Wait()
+		}()
+		var err error
+	loop:
+		for {
+			select {
+			case sig := <-sigs:
+				tlog.Debug.Printf("runCommand: passing %v to the command", sig)
+				cmd.Process.Signal(sig)
+			case err = <-waitErr:
+				break loop
+			}
+		}
+		ret = commandExitCode(err)
+		tlog.Debug.Printf("runCommand: command exited with code %d", ret)
+	}
+	if err := h.Unmount(); err != nil {
+		tlog.Warn.Printf("Unmount failed: %v", err)
+	}
+	h.Wait()
+	return ret
+}
+
+// commandExitCode converts the error returned by exec.Cmd.Wait into an exit
+// code.
+func commandExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				return 128 + int(ws.Signal())
+			}
+			return ws.ExitStatus()
+		}
+	}
+	tlog.Warn.Printf("Command failed: %v", err)
+	return exitcodes.RunCommand
+}
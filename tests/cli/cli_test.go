@@ -3,15 +3,23 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
@@ -63,6 +71,231 @@ func TestInitReverse(t *testing.T) {
 	}
 }
 
+// Test -init with -encrypted-diriv
+func TestInitEncryptedDirIV(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-encrypted-diriv")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagEncryptedDirIV) {
+		t.Error("EncryptedDirIV flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err = os.Mkdir(mnt+"/dir1", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/dir1/file1", []byte("somecontent"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Root diriv plus the one in dir1, both with nonce, IV and tag
+	matches, _ := filepath.Glob(dir + "/*/gocryptfs.diriv")
+	matches = append(matches, dir+"/gocryptfs.diriv")
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 48 {
+			t.Errorf("%s: wrong size %d", m, fi.Size())
+		}
+	}
+	if len(matches) != 2 {
+		t.Errorf("found %d diriv files", len(matches))
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	content, err := ioutil.ReadFile(mnt + "/dir1/file1")
+	if err != nil {
+		t.Error(err)
+	} else if string(content) != "somecontent" {
+		t.Errorf("wrong content: %q", string(content))
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
+// Test -init with -symlink-files: symlinks are stored as regular files and
+// long targets survive
+func TestInitSymlinkFiles(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-symlink-files")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagSymlinkFiles) {
+		t.Errorf("SymlinkFiles not set: %v", c.FeatureFlags)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	target := strings.Repeat("x", 4000)
+	if err = os.Symlink(target, mnt+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	out, err := os.Readlink(mnt + "/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != target {
+		t.Errorf("wrong target, got %d bytes", len(out))
+	}
+	// No symlinks in CIPHERDIR
+	cNames, err := filepath.Glob(dir + "/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range cNames {
+		if fi, err := os.Lstat(n); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("%s is a symlink", n)
+		}
+	}
+}
+
+// Test -init with -name-padding: names of different lengths get the same
+// ciphertext length, long names still work
+func TestInitNamePadding(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-name-padding=64")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagNamePadding) || c.NamePadding != 64 {
+		t.Errorf("NamePadding not set correctly: %v %d", c.FeatureFlags, c.NamePadding)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	names := []string{"a", "abcdefghijklmnopqrstuvwxyz", strings.Repeat("x", 200)}
+	for _, n := range names {
+		if err = ioutil.WriteFile(mnt+"/"+n, []byte(n), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+	cNames, err := filepath.Glob(dir + "/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var short []string
+	for _, m := range cNames {
+		b := filepath.Base(m)
+		if b == configfile.ConfDefaultName || b == "gocryptfs.diriv" || strings.HasPrefix(b, "gocryptfs.longname.") {
+			continue
+		}
+		short = append(short, b)
+	}
+	if len(short) != 2 || len(short[0]) != len(short[1]) {
+		t.Errorf("short names should have the same length: %v", short)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	for _, n := range names {
+		content, err := ioutil.ReadFile(mnt + "/" + n)
+		if err != nil || string(content) != n {
+			t.Errorf("%q: wrong content %q, err=%v", n, content, err)
+		}
+	}
+}
+
+// Test -label and -set-label
+func TestLabel(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-label", "my files")
+	conf := dir + "/" + configfile.ConfDefaultName
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-info", dir).CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "Label:        my files\n") {
+		t.Errorf("label missing from -info output:\n%s", out)
+	}
+	// Changing the label does not need the password
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-set-label", "backup 2", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "backup 2" {
+		t.Errorf("wrong label %q", c.Label)
+	}
+	// Control characters are rejected
+	err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-set-label", "a\nb", dir).Run()
+	if err == nil {
+		t.Fatal("should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: want=%d have=%d", exitcodes.Usage, exitCode)
+	}
+	// Empty label removes it
+	if err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-set-label", "", dir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	js, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(js), "Label") {
+		t.Errorf("empty label should not be stored:\n%s", js)
+	}
+}
+
+// fingerprint runs "gocryptfs -fingerprint" on "dir" and returns the output
+func fingerprint(t *testing.T, dir string, extraArgs ...string) string {
+	args := []string{"-q", "-fingerprint", "-extpass", "echo test"}
+	args = append(args, extraArgs...)
+	args = append(args, dir)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Test -fingerprint
+func TestFingerprint(t *testing.T) {
+	dir1 := test_helpers.InitFS(t)
+	// dir2 shares the master key with dir1
+	dir2 := test_helpers.InitFS(t)
+	js, err := ioutil.ReadFile(dir1 + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir2+"/"+configfile.ConfDefaultName, js, 0400); err != nil {
+		t.Fatal(err)
+	}
+	dir3 := test_helpers.InitFS(t)
+	fp1 := fingerprint(t, dir1)
+	if len(fp1) != 35 {
+		t.Fatalf("malformed fingerprint %q", fp1)
+	}
+	// Stable
+	if fp := fingerprint(t, dir1); fp != fp1 {
+		t.Errorf("fingerprint changed: %q -> %q", fp1, fp)
+	}
+	if fp := fingerprint(t, dir2); fp != fp1 {
+		t.Errorf("same master key, different fingerprint: %q vs %q", fp1, fp)
+	}
+	if fp := fingerprint(t, dir3); fp == fp1 {
+		t.Errorf("different master key, same fingerprint %q", fp)
+	}
+	// The fingerprint is computed from the master key, not the config file
+	zerokey := "00000000-00000000-00000000-00000000-00000000-00000000-00000000-00000000"
+	if fp := fingerprint(t, dir1, "-masterkey", zerokey); fp != "1c138b9a-c7bb4071-d6541398-56a3d639" {
+		t.Errorf("zero key: wrong fingerprint %q", fp)
+	}
+}
+
 func testPasswd(t *testing.T, dir string, extraArgs ...string) {
 	// Change password using "-extpass"
 	args := []string{"-q", "-passwd", "-extpass", "echo test"}
@@ -133,6 +366,68 @@ func TestPasswd(t *testing.T) {
 	}
 }
 
+// Test -change-kdf: the scrypt parameters change, the password does not
+func TestChangeKDF(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	file1 := mnt + "/file1"
+	if err := ioutil.WriteFile(file1, []byte("somecontent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	conf := dir + "/" + configfile.ConfDefaultName
+	_, c, err := configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldParams := c.ScryptObject.Params()
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-change-kdf", "-scryptn", "12",
+		"-scryptp", "2", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := configfile.ScryptParams{LogN: 12, R: oldParams.R, P: 2}
+	if p := c.ScryptObject.Params(); p != want {
+		t.Errorf("wrong scrypt parameters: want %s, have %s", want, p)
+	}
+	// Nothing to change
+	err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-change-kdf", "-scryptn", "12",
+		"-extpass", "echo test", dir).Run()
+	if err == nil {
+		t.Fatal("should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: want=%d have=%d", exitcodes.Usage, exitCode)
+	}
+	// Wrong password
+	err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-change-kdf", "-scryptn", "13",
+		"-extpass", "echo wrong", dir).Run()
+	if err == nil {
+		t.Fatal("should have failed")
+	}
+	exitCode = err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("wrong exit code: want=%d have=%d", exitcodes.PasswordIncorrect, exitCode)
+	}
+	// Mount with the unchanged password
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	content, err := ioutil.ReadFile(file1)
+	if err != nil {
+		t.Error(err)
+	} else if string(content) != "somecontent" {
+		t.Errorf("wrong content: %q", string(content))
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
 // Test -passwd with -masterkey
 func TestPasswdMasterkey(t *testing.T) {
 	// Create FS
@@ -337,6 +632,54 @@ func TestMountPasswordIncorrect(t *testing.T) {
 	}
 }
 
+// TestInitEmptyPassword checks that "-init" rejects an empty password unless
+// "-allow-empty-password" is passed, and that the resulting filesystem
+// mounts with the empty password.
+func TestInitEmptyPassword(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo", "-scryptn=10", dir)
+	if cmd.Run() == nil {
+		t.Fatal("-init with an empty password should have failed")
+	}
+	if _, err = os.Stat(dir + "/" + configfile.ConfDefaultName); !os.IsNotExist(err) {
+		t.Errorf("config file was created: %v", err)
+	}
+
+	dir = test_helpers.InitFS(t, "-extpass", "echo", "-allow-empty-password")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo")
+	err = ioutil.WriteFile(mnt+"/foo", []byte("bar"), 0600)
+	test_helpers.UnmountPanic(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A wrong password still fails
+	err = test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-wpanic=false")
+	if err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Error("mounting with the wrong password should have failed")
+	}
+}
+
+// TestMountEmptyPassword checks that mounting a normal filesystem with an
+// empty password fails with the PasswordEmpty exit code.
+func TestMountEmptyPassword(t *testing.T) {
+	cDir := test_helpers.InitFS(t) // Create filesystem with password "test"
+	pDir := cDir + ".mnt"
+	err := test_helpers.Mount(cDir, pDir, false, "-extpass", "echo", "-wpanic=false")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mounting with an empty password should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.PasswordEmpty {
+		t.Errorf("want=%d, got=%d", exitcodes.PasswordEmpty, exitCode)
+	}
+}
+
 // TestPasswdPasswordIncorrect makes sure the correct exit code is used when the password
 // was incorrect while changing the password
 func TestPasswdPasswordIncorrect(t *testing.T) {
@@ -415,3 +758,1093 @@ func TestMountBackground(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+// Test -init with -compress: file content must survive a round trip, and a
+// compressible file must take less space than its plaintext.
+func TestInitCompress(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-compress")
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagCompression) {
+		t.Fatal("Compression flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	compressible := bytes.Repeat([]byte("gocryptfs "), 10000)
+	incompressible := make([]byte, 100000)
+	rand.Read(incompressible)
+	for name, content := range map[string][]byte{"c": compressible, "i": incompressible} {
+		path := mnt + "/" + name
+		err = ioutil.WriteFile(path, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Overwrite a range in the middle to exercise read-modify-write
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt([]byte("xyz"), 50000)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(content[50000:], "xyz")
+		back, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(back, content) {
+			t.Errorf("%s: content mismatch", name)
+		}
+		test_helpers.VerifySize(t, path, len(content))
+	}
+	// The ciphertext of the compressible file should be mostly holes
+	// (assuming the backing filesystem supports hole punching).
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var minDu int64 = -1
+	for _, fi := range fis {
+		if fi.Size() < 100000 {
+			continue
+		}
+		f, err := os.Open(dir + "/" + fi.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		du := test_helpers.Du(t, int(f.Fd()))
+		f.Close()
+		if minDu < 0 || du < minDu {
+			minDu = du
+		}
+	}
+	if minDu < 0 || minDu > 50000 {
+		t.Errorf("compressible file uses %d bytes on disk", minDu)
+	}
+}
+
+// TestInitKeyFile tests "-init -keyfile": the master key is stored in a
+// separate file and mounting works without a password.
+func TestInitKeyFile(t *testing.T) {
+	keyFile := test_helpers.TmpDir + "/TestInitKeyFile.key"
+	os.Remove(keyFile)
+	dir := test_helpers.InitFS(t, "-keyfile", keyFile)
+	_, c, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagKeyFile) {
+		t.Fatal("KeyFile flag should be set but is not")
+	}
+	fi, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != cryptocore.KeyLen {
+		t.Errorf("key file has wrong size %d", fi.Size())
+	}
+	// Mount using the path stored in the config file
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt)
+	err = ioutil.WriteFile(mnt+"/foo", []byte("bar"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Mount using an explicit path
+	keyFile2 := keyFile + ".moved"
+	os.Remove(keyFile2)
+	err = os.Rename(keyFile, keyFile2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-keyfile", keyFile2)
+	content, err := ioutil.ReadFile(mnt + "/foo")
+	if err != nil {
+		t.Error(err)
+	} else if string(content) != "bar" {
+		t.Errorf("wrong content: %q", content)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Changing the password makes no sense
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-extpass", "echo test", dir)
+	if cmd.Run() == nil {
+		t.Error("-passwd should have failed")
+	}
+}
+
+// TestMountKeyFileBad makes sure that mounting with a missing or broken key
+// file fails with the right exit code.
+func TestMountKeyFileBad(t *testing.T) {
+	keyFile := test_helpers.TmpDir + "/TestMountKeyFileBad.key"
+	os.Remove(keyFile)
+	dir := test_helpers.InitFS(t, "-keyfile", keyFile)
+	mnt := dir + ".mnt"
+	short := keyFile + ".short"
+	err := ioutil.WriteFile(short, make([]byte, cryptocore.KeyLen/2), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := keyFile + ".wrong"
+	err = ioutil.WriteFile(wrong, make([]byte, cryptocore.KeyLen), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kf := range []string{keyFile + ".missing", short, wrong} {
+		err = test_helpers.Mount(dir, mnt, false, "-keyfile", kf, "-wpanic=false")
+		if err == nil {
+			test_helpers.UnmountPanic(mnt)
+			t.Errorf("%s: mount should have failed", kf)
+			continue
+		}
+		exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		if exitCode != exitcodes.KeyFile {
+			t.Errorf("%s: want=%d, got=%d", kf, exitcodes.KeyFile, exitCode)
+		}
+	}
+}
+
+// TestCheck tests "-check" on a healthy and on a corrupted file.
+func TestCheck(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	err := ioutil.WriteFile(mnt+"/foo", make([]byte, 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	check := func() (string, int) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-check", "-extpass", "echo test", dir, "foo")
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			return string(out), 0
+		}
+		return string(out), err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	out, code := check()
+	if code != 0 {
+		t.Fatalf("healthy file: exit code %d, output: %s", code, out)
+	}
+	if !strings.Contains(out, "3 blocks checked") {
+		t.Errorf("unexpected output: %s", out)
+	}
+	// Corrupt the second block
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, fi := range fis {
+		if fi.Size() > 10000 {
+			cFile = dir + "/" + fi.Name()
+		}
+	}
+	if cFile == "" {
+		t.Fatal("ciphertext file not found")
+	}
+	f, err := os.OpenFile(cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xaa, 0xbb}, 18+4128+100)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, code = check()
+	if code != exitcodes.CheckFailed {
+		t.Errorf("corrupt file: want exit code %d, got %d", exitcodes.CheckFailed, code)
+	}
+	if !strings.Contains(out, "first failing block: 1") {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
+
+// TestReencrypt tests that "-reencrypt" produces a filesystem that contains
+// the same files but can only be read with the new master key.
+func TestReencrypt(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	content := make([]byte, 100000)
+	rand.Read(content)
+	err := os.Mkdir(mnt+"/dir", 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/dir/foo", content, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("dir/foo", mnt+"/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	newDir := dir + ".new"
+	err = os.Mkdir(newDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Running it twice exercises the resume logic
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-reencrypt", "-extpass", "echo test", dir, newDir)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+	oldKey, _, err := configfile.LoadConfFile(dir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, _, err := configfile.LoadConfFile(newDir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldKey, newKey) {
+		t.Fatal("master key was not changed")
+	}
+	// Mount with the password (= new key)
+	test_helpers.MountOrFatal(t, newDir, mnt, "-extpass=echo test")
+	buf, err := ioutil.ReadFile(mnt + "/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, content) {
+		t.Error("content mismatch")
+	}
+	fi, err := os.Stat(mnt + "/dir/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("wrong permissions: %v", fi.Mode())
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Mount with the old key
+	test_helpers.MountOrFatal(t, newDir, mnt, "-masterkey", hex.EncodeToString(oldKey))
+	_, err = ioutil.ReadFile(mnt + "/dir/foo")
+	if err == nil {
+		t.Error("reading with the old master key should have failed")
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
+// TestReencryptKeepGoing checks that "-reencrypt -keep-going" copies
+// everything it can, reports every corrupt file and exits with
+// exitcodes.FilesFailed.
+func TestReencryptKeepGoing(t *testing.T) {
+	// With plaintext names, we know which ciphertext file to corrupt
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	content := make([]byte, 10000)
+	for _, name := range []string{"good1", "bad1", "good2", "bad2"} {
+		err := ioutil.WriteFile(mnt+"/"+name, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+	for _, name := range []string{"bad1", "bad2"} {
+		f, err := os.OpenFile(dir+"/"+name, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt([]byte("garbage"), 100)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	newDir := dir + ".new"
+	err := os.Mkdir(newDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-reencrypt", "-keep-going",
+		"-extpass", "echo test", dir, newDir)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		t.Fatal("-reencrypt should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.FilesFailed {
+		t.Errorf("wrong exit code: want=%d have=%d", exitcodes.FilesFailed, exitCode)
+	}
+	for _, name := range []string{"bad1", "bad2"} {
+		if !strings.Contains(stderr.String(), name) {
+			t.Errorf("%q is not reported:\n%s", name, stderr.String())
+		}
+	}
+	test_helpers.MountOrFatal(t, newDir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	for _, name := range []string{"good1", "good2"} {
+		buf, err := ioutil.ReadFile(mnt + "/" + name)
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(buf, content) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+	for _, name := range []string{"bad1", "bad2"} {
+		if _, err = os.Stat(mnt + "/" + name); !os.IsNotExist(err) {
+			t.Errorf("%s: the partial copy should have been deleted, err=%v", name, err)
+		}
+	}
+}
+
+// TestDebugFuse checks that "-debug-fuse" logs the FUSE opcodes but neither
+// file names nor file content.
+func TestDebugFuse(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	logFile, err := ioutil.TempFile(test_helpers.TmpDir, "debug-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	err = os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without "-fg" and with "-nosyslog", the background process keeps
+	// writing to our log file.
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-nosyslog", "-debug-fuse",
+		"-extpass", "echo test", dir, mnt)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const secretName = "secret-name-4711"
+	const secretContent = "secret-content-0815"
+	err = ioutil.WriteFile(mnt+"/"+secretName, []byte(secretContent), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadFile(mnt + "/" + secretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Give the background process a moment to write its last lines
+	time.Sleep(100 * time.Millisecond)
+	out, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"LOOKUP", "CREATE", "WRITE", "READ", "RELEASE"} {
+		if !bytes.Contains(out, []byte(op)) {
+			t.Errorf("opcode %s missing from the log", op)
+		}
+	}
+	for _, secret := range []string{secretName, secretContent} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("%q leaked into the log", secret)
+		}
+	}
+}
+
+// healthCheck runs "gocryptfs -healthcheck" on "mnt" and returns the exit code
+func healthCheck(t *testing.T, mnt string) int {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-healthcheck", "-healthcheck-timeout", "2s", mnt)
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err == nil {
+		return 0
+	}
+	return err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+}
+
+// TestHealthCheck checks that "-healthcheck" reports a live mount as healthy,
+// and an unmounted directory and a mount whose process died as unhealthy.
+func TestHealthCheck(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := healthCheck(t, mnt); code != exitcodes.HealthCheck {
+		t.Errorf("not mounted: want exit code %d, got %d", exitcodes.HealthCheck, code)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if code := healthCheck(t, mnt); code != 0 {
+		t.Errorf("mounted: want exit code 0, got %d", code)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Kill the gocryptfs process. This leaves a stale mount behind that
+	// returns ENOTCONN.
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fg", "-nosyslog",
+		"-extpass", "echo test", dir, mnt)
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; healthCheck(t, mnt) != 0; i++ {
+		if i > 50 {
+			cmd.Process.Kill()
+			t.Fatal("mount did not become healthy")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if code := healthCheck(t, mnt); code != exitcodes.HealthCheck {
+		t.Errorf("stale mount: want exit code %d, got %d", exitcodes.HealthCheck, code)
+	}
+	test_helpers.UnmountErr(mnt)
+}
+
+// TestFindPath tests "-findpath" on a short-named file, a long-named file,
+// a directory and a nonexistent path.
+func TestFindPath(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	longName := strings.Repeat("x", 200)
+	err := ioutil.WriteFile(mnt+"/short", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(mnt+"/dir1", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/dir1/"+longName, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	findPath := func(path string) ([]string, int) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-findpath", "-extpass", "echo test", dir, path)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		return strings.Split(strings.TrimSpace(string(out)), "\n"), 0
+	}
+	// Every printed path must exist and be inside CIPHERDIR
+	checkPaths := func(paths []string, want int) {
+		if len(paths) != want {
+			t.Errorf("want %d paths, got %q", want, paths)
+		}
+		for _, p := range paths {
+			if !strings.HasPrefix(p, dir+"/") {
+				t.Errorf("%q is not inside CIPHERDIR", p)
+			}
+			if _, err := os.Lstat(p); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	paths, code := findPath("short")
+	if code != 0 {
+		t.Fatalf("short: exit code %d", code)
+	}
+	checkPaths(paths, 1)
+	paths, code = findPath("dir1/" + longName)
+	if code != 0 {
+		t.Fatalf("long: exit code %d", code)
+	}
+	checkPaths(paths, 2)
+	if len(paths) == 2 && paths[1] != paths[0]+".name" {
+		t.Errorf("second path should be the .name file: %q", paths)
+	}
+	paths, code = findPath("/dir1/")
+	if code != 0 {
+		t.Fatalf("dir: exit code %d", code)
+	}
+	checkPaths(paths, 2)
+	if len(paths) == 2 && paths[1] != paths[0]+"/gocryptfs.diriv" {
+		t.Errorf("second path should be the diriv: %q", paths)
+	}
+	_, code = findPath("nonexistent")
+	if code != exitcodes.FindPath {
+		t.Errorf("nonexistent: want exit code %d, got %d", exitcodes.FindPath, code)
+	}
+}
+
+// TestSnapshot mounts a copy of CIPHERDIR with "-snapshot" while the original
+// is mounted read-write, and checks that the snapshot is isolated from the
+// changes and read-only. It also mounts the live CIPHERDIR with "-snapshot"
+// and checks that changes show up without delay.
+func TestSnapshot(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	err := ioutil.WriteFile(mnt+"/foo", []byte("v1"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := dir + ".snap"
+	out, err := exec.Command("cp", "-a", dir, snap).CombinedOutput()
+	if err != nil {
+		t.Fatalf("cp: %v, %s", err, out)
+	}
+	snapMnt := snap + ".mnt"
+	test_helpers.MountOrFatal(t, snap, snapMnt, "-extpass=echo test", "-snapshot")
+	defer test_helpers.UnmountPanic(snapMnt)
+	liveMnt := dir + ".live"
+	test_helpers.MountOrFatal(t, dir, liveMnt, "-extpass=echo test", "-snapshot")
+	defer test_helpers.UnmountPanic(liveMnt)
+	// Populate the caches of the "-snapshot" mounts
+	for _, m := range []string{snapMnt, liveMnt} {
+		if _, err = os.Stat(m + "/bar"); !os.IsNotExist(err) {
+			t.Errorf("%s/bar: want ENOENT, got %v", m, err)
+		}
+		content, err := ioutil.ReadFile(m + "/foo")
+		if err != nil || string(content) != "v1" {
+			t.Errorf("%s/foo: %q, %v", m, content, err)
+		}
+	}
+	// Change the original
+	err = ioutil.WriteFile(mnt+"/foo", []byte("v2 longer"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/bar", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot does not see the changes
+	content, err := ioutil.ReadFile(snapMnt + "/foo")
+	if err != nil || string(content) != "v1" {
+		t.Errorf("snapshot foo: %q, %v", content, err)
+	}
+	if _, err = os.Stat(snapMnt + "/bar"); !os.IsNotExist(err) {
+		t.Errorf("snapshot bar: want ENOENT, got %v", err)
+	}
+	// The live read-only mount sees them immediately
+	content, err = ioutil.ReadFile(liveMnt + "/foo")
+	if err != nil || string(content) != "v2 longer" {
+		t.Errorf("live foo: %q, %v", content, err)
+	}
+	if _, err = os.Stat(liveMnt + "/bar"); err != nil {
+		t.Errorf("live bar: %v", err)
+	}
+	// Both are read-only
+	for _, m := range []string{snapMnt, liveMnt} {
+		err = ioutil.WriteFile(m+"/baz", nil, 0600)
+		if err == nil || !strings.Contains(err.Error(), "read-only") {
+			t.Errorf("%s: write should have failed with EROFS, got %v", m, err)
+		}
+	}
+}
+
+// TestAllowRootAllowOther checks that "-allow_root" cannot be combined with
+// "-allow_other"
+func TestAllowRootAllowOther(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := test_helpers.Mount(dir, mnt, false, "-extpass=echo test", "-allow_root", "-allow_other")
+	if err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("mount should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want=%d, got=%d", exitcodes.Usage, exitCode)
+	}
+}
+
+// TestACLNeedsAllowOther checks that "-acl" is rejected without
+// "-allow_other"
+func TestACLNeedsAllowOther(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := test_helpers.Mount(dir, mnt, false, "-extpass=echo test", "-acl")
+	if err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("mount should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want=%d, got=%d", exitcodes.Usage, exitCode)
+	}
+}
+
+// runWithCommand runs "gocryptfs CIPHERDIR MOUNTPOINT -- CMD..." and returns
+// the exit code.
+func runWithCommand(t *testing.T, dir string, mnt string, command ...string) int {
+	args := []string{"-q", "-extpass", "echo test", dir, mnt, "--"}
+	args = append(args, command...)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatal(err)
+	}
+	return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+}
+
+// Test "gocryptfs CIPHERDIR MOUNTPOINT -- CMD ARGS..."
+func TestMountRunCommand(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	code := runWithCommand(t, dir, mnt, "sh", "-c", "echo hello > "+mnt+"/foo; exit 3")
+	if code != 3 {
+		t.Errorf("wrong exit code: want=3 have=%d", code)
+	}
+	if test_helpers.UnmountErr(mnt) == nil {
+		t.Fatal("filesystem is still mounted")
+	}
+	if _, err := os.Stat(mnt + "/foo"); !os.IsNotExist(err) {
+		t.Errorf("foo should only exist in the mounted filesystem: %v", err)
+	}
+	// The command is killed. We still unmount.
+	code = runWithCommand(t, dir, mnt, "sh", "-c", "kill -9 $$")
+	if code != 128+int(syscall.SIGKILL) {
+		t.Errorf("wrong exit code: want=%d have=%d", 128+int(syscall.SIGKILL), code)
+	}
+	if test_helpers.UnmountErr(mnt) == nil {
+		t.Fatal("filesystem is still mounted after the command was killed")
+	}
+	code = runWithCommand(t, dir, mnt, "/nonexistent/command")
+	if code != exitcodes.RunCommand {
+		t.Errorf("wrong exit code: want=%d have=%d", exitcodes.RunCommand, code)
+	}
+	if test_helpers.UnmountErr(mnt) == nil {
+		t.Fatal("filesystem is still mounted after the command failed to start")
+	}
+	// The file has been stored encrypted
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(mnt + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello\n" {
+		t.Errorf("wrong content: %q", content)
+	}
+}
+
+// TestDiff checks that "-diff" reports nothing for a copy of a filesystem,
+// and exactly the modified file once it has been changed.
+func TestDiff(t *testing.T) {
+	dirA := test_helpers.InitFS(t)
+	mnt := dirA + ".mnt"
+	test_helpers.MountOrFatal(t, dirA, mnt, "-extpass=echo test")
+	err := os.Mkdir(mnt+"/dir", 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"foo", "dir/bar", "dir/baz"} {
+		err = ioutil.WriteFile(mnt+"/"+f, []byte("content of "+f), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Symlink("dir/bar", mnt+"/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	dirB := dirA + ".copy"
+	out, err := exec.Command("cp", "-a", dirA, dirB).CombinedOutput()
+	if err != nil {
+		t.Fatalf("cp: %v: %s", err, out)
+	}
+	diff := func() ([]string, int) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-diff", "-extpass", "echo test", dirA, dirB)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		code := 0
+		if err != nil {
+			code = err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		if len(out) == 0 {
+			return nil, code
+		}
+		return strings.Split(strings.TrimSpace(string(out)), "\n"), code
+	}
+	if lines, code := diff(); len(lines) != 0 || code != 0 {
+		t.Fatalf("identical filesystems: exit code %d, output %q", code, lines)
+	}
+	// Same size, different content
+	test_helpers.MountOrFatal(t, dirB, mnt, "-extpass=echo test")
+	err = ioutil.WriteFile(mnt+"/dir/baz", []byte("CONTENT of dir/baz"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	lines, code := diff()
+	if code != exitcodes.Diff {
+		t.Errorf("wrong exit code %d", code)
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "dir/baz: ") || !strings.Contains(lines[0], "content") {
+		t.Errorf("want exactly dir/baz with a content difference, got %q", lines)
+	}
+}
+
+// TestEphemeral mounts a filesystem that only lives in memory, writes and
+// reads a file, and checks that nothing is left after unmount.
+func TestEphemeral(t *testing.T) {
+	// Same order as gocryptfs
+	var shm string
+	for _, d := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"} {
+		if mem, _ := syscallcompat.IsMemoryFS(d); d != "" && mem {
+			shm = d
+			break
+		}
+	}
+	if shm == "" {
+		t.Skip("no tmpfs found")
+	}
+	leftovers := func() []string {
+		m, _ := filepath.Glob(shm + "/gocryptfs-ephemeral-*")
+		return m
+	}
+	before := len(leftovers())
+	mnt := test_helpers.TmpDir + "/ephemeral.mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-wpanic", "-nosyslog", "-ephemeral", mnt)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers()) != before+1 {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatalf("CIPHERDIR was not created in %s", shm)
+	}
+	content := make([]byte, 100000)
+	rand.Read(content)
+	err = ioutil.WriteFile(mnt+"/foo", content, 0600)
+	if err != nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadFile(mnt + "/foo")
+	test_helpers.UnmountPanic(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Error("wrong content")
+	}
+	// UnmountPanic returns before the gocryptfs process exits
+	for i := 0; i < 50 && len(leftovers()) > before; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(leftovers()) != before {
+		t.Error("CIPHERDIR has not been deleted")
+	}
+}
+
+// TestNotifyChanges changes CIPHERDIR behind our back and checks that
+// "-notify-changes" makes the changes visible in the mount before the
+// cache timeout of one second.
+func TestNotifyChanges(t *testing.T) {
+	// With plaintext names, we can copy ciphertext files to a new name
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-notify-changes")
+	defer test_helpers.UnmountPanic(mnt)
+	err := ioutil.WriteFile(mnt+"/a", []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// waitFor polls "cond" for half the cache timeout
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; i < 50; i++ {
+			if cond() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("%s: change not visible after 500ms", what)
+	}
+	// Caches a negative entry for "b" and a positive one for "a"
+	if _, err = os.Stat(mnt + "/b"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(mnt + "/a"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dir + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/b", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("create", func() bool {
+		_, err := os.Stat(mnt + "/b")
+		return err == nil
+	})
+	if buf, err := ioutil.ReadFile(mnt + "/b"); err != nil || string(buf) != "foo" {
+		t.Errorf("reading the new file: %q, %v", buf, err)
+	}
+	if err = os.Remove(dir + "/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("delete", func() bool {
+		_, err := os.Stat(mnt + "/a")
+		return os.IsNotExist(err)
+	})
+}
+
+// TestDirectIO mounts the same CIPHERDIR twice and checks that a reader on
+// one mount sees writes made through the other mount immediately when the
+// file is selected by "-direct-io", although it has been cached before.
+func TestDirectIO(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mntA := dir + ".mntA"
+	mntB := dir + ".mntB"
+	opts := []string{"-extpass=echo test", "-sharedstorage", "-direct-io=*.log"}
+	test_helpers.MountOrFatal(t, dir, mntA, opts...)
+	defer test_helpers.UnmountPanic(mntA)
+	test_helpers.MountOrFatal(t, dir, mntB, opts...)
+	defer test_helpers.UnmountPanic(mntB)
+	if err := ioutil.WriteFile(mntA+"/status.log", []byte("aaaa"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := os.Open(mntB + "/status.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 4)
+	if _, err = r.ReadAt(buf, 0); err != nil || string(buf) != "aaaa" {
+		t.Fatalf("first read: %q, %v", buf, err)
+	}
+	w, err := os.OpenFile(mntA+"/status.log", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err = w.WriteAt([]byte("bbbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.ReadAt(buf, 0); err != nil || string(buf) != "bbbb" {
+		t.Errorf("stale read: %q, %v", buf, err)
+	}
+}
+
+// TestFindDup checks that "-finddup" reports files with the same content,
+// and only those.
+func TestFindDup(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := os.Mkdir(mnt+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a":       "same content",
+		"dir/b":   "same content",
+		"unique":  "other content",
+		"samelen": "same CONTENT",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(mnt+"/"+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-finddup", "-extpass", "echo test", dir)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "a\ndir/b\n\n" {
+		t.Errorf("wrong output: %q", out)
+	}
+}
+
+// TestPassenv mounts with the password from an environment variable and
+// checks that it cannot be combined with another password source.
+func TestPassenv(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	os.Setenv("GOCRYPTFS_TEST_PW", "test")
+	defer os.Unsetenv("GOCRYPTFS_TEST_PW")
+	test_helpers.MountOrFatal(t, dir, mnt, "-passenv", "GOCRYPTFS_TEST_PW")
+	test_helpers.UnmountPanic(mnt)
+	err := test_helpers.Mount(dir, mnt, false, "-passenv", "GOCRYPTFS_TEST_PW", "-extpass", "echo test")
+	if err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("-passenv together with -extpass should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want=%d, got=%d", exitcodes.Usage, exitCode)
+	}
+}
+
+// TestPassenvCleared checks that the variable is removed from the
+// environment after reading it, so a command run on the mounted filesystem
+// does not see it.
+func TestPassenvCleared(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passenv", "GOCRYPTFS_TEST_PW", dir, mnt, "--",
+		"sh", "-c", `test -z "${GOCRYPTFS_TEST_PW+set}"`)
+	cmd.Env = append(os.Environ(), "GOCRYPTFS_TEST_PW=test")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Errorf("GOCRYPTFS_TEST_PW is still set in the environment: %v", err)
+	}
+}
+
+// TestBackingDirGone renames CIPHERDIR away under a live mount and checks
+// that operations fail with EIO and that the mount can still be unmounted.
+func TestBackingDirGone(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/foo", []byte("foo"), 0600); err != nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir, dir+".moved"); err != nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal(err)
+	}
+	// Names that the kernel has not cached yet
+	_, err := os.Stat(mnt + "/bar")
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+		t.Errorf("stat: want EIO, got %v", err)
+	}
+	_, err = ioutil.ReadDir(mnt)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+		t.Errorf("readdir: want EIO, got %v", err)
+	}
+	err = ioutil.WriteFile(mnt+"/baz", nil, 0600)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+		t.Errorf("create: want EIO, got %v", err)
+	}
+	if err = test_helpers.UnmountErr(mnt); err != nil {
+		t.Fatalf("unmount failed: %v", err)
+	}
+}
+
+// TestArchive mounts a tar archive of CIPHERDIR and checks that the files
+// can be read and that it is read-only.
+func TestArchive(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	longName := strings.Repeat("x", 200)
+	content := bytes.Repeat([]byte("archive"), 2000)
+	err := os.Mkdir(mnt+"/dir", 0700)
+	if err == nil {
+		err = ioutil.WriteFile(mnt+"/dir/"+longName, content, 0600)
+	}
+	if err == nil {
+		err = os.Symlink("dir/"+longName, mnt+"/link")
+	}
+	test_helpers.UnmountPanic(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarFile := dir + ".tar"
+	cmd := exec.Command("tar", "-cf", tarFile, "-C", dir, ".")
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, tarFile, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	data, err := ioutil.ReadFile(mnt + "/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("wrong content")
+	}
+	target, err := os.Readlink(mnt + "/link")
+	if err != nil || target != "dir/"+longName {
+		t.Errorf("readlink: %q %v", target, err)
+	}
+	err = ioutil.WriteFile(mnt+"/new", nil, 0600)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EROFS {
+		t.Errorf("create: want EROFS, got %v", err)
+	}
+}
+
+// checkPprof checks that "name" is a non-empty, gzip-compressed pprof
+// profile.
+func checkPprof(t *testing.T, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Errorf("%s: not a pprof profile: %v", name, err)
+		return
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil || len(data) == 0 {
+		t.Errorf("%s: invalid or empty profile: %d bytes, %v", name, len(data), err)
+	}
+}
+
+// TestProfile mounts with "-cpuprofile" and "-memprofile", stops the mount
+// with SIGTERM and checks that both profiles have been written.
+func TestProfile(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cpuprofile, memprofile := dir+".cpu.pprof", dir+".mem.pprof"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fg", "-nosyslog",
+		"-cpuprofile", cpuprofile, "-memprofile", memprofile,
+		"-extpass", "echo test", dir, mnt)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; healthCheck(t, mnt) != 0; i++ {
+		if i > 50 {
+			cmd.Process.Kill()
+			t.Fatal("mount did not become healthy")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := ioutil.WriteFile(mnt+"/foo", bytes.Repeat([]byte("x"), 100000), 0600); err != nil {
+		t.Error(err)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	if ws := cmd.ProcessState.Sys().(syscall.WaitStatus); ws.Signaled() {
+		t.Fatalf("gocryptfs was killed by %v instead of exiting", ws.Signal())
+	}
+	checkPprof(t, cpuprofile)
+	checkPprof(t, memprofile)
+}
@@ -1,9 +1,15 @@
 package defaults
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/ctlsock"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
@@ -96,3 +102,245 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// TestCtlSockOpenFiles opens two files and checks that they show up in the
+// "OpenFiles" response with the right mode and path, also after a rename.
+func TestCtlSockOpenFiles(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	req := ctlsock.RequestStruct{OpenFiles: true}
+	resp := test_helpers.QueryCtlSock(t, sock, req)
+	if resp.ErrNo != 0 || resp.Result != "" {
+		t.Fatalf("no files should be open: %+v", resp)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := os.Create(pDir + "/dir/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	if err = ioutil.WriteFile(pDir+"/file2", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.Open(pDir + "/file2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	// Each line is MODE<tab>SECONDS<tab>PATH. As the kernel sends RELEASE
+	// asynchronously, closed files may show up for a short time.
+	check := func(want []string) {
+		var got []string
+		for i := 0; i < 100; i++ {
+			resp := test_helpers.QueryCtlSock(t, sock, req)
+			if resp.ErrNo != 0 {
+				t.Fatalf("got an error reply: %+v", resp)
+			}
+			got = nil
+			for _, l := range strings.Split(resp.Result, "\n") {
+				if f := strings.Split(l, "\t"); len(f) == 3 {
+					got = append(got, f[0]+" "+f[2])
+				}
+			}
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("want %q, got %q", want, got)
+	}
+	check([]string{"rw dir/file1", "r file2"})
+	if err = os.Rename(pDir+"/dir", pDir+"/dir2"); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"rw dir2/file1", "r file2"})
+	f1.Close()
+	check([]string{"r file2"})
+}
+
+// TestCtlSockErrCode checks the ErrCode field of error responses.
+func TestCtlSockErrCode(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	testCases := []struct {
+		req  ctlsock.RequestStruct
+		code int32
+	}{
+		{ctlsock.RequestStruct{EncryptPath: "foo"}, ctlsock.ErrCodeOK},
+		{ctlsock.RequestStruct{EncryptPath: "not-existing-dir/xyz"}, ctlsock.ErrCodeNotFound},
+		{ctlsock.RequestStruct{DecryptPath: "zzzz"}, ctlsock.ErrCodeDecrypt},
+		{ctlsock.RequestStruct{DecryptPath: "!!!!"}, ctlsock.ErrCodeDecrypt},
+		{ctlsock.RequestStruct{EncryptPath: "foo", DecryptPath: "bar"}, ctlsock.ErrCodeBadRequest},
+		{ctlsock.RequestStruct{}, ctlsock.ErrCodeBadRequest},
+		{ctlsock.RequestStruct{TrashList: true, EncryptPath: "foo"}, ctlsock.ErrCodeBadRequest},
+		// Mounted without "-trash" and "-cow-snapshots"
+		{ctlsock.RequestStruct{TrashEmpty: true}, ctlsock.ErrCodeNotSupported},
+		{ctlsock.RequestStruct{SnapshotList: true}, ctlsock.ErrCodeNotSupported},
+	}
+	for i, tc := range testCases {
+		resp := test_helpers.QueryCtlSock(t, sock, tc.req)
+		if resp.ErrCode != tc.code {
+			t.Errorf("testcase %d: want ErrCode %d, got %+v", i, tc.code, resp)
+		}
+	}
+	// Invalid JSON
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write([]byte("{foo")); err != nil {
+		t.Fatal(err)
+	}
+	var resp ctlsock.ResponseStruct
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ErrCode != ctlsock.ErrCodeBadRequest {
+		t.Errorf("invalid JSON: want ErrCode %d, got %+v", ctlsock.ErrCodeBadRequest, resp)
+	}
+}
+
+// TestCtlSockStat stats a batch of paths, some of them missing, in one
+// request.
+func TestCtlSockStat(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/dir/foo", make([]byte, 5000), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("foo", pDir+"/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(pDir + "/dir/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"dir/foo", "dir/missing", "dir", "dir/link", "missing/foo", "/dir//foo"}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stat: paths})
+	if resp.ErrCode != ctlsock.ErrCodeOK || len(resp.Stat) != len(paths) {
+		t.Fatalf("wrong response: %+v", resp)
+	}
+	for i, e := range resp.Stat {
+		if e.Path != paths[i] {
+			t.Errorf("entry %d: wrong path %q", i, e.Path)
+		}
+	}
+	for _, i := range []int{0, 5} {
+		e := resp.Stat[i]
+		if e.ErrCode != 0 || e.Size != 5000 || e.Mode != syscall.S_IFREG|0640 {
+			t.Errorf("%s: wrong entry %+v", e.Path, e)
+		}
+		if int64(e.Mtime) != fi.ModTime().Unix() || int64(e.Mtimensec) != int64(fi.ModTime().Nanosecond()) {
+			t.Errorf("%s: wrong mtime %d.%d", e.Path, e.Mtime, e.Mtimensec)
+		}
+	}
+	for _, i := range []int{1, 4} {
+		e := resp.Stat[i]
+		if e.ErrCode != ctlsock.ErrCodeNotFound || e.ErrNo != int32(syscall.ENOENT) || e.ErrText == "" {
+			t.Errorf("%s: wrong entry %+v", e.Path, e)
+		}
+	}
+	if e := resp.Stat[2]; e.ErrCode != 0 || e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("%s: wrong entry %+v", e.Path, e)
+	}
+	if e := resp.Stat[3]; e.ErrCode != 0 || e.Mode&syscall.S_IFMT != syscall.S_IFLNK || e.Size != 3 {
+		t.Errorf("%s: wrong entry %+v", e.Path, e)
+	}
+}
+
+// TestCtlSockCapabilities checks that the "Capabilities" request reports
+// the case sensitivity the filesystem has been mounted with.
+func TestCtlSockCapabilities(t *testing.T) {
+	for _, ci := range []bool{false, true} {
+		cDir := test_helpers.InitFS(t)
+		pDir := cDir + ".mnt"
+		sock := cDir + ".sock"
+		opts := []string{"-ctlsock=" + sock, "-extpass", "echo test"}
+		if ci {
+			opts = append(opts, "-caseinsensitive")
+		}
+		test_helpers.MountOrFatal(t, cDir, pDir, opts...)
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Capabilities: true})
+		test_helpers.UnmountPanic(pDir)
+		if resp.ErrNo != 0 || resp.Capabilities == nil {
+			t.Fatalf("-caseinsensitive=%v: bad response %+v", ci, resp)
+		}
+		if resp.Capabilities.CaseSensitive == ci {
+			t.Errorf("-caseinsensitive=%v: CaseSensitive=%v", ci, resp.Capabilities.CaseSensitive)
+		}
+	}
+}
+
+// TestCtlSockAccess checks the "Access" request for the owner of a file,
+// for another user, and for a missing path.
+func TestCtlSockAccess(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := ioutil.WriteFile(pDir+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	query := func(path string, uid uint32) ctlsock.ResponseStruct {
+		return test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Access: &ctlsock.AccessRequest{
+			Path: path,
+			Uid:  uid,
+			Gid:  uid,
+			Mode: 4 | 2,
+		}})
+	}
+	resp := query("file", uint32(os.Getuid()))
+	if resp.ErrNo != 0 || resp.Granted == nil || !*resp.Granted {
+		t.Errorf("owner: bad response %+v", resp)
+	}
+	resp = query("file", 23456)
+	if resp.ErrNo != 0 || resp.Granted == nil || *resp.Granted {
+		t.Errorf("other user: bad response %+v", resp)
+	}
+	resp = query("missing", uint32(os.Getuid()))
+	if resp.ErrNo != int32(syscall.ENOENT) || resp.Granted != nil {
+		t.Errorf("missing path: bad response %+v", resp)
+	}
+}
+
+// TestCtlSockSyncAll sends "SyncAll" while a file is open for writing
+func TestCtlSockSyncAll(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f, err := os.Create(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{SyncAll: true})
+	if resp.ErrNo != 0 || resp.ErrCode != ctlsock.ErrCodeOK {
+		t.Errorf("bad response %+v", resp)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{SyncAll: true, EncryptPath: "file"})
+	if resp.ErrCode != ctlsock.ErrCodeBadRequest {
+		t.Errorf("ambiguous request: bad response %+v", resp)
+	}
+}
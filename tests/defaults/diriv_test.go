@@ -71,3 +71,35 @@ func TestDirIVRace(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// With encrypted names, creating files called like gocryptfs control files
+// must work and must not touch the actual control files.
+func TestReservedNamesEncrypted(t *testing.T) {
+	dir := test_helpers.DefaultPlainDir + "/TestReservedNamesEncrypted"
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"gocryptfs.diriv", "gocryptfs.longname.foo", "gocryptfs.conf"}
+	for _, n := range names {
+		err = ioutil.WriteFile(dir+"/"+n, []byte("foo"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The directory must still be readable, which needs a valid
+	// gocryptfs.diriv in the ciphertext dir.
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != len(names) {
+		t.Errorf("wrong number of entries: %d", len(fis))
+	}
+	for _, n := range names {
+		buf, err := ioutil.ReadFile(dir + "/" + n)
+		if err != nil || string(buf) != "foo" {
+			t.Errorf("%q: err=%v content=%q", n, err, buf)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"runtime"
@@ -191,3 +192,91 @@ func TestWrite0200File(t *testing.T) {
 		t.Fatal("wrong restored permissions")
 	}
 }
+
+// TestMixedAlignedWrites writes a random mix of complete, block-aligned
+// blocks and unaligned ranges to one file and compares the result with the
+// expected content. Complete blocks skip Read-Modify-Write, so this makes
+// sure both write paths agree.
+func TestMixedAlignedWrites(t *testing.T) {
+	const bs = 4096
+	const fileSize = 16 * bs
+	fn := test_helpers.DefaultPlainDir + "/TestMixedAlignedWrites"
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := make([]byte, fileSize)
+	_, err = f.Write(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		var off, length int
+		if i%2 == 0 {
+			// Complete blocks
+			n := 1 + rnd.Intn(4)
+			off = rnd.Intn(fileSize/bs-n+1) * bs
+			length = n * bs
+		} else {
+			off = rnd.Intn(fileSize - 1)
+			length = 1 + rnd.Intn(fileSize-off)
+		}
+		buf := make([]byte, length)
+		rnd.Read(buf)
+		_, err = f.WriteAt(buf, int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(want[off:], buf)
+	}
+	have, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch")
+	}
+}
+
+// TestSmallWrites does many small writes at random offsets, some of them
+// beyond the end of the file, and checks the size after every write and the
+// content after reopening the file.
+func TestSmallWrites(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestSmallWrites"
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fn)
+	rnd := rand.New(rand.NewSource(1))
+	var want []byte
+	for i := 0; i < 2000; i++ {
+		buf := make([]byte, 1+rnd.Intn(300))
+		rnd.Read(buf)
+		off := rnd.Intn(len(want) + 5000)
+		if _, err = f.WriteAt(buf, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if end := off + len(buf); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], buf)
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(want)) {
+			t.Fatalf("write %d: size %d, want %d", i, fi.Size(), len(want))
+		}
+	}
+	f.Close()
+	have, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch")
+	}
+}
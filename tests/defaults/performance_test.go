@@ -129,3 +129,59 @@ func BenchmarkCreate4kB(t *testing.B) {
 func BenchmarkCreate10kB(t *testing.B) {
 	createFiles(t, t.N, 10*1024)
 }
+
+// overwrite - repeatedly overwrite a 1 MiB file with 128 KiB writes starting
+// at "skew" bytes into the first block. With skew=0, all writes consist
+// of complete blocks and no Read-Modify-Write is needed.
+func overwrite(t *testing.B, skew int64) {
+	fn := fmt.Sprintf("%s/overwrite_%d", test_helpers.DefaultPlainDir, skew)
+	const fileSize = 1024 * 1024
+	err := ioutil.WriteFile(fn, make([]byte, fileSize+skew), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fn)
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 128*1024)
+	t.SetBytes(int64(len(buf)))
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		off := int64(i*len(buf))%fileSize + skew
+		_, err = f.WriteAt(buf, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOverwriteAligned(t *testing.B) {
+	overwrite(t, 0)
+}
+
+func BenchmarkOverwriteUnaligned(t *testing.B) {
+	overwrite(t, 1)
+}
+
+// BenchmarkSmallWrites appends 100-byte writes to a file. Every write
+// reaches gocryptfs as its own request and rewrites the last block.
+func BenchmarkSmallWrites(t *testing.B) {
+	fn := test_helpers.DefaultPlainDir + "/BenchmarkSmallWrites"
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fn)
+	defer f.Close()
+	buf := make([]byte, 100)
+	t.SetBytes(int64(len(buf)))
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		if _, err = f.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
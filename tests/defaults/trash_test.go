@@ -0,0 +1,96 @@
+package defaults
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Test "-trash": a deleted file must disappear from the listing, be
+// restorable through the ctlsock, and be gone for good after emptying the
+// trash.
+func TestTrash(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-trash", "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	err := os.Mkdir(pDir+"/dir", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := pDir + "/dir/" + strings.Repeat("x", 200)
+	err = ioutil.WriteFile(file, []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test_helpers.VerifyExistence(file) {
+		t.Fatal("file still exists after deletion")
+	}
+	// The trash dir must not show up in the plaintext view
+	fis, err := ioutil.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Errorf("unexpected entries in the root dir: %v", fis)
+	}
+	// The original path must not be stored in the clear
+	out, _ := ioutil.ReadDir(cDir + "/.gocryptfs.trash")
+	if len(out) != 2 {
+		t.Fatalf("expected 2 entries in the trash dir, have %d", len(out))
+	}
+	for _, fi := range out {
+		buf, _ := ioutil.ReadFile(cDir + "/.gocryptfs.trash/" + fi.Name())
+		if strings.Contains(string(buf), "xxx") {
+			t.Errorf("%s leaks the plaintext path", fi.Name())
+		}
+	}
+	// List
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{TrashList: true})
+	fields := strings.Split(resp.Result, "\t")
+	if resp.ErrNo != 0 || len(fields) != 3 || fields[2] != "dir/"+strings.Repeat("x", 200) {
+		t.Fatalf("unexpected TrashList response: %+v", resp)
+	}
+	// Restore
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{TrashRestore: fields[0]})
+	if resp.ErrNo != 0 {
+		t.Fatalf("TrashRestore failed: %+v", resp)
+	}
+	// The kernel may have cached the non-existence of the file for up to
+	// one second (NegativeTimeout).
+	var buf []byte
+	for i := 0; i < 20; i++ {
+		buf, err = ioutil.ReadFile(file)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || string(buf) != "content" {
+		t.Fatalf("restored file is broken: %v %q", err, buf)
+	}
+	// Delete again, plus the directory, then empty the trash
+	os.Remove(file)
+	err = os.Remove(pDir + "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{TrashEmpty: true})
+	if resp.ErrNo != 0 {
+		t.Fatalf("TrashEmpty failed: %+v", resp)
+	}
+	out, _ = ioutil.ReadDir(cDir + "/.gocryptfs.trash")
+	if len(out) != 0 {
+		t.Errorf("trash is not empty: %v", out)
+	}
+}
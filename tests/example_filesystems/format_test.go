@@ -0,0 +1,171 @@
+package example_filesystems
+
+// Verify the on-disk format byte-for-byte against the upstream gocryptfs
+// format, without mounting. Anything that changes the output of these tests
+// breaks compatibility with upstream and must be hidden behind a new
+// feature flag instead.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// upstreamFlags are the feature flags that upstream gocryptfs sets on
+// "-init" without further options.
+var upstreamFlags = []string{"DirIV", "EMENames", "GCMIV128", "HKDF", "LongNames", "Raw64"}
+
+// checkFormat decrypts the example content in "cDir" using only the
+// documented upstream format and checks that re-encrypting it gives the
+// same bytes that are on disk.
+func checkFormat(t *testing.T, cDir string) {
+	key, cf, err := configfile.LoadConfFile(filepath.Join(cDir, configfile.ConfDefaultName), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := append([]string(nil), cf.FeatureFlags...)
+	sort.Strings(flags)
+	if strings.Join(flags, ",") != strings.Join(upstreamFlags, ",") {
+		t.Errorf("feature flags: want %v, got %v", upstreamFlags, flags)
+	}
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	nt := nametransform.New(cc.EMECipher, true, true, false)
+	// DirIV: 16 random bytes, nothing else
+	dirIV, err := ioutil.ReadFile(filepath.Join(cDir, nametransform.DirIVFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirIV) != 16 {
+		t.Fatalf("gocryptfs.diriv: want 16 bytes, got %d", len(dirIV))
+	}
+	fis, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, fi := range fis {
+		cName := fi.Name()
+		if cName == configfile.ConfDefaultName || cName == nametransform.DirIVFilename ||
+			nametransform.NameType(cName) == nametransform.LongNameFilename {
+			continue
+		}
+		encName := cName
+		if nametransform.NameType(cName) == nametransform.LongNameContent {
+			// gocryptfs.longname.[base64(sha256(encName))], encName stored in .name
+			buf, err := ioutil.ReadFile(filepath.Join(cDir, cName+nametransform.LongNameSuffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			encName = string(buf)
+			if h := nt.HashLongName(encName); h != cName {
+				t.Errorf("long name hash: want %q, got %q", cName, h)
+			}
+		}
+		name, err := nt.DecryptName(encName, dirIV)
+		if err != nil {
+			t.Errorf("%s: %v", cName, err)
+			continue
+		}
+		found[name] = true
+		// EME is deterministic: the name must encrypt to the same bytes
+		if e := nt.EncryptName(name, dirIV); e != encName {
+			t.Errorf("%s: name re-encrypts to %q", name, e)
+		}
+		path := filepath.Join(cDir, cName)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// Symlink target: base64(nonce + GCM(target, AD=blockNo 0)) without file ID
+			cTarget, err := os.Readlink(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cBin, err := nt.B64.DecodeString(cTarget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkBlock(t, cc, name, cBin, 0, nil)
+			continue
+		}
+		// File content: [version uint16 BE = 2][16 byte file ID][blocks...]
+		cBuf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantLen := contentenc.HeaderLen + 16 + len(statusTxtContent) + 16
+		if len(cBuf) != wantLen {
+			t.Errorf("%s: want %d ciphertext bytes, got %d", name, wantLen, len(cBuf))
+			continue
+		}
+		if v := binary.BigEndian.Uint16(cBuf); v != 2 {
+			t.Errorf("%s: header version %d", name, v)
+		}
+		plain := checkBlock(t, cc, name, cBuf[contentenc.HeaderLen:], 0, cBuf[2:contentenc.HeaderLen])
+		if string(plain) != statusTxtContent {
+			t.Errorf("%s: wrong content %q", name, plain)
+		}
+	}
+	for _, n := range []string{"status.txt", "rel", "abs"} {
+		if !found[n] {
+			t.Errorf("%q not found", n)
+		}
+	}
+}
+
+// checkBlock decrypts the ciphertext block "cBlock" ([16 byte nonce]
+// [ciphertext][16 byte tag], authenticated with blockNo uint64 BE + fileID)
+// and checks that encrypting the plaintext with the same nonce gives the
+// same bytes.
+func checkBlock(t *testing.T, cc *cryptocore.CryptoCore, name string, cBlock []byte, blockNo uint64, fileID []byte) []byte {
+	aData := make([]byte, 8)
+	binary.BigEndian.PutUint64(aData, blockNo)
+	aData = append(aData, fileID...)
+	nonce := cBlock[:16]
+	plain, err := cc.AEADCipher.Open(nil, nonce, cBlock[16:], aData)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return nil
+	}
+	again := cc.AEADCipher.Seal(append([]byte(nil), nonce...), nonce, plain, aData)
+	if !bytes.Equal(again, cBlock) {
+		t.Errorf("%s: block does not re-encrypt to the same bytes", name)
+	}
+	return plain
+}
+
+// TestFormatUpstream checks a filesystem created by upstream gocryptfs v1.3.
+func TestFormatUpstream(t *testing.T) {
+	checkFormat(t, "v1.3")
+}
+
+// TestFormatLocal checks that a filesystem created by this version of
+// gocryptfs uses the same format, so upstream gocryptfs can mount it.
+func TestFormatLocal(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", opensslOpt)
+	longname := "longname_255_" + strings.Repeat("x", 255-len("longname_255_"))
+	for _, n := range []string{"status.txt", longname} {
+		err := ioutil.WriteFile(filepath.Join(pDir, n), []byte(statusTxtContent), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("status.txt", filepath.Join(pDir, "rel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/a/b/c/d", filepath.Join(pDir, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	checkFormat(t, cDir)
+}
@@ -19,6 +19,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -527,6 +528,52 @@ func TestDirOverwrite(t *testing.T) {
 	}
 }
 
+// Rename a file over another file that is still open. The open file must
+// stay readable and writable through its file descriptor. Done for a short
+// and for a long (hashed) destination name.
+func TestRenameOverOpenFile(t *testing.T) {
+	for _, name := range []string{"RenameOverOpen", string(bytes.Repeat([]byte("x"), 255))} {
+		dst := test_helpers.DefaultPlainDir + "/" + name
+		src := test_helpers.DefaultPlainDir + "/RenameOverOpenSrc"
+		oldContent := []byte("old content of the destination")
+		if err := ioutil.WriteFile(dst, oldContent, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(src, []byte("new"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(dst, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syscall.Rename(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 100)
+		n, err := f.ReadAt(buf, 0)
+		if n != len(oldContent) || !bytes.Equal(buf[:n], oldContent) {
+			t.Errorf("wrong content through the old fd: %q, err=%v", buf[:n], err)
+		}
+		if _, err = f.WriteAt([]byte("OLD"), 0); err != nil {
+			t.Error(err)
+		}
+		n, _ = f.ReadAt(buf, 0)
+		if string(buf[:n]) != "OLD content of the destination" {
+			t.Errorf("wrong content after write through the old fd: %q", buf[:n])
+		}
+		fi, err := f.Stat()
+		if err != nil || fi.Size() != int64(len(oldContent)) {
+			t.Errorf("wrong Fstat result: %v, err=%v", fi, err)
+		}
+		f.Close()
+		content, err := ioutil.ReadFile(dst)
+		if err != nil || string(content) != "new" {
+			t.Errorf("wrong content of the renamed file: %q, err=%v", content, err)
+		}
+		os.Remove(dst)
+	}
+}
+
 func TestLongNames(t *testing.T) {
 	fi, err := ioutil.ReadDir(test_helpers.DefaultCipherDir)
 	if err != nil {
@@ -791,6 +838,13 @@ func TestMkfifo(t *testing.T) {
 	}
 	path = test_helpers.DefaultPlainDir + "/gocryptfs.longname.XXX"
 	err = syscall.Mkfifo(path, 0700)
+	// With "-plaintextnames", the name is reserved
+	if testcase.plaintextnames {
+		if err != syscall.EPERM {
+			t.Errorf("want EPERM, got %v", err)
+		}
+		return
+	}
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -800,10 +854,73 @@ func TestMkfifo(t *testing.T) {
 	}
 }
 
+// Create a FIFO, a socket and a character device through Mknod, with short
+// and long names, and check their type
+func TestMknodTypes(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	for _, tc := range []struct {
+		name string
+		mode uint32
+	}{
+		{"fifo2", syscall.S_IFIFO},
+		{"socket1", syscall.S_IFSOCK},
+		{"fifo_" + long, syscall.S_IFIFO},
+		{"socket_" + long, syscall.S_IFSOCK},
+	} {
+		path := test_helpers.DefaultPlainDir + "/" + tc.name
+		err := syscall.Mknod(path, tc.mode|0600, 0)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var st syscall.Stat_t
+		err = syscall.Lstat(path, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint32(st.Mode)&syscall.S_IFMT != tc.mode {
+			t.Errorf("%s: wrong type %#o", tc.name, st.Mode&syscall.S_IFMT)
+		}
+		if err = syscall.Unlink(path); err != nil {
+			t.Error(err)
+		}
+	}
+	// Device nodes need CAP_MKNOD
+	path := test_helpers.DefaultPlainDir + "/chardev1"
+	// /dev/null is 1:3
+	dev := 1<<8 | 3
+	err := syscall.Mknod(path, syscall.S_IFCHR|0600, dev)
+	if os.Getuid() != 0 {
+		if err != syscall.EPERM {
+			t.Errorf("want EPERM, got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(path)
+	var st syscall.Stat_t
+	err = syscall.Lstat(path, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint32(st.Mode)&syscall.S_IFMT != syscall.S_IFCHR || uint64(st.Rdev) != uint64(dev) {
+		t.Errorf("wrong type %#o or device %#x", st.Mode&syscall.S_IFMT, st.Rdev)
+	}
+}
+
 // Make sure the Symlink call works with paths starting with "gocryptfs.longname."
 func TestSymlink(t *testing.T) {
 	path := test_helpers.DefaultPlainDir + "/gocryptfs.longname.XXX"
 	err := syscall.Symlink("target", path)
+	// With "-plaintextnames", the name is reserved
+	if testcase.plaintextnames {
+		if err != syscall.EPERM {
+			t.Errorf("want EPERM, got %v", err)
+		}
+		return
+	}
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -823,6 +940,14 @@ func TestLink(t *testing.T) {
 	f.Close()
 	path := test_helpers.DefaultPlainDir + "/gocryptfs.longname.XXX"
 	err = syscall.Link(target, path)
+	// With "-plaintextnames", the name is reserved
+	if testcase.plaintextnames {
+		if err != syscall.EPERM {
+			t.Errorf("want EPERM, got %v", err)
+		}
+		os.Remove(target)
+		return
+	}
 	if err != nil {
 		t.Fatal(err)
 	}
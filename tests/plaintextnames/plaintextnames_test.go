@@ -67,10 +67,6 @@ func TestFiltered(t *testing.T) {
 	if err == nil {
 		t.Errorf("should have failed but didn't")
 	}
-	err = ioutil.WriteFile(pDir+"/gocryptfs.diriv", []byte("foo"), 0777)
-	if err != nil {
-		t.Error(err)
-	}
 	subDir, err := ioutil.TempDir(pDir, "")
 	if err != nil {
 		t.Fatal(err)
@@ -82,3 +78,40 @@ func TestFiltered(t *testing.T) {
 		fd.Close()
 	}
 }
+
+// With "-plaintextnames", names that look like gocryptfs control files
+// cannot be created anywhere.
+func TestReservedNames(t *testing.T) {
+	for _, dir := range []string{pDir, pDir + "/dir2"} {
+		os.Mkdir(dir, 0700)
+		for _, n := range []string{"gocryptfs.diriv", "gocryptfs.longname.foo"} {
+			path := dir + "/" + n
+			err := ioutil.WriteFile(path, []byte("foo"), 0600)
+			if err == nil {
+				t.Errorf("creating %q should have failed", path)
+			}
+			err = os.Mkdir(path, 0700)
+			if err == nil {
+				t.Errorf("mkdir %q should have failed", path)
+			}
+			err = os.Symlink("foo", path)
+			if err == nil {
+				t.Errorf("symlink %q should have failed", path)
+			}
+			tmp := dir + "/tmp"
+			err = ioutil.WriteFile(tmp, []byte("foo"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Rename(tmp, path)
+			if err == nil {
+				t.Errorf("rename to %q should have failed", path)
+			}
+			err = os.Link(tmp, path)
+			if err == nil {
+				t.Errorf("link to %q should have failed", path)
+			}
+			os.Remove(tmp)
+		}
+	}
+}
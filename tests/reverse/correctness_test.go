@@ -201,3 +201,56 @@ func TestTooLongSymlink(t *testing.T) {
 			err2.Err)
 	}
 }
+
+// TestSingleFile reverse-mounts a single file and decrypts the result in
+// forward mode. The other files in its directory must not be visible.
+func TestSingleFile(t *testing.T) {
+	args := []string{"-reverse"}
+	if plaintextnames {
+		args = append(args, "-plaintextnames")
+	}
+	a := test_helpers.InitFS(t, args...)
+	content := bytes.Repeat([]byte("single file "), 1000)
+	if err := ioutil.WriteFile(a+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(a+"/other", []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(a+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	b := a + ".b"
+	c := a + ".c"
+	test_helpers.MountOrFatal(t, a+"/file", b, "-reverse", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(b)
+	entries, err := ioutil.ReadDir(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := 3 // gocryptfs.conf, gocryptfs.diriv and the file
+	if plaintextnames {
+		want = 2
+	}
+	if len(names) != want {
+		t.Errorf("want %d entries, got %v", want, names)
+	}
+	test_helpers.MountOrFatal(t, b, c, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(c)
+	got, err := ioutil.ReadFile(c + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("content mismatch")
+	}
+	for _, hidden := range []string{"other", "dir"} {
+		if _, err = os.Stat(c + "/" + hidden); !os.IsNotExist(err) {
+			t.Errorf("%q should be hidden, got err=%v", hidden, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"runtime"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+// versionInfo is what "-version -json" prints
+type versionInfo struct {
+	// Version is the gocryptfs version according to git, like
+	// "v1.4.3-36-ge021b9d-dirty"
+	Version string
+	// GitCommit is the abbreviated commit hash contained in Version. Empty
+	// for tagged releases.
+	GitCommit string
+	// GoFuse is the go-fuse library version
+	GoFuse    string
+	BuildDate string
+	GoVersion string
+	// OnDiskFormat is the version of the on-disk format we write
+	OnDiskFormat uint16
+	// Race is true if we have been compiled with "go build -race"
+	Race bool
+	// OpenSSL is true if OpenSSL support has been compiled in (no
+	// "without_openssl" build tag). OpenSSLVersion is the version of the
+	// library, empty if it has not been compiled in.
+	OpenSSL        bool
+	OpenSSLVersion string
+	// PreferOpenSSL is what "-openssl auto" chooses on this machine
+	PreferOpenSSL bool
+	// CPU are the crypto instructions of the CPU
+	CPU prefer_openssl.CPUFeatures
+}
+
+// gitCommitRe matches the commit hash in a "git describe" string like
+// "v1.4.3-36-ge021b9d-dirty"
+var gitCommitRe = regexp.MustCompile(`-g([0-9a-f]{7,})(-dirty)?$`)
+
+// getVersionInfo collects the information for "-version -json".
+func getVersionInfo() versionInfo {
+	v := versionInfo{
+		Version:        GitVersion,
+		GoFuse:         GitVersionFuse,
+		BuildDate:      BuildDate,
+		GoVersion:      runtime.Version(),
+		OnDiskFormat:   contentenc.CurrentVersion,
+		Race:           raceDetector,
+		OpenSSL:        !stupidgcm.BuiltWithoutOpenssl,
+		OpenSSLVersion: stupidgcm.OpenSSLVersion(),
+		PreferOpenSSL:  prefer_openssl.PreferOpenSSL(),
+		CPU:            prefer_openssl.GetCPUFeatures(),
+	}
+	if m := gitCommitRe.FindStringSubmatch(GitVersion); m != nil {
+		v.GitCommit = m[1]
+	}
+	return v
+}
+
+// printVersionJSON prints getVersionInfo() as JSON
+func printVersionJSON() {
+	js, err := json.MarshalIndent(getVersionInfo(), "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(js))
+}
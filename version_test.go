@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+func TestVersionInfo(t *testing.T) {
+	js, err := json.Marshal(getVersionInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(js, &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"Version", "GitCommit", "GoFuse", "BuildDate", "GoVersion",
+		"OnDiskFormat", "Race", "OpenSSL", "OpenSSLVersion", "PreferOpenSSL", "CPU"} {
+		if _, ok := m[k]; !ok {
+			t.Errorf("field %q is missing: %s", k, js)
+		}
+	}
+	cpu, _ := m["CPU"].(map[string]interface{})
+	for _, k := range []string{"AESNI", "CLMUL", "ARMAES", "ARMPMULL"} {
+		if _, ok := cpu[k]; !ok {
+			t.Errorf("CPU field %q is missing: %s", k, js)
+		}
+	}
+	if m["OpenSSL"] != !stupidgcm.BuiltWithoutOpenssl {
+		t.Errorf("OpenSSL=%v does not match the build tags", m["OpenSSL"])
+	}
+	if (m["OpenSSLVersion"] != "") != !stupidgcm.BuiltWithoutOpenssl {
+		t.Errorf("OpenSSLVersion=%q does not match the build tags", m["OpenSSLVersion"])
+	}
+}
+
+func TestGitCommit(t *testing.T) {
+	testCases := map[string]string{
+		"v1.4.3":                   "",
+		"v1.4.3-36-ge021b9d":       "e021b9d",
+		"v1.4.3-36-ge021b9d-dirty": "e021b9d",
+		"[GitVersion not set - please compile using ./build.bash]": "",
+	}
+	for in, want := range testCases {
+		have := ""
+		if m := gitCommitRe.FindStringSubmatch(in); m != nil {
+			have = m[1]
+		}
+		if have != want {
+			t.Errorf("%q: want %q, have %q", in, want, have)
+		}
+	}
+}